@@ -0,0 +1,32 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cmdutil contains display helpers shared by the commands in
+// this module.
+package cmdutil
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aclements/go-perf/perfsession"
+)
+
+// FuncName returns the name of the function containing ip in process
+// pid, or ip in hex if it can't be symbolized.
+func FuncName(s *perfsession.Session, pid int, ip uint64) string {
+	var sym perfsession.Symbolic
+	if pidInfo := s.LookupPID(pid); pidInfo != nil {
+		if mmap := pidInfo.LookupMmap(ip); mmap != nil && perfsession.Symbolize(s, mmap, ip, &sym) && sym.FuncName != "" {
+			return sym.FuncName
+		}
+	}
+	return fmt.Sprintf("%#x", ip)
+}
+
+// FormatNS formats a duration of ns nanoseconds, such as the
+// difference between two sample times, rounded to 10ns for display.
+func FormatNS(ns uint64) string {
+	return time.Duration(ns).Round(10 * time.Nanosecond).String()
+}
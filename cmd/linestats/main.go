@@ -0,0 +1,226 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command linestats reports profile samples aggregated by source
+// line.
+//
+// Most profile reports attribute samples to functions. linestats
+// instead uses DWARF line tables to attribute each sample to a
+// (file, line) pair, which makes hot spots within large functions
+// visible. The output is a table like
+//
+//	samples        %  function             location
+//	   1532   18.40%  runtime.scanobject   mgcmark.go:1287
+//	        1286         for i := uintptr(0); i < n; i += goarch.PtrSize {
+//	        1287                 if i != 0 {
+//	        1288                         // Avoid needless hbits.next() on last iteration.
+//
+// By default, the report is printed as text. With -html, linestats
+// instead writes a self-contained HTML page.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perfsession"
+)
+
+type lineKey struct {
+	file string
+	line int
+}
+
+type lineStat struct {
+	lineKey
+	funcName string
+	samples  uint64
+}
+
+func main() {
+	var (
+		flagInput   = flag.String("i", "perf.data", "input perf.data `file`")
+		flagLimit   = flag.Int("limit", 30, "report the top `n` lines")
+		flagContext = flag.Int("context", 1, "show `n` lines of source context")
+		flagHTML    = flag.Bool("html", false, "write report as HTML")
+	)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	f, err := perffile.Open(*flagInput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	s := perfsession.New(f)
+
+	lines := make(map[lineKey]*lineStat)
+	var total uint64
+	var sym perfsession.Symbolic
+	rs := f.Records(perffile.RecordsCausalOrder)
+	for rs.Next() {
+		s.Update(rs.Record)
+
+		r, ok := rs.Record.(*perffile.RecordSample)
+		if !ok || r.Format&perffile.SampleFormatIP == 0 {
+			continue
+		}
+		total++
+
+		pidInfo := s.LookupPID(r.PID)
+		if pidInfo == nil {
+			continue
+		}
+		mmap := pidInfo.LookupMmap(r.IP)
+		if mmap == nil || !perfsession.Symbolize(s, mmap, r.IP, &sym) || sym.Line.File == nil {
+			continue
+		}
+
+		key := lineKey{sym.Line.File.Name, sym.Line.Line}
+		ls := lines[key]
+		if ls == nil {
+			ls = &lineStat{lineKey: key, funcName: sym.FuncName}
+			lines[key] = ls
+		}
+		ls.samples++
+	}
+	if err := rs.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	stats := make([]*lineStat, 0, len(lines))
+	for _, ls := range lines {
+		stats = append(stats, ls)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].samples != stats[j].samples {
+			return stats[i].samples > stats[j].samples
+		}
+		if stats[i].file != stats[j].file {
+			return stats[i].file < stats[j].file
+		}
+		return stats[i].line < stats[j].line
+	})
+	if len(stats) > *flagLimit {
+		stats = stats[:*flagLimit]
+	}
+
+	if *flagHTML {
+		writeHTML(stats, total, *flagContext)
+	} else {
+		writeText(stats, total, *flagContext)
+	}
+}
+
+func writeText(stats []*lineStat, total uint64, context int) {
+	fmt.Printf("%8s %8s  %-30s %s\n", "samples", "%", "function", "location")
+	for _, ls := range stats {
+		pct := 100 * float64(ls.samples) / float64(total)
+		fmt.Printf("%8d %7.2f%%  %-30s %s:%d\n", ls.samples, pct, ls.funcName, filepath.Base(ls.file), ls.line)
+		for _, sl := range sourceLines(ls.file, ls.line-context, ls.line+context) {
+			fmt.Printf("%12d %s\n", sl.Line, sl.Text)
+		}
+		fmt.Println()
+	}
+}
+
+var htmlTemplate = template.Must(template.New("linestats").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>linestats</title>
+<style>
+body { font-family: sans-serif; }
+pre { margin: 0 0 1em 2em; }
+.hot { background: #fdd; }
+</style>
+</head>
+<body>
+<p>{{.Total}} samples</p>
+{{range .Lines}}
+<h3>{{printf "%.2f" .Percent}}% ({{.Samples}} samples) {{.FuncName}} {{.File}}:{{.Line}}</h3>
+<pre>{{range .Source}}<span{{if .Hot}} class="hot"{{end}}>{{printf "%6d" .Line}} {{.Text}}</span>
+{{end}}</pre>
+{{end}}
+</body>
+</html>
+`))
+
+func writeHTML(stats []*lineStat, total uint64, context int) {
+	type htmlSource struct {
+		sourceLine
+		Hot bool
+	}
+	type htmlLine struct {
+		FuncName, File string
+		Line           int
+		Samples        uint64
+		Percent        float64
+		Source         []htmlSource
+	}
+	data := struct {
+		Total uint64
+		Lines []htmlLine
+	}{Total: total}
+
+	for _, ls := range stats {
+		hl := htmlLine{
+			FuncName: ls.funcName,
+			File:     ls.file,
+			Line:     ls.line,
+			Samples:  ls.samples,
+			Percent:  100 * float64(ls.samples) / float64(total),
+		}
+		for _, sl := range sourceLines(ls.file, ls.line-context, ls.line+context) {
+			hl.Source = append(hl.Source, htmlSource{sl, sl.Line == ls.line})
+		}
+		data.Lines = append(data.Lines, hl)
+	}
+
+	if err := htmlTemplate.Execute(os.Stdout, data); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type sourceLine struct {
+	Line int
+	Text string
+}
+
+var sourceCache = make(map[string][]string)
+
+// sourceLines returns the lines in [lo, hi] of path, clipped to the
+// lines in the file. Line numbers are 1-based. If the file can't be
+// read, it returns nil.
+func sourceLines(path string, lo, hi int) []sourceLine {
+	text, ok := sourceCache[path]
+	if !ok {
+		if data, err := os.ReadFile(path); err == nil {
+			text = strings.Split(string(data), "\n")
+		}
+		sourceCache[path] = text
+	}
+	if lo < 1 {
+		lo = 1
+	}
+	if hi > len(text) {
+		hi = len(text)
+	}
+	var out []sourceLine
+	for l := lo; l <= hi; l++ {
+		out = append(out, sourceLine{l, text[l-1]})
+	}
+	return out
+}
@@ -0,0 +1,545 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command perfannotate prints per-instruction sample counts for the
+// hottest functions in a profile, similar to "perf annotate".
+//
+// For each function, perfannotate disassembles the function's code
+// and prints each instruction alongside the fraction of the
+// function's samples that landed on that instruction. If the binary
+// has DWARF line tables, source lines are interleaved with the
+// instructions they produced.
+//
+// Disassembly is done by running objdump, which can be overridden
+// with the -objdump flag. If objdump is unavailable or -objdump is
+// empty, perfannotate uses a built-in instruction length decoder,
+// which supports x86-64 and most fixed-width architectures and lists
+// the bytes of each instruction instead of its disassembly. Failing
+// that, it lists only the sampled addresses.
+//
+// Samples of imprecise events often land on an instruction after the
+// one that caused them. With -skid, perfannotate attributes such
+// samples to the preceding instruction. This uses the rules of
+// perfsession.SampleSkid, so samples from precise events with exact
+// IPs, and from PMUs such as AMD IBS and Arm SPE, are left alone.
+// This requires disassembly or the built-in length decoder.
+//
+// Kernel functions are annotated only if -vmlinux gives the path of
+// the kernel's vmlinux file. Since the kernel modifies its own code
+// at run time, perfannotate applies any kernel text modifications
+// recorded in the profile (text poke records) before disassembling,
+// so the disassembly matches the code that ran.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aclements/go-perf/internal/insnlen"
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perfsession"
+)
+
+type funcKey struct {
+	filename string
+	funcName string
+}
+
+type funcProfile struct {
+	funcKey
+
+	mmap  *perfsession.Mmap
+	total uint64
+
+	// counts maps from file offset to sample count.
+	counts map[uint64]uint64
+
+	// skidded maps from file offset to the count of samples
+	// whose IP is likely after the instruction that caused them.
+	// These are not included in counts.
+	skidded map[uint64]uint64
+}
+
+func main() {
+	var (
+		flagInput   = flag.String("i", "perf.data", "input perf.data `file`")
+		flagFunc    = flag.String("func", "", "only annotate functions matching `regexp`")
+		flagTop     = flag.Int("n", 10, "annotate the top `n` functions")
+		flagObjdump = flag.String("objdump", "objdump", "`path` to objdump")
+		flagVmlinux = flag.String("vmlinux", "", "annotate kernel functions using vmlinux `file`")
+		flagSkid    = flag.Bool("skid", false, "attribute imprecise samples to the preceding instruction")
+	)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	funcRe, err := regexp.Compile(*flagFunc)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := perffile.Open(*flagInput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	s := perfsession.New(f)
+
+	funcs := make(map[funcKey]*funcProfile)
+	var sym perfsession.Symbolic
+	rs := f.Records(perffile.RecordsCausalOrder)
+	for rs.Next() {
+		s.Update(rs.Record)
+
+		r, ok := rs.Record.(*perffile.RecordSample)
+		if !ok || r.Format&perffile.SampleFormatIP == 0 {
+			continue
+		}
+		pidInfo := s.LookupPID(r.PID)
+		if pidInfo == nil {
+			continue
+		}
+		mmap := pidInfo.LookupMmap(r.IP)
+		if mmap == nil || !perfsession.Symbolize(s, mmap, r.IP, &sym) || sym.FuncName == "" {
+			continue
+		}
+		if !funcRe.MatchString(sym.FuncName) {
+			continue
+		}
+
+		key := funcKey{mmap.Filename, sym.FuncName}
+		fp := funcs[key]
+		if fp == nil {
+			fp = &funcProfile{funcKey: key, counts: make(map[uint64]uint64), skidded: make(map[uint64]uint64)}
+			funcs[key] = fp
+		}
+		fp.mmap = mmap
+		fp.total++
+		counts := fp.counts
+		if *flagSkid && s.SampleSkid(r) != perfsession.SkidNone {
+			counts = fp.skidded
+		}
+		if isKernel(mmap) {
+			counts[r.IP]++
+		} else {
+			counts[r.IP-mmap.Addr+mmap.FileOffset]++
+		}
+	}
+	if err := rs.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Sort functions by sample count.
+	profiles := make([]*funcProfile, 0, len(funcs))
+	for _, fp := range funcs {
+		profiles = append(profiles, fp)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		if profiles[i].total != profiles[j].total {
+			return profiles[i].total > profiles[j].total
+		}
+		return profiles[i].funcName < profiles[j].funcName
+	})
+	if len(profiles) > *flagTop {
+		profiles = profiles[:*flagTop]
+	}
+
+	var dis disassembler = insnDecoder{}
+	if *flagObjdump != "" {
+		dis = fallbackDisassembler{&objdump{*flagObjdump}, dis}
+	}
+	for _, fp := range profiles {
+		annotate(s, dis, fp, *flagVmlinux)
+	}
+}
+
+// isKernel reports whether mmap is the kernel's text mapping.
+func isKernel(mmap *perfsession.Mmap) bool {
+	return strings.HasPrefix(mmap.Filename, "[kernel.kallsyms]")
+}
+
+// insn is a single disassembled instruction.
+type insn struct {
+	addr uint64 // ELF virtual address
+	text string
+}
+
+// A disassembler disassembles the instructions in [lo, hi) of an ELF
+// file, or a block of code for machine mach loaded at address addr.
+type disassembler interface {
+	disasm(path string, lo, hi uint64) ([]insn, error)
+	disasmCode(code []byte, addr uint64, mach elf.Machine) ([]insn, error)
+}
+
+// fallbackDisassembler is a disassembler that tries each of a list of
+// disassemblers until one succeeds.
+type fallbackDisassembler []disassembler
+
+func (ds fallbackDisassembler) disasm(path string, lo, hi uint64) ([]insn, error) {
+	return ds.try(func(d disassembler) ([]insn, error) { return d.disasm(path, lo, hi) })
+}
+
+func (ds fallbackDisassembler) disasmCode(code []byte, addr uint64, mach elf.Machine) ([]insn, error) {
+	return ds.try(func(d disassembler) ([]insn, error) { return d.disasmCode(code, addr, mach) })
+}
+
+func (ds fallbackDisassembler) try(f func(d disassembler) ([]insn, error)) ([]insn, error) {
+	var firstErr error
+	for _, d := range ds {
+		insns, err := f(d)
+		if err == nil && len(insns) > 0 {
+			return insns, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// insnDecoder is a disassembler that only finds instruction
+// boundaries, using a built-in instruction length decoder. The text
+// of each instruction is its bytes.
+type insnDecoder struct{}
+
+func (d insnDecoder) disasm(path string, lo, hi uint64) ([]insn, error) {
+	elff, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer elff.Close()
+	code, err := readCode(elff, lo, hi)
+	if err != nil {
+		return nil, err
+	}
+	return d.disasmCode(code, lo, elff.Machine)
+}
+
+func (insnDecoder) disasmCode(code []byte, addr uint64, mach elf.Machine) ([]insn, error) {
+	if !insnlen.Supported(mach) {
+		return nil, fmt.Errorf("cannot decode instructions for %s", mach)
+	}
+	var insns []insn
+	for len(code) > 0 {
+		n, err := insnlen.Len(mach, code)
+		text := fmt.Sprintf("% x", code[:n])
+		if err != nil {
+			// Like objdump, skip a byte and carry on.
+			n, text = 1, fmt.Sprintf("%02x (bad)", code[0])
+		}
+		insns = append(insns, insn{addr, text})
+		code, addr = code[n:], addr+uint64(n)
+	}
+	return insns, nil
+}
+
+// objdump is a disassembler that uses an external objdump binary.
+type objdump struct {
+	path string
+}
+
+var objdumpRe = regexp.MustCompile(`^\s*([0-9a-f]+):\t(.*)$`)
+
+func (d *objdump) disasm(path string, lo, hi uint64) ([]insn, error) {
+	cmd := exec.Command(d.path, "-d", "--no-show-raw-insn",
+		fmt.Sprintf("--start-address=%#x", lo),
+		fmt.Sprintf("--stop-address=%#x", hi),
+		path)
+	return d.run(cmd)
+}
+
+// objdumpArch maps ELF machines to objdump architecture names.
+var objdumpArch = map[elf.Machine]string{
+	elf.EM_386:     "i386",
+	elf.EM_X86_64:  "i386:x86-64",
+	elf.EM_AARCH64: "aarch64",
+	elf.EM_PPC64:   "powerpc:common64",
+	elf.EM_S390:    "s390:64-bit",
+}
+
+func (d *objdump) disasmCode(code []byte, addr uint64, mach elf.Machine) ([]insn, error) {
+	arch, ok := objdumpArch[mach]
+	if !ok {
+		return nil, fmt.Errorf("cannot disassemble code for %s", mach)
+	}
+	tmp, err := os.CreateTemp("", "perfannotate")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(code)
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(d.path, "-D", "--no-show-raw-insn",
+		"-b", "binary", "-m", arch,
+		fmt.Sprintf("--adjust-vma=%#x", addr),
+		tmp.Name())
+	return d.run(cmd)
+}
+
+func (d *objdump) run(cmd *exec.Cmd) ([]insn, error) {
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", d.path, err)
+	}
+	var insns []insn
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		subs := objdumpRe.FindStringSubmatch(scanner.Text())
+		if subs == nil {
+			continue
+		}
+		addr, err := strconv.ParseUint(subs[1], 16, 64)
+		if err != nil {
+			continue
+		}
+		insns = append(insns, insn{addr, subs[2]})
+	}
+	return insns, scanner.Err()
+}
+
+func annotate(s *perfsession.Session, dis disassembler, fp *funcProfile, vmlinux string) {
+	fmt.Printf("%s: %s (%d samples)\n", fp.filename, fp.funcName, fp.total)
+
+	path, kernel := fp.filename, isKernel(fp.mmap)
+	if kernel {
+		if vmlinux == "" {
+			log.Printf("not annotating kernel function %s without -vmlinux", fp.funcName)
+			fmt.Println()
+			return
+		}
+		path = vmlinux
+	}
+	elff, err := elf.Open(path)
+	if err != nil {
+		log.Printf("error loading ELF file %s: %s", path, err)
+		fmt.Println()
+		return
+	}
+	defer elff.Close()
+
+	// For the kernel, samples are recorded by run-time address,
+	// which may be offset from the vmlinux address by KASLR.
+	var slide uint64
+	if kernel {
+		slide, err = kernelSlide(elff, fp.mmap)
+		if err != nil {
+			log.Print(err)
+			fmt.Println()
+			return
+		}
+	}
+
+	// Map sampled file offsets to ELF virtual addresses.
+	lo, hi := ^uint64(0), uint64(0)
+	toAddrs := func(offs map[uint64]uint64) map[uint64]uint64 {
+		counts := make(map[uint64]uint64)
+		for off, n := range offs {
+			addr, ok := off-slide, true
+			if !kernel {
+				addr, ok = offToAddr(elff, off)
+			}
+			if !ok {
+				continue
+			}
+			counts[addr] += n
+			if addr < lo {
+				lo = addr
+			}
+			if addr >= hi {
+				hi = addr + 1
+			}
+		}
+		return counts
+	}
+	counts, skidded := toAddrs(fp.counts), toAddrs(fp.skidded)
+	if lo >= hi {
+		fmt.Println()
+		return
+	}
+	if slo, shi, ok := funcBounds(elff, lo); ok {
+		lo, hi = slo, shi
+	}
+
+	var insns []insn
+	patched := false
+	if kernel {
+		// Apply run-time modifications to the kernel text.
+		if code, err := readCode(elff, lo, hi); err == nil && s.PatchKernelText(lo+slide, code) {
+			insns, err = dis.disasmCode(code, lo, elff.Machine)
+			if err != nil {
+				log.Print(err)
+			} else {
+				patched = true
+			}
+		}
+	}
+	if !patched {
+		insns, err = dis.disasm(path, lo, hi)
+	}
+	if patched && len(insns) > 0 {
+		fmt.Printf("%16s (with run-time kernel text modifications)\n", "")
+	}
+	// Attribute skidded samples to the instruction preceding
+	// their IP. Without disassembly, we don't know where that is.
+	disassembled := err == nil && len(insns) > 0
+	for addr, n := range skidded {
+		if disassembled {
+			i := sort.Search(len(insns), func(i int) bool { return insns[i].addr >= addr })
+			if 0 < i && i < len(insns) && insns[i].addr == addr {
+				addr = insns[i-1].addr
+			}
+		}
+		counts[addr] += n
+	}
+	if !disassembled {
+		if err != nil {
+			log.Print(err)
+		}
+		// Fall back to just the sampled addresses.
+		insns = insns[:0]
+		for addr := range counts {
+			insns = append(insns, insn{addr: addr})
+		}
+		sort.Slice(insns, func(i, j int) bool {
+			return insns[i].addr < insns[j].addr
+		})
+	}
+
+	var sym perfsession.Symbolic
+	lastFile, lastLine := "", 0
+	for _, in := range insns {
+		ip := in.addr
+		if kernel {
+			ip = in.addr + slide
+		} else if off, ok := addrToOff(elff, in.addr); ok {
+			ip = off - fp.mmap.FileOffset + fp.mmap.Addr
+		}
+		if perfsession.Symbolize(s, fp.mmap, ip, &sym) && sym.Line.File != nil {
+			if sym.Line.File.Name != lastFile || sym.Line.Line != lastLine {
+				lastFile, lastLine = sym.Line.File.Name, sym.Line.Line
+				src := sourceLine(lastFile, lastLine)
+				fmt.Printf("%16s %s:%d %s\n", "", filepath.Base(lastFile), lastLine, src)
+			}
+		}
+
+		n := counts[in.addr]
+		if n == 0 {
+			fmt.Printf("%16s %8x: %s\n", "", in.addr, in.text)
+		} else {
+			pct := 100 * float64(n) / float64(fp.total)
+			fmt.Printf("%6.2f%% %8d %8x: %s\n", pct, n, in.addr, in.text)
+		}
+	}
+	fmt.Println()
+}
+
+// offToAddr maps a file offset to an ELF virtual address using the
+// file's loadable segments.
+func offToAddr(elff *elf.File, off uint64) (uint64, bool) {
+	for _, p := range elff.Progs {
+		if p.Type == elf.PT_LOAD && p.Off <= off && off < p.Off+p.Filesz {
+			return off - p.Off + p.Vaddr, true
+		}
+	}
+	return 0, false
+}
+
+// addrToOff is the inverse of offToAddr.
+func addrToOff(elff *elf.File, addr uint64) (uint64, bool) {
+	for _, p := range elff.Progs {
+		if p.Type == elf.PT_LOAD && p.Vaddr <= addr && addr < p.Vaddr+p.Filesz {
+			return addr - p.Vaddr + p.Off, true
+		}
+	}
+	return 0, false
+}
+
+// kernelSlide returns the difference between the kernel's run-time
+// addresses and the addresses in vmlinux.
+func kernelSlide(elff *elf.File, mmap *perfsession.Mmap) (uint64, error) {
+	// perf names the kernel mapping after a reference symbol,
+	// such as "[kernel.kallsyms]_text", and records the symbol's
+	// run-time address as the mapping's file offset. See
+	// perf_event__synthesize_kernel_mmap.
+	ref := strings.TrimPrefix(mmap.Filename, "[kernel.kallsyms]")
+	if ref == "" {
+		return 0, nil
+	}
+	syms, err := elff.Symbols()
+	if err != nil {
+		return 0, err
+	}
+	for _, sym := range syms {
+		if sym.Name == ref {
+			return mmap.FileOffset - sym.Value, nil
+		}
+	}
+	return 0, fmt.Errorf("kernel reference symbol %s not found in vmlinux", ref)
+}
+
+// readCode returns the contents of ELF virtual addresses [lo, hi).
+func readCode(elff *elf.File, lo, hi uint64) ([]byte, error) {
+	for _, sec := range elff.Sections {
+		if sec.Type == elf.SHT_PROGBITS && sec.Addr <= lo && hi <= sec.Addr+sec.Size {
+			code := make([]byte, hi-lo)
+			_, err := sec.ReadAt(code, int64(lo-sec.Addr))
+			return code, err
+		}
+	}
+	return nil, fmt.Errorf("no code at %#x in ELF file", lo)
+}
+
+// funcBounds returns the bounds of the function symbol containing
+// addr.
+func funcBounds(elff *elf.File, addr uint64) (lo, hi uint64, ok bool) {
+	syms, err := elff.Symbols()
+	if err != nil {
+		return 0, 0, false
+	}
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) != elf.STT_FUNC || sym.Section == elf.SHN_UNDEF {
+			continue
+		}
+		if sym.Value <= addr && addr < sym.Value+sym.Size {
+			return sym.Value, sym.Value + sym.Size, true
+		}
+	}
+	return 0, 0, false
+}
+
+var sourceCache = make(map[string][]string)
+
+// sourceLine returns the text of 1-based line number line in path, or
+// "" if it can't be read.
+func sourceLine(path string, line int) string {
+	lines, ok := sourceCache[path]
+	if !ok {
+		if data, err := os.ReadFile(path); err == nil {
+			lines = strings.Split(string(data), "\n")
+		}
+		sourceCache[path] = lines
+	}
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	return lines[line-1]
+}
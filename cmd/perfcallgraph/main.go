@@ -0,0 +1,255 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command perfcallgraph prints the call graph of a profile recorded
+// with callchains ("perf record -g"), like "perf report -g".
+//
+// By default, perfcallgraph prints a caller tree, starting from the
+// outermost functions and descending into their callees:
+//
+//	   cum     self
+//	92.10%    0.00%  runtime.goexit
+//	90.31%    0.00%    main.main
+//	61.02%   12.40%      main.parse
+//	48.62%   48.62%        strings.Index
+//
+// Each line gives the fraction of samples in that function and its
+// callees along this path (cum), and the fraction in the function
+// itself (self).
+//
+// With -order=callee, the tree is inverted: it starts from the
+// functions where samples were taken and ascends into their callers.
+// This shows which paths lead to the hottest functions.
+//
+// Nodes below -min-percent are omitted. With -dot, perfcallgraph
+// instead writes the call graph in Graphviz dot format, with one node
+// per function and edges weighted by the samples flowing through
+// them.
+//
+// With -trim, stacks are trimmed before they are added to the graph.
+// See perfsession.TrimAll.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perfsession"
+)
+
+// A treeNode is a node in a caller or callee tree.
+type treeNode struct {
+	name      string
+	cum, self uint64
+	kids      map[string]*treeNode
+}
+
+func (n *treeNode) child(name string) *treeNode {
+	kid := n.kids[name]
+	if kid == nil {
+		kid = &treeNode{name: name, kids: make(map[string]*treeNode)}
+		n.kids[name] = kid
+	}
+	return kid
+}
+
+// A graph is a call graph in which each function appears once.
+type graph struct {
+	nodes map[string]*graphNode
+	edges map[[2]string]uint64 // Caller, callee -> weight
+}
+
+type graphNode struct {
+	cum, self uint64
+}
+
+func main() {
+	var (
+		flagInput = flag.String("i", "perf.data", "input perf.data `file`")
+		flagOrder = flag.String("order", "caller", "tree `order`: caller or callee")
+		flagMin   = flag.Float64("min-percent", 0.5, "omit nodes below `percent` of samples")
+		flagDot   = flag.Bool("dot", false, "write call graph in Graphviz dot format")
+		flagTrim  = flag.Bool("trim", false, "trim runtime and startup frames from stacks")
+	)
+	flag.Parse()
+	if flag.NArg() > 0 || (*flagOrder != "caller" && *flagOrder != "callee") {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	f, err := perffile.Open(*flagInput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	s := perfsession.New(f)
+	var trim perfsession.StackTrim
+	if *flagTrim {
+		trim = perfsession.TrimAll
+	}
+
+	root := &treeNode{kids: make(map[string]*treeNode)}
+	g := &graph{make(map[string]*graphNode), make(map[[2]string]uint64)}
+	var total uint64
+	rs := f.Records(perffile.RecordsCausalOrder)
+	for rs.Next() {
+		s.Update(rs.Record)
+
+		r, ok := rs.Record.(*perffile.RecordSample)
+		if !ok || r.Format&perffile.SampleFormatIP == 0 {
+			continue
+		}
+		weight := uint64(1)
+		if r.Format&perffile.SampleFormatPeriod != 0 {
+			weight = r.Period
+		}
+		total += weight
+
+		stack := trim.Apply(s.Stack(r))
+		names := make([]string, len(stack))
+		for i := range stack {
+			names[i] = stack[i].Name()
+		}
+
+		// Add to the tree. names is leaf first.
+		n := root
+		if *flagOrder == "caller" {
+			for i := len(names) - 1; i >= 0; i-- {
+				n = n.child(names[i])
+				n.cum += weight
+			}
+			n.self += weight
+		} else {
+			for i, name := range names {
+				n = n.child(name)
+				n.cum += weight
+				if i == 0 {
+					n.self += weight
+				}
+			}
+		}
+
+		// Add to the graph, counting each node and edge once
+		// per sample even if the stack is recursive.
+		seen := make(map[string]bool)
+		seenEdge := make(map[[2]string]bool)
+		for i, name := range names {
+			gn := g.nodes[name]
+			if gn == nil {
+				gn = new(graphNode)
+				g.nodes[name] = gn
+			}
+			if i == 0 {
+				gn.self += weight
+			}
+			if !seen[name] {
+				seen[name] = true
+				gn.cum += weight
+			}
+			if i > 0 {
+				e := [2]string{name, names[i-1]}
+				if !seenEdge[e] {
+					seenEdge[e] = true
+					g.edges[e] += weight
+				}
+			}
+		}
+	}
+	if err := rs.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	if total == 0 {
+		log.Fatal("no samples")
+	}
+	minWeight := uint64(*flagMin / 100 * float64(total))
+	if *flagDot {
+		g.writeDot(total, minWeight)
+	} else {
+		writeTree(root, total, minWeight)
+	}
+}
+
+func pct(x, total uint64) float64 {
+	return 100 * float64(x) / float64(total)
+}
+
+// sortedKids returns n's children with at least minWeight cumulative
+// weight, heaviest first.
+func sortedKids(n *treeNode, minWeight uint64) []*treeNode {
+	var kids []*treeNode
+	for _, kid := range n.kids {
+		if kid.cum >= minWeight {
+			kids = append(kids, kid)
+		}
+	}
+	sort.Slice(kids, func(i, j int) bool {
+		if kids[i].cum != kids[j].cum {
+			return kids[i].cum > kids[j].cum
+		}
+		return kids[i].name < kids[j].name
+	})
+	return kids
+}
+
+func writeTree(root *treeNode, total, minWeight uint64) {
+	fmt.Printf("%8s %8s\n", "cum", "self")
+	var walk func(n *treeNode, depth int)
+	walk = func(n *treeNode, depth int) {
+		for _, kid := range sortedKids(n, minWeight) {
+			fmt.Printf("%7.2f%% %7.2f%%  %s%s\n", pct(kid.cum, total), pct(kid.self, total), strings.Repeat("  ", depth), kid.name)
+			walk(kid, depth+1)
+		}
+	}
+	walk(root, 0)
+}
+
+func (g *graph) writeDot(total, minWeight uint64) {
+	// Assign stable IDs to the nodes that pass the filter.
+	var names []string
+	for name, gn := range g.nodes {
+		if gn.cum >= minWeight {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	ids := make(map[string]int)
+	for i, name := range names {
+		ids[name] = i
+	}
+
+	fmt.Println("digraph callgraph {")
+	fmt.Println("\tnode [shape=box];")
+	for i, name := range names {
+		gn := g.nodes[name]
+		// Scale the font with self time, like pprof.
+		size := 8 + 16*float64(gn.self)/float64(total)
+		fmt.Printf("\tn%d [label=%q, fontsize=%.1f];\n", i, fmt.Sprintf("%s\n%.2f%% of %.2f%%", name, pct(gn.self, total), pct(gn.cum, total)), size)
+	}
+	var edges [][2]string
+	for e, w := range g.edges {
+		_, ok1 := ids[e[0]]
+		_, ok2 := ids[e[1]]
+		if ok1 && ok2 && w >= minWeight {
+			edges = append(edges, e)
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i][0] != edges[j][0] {
+			return edges[i][0] < edges[j][0]
+		}
+		return edges[i][1] < edges[j][1]
+	})
+	for _, e := range edges {
+		w := g.edges[e]
+		fmt.Printf("\tn%d -> n%d [label=\"%.2f%%\", penwidth=%.1f];\n", ids[e[0]], ids[e[1]], pct(w, total), 1+4*float64(w)/float64(total))
+	}
+	fmt.Println("}")
+}
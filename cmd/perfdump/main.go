@@ -65,6 +65,9 @@ func main() {
 		{"NUMA nodes", f.Meta.NUMANodes},
 		{"PMU mappings", f.Meta.PMUMappings},
 		{"groups", f.Meta.Groups},
+		{"memory topology", f.Meta.MemTopology},
+		{"compression", f.Meta.Compression},
+		{"caches", f.Meta.Caches},
 	} {
 		if hdr.val == reflect.Zero(reflect.ValueOf(hdr.val).Type()) {
 			continue
@@ -131,7 +134,7 @@ func fmtVal(name string, v reflect.Value) string {
 		return fmt.Sprintf("%-14s %p", name+":", v.Interface())
 	}
 	switch name {
-	case "IP", "Addr", "Callchain":
+	case "IP", "Addr", "Callchain", "Raw":
 		return fmt.Sprintf("%-14s %#x", name+":", v.Interface())
 	}
 	return fmt.Sprintf("%-14s %+v", name+":", v.Interface())
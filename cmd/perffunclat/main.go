@@ -0,0 +1,364 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command perffunclat reports the latency and return values of
+// functions traced with entry and return probes.
+//
+// perffunclat expects a profile recorded with a probe at the entry of
+// each function and a probe at its return, such as
+//
+//	perf probe -a do_sys_openat2 -a 'do_sys_openat2%return $retval'
+//	perf record -g -e probe:do_sys_openat2 -e probe:do_sys_openat2__return <cmd>
+//
+// This also works with uprobes, such as
+//
+//	perf probe -x /usr/bin/prog -a main.work -a 'main.work%return $retval'
+//
+// perffunclat pairs each return probe "name__return" with the entry
+// probe "name" in the same system, matches entries and returns on
+// each thread, and reports the number of calls and their total,
+// average, 99th percentile, and maximum latency for each caller of
+// each function. The output is a table like
+//
+//	calls        total         avg         p99         max  errors  function        caller
+//	 1024      12.30ms     12.01us     95.50us    180.20us       3  do_sys_openat2  __x64_sys_openat
+//
+// The errors column counts calls whose return value is an error
+// number, that is, between -4095 and -1. With -errors, perffunclat
+// also breaks down each row by error number. With -hist, it prints a
+// histogram of each row's latencies.
+//
+// With -prom or -otlp, perffunclat also writes the latency histogram
+// and error count of each function and caller to a file, in the
+// Prometheus text format or as OTLP/JSON metrics, respectively, so
+// they can be fed to a monitoring system.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aclements/go-perf/cmd/internal/cmdutil"
+	"github.com/aclements/go-perf/internal/hist"
+	"github.com/aclements/go-perf/internal/metrics"
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perfsession"
+)
+
+// A probe is a pair of entry and return probes of one function.
+type probe struct {
+	name  string
+	entry *perffile.TracepointFormat
+	ret   *perffile.TracepointFormat
+	// retval is the return probe's field holding the return
+	// value, or nil if it has none.
+	retval *perffile.TracepointField
+}
+
+// A call is an entry to a probed function awaiting its return.
+type call struct {
+	probe *probe
+	time  uint64
+	stack []perfsession.Frame
+}
+
+// A stat aggregates the calls to a function from one stack.
+type stat struct {
+	probe     *probe
+	stack     []perfsession.Frame
+	stackName string
+	errors    map[int64]int
+	nerrors   int
+
+	// lat and log2 record the latency of each call in
+	// nanoseconds. lat gives accurate percentiles, while log2
+	// has fewer buckets for printing.
+	lat  *hist.HDR
+	log2 hist.Log2
+}
+
+func main() {
+	var (
+		flagInput  = flag.String("i", "perf.data", "input perf.data `file`")
+		flagLimit  = flag.Int("limit", 30, "report the top `n` stacks")
+		flagRet    = flag.String("ret", "arg1", "return probe `field` holding the return value")
+		flagErrors = flag.Bool("errors", false, "break down calls by error number")
+		flagHist   = flag.Bool("hist", false, "print a latency histogram for each stack")
+		flagProm   = flag.String("prom", "", "write metrics in Prometheus text format to `file`")
+		flagOTLP   = flag.String("otlp", "", "write metrics in OTLP/JSON format to `file`")
+	)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	f, err := perffile.Open(*flagInput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	formats, err := f.Meta.TracepointFormats()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Pair up entry and return probes.
+	byName := make(map[string]*perffile.TracepointFormat)
+	for _, tf := range formats {
+		byName[tf.String()] = tf
+	}
+	probes := make(map[perffile.EventTracepoint]*probe)
+	for _, tf := range formats {
+		name := strings.TrimSuffix(tf.Name, "__return")
+		if name == tf.Name {
+			continue
+		}
+		entry := byName[tf.System+":"+name]
+		if entry == nil {
+			continue
+		}
+		p := &probe{name: name, entry: entry, ret: tf, retval: tf.Field(*flagRet)}
+		probes[entry.ID] = p
+		probes[tf.ID] = p
+	}
+	if len(probes) == 0 {
+		log.Fatal("profile does not have pairs of entry and return probes")
+	}
+
+	s := perfsession.New(f)
+	// calls records the pending calls on each thread. Each
+	// thread has a stack of calls, since probed functions may
+	// be recursive or call each other.
+	calls := make(map[int][]call)
+	stats := make(map[string]*stat)
+	// first and last are the times of the first and last probe
+	// events.
+	var first, last uint64
+	rs := f.Records(perffile.RecordsTimeOrder)
+	for rs.Next() {
+		s.Update(rs.Record)
+
+		r, ok := rs.Record.(*perffile.RecordSample)
+		if !ok {
+			continue
+		}
+		tp, ok := r.EventAttr.Event.(perffile.EventTracepoint)
+		if !ok {
+			continue
+		}
+		p := probes[tp]
+		if p == nil {
+			continue
+		}
+		if r.Format&perffile.SampleFormatTime == 0 || r.Format&perffile.SampleFormatTID == 0 {
+			log.Fatal("profile does not have sample timestamps and thread IDs")
+		}
+		if first == 0 {
+			first = r.Time
+		}
+		last = r.Time
+		if tp == p.entry.ID {
+			calls[r.TID] = append(calls[r.TID], call{p, r.Time, s.Stack(r)})
+			continue
+		}
+
+		// Find the matching entry. Entries above it on the
+		// thread's stack lost their returns, for example to
+		// a dropped sample, so discard them.
+		pending := calls[r.TID]
+		i := len(pending) - 1
+		for i >= 0 && pending[i].probe != p {
+			i--
+		}
+		if i < 0 {
+			// The call began before the profile.
+			continue
+		}
+		c := pending[i]
+		calls[r.TID] = pending[:i]
+
+		key := p.name + "," + perfsession.StackKey(c.stack)
+		st := stats[key]
+		if st == nil {
+			st = &stat{probe: p, stack: c.stack, stackName: key, errors: make(map[int64]int), lat: hist.NewHDR(7)}
+			stats[key] = st
+		}
+		st.lat.Add(r.Time - c.time)
+		st.log2.Add(r.Time - c.time)
+		if p.retval != nil {
+			if ret := signExtend(p.retval.Uint(r.Raw), p.retval.Size); -4095 <= ret && ret < 0 {
+				st.errors[ret]++
+				st.nerrors++
+			}
+		}
+	}
+	if err := rs.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	if *flagProm != "" || *flagOTLP != "" {
+		fams := exportFamilies(stats)
+		if *flagProm != "" {
+			err := writeFile(*flagProm, func(w *os.File) error {
+				return metrics.WritePrometheus(w, fams)
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *flagOTLP != "" {
+			resource := map[string]string{"service.name": "perffunclat"}
+			if f.Meta.Hostname != "" {
+				resource["host.name"] = f.Meta.Hostname
+			}
+			if f.Meta.Arch != "" {
+				resource["host.arch"] = f.Meta.Arch
+			}
+			if f.Meta.OSRelease != "" {
+				resource["os.version"] = f.Meta.OSRelease
+			}
+			// Sample times aren't wall-clock times, so
+			// report the profile's duration ending now.
+			end := time.Now()
+			start := end.Add(-time.Duration(last - first))
+			err := writeFile(*flagOTLP, func(w *os.File) error {
+				return metrics.WriteOTLP(w, fams, resource, start, end)
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	sorted := make([]*stat, 0, len(stats))
+	for _, st := range stats {
+		sorted = append(sorted, st)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if ti, tj := sorted[i].lat.Stats().Sum, sorted[j].lat.Stats().Sum; ti != tj {
+			return ti > tj
+		}
+		return sorted[i].stackName < sorted[j].stackName
+	})
+	if len(sorted) > *flagLimit {
+		sorted = sorted[:*flagLimit]
+	}
+
+	fmt.Printf("%10s %12s %11s %11s %11s  %6s  %-14s  %s\n", "calls", "total", "avg", "p99", "max", "errors", "function", "caller")
+	for _, st := range sorted {
+		ls := st.lat.Stats()
+		fmt.Printf("%10d %12s %11s %11s %11s  %6d  %-14s  %s\n", ls.Count, cmdutil.FormatNS(ls.Sum), cmdutil.FormatNS(ls.Sum/ls.Count), cmdutil.FormatNS(hist.Quantile(st.lat, 0.99)), cmdutil.FormatNS(ls.Max), st.nerrors, st.probe.name, caller(st.stack))
+		if *flagErrors && st.nerrors > 0 {
+			errs := make([]int64, 0, len(st.errors))
+			for e := range st.errors {
+				errs = append(errs, e)
+			}
+			sort.Slice(errs, func(i, j int) bool {
+				return st.errors[errs[i]] > st.errors[errs[j]]
+			})
+			for _, e := range errs {
+				fmt.Printf("%10d  error %d (%s)\n", st.errors[e], e, syscall.Errno(-e))
+			}
+		}
+		if *flagHist {
+			hist.Fprint(os.Stdout, &st.log2, cmdutil.FormatNS)
+		}
+	}
+}
+
+// exportFamilies returns the latency histograms and error counts of
+// stats, aggregated by function and caller.
+func exportFamilies(stats map[string]*stat) []*metrics.Family {
+	type key struct{ fn, caller string }
+	lats := make(map[key]*hist.HDR)
+	errs := make(map[key]map[int64]int)
+	for _, st := range stats {
+		k := key{st.probe.name, caller(st.stack)}
+		if lats[k] == nil {
+			lats[k] = hist.NewHDR(7)
+			errs[k] = make(map[int64]int)
+		}
+		lats[k].Merge(st.lat)
+		for e, n := range st.errors {
+			errs[k][e] += n
+		}
+	}
+	keys := make([]key, 0, len(lats))
+	for k := range lats {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].fn != keys[j].fn {
+			return keys[i].fn < keys[j].fn
+		}
+		return keys[i].caller < keys[j].caller
+	})
+
+	latFam := &metrics.Family{
+		Name:  "perf_function_latency_seconds",
+		Help:  "Latency of probed function calls.",
+		Unit:  "s",
+		Scale: 1e-9,
+	}
+	errFam := &metrics.Family{
+		Name: "perf_function_errors_total",
+		Help: "Probed function calls that returned an error number.",
+	}
+	for _, k := range keys {
+		labels := map[string]string{"function": k.fn, "caller": k.caller}
+		latFam.Series = append(latFam.Series, metrics.Series{Labels: labels, Hist: lats[k]})
+		var es []int64
+		for e := range errs[k] {
+			es = append(es, e)
+		}
+		sort.Slice(es, func(i, j int) bool { return es[i] > es[j] })
+		for _, e := range es {
+			errFam.Series = append(errFam.Series, metrics.Series{
+				Labels: map[string]string{"function": k.fn, "caller": k.caller, "errno": fmt.Sprint(-e)},
+				Value:  float64(errs[k][e]),
+			})
+		}
+	}
+	fams := []*metrics.Family{latFam}
+	if len(errFam.Series) > 0 {
+		fams = append(fams, errFam)
+	}
+	return fams
+}
+
+// writeFile creates file path and writes it using write.
+func writeFile(path string, write func(w *os.File) error) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write(out)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// signExtend sign-extends the size-byte integer x.
+func signExtend(x uint64, size int) int64 {
+	shift := 64 - 8*uint(size)
+	return int64(x<<shift) >> shift
+}
+
+// caller returns the caller of the probed function. The entry probe
+// fires at the function's first instruction, so this is the second
+// frame of the entry's stack.
+func caller(stack []perfsession.Frame) string {
+	if len(stack) < 2 {
+		return "[unknown]"
+	}
+	return stack[1].Name()
+}
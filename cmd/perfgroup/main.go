@@ -0,0 +1,231 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command perfgroup attributes the counts of an event group to
+// functions, using a sampling leader.
+//
+// perfgroup expects a profile recorded with an event group in which
+// only the leader is sampled and the other members are read at each
+// sample, such as
+//
+//	perf record -e '{cycles,instructions,cache-misses}:S' <cmd>
+//
+// At each sample, the counts of the members since the previous sample
+// are attributed to the sampled function. For each function,
+// perfgroup reports the number of samples and the ratio of each
+// member's count to the leader's count. With cycles as the leader,
+// the ratio for instructions is the function's IPC, and the ratio for
+// stalled-cycles-frontend is the fraction of cycles stalled. With
+// -per-insn, perfgroup instead reports the count of each member per
+// 1000 instructions, such as cache misses per kilo-instruction.
+//
+// Each ratio is followed by its 95% confidence interval, derived from
+// the variation between the function's samples. Ratios for functions
+// with few samples have wide intervals and should not be
+// over-interpreted.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/aclements/go-perf/cmd/internal/cmdutil"
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perfsession"
+)
+
+// A ratioStat accumulates the per-sample counts (x, y) of two events
+// to estimate the ratio sum(y)/sum(x) and its standard error.
+type ratioStat struct {
+	n             int
+	sx, sy        float64
+	sxx, syy, sxy float64
+}
+
+func (s *ratioStat) add(x, y float64) {
+	s.n++
+	s.sx += x
+	s.sy += y
+	s.sxx += x * x
+	s.syy += y * y
+	s.sxy += x * y
+}
+
+// ratio returns the ratio estimate and the half-width of its 95%
+// confidence interval.
+func (s *ratioStat) ratio() (r, ci float64) {
+	if s.sx == 0 {
+		return math.NaN(), math.NaN()
+	}
+	r = s.sy / s.sx
+	if s.n < 2 {
+		return r, math.Inf(1)
+	}
+	// This is the standard error of a ratio estimator: the
+	// variance of the residuals y - r*x, scaled by the mean of x.
+	n := float64(s.n)
+	resid := (s.syy - 2*r*s.sxy + r*r*s.sxx) / (n - 1)
+	if resid < 0 {
+		resid = 0
+	}
+	xbar := s.sx / n
+	se := math.Sqrt(resid/n) / xbar
+	return r, 1.96 * se
+}
+
+type funcStat struct {
+	name    string
+	samples int
+	leader  uint64
+	ratios  []ratioStat // Indexed by member
+}
+
+func main() {
+	var (
+		flagInput   = flag.String("i", "perf.data", "input perf.data `file`")
+		flagLimit   = flag.Int("limit", 30, "report the top `n` functions")
+		flagPerInsn = flag.Bool("per-insn", false, "report counts per 1000 instructions instead of per leader event")
+	)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	f, err := perffile.Open(*flagInput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	s := perfsession.New(f)
+
+	// members are the events of the group, leader first, as
+	// found in the first group sample.
+	var members []*perffile.EventAttr
+	// base is the index of the member each count is divided by:
+	// the leader, or instructions with -per-insn.
+	base := 0
+	funcs := make(map[string]*funcStat)
+	// last records the previous counter values of each counter
+	// instance, keyed by stream ID.
+	last := make(map[uint64][]uint64)
+
+	rs := f.Records(perffile.RecordsTimeOrder)
+	for rs.Next() {
+		s.Update(rs.Record)
+
+		r, ok := rs.Record.(*perffile.RecordSample)
+		if !ok || r.Format&perffile.SampleFormatIP == 0 || len(r.SampleRead) < 2 {
+			continue
+		}
+		if members == nil {
+			for _, c := range r.SampleRead {
+				if c.EventAttr == nil {
+					log.Fatal("group samples do not identify their events; record with -e '{...}:S'")
+				}
+				members = append(members, c.EventAttr)
+			}
+			if *flagPerInsn {
+				base = -1
+				for i, m := range members {
+					if hw, ok := m.Event.(perffile.EventHardware); ok && hw.ID == perffile.EventHardwareIDInstructions {
+						base = i
+					}
+				}
+				if base < 0 {
+					log.Fatal("-per-insn requires instructions in the event group")
+				}
+			}
+		}
+		if len(r.SampleRead) != len(members) {
+			continue
+		}
+
+		stream := r.StreamID
+		if r.Format&perffile.SampleFormatStreamID == 0 {
+			stream = uint64(r.ID)
+		}
+		vals := make([]uint64, len(members))
+		for i, c := range r.SampleRead {
+			vals[i] = c.Value
+		}
+		prev, ok := last[stream]
+		last[stream] = vals
+		if !ok {
+			// There's no interval to attribute yet.
+			continue
+		}
+
+		name := cmdutil.FuncName(s, r.PID, r.IP)
+		fs := funcs[name]
+		if fs == nil {
+			fs = &funcStat{name: name, ratios: make([]ratioStat, len(members))}
+			funcs[name] = fs
+		}
+		fs.samples++
+		fs.leader += vals[0] - prev[0]
+		x := float64(vals[base] - prev[base])
+		for i := range members {
+			fs.ratios[i].add(x, float64(vals[i]-prev[i]))
+		}
+	}
+	if err := rs.Err(); err != nil {
+		log.Fatal(err)
+	}
+	if members == nil {
+		log.Fatal("profile does not have event group samples")
+	}
+
+	sorted := make([]*funcStat, 0, len(funcs))
+	var total uint64
+	for _, fs := range funcs {
+		sorted = append(sorted, fs)
+		total += fs.leader
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].leader != sorted[j].leader {
+			return sorted[i].leader > sorted[j].leader
+		}
+		return sorted[i].name < sorted[j].name
+	})
+	if len(sorted) > *flagLimit {
+		sorted = sorted[:*flagLimit]
+	}
+
+	// Print the header. The base member's own ratio is always 1,
+	// so skip it.
+	scale := 1.0
+	if *flagPerInsn {
+		scale = 1000
+	}
+	fmt.Printf("%8s %7s", "samples", members[0].Name(nil))
+	for i, m := range members {
+		if i == base {
+			continue
+		}
+		col := m.Name(nil) + "/" + members[base].Name(nil)
+		if *flagPerInsn {
+			col = m.Name(nil) + "/kinsn"
+		}
+		fmt.Printf("  %22s", col)
+	}
+	fmt.Println("  function")
+
+	for _, fs := range sorted {
+		fmt.Printf("%8d %6.2f%%", fs.samples, 100*float64(fs.leader)/float64(total))
+		for i := range members {
+			if i == base {
+				continue
+			}
+			r, ci := fs.ratios[i].ratio()
+			fmt.Printf("  %10.3f ± %-9.3f", r*scale, ci*scale)
+		}
+		fmt.Printf("  %s\n", fs.name)
+	}
+}
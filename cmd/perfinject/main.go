@@ -0,0 +1,146 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command perfinject post-processes a perf.data file to make it
+// self-contained, like "perf inject -b".
+//
+// perfinject records the build ID of every file mapped by the
+// profiled processes in the output's build ID table. Tools such as
+// perfsession use this table to find the right binary in the
+// build-ID cache (~/.debug) even after the original file has been
+// replaced. To populate the cache, use "perf buildid-cache".
+//
+// Build IDs are read from the files on the local machine, so
+// perfinject should be run on the machine that recorded the profile.
+//
+// With -archive, perfinject also writes a tar archive of the mapped
+// files, like "perf archive". Extracting this archive into ~/.debug
+// on another machine makes the profile symbolizable there.
+//
+// Symbols for JIT-compiled code are read directly from jitdump and
+// /tmp/perf-<pid>.map files by perfsession, so perfinject does not
+// synthesize images for them.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perfsession"
+)
+
+func main() {
+	var (
+		flagInput   = flag.String("i", "perf.data", "input perf.data `file`")
+		flagOutput  = flag.String("o", "", "output perf.data `file` (required)")
+		flagArchive = flag.String("archive", "", "also write mapped files to tar `file`")
+	)
+	flag.Parse()
+	if flag.NArg() > 0 || *flagOutput == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	f, err := perffile.Open(*flagInput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := addBuildIDs(f); err != nil {
+		log.Fatal(err)
+	}
+
+	out, err := os.Create(*flagOutput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = perffile.Copy(f, out)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(*flagOutput)
+		log.Fatal(err)
+	}
+
+	if *flagArchive != "" {
+		out, err := os.Create(*flagArchive)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = perfsession.Archive(f, out)
+		if err2 := out.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// addBuildIDs adds the build IDs of all files mapped in f that aren't
+// already in f.Meta.BuildIDs.
+func addBuildIDs(f *perffile.File) error {
+	have := make(map[string]bool)
+	for _, bid := range f.Meta.BuildIDs {
+		have[bid.Filename] = true
+	}
+
+	rs := f.Records(perffile.RecordsFileOrder)
+	for rs.Next() {
+		r, ok := rs.Record.(*perffile.RecordMmap)
+		if !ok || r.Data {
+			continue
+		}
+		// The kernel is mapped as "[kernel.kallsyms]_text",
+		// but perf and perfsession look up its build ID as
+		// "[kernel.kallsyms]". See machine__mmap_name in
+		// tools/perf/util/machine.c.
+		name := r.Filename
+		if strings.HasPrefix(name, kallsyms) {
+			name = kallsyms
+		}
+		if have[name] {
+			continue
+		}
+		have[name] = true
+
+		var buildID perffile.BuildID
+		var err error
+		switch {
+		case r.BuildID != nil:
+			// The kernel already recorded it.
+			buildID = r.BuildID
+		case strings.HasPrefix(name, "/"), name == kallsyms:
+			buildID, err = readBuildID(r.Filename)
+		default:
+			// Anonymous or special mapping.
+			continue
+		}
+		if err != nil {
+			log.Printf("%s: %v", r.Filename, err)
+			continue
+		}
+		if buildID == nil {
+			continue
+		}
+		f.Meta.BuildIDs = append(f.Meta.BuildIDs, perffile.BuildIDInfo{
+			CPUMode:  r.CPUMode,
+			PID:      -1,
+			BuildID:  buildID,
+			Filename: name,
+		})
+	}
+	return rs.Err()
+}
+
+const kallsyms = "[kernel.kallsyms]"
+
+// readBuildID reads the build ID of a mapped file. Tests replace it
+// to avoid depending on the files of the machine.
+var readBuildID = perfsession.ReadBuildID
@@ -0,0 +1,153 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perfsession"
+)
+
+// TestInjectSymbolize checks that perfsession can symbolize the
+// kernel using the build ID perfinject adds for it.
+func TestInjectSymbolize(t *testing.T) {
+	// perfsession finds the build ID cache through $HOME when
+	// it's initialized, so run the test in a child process with
+	// a temporary home directory.
+	home := os.Getenv("PERFINJECT_TEST_HOME")
+	if home == "" {
+		home = t.TempDir()
+		cmd := exec.Command(os.Args[0], "-test.run=^TestInjectSymbolize$", "-test.v")
+		cmd.Env = append(os.Environ(), "HOME="+home, "PERFINJECT_TEST_HOME="+home)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		if !bytes.Contains(out, []byte("--- PASS: TestInjectSymbolize")) {
+			t.Fatalf("test didn't run in child process:\n%s", out)
+		}
+		return
+	}
+
+	// Put the kernel's symbols in the build ID cache, as "perf
+	// buildid-cache" would.
+	kernelID := perffile.BuildID{0xab, 0xcd, 0xef, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17}
+	cachePath := filepath.Join(home, ".debug", ".build-id", "ab", kernelID.String()[2:])
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0777); err != nil {
+		t.Fatal(err)
+	}
+	kallsymsData := "ffffffff81000000 T _text\nffffffff81001000 T do_work\nffffffff81002000 T _etext\n"
+	if err := os.WriteFile(cachePath, []byte(kallsymsData), 0666); err != nil {
+		t.Fatal(err)
+	}
+	readBuildID = func(filename string) (perffile.BuildID, error) {
+		if filename != "[kernel.kallsyms]_text" {
+			t.Errorf("reading build ID of unexpected file %q", filename)
+			return nil, nil
+		}
+		return kernelID, nil
+	}
+
+	// Write a profile with a kernel mapping that doesn't carry
+	// its build ID and a sample in it.
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	w := perffile.NewPipeWriter(&buf, binary.LittleEndian)
+	attr := &perffile.EventAttr{
+		Event:        perffile.EventHardware{ID: perffile.EventHardwareIDCPUCycles},
+		SamplePeriod: 1,
+		SampleFormat: perffile.SampleFormatIP | perffile.SampleFormatTID,
+		Flags:        perffile.EventFlagSampleIDAll,
+	}
+	if err := w.AddEvent(attr); err != nil {
+		t.Fatal(err)
+	}
+	records := []perffile.Record{
+		&perffile.RecordComm{RecordCommon: perffile.RecordCommon{PID: 10, TID: 10}, Comm: "gopher"},
+		&perffile.RecordMmap{RecordCommon: perffile.RecordCommon{PID: -1, TID: 0}, CPUMode: perffile.CPUModeKernel, Addr: 0xffffffff81000000, Len: 0x2000, FileOffset: 0xffffffff81000000, Filename: "[kernel.kallsyms]_text"},
+		&perffile.RecordSample{RecordCommon: perffile.RecordCommon{EventAttr: attr, PID: 10, TID: 10}, CPUMode: perffile.CPUModeKernel, IP: 0xffffffff81001010},
+	}
+	for _, r := range records {
+		if err := w.WriteRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in, err := perffile.NewPipe(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := filepath.Join(dir, "recorded.data")
+	copyTo(t, in, recorded)
+
+	// Inject build IDs, as main does.
+	f, err := perffile.Open(recorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := addBuildIDs(f); err != nil {
+		t.Fatal(err)
+	}
+	injected := filepath.Join(dir, "injected.data")
+	copyTo(t, f, injected)
+
+	// Symbolize the sample from the injected profile.
+	f2, err := perffile.Open(injected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	if n := len(f2.Meta.BuildIDs); n != 1 || f2.Meta.BuildIDs[0].Filename != kallsyms {
+		t.Fatalf("build IDs %+v, want one for %s", f2.Meta.BuildIDs, kallsyms)
+	}
+	s := perfsession.New(f2)
+	found := false
+	rs := f2.Records(perffile.RecordsFileOrder)
+	for rs.Next() {
+		s.Update(rs.Record)
+		r, ok := rs.Record.(*perffile.RecordSample)
+		if !ok {
+			continue
+		}
+		found = true
+		var mmap *perfsession.Mmap
+		if pidInfo := s.LookupPID(r.PID); pidInfo != nil {
+			mmap = pidInfo.LookupMmap(r.IP)
+		}
+		var sym perfsession.Symbolic
+		if mmap == nil || !perfsession.Symbolize(s, mmap, r.IP, &sym) {
+			t.Fatalf("failed to symbolize sample at %#x", r.IP)
+		}
+		if sym.FuncName != "do_work" {
+			t.Errorf("sample at %#x symbolized to %q, want do_work", r.IP, sym.FuncName)
+		}
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("sample not found")
+	}
+}
+
+func copyTo(t *testing.T, f *perffile.File, path string) {
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = perffile.Copy(f, out)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
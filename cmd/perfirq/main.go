@@ -0,0 +1,234 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command perfirq reports time spent in hardware interrupt and
+// softirq handlers.
+//
+// perfirq expects a system-wide perf.data recorded with the irq
+// tracepoints:
+//
+//	perf record -a -e irq:irq_handler_entry -e irq:irq_handler_exit \
+//		-e irq:softirq_entry -e irq:softirq_exit sleep 10
+//
+// Either pair of events may be omitted. perfirq pairs the entry and
+// exit events on each CPU to measure each handler invocation, and
+// aggregates the handler latency by IRQ number or softirq vector. For
+// example,
+//
+//	kind     irq                 count   total time    max time    avg time
+//	irq      24:nvme0q3           1520       14.2ms      41.2µs      9.34µs
+//	softirq  NET_RX               8830      61.02ms     310.5µs      6.91µs
+//
+// With -cpu, the latency is further broken down by CPU, which shows
+// whether interrupt load is concentrated on a few CPUs.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/aclements/go-perf/cmd/internal/cmdutil"
+	"github.com/aclements/go-perf/perffile"
+)
+
+// softirqNames are the names of the softirq vectors. See softirq_to_name
+// in kernel/softirq.c.
+var softirqNames = []string{"HI", "TIMER", "NET_TX", "NET_RX", "BLOCK", "IRQ_POLL", "TASKLET", "SCHED", "HRTIMER", "RCU"}
+
+// A handlerKey identifies the handler an invocation is aggregated
+// under.
+type handlerKey struct {
+	soft bool
+	irq  uint64
+	name string
+	cpu  int // -1 if not splitting by CPU
+}
+
+type stat struct {
+	count int
+	total uint64
+	max   uint64
+}
+
+// An entry is a handler entry event awaiting its exit.
+type entry struct {
+	key  handlerKey
+	time uint64
+}
+
+func main() {
+	var (
+		flagInput = flag.String("i", "perf.data", "input perf.data `file`")
+		flagCPU   = flag.Bool("cpu", false, "break down latency by CPU")
+	)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	f, err := perffile.Open(*flagInput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	formats, err := f.Meta.TracepointFormats()
+	if err != nil {
+		log.Fatal(err)
+	}
+	events := make(map[string]*perffile.TracepointFormat)
+	for _, tf := range formats {
+		if tf.System == "irq" {
+			events[tf.Name] = tf
+		}
+	}
+	hardEntry, hardExit := events["irq_handler_entry"], events["irq_handler_exit"]
+	softEntry, softExit := events["softirq_entry"], events["softirq_exit"]
+	if (hardEntry == nil || hardExit == nil) && (softEntry == nil || softExit == nil) {
+		log.Fatal("profile does not have irq handler or softirq entry and exit events")
+	}
+	var irqField, nameField, vecField *perffile.TracepointField
+	if hardEntry != nil {
+		irqField, nameField = hardEntry.Field("irq"), hardEntry.Field("name")
+		if irqField == nil {
+			log.Fatal("irq_handler_entry event has no irq field")
+		}
+	}
+	if softEntry != nil {
+		if vecField = softEntry.Field("vec"); vecField == nil {
+			log.Fatal("softirq_entry event has no vec field")
+		}
+	}
+
+	// Hardware interrupts and softirqs can nest, so track the
+	// pending entries of each separately.
+	type pendingKey struct {
+		cpu  int
+		soft bool
+	}
+	pending := make(map[pendingKey]entry)
+	stats := make(map[handlerKey]*stat)
+
+	rs := f.Records(perffile.RecordsTimeOrder)
+	for rs.Next() {
+		r, ok := rs.Record.(*perffile.RecordSample)
+		if !ok {
+			continue
+		}
+		tp, ok := r.EventAttr.Event.(perffile.EventTracepoint)
+		if !ok {
+			continue
+		}
+		if r.Format&perffile.SampleFormatTime == 0 || r.Format&perffile.SampleFormatCPU == 0 {
+			log.Fatal("profile does not have sample timestamps and CPUs")
+		}
+		cpu := -1
+		if *flagCPU {
+			cpu = int(r.CPU)
+		}
+
+		var soft, isEntry bool
+		switch {
+		case hardEntry != nil && tp == hardEntry.ID:
+			isEntry = true
+		case hardExit != nil && tp == hardExit.ID:
+		case softEntry != nil && tp == softEntry.ID:
+			soft, isEntry = true, true
+		case softExit != nil && tp == softExit.ID:
+			soft = true
+		default:
+			continue
+		}
+		pk := pendingKey{int(r.CPU), soft}
+
+		if isEntry {
+			key := handlerKey{soft: soft, cpu: cpu}
+			if soft {
+				key.irq = vecField.Uint(r.Raw)
+			} else {
+				key.irq = irqField.Uint(r.Raw)
+				if nameField != nil {
+					key.name = nameField.String(r.Raw)
+				}
+			}
+			pending[pk] = entry{key, r.Time}
+			continue
+		}
+
+		e, ok := pending[pk]
+		if !ok {
+			// The handler was entered before the profile.
+			continue
+		}
+		delete(pending, pk)
+		st := stats[e.key]
+		if st == nil {
+			st = new(stat)
+			stats[e.key] = st
+		}
+		d := r.Time - e.time
+		st.count++
+		st.total += d
+		if d > st.max {
+			st.max = d
+		}
+	}
+	if err := rs.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	keys := make([]handlerKey, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.soft != b.soft {
+			return !a.soft
+		}
+		if a.irq != b.irq {
+			return a.irq < b.irq
+		}
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		return a.cpu < b.cpu
+	})
+
+	if *flagCPU {
+		fmt.Printf("%-8s %-16s %4s %8s %12s %11s %11s\n", "kind", "irq", "cpu", "count", "total time", "max time", "avg time")
+	} else {
+		fmt.Printf("%-8s %-16s %8s %12s %11s %11s\n", "kind", "irq", "count", "total time", "max time", "avg time")
+	}
+	for _, key := range keys {
+		st := stats[key]
+		kind := "irq"
+		if key.soft {
+			kind = "softirq"
+		}
+		if *flagCPU {
+			fmt.Printf("%-8s %-16s %4d ", kind, key.String(), key.cpu)
+		} else {
+			fmt.Printf("%-8s %-16s ", kind, key.String())
+		}
+		fmt.Printf("%8d %12s %11s %11s\n", st.count, cmdutil.FormatNS(st.total), cmdutil.FormatNS(st.max), cmdutil.FormatNS(st.total/uint64(st.count)))
+	}
+}
+
+func (k handlerKey) String() string {
+	if k.soft {
+		if k.irq < uint64(len(softirqNames)) {
+			return softirqNames[k.irq]
+		}
+		return fmt.Sprint(k.irq)
+	}
+	if k.name == "" {
+		return fmt.Sprint(k.irq)
+	}
+	return fmt.Sprintf("%d:%s", k.irq, k.name)
+}
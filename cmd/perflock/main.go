@@ -0,0 +1,130 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command perflock reports lock contention, like
+// "perf lock contention".
+//
+// perflock expects a perf.data recorded with call stacks and either
+// the kernel lock contention tracepoints (Linux 5.19 and later), the
+// futex system call tracepoints, or both:
+//
+//	perf record -g -e lock:contention_begin -e lock:contention_end \
+//		-e syscalls:sys_enter_futex -e syscalls:sys_exit_futex <cmd>
+//
+// The lock tracepoints measure waits for kernel locks. The futex
+// tracepoints measure waits for user-space locks, such as pthread
+// mutexes and the Go runtime's locks, which block in futex calls.
+//
+// perflock pairs the begin and end events of each thread to measure
+// how long the thread waited, and aggregates the waits by the call
+// stack at which the thread began waiting. The output is a table like
+//
+//	contended   total wait    max wait    avg wait  type      caller
+//	     2340      91.20ms      1.10ms     38.97us  spinlock  tcp_sendmsg
+//
+// With -pprof, perflock also writes the contention profile in pprof
+// format, with the number of contentions and the total delay in
+// nanoseconds for each stack. The profile's comments record the number
+// of events, the fraction lost, and the machine that recorded the
+// profile, which "pprof -comments" shows.
+//
+// The analysis is available to other programs as
+// perfsession.Contention.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aclements/go-perf/cmd/internal/cmdutil"
+	"github.com/aclements/go-perf/internal/pprof"
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perfsession"
+)
+
+func main() {
+	var (
+		flagInput = flag.String("i", "perf.data", "input perf.data `file`")
+		flagPprof = flag.String("pprof", "", "write pprof contention profile to `file`")
+		flagLimit = flag.Int("limit", 30, "report the top `n` stacks")
+	)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	f, err := perffile.Open(*flagInput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	s := perfsession.New(f)
+	c, err := perfsession.NewContention(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rs := f.Records(perffile.RecordsTimeOrder)
+	for rs.Next() {
+		s.Update(rs.Record)
+		if r, ok := rs.Record.(*perffile.RecordSample); ok {
+			if err := c.Sample(r); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	if err := rs.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	sorted := c.Stats()
+	if *flagPprof != "" {
+		if err := writePprof(*flagPprof, s, sorted); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if len(sorted) > *flagLimit {
+		sorted = sorted[:*flagLimit]
+	}
+	fmt.Printf("%10s %12s %11s %11s  %-8s  %s\n", "contended", "total wait", "max wait", "avg wait", "type", "caller")
+	for _, st := range sorted {
+		fmt.Printf("%10d %12s %11s %11s  %-8s  %s\n", st.Count, cmdutil.FormatNS(st.Total), cmdutil.FormatNS(st.Max), cmdutil.FormatNS(st.Total/uint64(st.Count)), st.Type, st.Caller())
+	}
+}
+
+func writePprof(path string, s *perfsession.Session, stats []*perfsession.ContentionStat) error {
+	b := pprof.NewBuilder(
+		pprof.ValueType{Type: "contentions", Unit: "count"},
+		pprof.ValueType{Type: "delay", Unit: "nanoseconds"},
+	)
+	b.Comment(fmt.Sprintf("samples: %d", s.Stats.Samples))
+	b.Comment(fmt.Sprintf("lost: %d records, %d samples (%.2f%%)", s.Stats.Lost, s.Stats.LostSamples, 100*s.Stats.LossRate()))
+	for _, info := range s.File.Meta.HostInfo() {
+		b.Comment(info)
+	}
+	for _, st := range stats {
+		frames := make([]pprof.Frame, len(st.Stack))
+		for i := range st.Stack {
+			f := &st.Stack[i]
+			frames[i] = pprof.Frame{Func: f.Name(), Line: f.Line.Line, Addr: f.IP}
+			if f.Line.File != nil {
+				frames[i].File = f.Line.File.Name
+			}
+		}
+		b.Add(frames, int64(st.Count), int64(st.Total))
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = b.Write(out)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,304 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command perfnet summarizes network stack tracepoints.
+//
+// perfnet expects a perf.data recorded with some of the following
+// tracepoints, ideally with call stacks:
+//
+//	perf record -a -g -e net:net_dev_queue -e net:netif_receive_skb \
+//		-e tcp:tcp_retransmit_skb -e sock:inet_sock_set_state sleep 10
+//
+// It reports a section for each kind of event present:
+//
+//   - Per-device transmit and receive packet and byte counts, from
+//     net:net_dev_queue and net:netif_receive_skb.
+//   - TCP retransmits per socket and per call stack, from
+//     tcp:tcp_retransmit_skb.
+//   - TCP state transitions, from sock:inet_sock_set_state, and the
+//     sockets that were reset or closed most often.
+//
+// The -limit flag caps the number of sockets and stacks listed in each
+// section.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perfsession"
+)
+
+// tcpStates are the names of TCP states. See include/net/tcp_states.h.
+var tcpStates = []string{"", "ESTABLISHED", "SYN_SENT", "SYN_RECV", "FIN_WAIT1", "FIN_WAIT2", "TIME_WAIT", "CLOSE", "CLOSE_WAIT", "LAST_ACK", "LISTEN", "CLOSING", "NEW_SYN_RECV"}
+
+const (
+	tcpTimeWait = 6
+	tcpClose    = 7
+	tcpLastAck  = 9
+	tcpClosing  = 11
+)
+
+func tcpState(s uint64) string {
+	if s < uint64(len(tcpStates)) && tcpStates[s] != "" {
+		return tcpStates[s]
+	}
+	return fmt.Sprint(s)
+}
+
+// A conn identifies a socket by its endpoints.
+type conn struct {
+	src, dst netip.AddrPort
+}
+
+func (c conn) String() string {
+	return c.src.String() + " -> " + c.dst.String()
+}
+
+// A connDecoder decodes the endpoints of a socket from the fields
+// shared by the tcp and sock tracepoints.
+type connDecoder struct {
+	family, sport, dport *perffile.TracepointField
+	saddr, daddr         *perffile.TracepointField
+	saddrV6, daddrV6     *perffile.TracepointField
+}
+
+func newConnDecoder(tf *perffile.TracepointFormat) *connDecoder {
+	d := &connDecoder{
+		family:  tf.Field("family"),
+		sport:   tf.Field("sport"),
+		dport:   tf.Field("dport"),
+		saddr:   tf.Field("saddr"),
+		daddr:   tf.Field("daddr"),
+		saddrV6: tf.Field("saddr_v6"),
+		daddrV6: tf.Field("daddr_v6"),
+	}
+	if d.sport == nil || d.dport == nil || d.saddr == nil || d.daddr == nil {
+		log.Fatalf("%s event does not have socket address fields", tf)
+	}
+	return d
+}
+
+func (d *connDecoder) decode(raw []byte) conn {
+	const afInet6 = 10
+	src, dst := d.saddr, d.daddr
+	if d.family != nil && d.family.Uint(raw) == afInet6 && d.saddrV6 != nil && d.daddrV6 != nil {
+		src, dst = d.saddrV6, d.daddrV6
+	}
+	addr := func(f *perffile.TracepointField) netip.Addr {
+		a, _ := netip.AddrFromSlice(f.Bytes(raw))
+		return a.Unmap()
+	}
+	// The ports have already been converted to host byte order.
+	return conn{
+		netip.AddrPortFrom(addr(src), uint16(d.sport.Uint(raw))),
+		netip.AddrPortFrom(addr(dst), uint16(d.dport.Uint(raw))),
+	}
+}
+
+type devStat struct {
+	txPackets, txBytes uint64
+	rxPackets, rxBytes uint64
+}
+
+func main() {
+	var (
+		flagInput = flag.String("i", "perf.data", "input perf.data `file`")
+		flagLimit = flag.Int("limit", 10, "list the top `n` sockets and stacks")
+	)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	f, err := perffile.Open(*flagInput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	formats, err := f.Meta.TracepointFormats()
+	if err != nil {
+		log.Fatal(err)
+	}
+	byName := make(map[string]*perffile.TracepointFormat)
+	for _, tf := range formats {
+		byName[tf.String()] = tf
+	}
+	devQueue := byName["net:net_dev_queue"]
+	devRecv := byName["net:netif_receive_skb"]
+	retrans := byName["tcp:tcp_retransmit_skb"]
+	setState := byName["sock:inet_sock_set_state"]
+	if devQueue == nil && devRecv == nil && retrans == nil && setState == nil {
+		log.Fatal("profile does not have any network tracepoints")
+	}
+
+	// Resolve the fields of each event up front.
+	var devQueueName, devQueueLen, devRecvName, devRecvLen *perffile.TracepointField
+	if devQueue != nil {
+		devQueueName, devQueueLen = devQueue.Field("name"), devQueue.Field("len")
+		if devQueueName == nil || devQueueLen == nil {
+			log.Fatal("net:net_dev_queue event does not have name and len fields")
+		}
+	}
+	if devRecv != nil {
+		devRecvName, devRecvLen = devRecv.Field("name"), devRecv.Field("len")
+		if devRecvName == nil || devRecvLen == nil {
+			log.Fatal("net:netif_receive_skb event does not have name and len fields")
+		}
+	}
+	var retransConn, stateConn *connDecoder
+	if retrans != nil {
+		retransConn = newConnDecoder(retrans)
+	}
+	var oldState, newState, protocol *perffile.TracepointField
+	if setState != nil {
+		stateConn = newConnDecoder(setState)
+		oldState, newState = setState.Field("oldstate"), setState.Field("newstate")
+		protocol = setState.Field("protocol")
+		if oldState == nil || newState == nil {
+			log.Fatal("sock:inet_sock_set_state event does not have state fields")
+		}
+	}
+
+	devs := make(map[string]*devStat)
+	dev := func(name string) *devStat {
+		d := devs[name]
+		if d == nil {
+			d = new(devStat)
+			devs[name] = d
+		}
+		return d
+	}
+	// Counts, keyed by socket, stack, or transition.
+	retransByConn := make(map[string]uint64)
+	retransByStack := make(map[string]uint64)
+	transitions := make(map[string]uint64)
+	resets := make(map[string]uint64)
+
+	s := perfsession.New(f)
+	rs := f.Records(perffile.RecordsCausalOrder)
+	for rs.Next() {
+		s.Update(rs.Record)
+
+		r, ok := rs.Record.(*perffile.RecordSample)
+		if !ok {
+			continue
+		}
+		tp, ok := r.EventAttr.Event.(perffile.EventTracepoint)
+		if !ok {
+			continue
+		}
+		switch {
+		case devQueue != nil && tp == devQueue.ID:
+			d := dev(devQueueName.String(r.Raw))
+			d.txPackets++
+			d.txBytes += devQueueLen.Uint(r.Raw)
+
+		case devRecv != nil && tp == devRecv.ID:
+			d := dev(devRecvName.String(r.Raw))
+			d.rxPackets++
+			d.rxBytes += devRecvLen.Uint(r.Raw)
+
+		case retrans != nil && tp == retrans.ID:
+			retransByConn[retransConn.decode(r.Raw).String()]++
+			if r.Format&perffile.SampleFormatCallchain != 0 {
+				retransByStack[stackString(s.Stack(r))]++
+			}
+
+		case setState != nil && tp == setState.ID:
+			const ipprotoTCP = 6
+			if protocol != nil && protocol.Uint(r.Raw) != ipprotoTCP {
+				continue
+			}
+			from, to := oldState.Uint(r.Raw), newState.Uint(r.Raw)
+			transitions[tcpState(from)+" -> "+tcpState(to)]++
+			// A transition to CLOSE from anything but the
+			// orderly shutdown states is an abort or reset.
+			if to == tcpClose && from != tcpTimeWait && from != tcpLastAck && from != tcpClosing {
+				resets[stateConn.decode(r.Raw).String()]++
+			}
+		}
+	}
+	if err := rs.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	if devQueue != nil || devRecv != nil {
+		fmt.Println("Devices:")
+		fmt.Printf("  %-16s %10s %12s %10s %12s\n", "device", "tx packets", "tx bytes", "rx packets", "rx bytes")
+		names := make([]string, 0, len(devs))
+		for name := range devs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			d := devs[name]
+			fmt.Printf("  %-16s %10d %12d %10d %12d\n", name, d.txPackets, d.txBytes, d.rxPackets, d.rxBytes)
+		}
+		fmt.Println()
+	}
+
+	if retrans != nil {
+		fmt.Println("TCP retransmits by socket:")
+		for _, key := range topN(retransByConn, *flagLimit) {
+			fmt.Printf("  %8d  %s\n", retransByConn[key], key)
+		}
+		if len(retransByStack) > 0 {
+			fmt.Println("\nTCP retransmits by stack:")
+			for _, key := range topN(retransByStack, *flagLimit) {
+				fmt.Printf("  %8d  %s\n", retransByStack[key], key)
+			}
+		}
+		fmt.Println()
+	}
+
+	if setState != nil {
+		fmt.Println("TCP state transitions:")
+		for _, key := range topN(transitions, len(transitions)) {
+			fmt.Printf("  %8d  %s\n", transitions[key], key)
+		}
+		if len(resets) > 0 {
+			fmt.Println("\nTCP sockets closed abnormally:")
+			for _, key := range topN(resets, *flagLimit) {
+				fmt.Printf("  %8d  %s\n", resets[key], key)
+			}
+		}
+		fmt.Println()
+	}
+}
+
+// stackString formats stack, leaf first, on one line.
+func stackString(stack []perfsession.Frame) string {
+	names := make([]string, len(stack))
+	for i := range stack {
+		names[i] = stack[i].Name()
+	}
+	return strings.Join(names, " <- ")
+}
+
+// topN returns the n keys of m with the highest counts.
+func topN(m map[string]uint64, n int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if m[keys[i]] != m[keys[j]] {
+			return m[keys[i]] > m[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
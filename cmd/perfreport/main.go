@@ -0,0 +1,447 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command perfreport summarizes where a profile's samples were taken,
+// like "perf report".
+//
+// Samples are grouped by the keys given by -sort, which is a
+// comma-separated list of
+//
+//	comm     process name
+//	pid      process ID
+//	dso      file name of the mapped binary
+//	symbol   function name
+//	srcline  source file and line
+//	data     variable containing the sampled data address
+//
+// The data key requires a profile with sampled data addresses, such
+// as from "perf mem record". The default is "comm,dso,symbol". Each
+// sample is weighted by its period if the profile records it, or
+// otherwise counts as 1.
+//
+// The report is a table sorted by overhead:
+//
+//	  self  comm / dso / symbol
+//	41.72%  bench  bench  runtime.scanobject
+//	12.03%  bench  bench  runtime.mallocgc
+//	 8.90%  bench  [kernel]  clear_page_erms
+//
+// With -children, perfreport also accounts each sample to every
+// caller on its stack, so the "children" column gives the fraction of
+// time spent in each function and everything it calls. This requires
+// a profile recorded with callchains ("perf record -g").
+//
+// With -hierarchy, the keys are nested instead of combined, so the
+// report shows overhead by comm, then by dso within each comm, and so
+// on.
+//
+// With -trim, stacks are trimmed before accounting: Go runtime frames
+// below user code and C startup frames are dropped from the root of
+// each stack, and PLT stubs are attributed to their targets. See
+// perfsession.TrimAll.
+//
+// With -confidence, perfreport prints the number of samples and the
+// fraction of records lost, the scaling of any multiplexed events,
+// the fraction of stack frames that couldn't be symbolized, and, for
+// each entry, the 95% confidence interval of its overhead.
+// Entries marked "~" are not statistically distinguishable from the
+// next entry, so their relative order is not meaningful. These are
+// computed from sample counts, so they are approximate if samples
+// have different periods.
+//
+// With -json, the report is written as JSON, including the
+// confidence information, counts of frames that couldn't be
+// symbolized, and a description of the machine that recorded the
+// profile.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perfsession"
+)
+
+// sortKeys maps each -sort key to a function returning the frame's
+// value for that key.
+var sortKeys = map[string]func(c *sampleCtx, f *perfsession.Frame) string{
+	"comm": func(c *sampleCtx, f *perfsession.Frame) string {
+		return c.comm
+	},
+	"pid": func(c *sampleCtx, f *perfsession.Frame) string {
+		return fmt.Sprint(c.r.PID)
+	},
+	"dso": func(c *sampleCtx, f *perfsession.Frame) string {
+		if f.Mmap == nil {
+			return "[unknown]"
+		}
+		if strings.HasPrefix(f.Mmap.Filename, "[kernel.kallsyms]") {
+			return "[kernel]"
+		}
+		return filepath.Base(f.Mmap.Filename)
+	},
+	"symbol": func(c *sampleCtx, f *perfsession.Frame) string {
+		return f.Name()
+	},
+	"srcline": func(c *sampleCtx, f *perfsession.Frame) string {
+		if f.Line.File == nil {
+			return "??:0"
+		}
+		return fmt.Sprintf("%s:%d", filepath.Base(f.Line.File.Name), f.Line.Line)
+	},
+	"data": func(c *sampleCtx, f *perfsession.Frame) string {
+		if c.r.Format&perffile.SampleFormatAddr == 0 {
+			return "[unknown]"
+		}
+		var sym perfsession.DataSymbolic
+		if !perfsession.SymbolizeData(c.s, c.r.PID, c.r.Addr, &sym) {
+			return fmt.Sprintf("%#x", c.r.Addr)
+		}
+		return fmt.Sprintf("%s+%#x", sym.VarName, sym.Offset)
+	},
+}
+
+// sampleCtx is the sample a sort key is computed for.
+type sampleCtx struct {
+	s    *perfsession.Session
+	r    *perffile.RecordSample
+	comm string
+}
+
+// A node is an entry in the report. In a flat report, the root's
+// children are the entries. In a hierarchical report, each level of
+// the tree corresponds to one sort key.
+type node struct {
+	keys     []string
+	self     uint64
+	children uint64
+	kids     map[string]*node
+
+	// nself and nchildren are the number of samples accounted to
+	// self and children, regardless of weight.
+	nself, nchildren uint64
+
+	// seen is the index of the last sample accounted to
+	// children, to count each sample once per node even if the
+	// stack is recursive.
+	seen int
+}
+
+func (n *node) child(keys []string) *node {
+	k := strings.Join(keys, "\x00")
+	kid := n.kids[k]
+	if kid == nil {
+		kid = &node{keys: keys, kids: make(map[string]*node), seen: -1}
+		n.kids[k] = kid
+	}
+	return kid
+}
+
+func main() {
+	var (
+		flagInput     = flag.String("i", "perf.data", "input perf.data `file`")
+		flagSort      = flag.String("sort", "comm,dso,symbol", "sort by comma-separated `keys`")
+		flagChildren  = flag.Bool("children", false, "accumulate callee overhead into callers")
+		flagHierarchy = flag.Bool("hierarchy", false, "nest sort keys")
+		flagTrim      = flag.Bool("trim", false, "trim runtime and startup frames from stacks")
+		flagJSON      = flag.Bool("json", false, "write report as JSON")
+		flagLimit     = flag.Float64("percent-limit", 0, "omit entries below `percent` overhead")
+		flagConf      = flag.Bool("confidence", false, "report sample counts and confidence intervals")
+	)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	keyNames := strings.Split(*flagSort, ",")
+	for _, k := range keyNames {
+		if sortKeys[k] == nil {
+			log.Fatalf("unknown sort key %q", k)
+		}
+	}
+
+	f, err := perffile.Open(*flagInput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	s := perfsession.New(f)
+
+	// levels gives the sort keys at each level of the tree.
+	var levels [][]string
+	if *flagHierarchy {
+		for _, k := range keyNames {
+			levels = append(levels, []string{k})
+		}
+	} else {
+		levels = [][]string{keyNames}
+	}
+
+	root := &node{kids: make(map[string]*node)}
+	var trim perfsession.StackTrim
+	if *flagTrim {
+		trim = perfsession.TrimAll
+	}
+	nSamples := 0
+	rs := f.Records(perffile.RecordsCausalOrder)
+	for rs.Next() {
+		s.Update(rs.Record)
+
+		r, ok := rs.Record.(*perffile.RecordSample)
+		if !ok || r.Format&perffile.SampleFormatIP == 0 {
+			continue
+		}
+		weight := uint64(1)
+		if r.Format&perffile.SampleFormatPeriod != 0 {
+			weight = r.Period
+		}
+		comm := "[unknown]"
+		if pidInfo := s.LookupPID(r.PID); pidInfo != nil && pidInfo.Comm != "" {
+			comm = pidInfo.Comm
+		}
+
+		var stack []perfsession.Frame
+		if *flagChildren {
+			stack = s.Stack(r)
+		} else {
+			// Only the leaf is needed, so skip symbolizing
+			// the whole callchain.
+			r2 := *r
+			r2.Callchain = nil
+			stack = s.Stack(&r2)
+		}
+		stack = trim.Apply(stack)
+		ctx := &sampleCtx{s, r, comm}
+
+		for i := range stack {
+			n := root
+			for _, level := range levels {
+				keys := make([]string, len(level))
+				for j, k := range level {
+					keys[j] = sortKeys[k](ctx, &stack[i])
+				}
+				n = n.child(keys)
+				if i == 0 {
+					n.self += weight
+					n.nself++
+				}
+				if n.seen != nSamples {
+					n.seen = nSamples
+					n.children += weight
+					n.nchildren++
+				}
+			}
+		}
+		root.self += weight
+		nSamples++
+	}
+	if err := rs.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	rep := &report{
+		total:      root.self,
+		nSamples:   uint64(nSamples),
+		children:   *flagChildren,
+		limit:      *flagLimit,
+		confidence: *flagConf,
+		stats:      s.Stats,
+		host:       f.Meta.HostInfo(),
+	}
+	for _, attr := range f.Events {
+		if sc := s.Scaling(attr); sc != 1 {
+			rep.scaling = append(rep.scaling, eventScaling{fmt.Sprint(attr.Event), sc})
+		}
+	}
+	if *flagJSON {
+		rep.writeJSON(keyNames, levels, root)
+	} else {
+		rep.writeText(keyNames, root)
+	}
+}
+
+type report struct {
+	total      uint64
+	nSamples   uint64
+	children   bool
+	limit      float64
+	confidence bool
+	stats      perfsession.Stats
+	scaling    []eventScaling
+	host       []string
+}
+
+// eventScaling records that an event was multiplexed, so its counts
+// are underestimated by a factor of scale.
+type eventScaling struct {
+	Event string  `json:"event"`
+	Scale float64 `json:"scale"`
+}
+
+func (rep *report) pct(x uint64) float64 {
+	return 100 * float64(x) / float64(rep.total)
+}
+
+// samples returns the number of samples accounted to n for the
+// reported overhead.
+func (rep *report) samples(n *node) uint64 {
+	if rep.children {
+		return n.nchildren
+	}
+	return n.nself
+}
+
+// interval returns the 95% confidence interval of n's overhead, in
+// percent.
+func (rep *report) interval(n *node) (lo, hi float64) {
+	lo, hi = perfsession.ShareInterval(rep.samples(n), rep.nSamples)
+	return 100 * lo, 100 * hi
+}
+
+// tied reports whether the overheads of a and b are statistically
+// indistinguishable.
+func (rep *report) tied(a, b *node) bool {
+	return !perfsession.Distinguishable(rep.samples(a), rep.samples(b), rep.nSamples)
+}
+
+// sorted returns the children of n sorted by overhead, omitting
+// those below the percent limit.
+func (rep *report) sorted(n *node) []*node {
+	weight := func(n *node) uint64 {
+		if rep.children {
+			return n.children
+		}
+		return n.self
+	}
+	var out []*node
+	for _, kid := range n.kids {
+		if rep.pct(weight(kid)) >= rep.limit {
+			out = append(out, kid)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if wi, wj := weight(out[i]), weight(out[j]); wi != wj {
+			return wi > wj
+		}
+		return strings.Join(out[i].keys, "\x00") < strings.Join(out[j].keys, "\x00")
+	})
+	return out
+}
+
+func (rep *report) writeText(keyNames []string, root *node) {
+	if rep.total == 0 {
+		fmt.Println("no samples")
+		return
+	}
+	if rep.confidence {
+		fmt.Printf("# %d samples, %d records lost (%.2f%%)\n", rep.nSamples, rep.stats.Lost+rep.stats.LostSamples, 100*rep.stats.LossRate())
+		for _, sc := range rep.scaling {
+			fmt.Printf("# %s multiplexed, counts scaled by %.2f\n", sc.Event, sc.Scale)
+		}
+		if fs := rep.stats.Frames; fs.Frames > 0 {
+			pct := func(n uint64) float64 { return 100 * float64(n) / float64(fs.Frames) }
+			fmt.Printf("# %d frames: %.2f%% unmapped, %.2f%% without a readable file, %.2f%% without a function\n", fs.Frames, pct(fs.Unmapped), pct(fs.NoFile), pct(fs.NoFunc))
+		}
+		fmt.Printf("%16s ", "95% interval")
+	}
+	if rep.children {
+		fmt.Printf("%9s ", "children")
+	}
+	fmt.Printf("%9s  %s\n", "self", strings.Join(keyNames, " / "))
+
+	var walk func(n *node, depth int)
+	walk = func(n *node, depth int) {
+		kids := rep.sorted(n)
+		for i, kid := range kids {
+			if rep.confidence {
+				lo, hi := rep.interval(kid)
+				tie := " "
+				if i+1 < len(kids) && rep.tied(kid, kids[i+1]) {
+					tie = "~"
+				}
+				fmt.Printf("%6.2f%%-%6.2f%%%s ", lo, hi, tie)
+			}
+			if rep.children {
+				fmt.Printf("%8.2f%% ", rep.pct(kid.children))
+			}
+			fmt.Printf("%8.2f%%  %s%s\n", rep.pct(kid.self), strings.Repeat("  ", depth), strings.Join(kid.keys, "  "))
+			walk(kid, depth+1)
+		}
+	}
+	walk(root, 0)
+}
+
+type jsonEntry struct {
+	Keys            map[string]string `json:"keys"`
+	Self            uint64            `json:"self"`
+	SelfPercent     float64           `json:"selfPercent"`
+	Children        uint64            `json:"children,omitempty"`
+	ChildrenPercent float64           `json:"childrenPercent,omitempty"`
+	Samples         uint64            `json:"samples"`
+	Interval        [2]float64        `json:"interval"`
+	TiedWithNext    bool              `json:"tiedWithNext,omitempty"`
+	Entries         []jsonEntry       `json:"entries,omitempty"`
+}
+
+// jsonFrames is perfsession.FrameStats with JSON field names.
+type jsonFrames struct {
+	Frames   uint64 `json:"frames"`
+	Unmapped uint64 `json:"unmapped"`
+	NoFile   uint64 `json:"noFile"`
+	NoFunc   uint64 `json:"noFunc"`
+}
+
+func (rep *report) writeJSON(keyNames []string, levels [][]string, root *node) {
+	var conv func(n *node, depth int) []jsonEntry
+	conv = func(n *node, depth int) []jsonEntry {
+		var out []jsonEntry
+		kids := rep.sorted(n)
+		for i, kid := range kids {
+			e := jsonEntry{
+				Keys:         make(map[string]string),
+				Self:         kid.self,
+				SelfPercent:  rep.pct(kid.self),
+				Samples:      rep.samples(kid),
+				TiedWithNext: i+1 < len(kids) && rep.tied(kid, kids[i+1]),
+				Entries:      conv(kid, depth+1),
+			}
+			e.Interval[0], e.Interval[1] = rep.interval(kid)
+			for i, k := range levels[depth] {
+				e.Keys[k] = kid.keys[i]
+			}
+			if rep.children {
+				e.Children = kid.children
+				e.ChildrenPercent = rep.pct(kid.children)
+			}
+			out = append(out, e)
+		}
+		return out
+	}
+	out := struct {
+		Sort     []string          `json:"sort"`
+		Total    uint64            `json:"total"`
+		Samples  uint64            `json:"samples"`
+		Lost     uint64            `json:"lost"`
+		LossRate float64           `json:"lossRate"`
+		Scaling  []eventScaling    `json:"scaling,omitempty"`
+		Host     []string          `json:"host,omitempty"`
+		Frames   jsonFrames        `json:"frames"`
+		CPUs     map[uint32]uint64 `json:"cpuSamples,omitempty"`
+		Entries  []jsonEntry       `json:"entries"`
+	}{keyNames, rep.total, rep.nSamples, rep.stats.Lost + rep.stats.LostSamples, rep.stats.LossRate(), rep.scaling, rep.host, jsonFrames(rep.stats.Frames), rep.stats.CPUSamples, conv(root, 0)}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(out); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command perfscript prints the samples in a profile in the default
+// format of "perf script".
+//
+// Each sample is printed as a header line giving the command, thread
+// ID, CPU, time, period, and event, followed by the sample's call
+// stack, one frame per line, and a blank line:
+//
+//	bench   12345 [003] 81234.567890:     250000 cycles:u:
+//	       4a2f31 runtime.scanobject (/home/gopher/bench)
+//	       4a1b02 runtime.gcDrain (/home/gopher/bench)
+//
+// If the profile does not have callchains, the sampled instruction is
+// printed on the header line instead, and the command is padded to 16
+// columns, as perf does. Tracepoint samples are followed
+// by their fields as name=value pairs.
+//
+// This output can be fed to tools that consume "perf script" output,
+// such as stackcollapse-perf.pl from FlameGraph.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perfsession"
+)
+
+func main() {
+	flagInput := flag.String("i", "perf.data", "input perf.data `file`")
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	f, err := perffile.Open(*flagInput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	if err := script(w, f); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// script writes the samples in f to w.
+func script(w *bufio.Writer, f *perffile.File) error {
+	tracepoints, err := f.Meta.TracepointFormats()
+	if err != nil {
+		return err
+	}
+	eventNames := make(map[*perffile.EventAttr]string)
+	for _, attr := range f.Events {
+		eventNames[attr] = attr.Name(tracepoints)
+	}
+
+	s := perfsession.New(f)
+	rs := f.Records(perffile.RecordsTimeOrder)
+	for rs.Next() {
+		s.Update(rs.Record)
+
+		r, ok := rs.Record.(*perffile.RecordSample)
+		if !ok || r.Format&perffile.SampleFormatIP == 0 {
+			continue
+		}
+
+		comm := "[unknown]"
+		if pidInfo := s.LookupPID(r.PID); pidInfo != nil && pidInfo.Comm != "" {
+			comm = pidInfo.Comm
+		}
+		// Like perf, pad the command only if there's no
+		// callchain. Tools that fold stacks find the header
+		// line by its leading non-space character.
+		hasCallchain := r.Format&perffile.SampleFormatCallchain != 0
+		if hasCallchain {
+			fmt.Fprintf(w, "%s ", comm)
+		} else {
+			fmt.Fprintf(w, "%16s ", comm)
+		}
+		fmt.Fprintf(w, "%7d ", r.TID)
+		if r.Format&perffile.SampleFormatCPU != 0 {
+			fmt.Fprintf(w, "[%03d] ", r.CPU)
+		}
+		if r.Format&perffile.SampleFormatTime != 0 {
+			fmt.Fprintf(w, "%5d.%06d: ", r.Time/1e9, r.Time%1e9/1e3)
+		}
+		if r.Format&perffile.SampleFormatPeriod != 0 {
+			fmt.Fprintf(w, "%10d ", r.Period)
+		}
+		name, ok := eventNames[r.EventAttr]
+		if !ok {
+			name = r.EventAttr.Name(tracepoints)
+		}
+		fmt.Fprintf(w, "%s:", name)
+
+		if tp, ok := r.EventAttr.Event.(perffile.EventTracepoint); ok && tracepoints[tp] != nil {
+			writeFields(w, tracepoints[tp], r.Raw)
+		}
+
+		if !hasCallchain {
+			pidInfo := s.LookupPID(r.PID)
+			frame := perfsession.Frame{IP: r.IP}
+			if pidInfo != nil {
+				frame.Mmap = pidInfo.LookupMmap(r.IP)
+			}
+			if frame.Mmap != nil {
+				perfsession.Symbolize(s, frame.Mmap, r.IP, &frame.Symbolic)
+			}
+			fmt.Fprint(w, " ")
+			writeFrame(w, &frame)
+			continue
+		}
+		fmt.Fprintln(w)
+		for _, frame := range s.Stack(r) {
+			fmt.Fprint(w, "\t")
+			writeFrame(w, &frame)
+		}
+		fmt.Fprintln(w)
+	}
+	return rs.Err()
+}
+
+// writeFrame writes one frame as "ip symbol (dso)".
+func writeFrame(w *bufio.Writer, f *perfsession.Frame) {
+	sym := f.FuncName
+	if sym == "" {
+		sym = "[unknown]"
+	}
+	dso := "[unknown]"
+	if f.Mmap != nil {
+		dso = f.Mmap.Filename
+		// perf names the kernel mapping by its reference
+		// symbol, such as "[kernel.kallsyms]_text".
+		if strings.HasPrefix(dso, "[kernel.kallsyms]") {
+			dso = "[kernel.kallsyms]"
+		}
+	}
+	fmt.Fprintf(w, "%16x %s (%s)\n", f.IP, sym, dso)
+}
+
+// writeFields writes the fields of a tracepoint sample, omitting the
+// common fields shared by all tracepoints.
+func writeFields(w *bufio.Writer, tf *perffile.TracepointFormat, raw []byte) {
+	for i := range tf.Fields {
+		field := &tf.Fields[i]
+		if strings.HasPrefix(field.Name, "common_") {
+			continue
+		}
+		isArray := strings.HasSuffix(field.Type, "]")
+		switch {
+		case isArray && strings.Contains(field.Type, "char"):
+			fmt.Fprintf(w, " %s=%s", field.Name, field.String(raw))
+		case isArray:
+			fmt.Fprintf(w, " %s=%x", field.Name, field.Bytes(raw))
+		case field.Signed:
+			fmt.Fprintf(w, " %s=%d", field.Name, int64(field.Uint(raw)))
+		default:
+			fmt.Fprintf(w, " %s=%d", field.Name, field.Uint(raw))
+		}
+	}
+}
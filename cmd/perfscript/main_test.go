@@ -0,0 +1,60 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perffile/perffiletest"
+)
+
+func TestScript(t *testing.T) {
+	var p perffiletest.Profile
+	cycles := p.Event(perffile.EventHardware{ID: perffile.EventHardwareIDCPUCycles}, perffile.SampleFormatCallchain)
+	faults := p.Event(perffile.EventSoftwarePageFaults, 0)
+	faults.Flags |= perffile.EventFlagExcludeKernel
+	p.Comm(100, 101, 0, "bench")
+	p.Mmap(100, 0, 0x400000, 0x10000, 0, "/home/gopher/bench")
+	s := p.Sample(cycles, 100, 101, 81234567890123, 0x401000, 0x402000)
+	s.CPU, s.Period = 3, 250000
+	s = p.Sample(faults, 100, 101, 81234567990123, 0x403000)
+	s.CPU, s.Period = 12, 1
+	f, err := p.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := script(w, f); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	// As in "perf script", the command is padded only when there
+	// is no callchain, and the TID is padded to 7 columns.
+	const want = "" +
+		"bench     101 [003] 81234.567890:     250000 cycles:\n" +
+		"\t          401000 [unknown] (/home/gopher/bench)\n" +
+		"\t          402000 [unknown] (/home/gopher/bench)\n" +
+		"\n" +
+		"           bench     101 [012] 81234.567990:          1 page-faults:u:           403000 [unknown] (/home/gopher/bench)\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// stackcollapse-perf.pl finds the header of each stack with
+	// this pattern.
+	header := regexp.MustCompile(`^(\S.+?)\s+(\d+)\/*(\d+)*\s+`)
+	line := strings.SplitN(buf.String(), "\n", 2)[0]
+	if m := header.FindStringSubmatch(line); m == nil || m[1] != "bench" || m[2] != "101" {
+		t.Errorf("stackcollapse-perf.pl header pattern matched %q in %q, want comm bench and TID 101", m, line)
+	}
+}
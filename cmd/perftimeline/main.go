@@ -0,0 +1,203 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command perftimeline shows how a profile changes over time.
+//
+// perftimeline divides the profile into time buckets of -bucket
+// duration and totals the samples in each bucket for each key. The
+// key is selected by -by:
+//
+//	symbol  function of the sampled instruction
+//	stack   full call stack, folded as "outer;...;inner"
+//	cpu     CPU the sample was taken on
+//
+// The output is a heatmap with one row per key and one column per
+// bucket, in CSV format, or in JSON format with -json. Only the -top
+// keys with the most samples are included. For example,
+//
+//	key,0s,100ms,200ms
+//	runtime.scanobject,0,1520,34
+//	main.parse,812,790,801
+//
+// shows a burst of garbage collection in the second 100ms of the
+// profile. This requires a profile with sample timestamps, which perf
+// records by default.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aclements/go-perf/cmd/internal/cmdutil"
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perfsession"
+)
+
+func main() {
+	var (
+		flagInput  = flag.String("i", "perf.data", "input perf.data `file`")
+		flagBucket = flag.Duration("bucket", 100*time.Millisecond, "time bucket `duration`")
+		flagBy     = flag.String("by", "symbol", "group samples by `key`: symbol, stack, or cpu")
+		flagTop    = flag.Int("top", 20, "include only the top `n` keys")
+		flagJSON   = flag.Bool("json", false, "write heatmap as JSON")
+	)
+	flag.Parse()
+	if flag.NArg() > 0 || *flagBucket <= 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	var keyOf func(s *perfsession.Session, r *perffile.RecordSample) string
+	switch *flagBy {
+	case "symbol":
+		keyOf = symbolKey
+	case "stack":
+		keyOf = stackKey
+	case "cpu":
+		keyOf = func(s *perfsession.Session, r *perffile.RecordSample) string {
+			return fmt.Sprint(r.CPU)
+		}
+	default:
+		log.Fatalf("unknown key %q", *flagBy)
+	}
+
+	f, err := perffile.Open(*flagInput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	s := perfsession.New(f)
+
+	// cells maps from key to bucket to weight. Most keys appear
+	// in only a few buckets, so this is sparse until the top
+	// keys are known.
+	cells := make(map[string]map[int]uint64)
+	totals := make(map[string]uint64)
+	var start uint64
+	nBuckets := 0
+	rs := f.Records(perffile.RecordsTimeOrder)
+	for rs.Next() {
+		s.Update(rs.Record)
+
+		r, ok := rs.Record.(*perffile.RecordSample)
+		if !ok || r.Format&perffile.SampleFormatIP == 0 {
+			continue
+		}
+		if r.Format&perffile.SampleFormatTime == 0 {
+			log.Fatal("profile does not have sample timestamps")
+		}
+		if start == 0 {
+			start = r.Time
+		}
+		weight := uint64(1)
+		if r.Format&perffile.SampleFormatPeriod != 0 {
+			weight = r.Period
+		}
+
+		bucket := int((r.Time - start) / uint64(*flagBucket))
+		if bucket >= nBuckets {
+			nBuckets = bucket + 1
+		}
+		key := keyOf(s, r)
+		cell := cells[key]
+		if cell == nil {
+			cell = make(map[int]uint64)
+			cells[key] = cell
+		}
+		cell[bucket] += weight
+		totals[key] += weight
+	}
+	if err := rs.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	keys := make([]string, 0, len(cells))
+	for key := range totals {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if totals[keys[i]] != totals[keys[j]] {
+			return totals[keys[i]] > totals[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > *flagTop {
+		keys = keys[:*flagTop]
+	}
+	rows := make(map[string][]uint64)
+	for _, key := range keys {
+		row := make([]uint64, nBuckets)
+		for bucket, weight := range cells[key] {
+			row[bucket] = weight
+		}
+		rows[key] = row
+	}
+
+	if *flagJSON {
+		writeJSON(keys, rows, nBuckets, *flagBucket)
+	} else {
+		writeCSV(keys, rows, nBuckets, *flagBucket)
+	}
+}
+
+func symbolKey(s *perfsession.Session, r *perffile.RecordSample) string {
+	return cmdutil.FuncName(s, r.PID, r.IP)
+}
+
+func stackKey(s *perfsession.Session, r *perffile.RecordSample) string {
+	stack := s.Stack(r)
+	names := make([]string, len(stack))
+	for i := range stack {
+		// Fold root first, as flame graph tools expect.
+		names[i] = stack[len(stack)-1-i].Name()
+	}
+	return strings.Join(names, ";")
+}
+
+func writeCSV(keys []string, rows map[string][]uint64, nBuckets int, bucket time.Duration) {
+	w := csv.NewWriter(os.Stdout)
+	hdr := []string{"key"}
+	for i := 0; i < nBuckets; i++ {
+		hdr = append(hdr, (time.Duration(i) * bucket).String())
+	}
+	w.Write(hdr)
+	for _, key := range keys {
+		rec := []string{key}
+		for _, v := range rows[key] {
+			rec = append(rec, fmt.Sprint(v))
+		}
+		w.Write(rec)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func writeJSON(keys []string, rows map[string][]uint64, nBuckets int, bucket time.Duration) {
+	type jsonRow struct {
+		Key     string   `json:"key"`
+		Buckets []uint64 `json:"buckets"`
+	}
+	out := struct {
+		BucketNS int64     `json:"bucketNS"`
+		Buckets  int       `json:"buckets"`
+		Rows     []jsonRow `json:"rows"`
+	}{BucketNS: bucket.Nanoseconds(), Buckets: nBuckets, Rows: []jsonRow{}}
+	for _, key := range keys {
+		out.Rows = append(out.Rows, jsonRow{key, rows[key]})
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(out); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command txstats summarizes hardware transactional memory behavior
+// from a profile with transaction information.
+//
+// txstats expects a perf.data with transaction flags recorded, such
+// as one collected on an Intel TSX machine with
+//
+//	perf record --transaction -e cpu/tx-abort/pp -e cycles <cmd>
+//
+// It classifies each sample as outside of a transaction, in a
+// transaction or elided lock, or as an abort with a particular
+// reason, and prints the total event weight of each class, followed
+// by the functions contributing the most to each abort class.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/aclements/go-perf/cmd/internal/cmdutil"
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perfsession"
+)
+
+// A txClass is a coarse classification of a sample's transaction
+// state.
+type txClass int
+
+const (
+	txNone txClass = iota
+	txInTransaction
+	txAbortConflict
+	txAbortCapacityRead
+	txAbortCapacityWrite
+	txAbortSync
+	txAbortAsync
+	numTxClasses
+)
+
+var txClassNames = [numTxClasses]string{
+	"no transaction",
+	"in transaction",
+	"abort: conflict",
+	"abort: capacity (read)",
+	"abort: capacity (write)",
+	"abort: synchronous",
+	"abort: asynchronous",
+}
+
+func (c txClass) String() string {
+	return txClassNames[c]
+}
+
+func (c txClass) isAbort() bool {
+	return c >= txAbortConflict
+}
+
+func classify(t perffile.Transaction) txClass {
+	switch {
+	case t == 0:
+		return txNone
+	case t&perffile.TransactionConflict != 0:
+		return txAbortConflict
+	case t&perffile.TransactionCapacityRead != 0:
+		return txAbortCapacityRead
+	case t&perffile.TransactionCapacityWrite != 0:
+		return txAbortCapacityWrite
+	case t&perffile.TransactionSync != 0:
+		return txAbortSync
+	case t&perffile.TransactionAsync != 0:
+		return txAbortAsync
+	}
+	// Only Transaction, Elision, and/or Retry.
+	return txInTransaction
+}
+
+type classStats struct {
+	samples uint64
+	weight  uint64
+	funcs   map[string]uint64
+}
+
+func main() {
+	var (
+		flagInput = flag.String("i", "perf.data", "input perf.data `file`")
+		flagLimit = flag.Int("limit", 5, "show top `n` functions per abort class")
+	)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	f, err := perffile.Open(*flagInput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	s := perfsession.New(f)
+
+	var stats [numTxClasses]classStats
+	for i := range stats {
+		stats[i].funcs = make(map[string]uint64)
+	}
+	rs := f.Records(perffile.RecordsCausalOrder)
+	for rs.Next() {
+		s.Update(rs.Record)
+
+		r, ok := rs.Record.(*perffile.RecordSample)
+		if !ok || r.Format&perffile.SampleFormatTransaction == 0 {
+			continue
+		}
+
+		var weight uint64 = 1
+		if r.Format&perffile.SampleFormatPeriod != 0 {
+			weight = r.Period
+		} else if r.EventAttr.SamplePeriod != 0 {
+			weight = r.EventAttr.SamplePeriod
+		}
+
+		c := classify(r.Transaction)
+		cs := &stats[c]
+		cs.samples++
+		cs.weight += weight
+
+		if !c.isAbort() {
+			continue
+		}
+		cs.funcs[cmdutil.FuncName(s, r.PID, r.IP)] += weight
+	}
+	if err := rs.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	var total uint64
+	for _, cs := range stats {
+		total += cs.weight
+	}
+	if total == 0 {
+		log.Fatal("profile has no samples with transaction information; record with perf record --transaction")
+	}
+
+	fmt.Printf("%-24s %10s %16s\n", "class", "samples", "weight")
+	for c, cs := range stats {
+		if cs.samples == 0 {
+			continue
+		}
+		fmt.Printf("%-24s %10d %16d (%5.1f%%)\n", txClass(c), cs.samples, cs.weight, 100*float64(cs.weight)/float64(total))
+	}
+
+	for c, cs := range stats {
+		if !txClass(c).isAbort() || cs.samples == 0 {
+			continue
+		}
+		fmt.Printf("\n%s:\n", txClass(c))
+		type fnWeight struct {
+			name   string
+			weight uint64
+		}
+		fns := make([]fnWeight, 0, len(cs.funcs))
+		for name, w := range cs.funcs {
+			fns = append(fns, fnWeight{name, w})
+		}
+		sort.Slice(fns, func(i, j int) bool {
+			if fns[i].weight != fns[j].weight {
+				return fns[i].weight > fns[j].weight
+			}
+			return fns[i].name < fns[j].name
+		})
+		if len(fns) > *flagLimit {
+			fns = fns[:*flagLimit]
+		}
+		for _, fn := range fns {
+			fmt.Printf("  %16d (%5.1f%%) %s\n", fn.weight, 100*float64(fn.weight)/float64(cs.weight), fn.name)
+		}
+	}
+}
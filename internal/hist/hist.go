@@ -0,0 +1,290 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package hist implements histograms of non-negative integer values,
+// such as latencies in nanoseconds.
+//
+// Log2 is a compact histogram with power-of-two buckets, like those
+// printed by the BCC and bpftrace tools. HDR is a high dynamic range
+// histogram, which bounds the relative error of each bucket and hence
+// gives more accurate percentiles.
+package hist
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"strings"
+)
+
+// A Histogram is a histogram of uint64 values.
+type Histogram interface {
+	// Buckets returns the buckets of the histogram in
+	// increasing order, from the lowest to the highest non-empty
+	// bucket.
+	Buckets() []Bucket
+
+	// Stats returns summary statistics of the recorded values.
+	Stats() Stats
+}
+
+// A Bucket is a range of values [Lo, Hi] and the number of recorded
+// values in that range.
+type Bucket struct {
+	Lo, Hi uint64
+	Count  uint64
+}
+
+// Stats summarizes the values recorded in a histogram.
+type Stats struct {
+	Count    uint64
+	Sum      uint64
+	Min, Max uint64
+}
+
+func (s *Stats) add(x uint64) {
+	if s.Count == 0 || x < s.Min {
+		s.Min = x
+	}
+	if x > s.Max {
+		s.Max = x
+	}
+	s.Count++
+	s.Sum += x
+}
+
+func (s *Stats) merge(o Stats) {
+	if o.Count == 0 {
+		return
+	}
+	if s.Count == 0 || o.Min < s.Min {
+		s.Min = o.Min
+	}
+	if o.Max > s.Max {
+		s.Max = o.Max
+	}
+	s.Count += o.Count
+	s.Sum += o.Sum
+}
+
+// Mean returns the mean of the recorded values, or NaN if there are
+// none.
+func (s Stats) Mean() float64 {
+	if s.Count == 0 {
+		return math.NaN()
+	}
+	return float64(s.Sum) / float64(s.Count)
+}
+
+// A Log2 is a histogram with power-of-two buckets. Bucket 0 holds
+// the value 0 and bucket i > 0 holds values in [2^(i-1), 2^i).
+//
+// The zero value is an empty histogram.
+type Log2 struct {
+	Counts [65]uint64
+	stats  Stats
+}
+
+// Add records value x.
+func (h *Log2) Add(x uint64) {
+	h.Counts[bits.Len64(x)]++
+	h.stats.add(x)
+}
+
+// Merge adds the values recorded in o to h.
+func (h *Log2) Merge(o *Log2) {
+	for i, n := range o.Counts {
+		h.Counts[i] += n
+	}
+	h.stats.merge(o.stats)
+}
+
+// Stats returns summary statistics of the values recorded in h.
+func (h *Log2) Stats() Stats {
+	return h.stats
+}
+
+// Buckets returns the buckets of h. See Histogram.
+func (h *Log2) Buckets() []Bucket {
+	if h.stats.Count == 0 {
+		return nil
+	}
+	lo, hi := bits.Len64(h.stats.Min), bits.Len64(h.stats.Max)
+	out := make([]Bucket, 0, hi-lo+1)
+	for i := lo; i <= hi; i++ {
+		b := Bucket{Count: h.Counts[i]}
+		if i > 0 {
+			b.Lo = 1 << (i - 1)
+			b.Hi = b.Lo<<1 - 1
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// An HDR is a high dynamic range histogram. Values below
+// 2^(precision+1) are recorded exactly, and each larger power-of-two
+// range is divided into 2^precision equal buckets, so the width of
+// each bucket is at most 2^-precision of its lower bound.
+type HDR struct {
+	precision uint
+	counts    []uint64
+	stats     Stats
+}
+
+// NewHDR returns an empty HDR histogram with the given precision in
+// bits. For example, a precision of 7 bounds the relative error of
+// each bucket to under 1%.
+func NewHDR(precision int) *HDR {
+	if precision < 0 || precision > 16 {
+		panic(fmt.Sprintf("hist: bad HDR precision %d", precision))
+	}
+	return &HDR{precision: uint(precision)}
+}
+
+// index returns the index of the bucket containing x.
+func (h *HDR) index(x uint64) int {
+	shift := bits.Len64(x) - 1 - int(h.precision)
+	if shift < 0 {
+		return int(x)
+	}
+	// The top precision+1 bits of x select the bucket within
+	// the power-of-two range.
+	return (shift+1)<<h.precision + int(x>>uint(shift)) - 1<<h.precision
+}
+
+// bounds returns the range of values in bucket i.
+func (h *HDR) bounds(i int) (lo, hi uint64) {
+	if i < 2<<h.precision {
+		return uint64(i), uint64(i)
+	}
+	shift := uint(i>>h.precision - 1)
+	mantissa := uint64(i&(1<<h.precision-1)) + 1<<h.precision
+	lo = mantissa << shift
+	return lo, lo + (1<<shift - 1)
+}
+
+// Add records value x.
+func (h *HDR) Add(x uint64) {
+	i := h.index(x)
+	if i >= len(h.counts) {
+		h.counts = append(h.counts, make([]uint64, i+1-len(h.counts))...)
+	}
+	h.counts[i]++
+	h.stats.add(x)
+}
+
+// Merge adds the values recorded in o to h. h and o must have the
+// same precision.
+func (h *HDR) Merge(o *HDR) {
+	if h.precision != o.precision {
+		panic("hist: merging HDR histograms of different precisions")
+	}
+	if len(o.counts) > len(h.counts) {
+		h.counts = append(h.counts, make([]uint64, len(o.counts)-len(h.counts))...)
+	}
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	h.stats.merge(o.stats)
+}
+
+// Stats returns summary statistics of the values recorded in h.
+func (h *HDR) Stats() Stats {
+	return h.stats
+}
+
+// Buckets returns the buckets of h. See Histogram.
+func (h *HDR) Buckets() []Bucket {
+	if h.stats.Count == 0 {
+		return nil
+	}
+	lo, hi := h.index(h.stats.Min), h.index(h.stats.Max)
+	out := make([]Bucket, 0, hi-lo+1)
+	for i := lo; i <= hi; i++ {
+		b := Bucket{Count: h.counts[i]}
+		b.Lo, b.Hi = h.bounds(i)
+		out = append(out, b)
+	}
+	return out
+}
+
+// Quantile estimates the q'th quantile of the values recorded in h,
+// where 0 <= q <= 1. For example, Quantile(h, 0.99) is the 99th
+// percentile. It interpolates linearly within the bucket containing
+// the quantile. It returns 0 if h is empty.
+func Quantile(h Histogram, q float64) uint64 {
+	st := h.Stats()
+	if st.Count == 0 {
+		return 0
+	}
+	// rank is the 1-based index of the value to find.
+	rank := uint64(math.Ceil(q * float64(st.Count)))
+	if rank < 1 {
+		rank = 1
+	} else if rank > st.Count {
+		rank = st.Count
+	}
+	var cum uint64
+	for _, b := range h.Buckets() {
+		if cum+b.Count < rank {
+			cum += b.Count
+			continue
+		}
+		// Clamp the bucket to the observed range, which
+		// makes the extreme quantiles exact.
+		lo, hi := b.Lo, b.Hi
+		if lo < st.Min {
+			lo = st.Min
+		}
+		if hi > st.Max {
+			hi = st.Max
+		}
+		if b.Count == 1 {
+			// The value is the minimum or maximum if the
+			// bucket contains it.
+			switch {
+			case lo == st.Min:
+				return lo
+			case hi == st.Max:
+				return hi
+			}
+			return lo + (hi-lo)/2
+		}
+		// Spread the bucket's values evenly from lo to hi.
+		frac := float64(rank-cum-1) / float64(b.Count-1)
+		return lo + uint64(frac*float64(hi-lo))
+	}
+	return st.Max
+}
+
+// Fprint writes a text rendering of h to w, with one line per bucket
+// giving the bucket's range, its count, and a bar proportional to its
+// count. format formats the bounds of each bucket; if nil, they are
+// printed as integers.
+func Fprint(w io.Writer, h Histogram, format func(uint64) string) error {
+	if format == nil {
+		format = func(x uint64) string { return fmt.Sprint(x) }
+	}
+	const width = 40
+	buckets := h.Buckets()
+	var max uint64
+	for _, b := range buckets {
+		if b.Count > max {
+			max = b.Count
+		}
+	}
+	for _, b := range buckets {
+		bar := strings.Repeat("*", int((b.Count*width+max-1)/max))
+		label := format(b.Lo)
+		if b.Hi != b.Lo {
+			label += " - " + format(b.Hi)
+		}
+		if _, err := fmt.Fprintf(w, "%24s %10d |%-*s|\n", label, b.Count, width, bar); err != nil {
+			return err
+		}
+	}
+	return nil
+}
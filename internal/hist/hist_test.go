@@ -0,0 +1,112 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hist
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestLog2(t *testing.T) {
+	var h Log2
+	for _, x := range []uint64{0, 1, 5, 6, 7, 100} {
+		h.Add(x)
+	}
+	want := []Bucket{{0, 0, 1}, {1, 1, 1}, {2, 3, 0}, {4, 7, 3}, {8, 15, 0}, {16, 31, 0}, {32, 63, 0}, {64, 127, 1}}
+	got := h.Buckets()
+	if len(got) != len(want) {
+		t.Fatalf("got buckets %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got buckets %v, want %v", got, want)
+		}
+	}
+	if st := h.Stats(); st.Count != 6 || st.Sum != 119 || st.Min != 0 || st.Max != 100 {
+		t.Errorf("got stats %+v", st)
+	}
+	if q := Quantile(&h, 0); q != 0 {
+		t.Errorf("0th percentile is %d, want 0", q)
+	}
+	if q := Quantile(&h, 1); q != 100 {
+		t.Errorf("100th percentile is %d, want 100", q)
+	}
+	if q := Quantile(&h, 0.5); q < 4 || q > 7 {
+		t.Errorf("median is %d, want in [4, 7]", q)
+	}
+
+	var h2 Log2
+	h2.Add(1 << 20)
+	h.Merge(&h2)
+	if st := h.Stats(); st.Count != 7 || st.Max != 1<<20 {
+		t.Errorf("after merge, got stats %+v", st)
+	}
+}
+
+func TestHDRBuckets(t *testing.T) {
+	h := NewHDR(3)
+	// Every value must land in a bucket containing it, and
+	// buckets must tile the values without gaps.
+	var prevHi uint64
+	for i := 0; i < 200; i++ {
+		lo, hi := h.bounds(i)
+		if i > 0 && lo != prevHi+1 {
+			t.Fatalf("bucket %d starts at %d, want %d", i, lo, prevHi+1)
+		}
+		for _, x := range []uint64{lo, hi} {
+			if j := h.index(x); j != i {
+				t.Fatalf("index(%d) = %d, want %d", x, j, i)
+			}
+		}
+		if lo >= 16 && float64(hi-lo+1)/float64(lo) > 1.0/8 {
+			t.Fatalf("bucket %d [%d, %d] is too wide", i, lo, hi)
+		}
+		prevHi = hi
+	}
+	if i := h.index(^uint64(0)); i < 0 {
+		t.Fatalf("bad index for max value")
+	}
+}
+
+func TestHDRQuantile(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	h := NewHDR(7)
+	xs := make([]uint64, 10000)
+	for i := range xs {
+		xs[i] = uint64(r.ExpFloat64() * 1e6)
+		h.Add(xs[i])
+	}
+	sort.Slice(xs, func(i, j int) bool { return xs[i] < xs[j] })
+	for _, q := range []float64{0, 0.5, 0.9, 0.99, 1} {
+		want := xs[int(q*float64(len(xs)-1))]
+		got := Quantile(h, q)
+		if d := float64(got) - float64(want); d > 0.01*float64(want)+1 || -d > 0.01*float64(want)+1 {
+			t.Errorf("quantile %v is %d, want %d", q, got, want)
+		}
+	}
+
+	h2 := NewHDR(7)
+	h2.Merge(h)
+	if h2.Stats() != h.Stats() || Quantile(h2, 0.5) != Quantile(h, 0.5) {
+		t.Errorf("merged histogram differs")
+	}
+}
+
+func TestFprint(t *testing.T) {
+	var h Log2
+	h.Add(3)
+	h.Add(5)
+	h.Add(6)
+	var buf bytes.Buffer
+	Fprint(&buf, &h, nil)
+	want := "" +
+		"                   2 - 3          1 |********************                    |\n" +
+		"                   4 - 7          2 |****************************************|\n"
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,380 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package insnlen decodes the lengths of machine instructions.
+//
+// This is enough to find instruction boundaries in a block of code,
+// for example to attribute samples to instructions, without depending
+// on a full disassembler.
+package insnlen
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrTruncated is returned when code ends in the middle of an
+	// instruction.
+	ErrTruncated = errors.New("truncated instruction")
+
+	// ErrInvalid is returned for an invalid or unsupported
+	// instruction encoding.
+	ErrInvalid = errors.New("invalid instruction")
+)
+
+// Supported reports whether Len supports machine mach.
+func Supported(mach elf.Machine) bool {
+	switch mach {
+	case elf.EM_X86_64, elf.EM_AARCH64, elf.EM_ARM, elf.EM_PPC64, elf.EM_RISCV, elf.EM_MIPS, elf.EM_LOONGARCH:
+		return true
+	}
+	return false
+}
+
+// Len returns the length in bytes of the instruction at the start of
+// code for machine mach. For EM_ARM, it assumes ARM (not Thumb) code.
+func Len(mach elf.Machine, code []byte) (int, error) {
+	var n int
+	switch mach {
+	case elf.EM_X86_64:
+		return x86Len(code)
+	case elf.EM_AARCH64, elf.EM_ARM, elf.EM_PPC64, elf.EM_MIPS, elf.EM_LOONGARCH:
+		n = 4
+	case elf.EM_RISCV:
+		// The low two bits are 11 for 32-bit instructions and
+		// anything else for compressed instructions.
+		if len(code) == 0 {
+			return 0, ErrTruncated
+		}
+		n = 4
+		if code[0]&3 != 3 {
+			n = 2
+		}
+	default:
+		return 0, fmt.Errorf("instruction lengths of %s not supported", mach)
+	}
+	if len(code) < n {
+		return 0, ErrTruncated
+	}
+	return n, nil
+}
+
+// Opcode properties in the x86 opcode tables.
+const (
+	m   = 1 << iota // Has a ModRM byte
+	i8              // 8-bit immediate
+	iz              // 16- or 32-bit immediate, depending on operand size
+	i16             // 16-bit immediate
+	bad             // Invalid in 64-bit mode
+)
+
+// x86OneByte gives the properties of one-byte opcodes in 64-bit
+// mode. Prefixes and escapes are handled separately.
+var x86OneByte = [256]uint8{
+	// 00-3F: ALU operations, in groups of 8.
+	0x00: m, m, m, m, i8, iz, bad, bad, m, m, m, m, i8, iz, bad, 0,
+	0x10: m, m, m, m, i8, iz, bad, bad, m, m, m, m, i8, iz, bad, bad,
+	0x20: m, m, m, m, i8, iz, 0, bad, m, m, m, m, i8, iz, 0, bad,
+	0x30: m, m, m, m, i8, iz, 0, bad, m, m, m, m, i8, iz, 0, bad,
+	// 60-6F: PUSHA, POPA, BOUND, and ARPL/MOVSXD.
+	0x60: bad, bad, bad, m, 0, 0, 0, 0, iz, m | iz, i8, m | i8, 0, 0, 0, 0,
+	// 70-7F: Jcc rel8.
+	0x70: i8, i8, i8, i8, i8, i8, i8, i8, i8, i8, i8, i8, i8, i8, i8, i8,
+	0x80: m | i8, m | iz, bad, m | i8, m, m, m, m, m, m, m, m, m, m, m, m,
+	// 9A is far CALL.
+	0x98: 0, 0, bad, 0, 0, 0, 0, 0,
+	// A0-A3 are MOV with a 64-bit moffs, handled specially.
+	0xa8: i8, iz,
+	0xb0: i8, i8, i8, i8, i8, i8, i8, i8,
+	// B8-BF are MOV r, imm, handled specially.
+	0xc0: m | i8, m | i8, i16, 0, bad, bad, m | i8, m | iz, 0, 0, i16, 0, 0, i8, bad, 0,
+	// D4-D6 are AAM, AAD, and SALC. D8-DF are x87.
+	0xd0: m, m, m, m, bad, bad, bad, 0, m, m, m, m, m, m, m, m,
+	// E8 and E9 are CALL and JMP rel32, which is 32 bits
+	// regardless of operand size. EA is far JMP.
+	0xe0: i8, i8, i8, i8, i8, i8, i8, i8, iz, iz, bad, i8, 0, 0, 0, 0,
+	// F6 and F7 have an immediate only for TEST, handled
+	// specially.
+	0xf0: 0, 0, 0, 0, 0, 0, m, m, 0, 0, 0, 0, 0, 0, m, m,
+}
+
+// x86TwoByte gives the properties of 0F xx opcodes. 0F 38 and 0F 3A
+// are escapes to the three-byte maps.
+var x86TwoByte = [256]uint8{
+	// 0F 0F is 3DNow!, which has an opcode suffix in place of an
+	// 8-bit immediate.
+	0x00: m, m, m, m, bad, 0, 0, 0, 0, 0, bad, 0, bad, m, 0, m | i8,
+	0x10: m, m, m, m, m, m, m, m, m, m, m, m, m, m, m, m,
+	0x20: m, m, m, m, bad, bad, bad, bad, m, m, m, m, m, m, m, m,
+	// 0F 30-37 are WRMSR, RDTSC, RDMSR, RDPMC, SYSENTER,
+	// SYSEXIT, and GETSEC.
+	0x30: 0, 0, 0, 0, 0, 0, bad, 0, 0, bad, 0, bad, bad, bad, bad, bad,
+	0x40: m, m, m, m, m, m, m, m, m, m, m, m, m, m, m, m,
+	0x50: m, m, m, m, m, m, m, m, m, m, m, m, m, m, m, m,
+	0x60: m, m, m, m, m, m, m, m, m, m, m, m, m, m, m, m,
+	// 0F 77 is EMMS.
+	0x70: m | i8, m | i8, m | i8, m | i8, m, m, m, 0, m, m, m, m, m, m, m, m,
+	// 0F 80-8F are Jcc rel32.
+	0x80: iz, iz, iz, iz, iz, iz, iz, iz, iz, iz, iz, iz, iz, iz, iz, iz,
+	0x90: m, m, m, m, m, m, m, m, m, m, m, m, m, m, m, m,
+	// 0F A0-A2 are PUSH FS, POP FS, and CPUID. A8-AA are PUSH
+	// GS, POP GS, and RSM.
+	0xa0: 0, 0, 0, m, m | i8, m, bad, bad, 0, 0, 0, m, m | i8, m, m, m,
+	0xb0: m, m, m, m, m, m, m, m, m, m, m | i8, m, m, m, m, m,
+	// 0F C8-CF are BSWAP.
+	0xc0: m, m, m | i8, m, m | i8, m | i8, m | i8, m, 0, 0, 0, 0, 0, 0, 0, 0,
+	0xd0: m, m, m, m, m, m, m, m, m, m, m, m, m, m, m, m,
+	0xe0: m, m, m, m, m, m, m, m, m, m, m, m, m, m, m, m,
+	0xf0: m, m, m, m, m, m, m, m, m, m, m, m, m, m, m, m,
+}
+
+// x86Len returns the length of the x86-64 instruction at the start of
+// code. See the Intel SDM, volume 2, chapter 2 and appendix A.
+func x86Len(code []byte) (int, error) {
+	const maxLen = 15
+	if len(code) > maxLen {
+		code = code[:maxLen]
+	}
+	pos := 0
+	next := func() (byte, bool) {
+		if pos >= len(code) {
+			return 0, false
+		}
+		pos++
+		return code[pos-1], true
+	}
+
+	// Prefixes. A REX prefix only applies if it immediately
+	// precedes the opcode.
+	var opsize16, addr32, rexW bool
+	var op byte
+	for {
+		b, ok := next()
+		if !ok {
+			return 0, ErrTruncated
+		}
+		rexW = false
+		switch {
+		case b == 0x66:
+			opsize16 = true
+			continue
+		case b == 0x67:
+			addr32 = true
+			continue
+		case b == 0xf0, b == 0xf2, b == 0xf3, b == 0x2e, b == 0x36, b == 0x3e, b == 0x26, b == 0x64, b == 0x65:
+			continue
+		case b&0xf0 == 0x40:
+			// REX. The opcode must follow.
+			rexW = b&8 != 0
+			if op, ok = next(); !ok {
+				return 0, ErrTruncated
+			}
+			if op&0xf0 == 0x40 || isX86Prefix(op) {
+				// The REX prefix is ignored.
+				pos--
+				continue
+			}
+		default:
+			op = b
+		}
+		break
+	}
+
+	// Opcode.
+	var props uint8
+	switch {
+	case op == 0x0f:
+		b, ok := next()
+		if !ok {
+			return 0, ErrTruncated
+		}
+		switch b {
+		case 0x38:
+			if _, ok := next(); !ok {
+				return 0, ErrTruncated
+			}
+			props = m
+		case 0x3a:
+			if _, ok := next(); !ok {
+				return 0, ErrTruncated
+			}
+			props = m | i8
+		default:
+			props = x86TwoByte[b]
+		}
+
+	case op == 0xc4, op == 0xc5, op == 0x62, op == 0x8f && pos < len(code) && code[pos]&0x1f >= 8:
+		// VEX, EVEX, or XOP prefix. Otherwise, 8F is POP r/m.
+		var ok bool
+		if props, ok = x86VEX(op, code, &pos); !ok {
+			return 0, ErrTruncated
+		}
+
+	case 0xb8 <= op && op <= 0xbf:
+		// MOV r, imm takes a full 64-bit immediate with REX.W.
+		switch {
+		case rexW:
+			pos += 8
+		case opsize16:
+			pos += 2
+		default:
+			pos += 4
+		}
+
+	case 0xa0 <= op && op <= 0xa3:
+		// MOV with a moffs, which is the address size.
+		if addr32 {
+			pos += 4
+		} else {
+			pos += 8
+		}
+
+	default:
+		props = x86OneByte[op]
+	}
+	if props&bad != 0 {
+		return 0, ErrInvalid
+	}
+
+	// ModRM, SIB, and displacement. In 64-bit mode, 32-bit
+	// addressing uses the same encoding as 64-bit addressing.
+	if props&m != 0 {
+		modrm, ok := next()
+		if !ok {
+			return 0, ErrTruncated
+		}
+		mod, reg, rm := modrm>>6, modrm>>3&7, modrm&7
+		if (op == 0xf6 || op == 0xf7) && reg < 2 {
+			// TEST r/m, imm.
+			if op == 0xf6 {
+				props |= i8
+			} else {
+				props |= iz
+			}
+		}
+		if mod != 3 {
+			if rm == 4 {
+				sib, ok := next()
+				if !ok {
+					return 0, ErrTruncated
+				}
+				if mod == 0 && sib&7 == 5 {
+					pos += 4
+				}
+			} else if mod == 0 && rm == 5 {
+				// RIP-relative.
+				pos += 4
+			}
+			switch mod {
+			case 1:
+				pos++
+			case 2:
+				pos += 4
+			}
+		}
+	}
+
+	// Immediates.
+	if props&i8 != 0 {
+		pos++
+	}
+	if props&i16 != 0 {
+		pos += 2
+	}
+	if props&iz != 0 {
+		// REX.W takes precedence over the operand size prefix.
+		if opsize16 && !rexW && op != 0xe8 && op != 0xe9 && op != 0x0f {
+			pos += 2
+		} else {
+			pos += 4
+		}
+	}
+	if op == 0xc8 {
+		// ENTER imm16, imm8.
+		pos += 3
+	}
+	if pos > len(code) {
+		if len(code) == maxLen {
+			return 0, ErrInvalid
+		}
+		return 0, ErrTruncated
+	}
+	return pos, nil
+}
+
+func isX86Prefix(b byte) bool {
+	switch b {
+	case 0x66, 0x67, 0xf0, 0xf2, 0xf3, 0x2e, 0x36, 0x3e, 0x26, 0x64, 0x65:
+		return true
+	}
+	return false
+}
+
+// x86VEX decodes the VEX (C4, C5), EVEX (62), or XOP (8F) prefix op
+// and the opcode following it, starting at code[*pos], and returns the
+// properties of the opcode. It returns false if code is truncated.
+func x86VEX(op byte, code []byte, pos *int) (props uint8, ok bool) {
+	rest := code[*pos:]
+	if len(rest) < 1 {
+		return 0, false
+	}
+	var pn int    // Prefix payload length
+	var mmap byte // Opcode map
+	switch op {
+	case 0xc5:
+		pn, mmap = 1, 1
+	case 0xc4:
+		pn, mmap = 2, rest[0]&0x1f
+	case 0x62:
+		pn, mmap = 3, rest[0]&7
+	case 0x8f:
+		pn, mmap = 2, rest[0]&0x1f
+	}
+	if len(rest) < pn+1 {
+		return 0, false
+	}
+	opcode := rest[pn]
+	*pos += pn + 1
+
+	switch op {
+	case 0x8f:
+		// XOP map 8 has an 8-bit immediate and map A has a
+		// 32-bit immediate.
+		switch mmap {
+		case 8:
+			return m | i8, true
+		case 9:
+			return m, true
+		case 0xa:
+			return m | iz, true
+		}
+		return bad, true
+	}
+	switch mmap {
+	case 1:
+		// The 0F map, where only a few opcodes take
+		// immediates. VZEROUPPER and VZEROALL (77) have no
+		// ModRM.
+		if op != 0x62 && opcode == 0x77 {
+			return 0, true
+		}
+		switch opcode {
+		case 0x70, 0x71, 0x72, 0x73, 0xc2, 0xc4, 0xc5, 0xc6:
+			return m | i8, true
+		}
+		return m, true
+	case 2:
+		return m, true
+	case 3:
+		return m | i8, true
+	case 5, 6:
+		if op == 0x62 {
+			// EVEX maps 5 and 6 (AVX512-FP16).
+			return m, true
+		}
+	}
+	return bad, true
+}
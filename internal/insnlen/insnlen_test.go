@@ -0,0 +1,91 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package insnlen
+
+import (
+	"debug/elf"
+	"encoding/hex"
+	"testing"
+)
+
+func TestX86Len(t *testing.T) {
+	tests := []struct {
+		hex  string
+		want int
+	}{
+		{"c3", 1},                    // ret
+		{"55", 1},                    // push %rbp
+		{"4889e5", 3},                // mov %rsp,%rbp
+		{"4881ec30040000", 7},        // sub $0x430,%rsp
+		{"4c8da42448fcffff", 8},      // lea -0x3b8(%rsp),%r12
+		{"4d3b6610", 4},              // cmp 0x10(%r14),%r12
+		{"0f8667110000", 6},          // jbe rel32
+		{"7405", 2},                  // je rel8
+		{"e800000000", 5},            // call rel32
+		{"48b88877665544332211", 10}, // movabs $imm64,%rax
+		{"b801000000", 5},            // mov $1,%eax
+		{"66b80100", 4},              // mov $1,%ax
+		{"66488100efbeadde", 8},      // data16 addq $-0x21524111,(%rax)
+		{"488b0500000000", 7},        // mov 0x0(%rip),%rax
+		{"8b042500000000", 7},        // mov 0x0,%eax (SIB, no base)
+		{"f6c101", 3},                // test $1,%cl
+		{"f7c101000000", 6},          // test $1,%ecx
+		{"f7d8", 2},                  // neg %eax
+		{"66660f1f840000000000", 10}, // nopw 0x0(%rax,%rax,1)
+		{"f30f1efa", 4},              // endbr64
+		{"c5f877", 3},                // vzeroupper
+		{"c5fd6f0424", 5},            // vmovdqa (%rsp),%ymm0
+		{"c4e37d18c101", 6},          // vinsertf128 $1,%xmm1,%ymm0,%ymm0
+		{"62f1fe486f44", 0},          // truncated EVEX
+		{"62f17c48104c2401", 8},      // vmovups 0x40(%rsp),%zmm1
+		{"660f3a0fc108", 6},          // palignr $8,%xmm1,%xmm0
+		{"c8100000", 4},              // enter $0x10,$0
+		{"48a10807060504030201", 10}, // movabs 0x0102030405060708,%rax
+		{"8f00", 2},                  // pop (%rax)
+		{"f048", 0},                  // truncated
+		{"06", 0},                    // invalid in 64-bit mode
+	}
+	for _, test := range tests {
+		code, err := hex.DecodeString(test.hex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Append a trailing instruction so over-reads show up
+		// as wrong lengths.
+		if test.want != 0 {
+			code = append(code, 0x90)
+		}
+		got, err := Len(elf.EM_X86_64, code)
+		if test.want == 0 {
+			if err == nil {
+				t.Errorf("%s: got length %d, want error", test.hex, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s: got %d, %v, want %d", test.hex, got, err, test.want)
+		}
+	}
+}
+
+func TestFixedLen(t *testing.T) {
+	for _, test := range []struct {
+		mach elf.Machine
+		hex  string
+		want int
+	}{
+		{elf.EM_AARCH64, "d65f03c0", 4},
+		{elf.EM_RISCV, "8280", 2}, // Compressed
+		{elf.EM_RISCV, "13050000", 4},
+	} {
+		code, _ := hex.DecodeString(test.hex)
+		if got, err := Len(test.mach, code); err != nil || got != test.want {
+			t.Errorf("%s %s: got %d, %v, want %d", test.mach, test.hex, got, err, test.want)
+		}
+	}
+	if _, err := Len(elf.EM_AARCH64, []byte{1, 2}); err != ErrTruncated {
+		t.Errorf("truncated AArch64 instruction: got %v, want %v", err, ErrTruncated)
+	}
+}
@@ -0,0 +1,445 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package metrics exports histograms and counters computed from
+// profiles to monitoring systems.
+//
+// WritePrometheus writes the Prometheus text exposition format,
+// WritePrometheusProto writes the Prometheus protobuf exposition
+// format, and WriteOTLP writes OpenTelemetry metrics in the OTLP/JSON
+// encoding. Histograms are exported with explicit bucket boundaries,
+// which represent both hist.Log2 and hist.HDR exactly.
+//
+// WritePrometheusProto also writes hist.Log2 histograms as Prometheus
+// native histograms, which only the protobuf format can carry. Their
+// schema 0 buckets are powers of two, like those of hist.Log2. Other
+// histograms have no such exact mapping, so they're written with
+// explicit buckets only.
+package metrics
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aclements/go-perf/internal/hist"
+)
+
+// A Family is a named set of time series of the same kind.
+type Family struct {
+	// Name is the metric name, such as
+	// "function_latency_seconds". Counters should end in
+	// "_total".
+	Name string
+	Help string
+
+	// Unit is the unit of the exported values, such as "s", for
+	// OTLP. It is ignored by WritePrometheus, which expects the
+	// unit in the name.
+	Unit string
+
+	// Scale converts recorded values to exported values. For
+	// example, a histogram of nanoseconds exported in seconds
+	// has scale 1e-9. If 0, values are exported unchanged.
+	Scale float64
+
+	Series []Series
+}
+
+// A Series is one time series of a Family. If Hist is non-nil, the
+// series is a histogram. Otherwise, it's a counter with value Value.
+type Series struct {
+	Labels map[string]string
+	Hist   hist.Histogram
+	Value  float64
+}
+
+func (f *Family) scale(x float64) float64 {
+	if f.Scale == 0 {
+		return x
+	}
+	return x * f.Scale
+}
+
+func (f *Family) isHist() bool {
+	return len(f.Series) > 0 && f.Series[0].Hist != nil
+}
+
+// WritePrometheus writes fams to w in the Prometheus text exposition
+// format. Histograms are written as cumulative "le" buckets.
+func WritePrometheus(w io.Writer, fams []*Family) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range fams {
+		typ := "counter"
+		if f.isHist() {
+			typ = "histogram"
+		}
+		if f.Help != "" {
+			fmt.Fprintf(bw, "# HELP %s %s\n", f.Name, escapeHelp(f.Help))
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.Name, typ)
+		for _, s := range f.Series {
+			labels := promLabels(s.Labels, "")
+			if s.Hist == nil {
+				fmt.Fprintf(bw, "%s%s %s\n", f.Name, labels, promFloat(s.Value))
+				continue
+			}
+			var cum uint64
+			for _, b := range s.Hist.Buckets() {
+				cum += b.Count
+				le := promLabels(s.Labels, promFloat(f.scale(float64(b.Hi))))
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", f.Name, le, cum)
+			}
+			st := s.Hist.Stats()
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", f.Name, promLabels(s.Labels, "+Inf"), st.Count)
+			fmt.Fprintf(bw, "%s_sum%s %s\n", f.Name, labels, promFloat(f.scale(float64(st.Sum))))
+			fmt.Fprintf(bw, "%s_count%s %d\n", f.Name, labels, st.Count)
+		}
+	}
+	return bw.Flush()
+}
+
+// WritePrometheusProto writes fams to w in the Prometheus protobuf
+// exposition format, as a sequence of length-delimited
+// io.prometheus.client.MetricFamily messages. This is the format
+// served with content type
+//
+//	application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited
+//
+// Histograms are written with cumulative explicit buckets, as
+// WritePrometheus writes them. A hist.Log2 histogram is also written
+// as a native histogram with schema 0 if f.Scale is 0 or a power of
+// two. Native bucket i holds values in (2^(i-1), 2^i], so hist.Log2
+// bucket i, [2^(i-1), 2^i), becomes native bucket i, shifted by
+// log2(f.Scale). The two have the same bounds and differ only in
+// which bound is inclusive. Value 0 goes in the zero bucket.
+func WritePrometheusProto(w io.Writer, fams []*Family) error {
+	const (
+		typeCounter   = 0
+		typeHistogram = 4
+	)
+	bw := bufio.NewWriter(w)
+	for _, f := range fams {
+		var fe encoder
+		fe.bytes(1, []byte(f.Name))
+		if f.Help != "" {
+			fe.bytes(2, []byte(f.Help))
+		}
+		if f.isHist() {
+			fe.uint(3, typeHistogram)
+		} else {
+			fe.uint(3, typeCounter)
+		}
+		for _, s := range f.Series {
+			var me encoder
+			for _, k := range sortedKeys(s.Labels) {
+				var le encoder
+				le.bytes(1, []byte(k))
+				le.bytes(2, []byte(s.Labels[k]))
+				me.msg(1, &le)
+			}
+			if s.Hist == nil {
+				var ce encoder
+				ce.double(1, s.Value)
+				me.msg(3, &ce)
+			} else {
+				me.msg(7, protoHist(f, s.Hist))
+			}
+			fe.msg(4, &me)
+		}
+
+		var le encoder
+		le.varint(uint64(len(fe.buf)))
+		bw.Write(le.buf)
+		bw.Write(fe.buf)
+	}
+	return bw.Flush()
+}
+
+// protoHist encodes h as an io.prometheus.client.Histogram.
+func protoHist(f *Family, h hist.Histogram) *encoder {
+	var he encoder
+	st := h.Stats()
+	he.uint(1, st.Count)
+	he.double(2, f.scale(float64(st.Sum)))
+	var cum uint64
+	for _, b := range h.Buckets() {
+		cum += b.Count
+		var be encoder
+		be.uint(1, cum)
+		be.double(2, f.scale(float64(b.Hi)))
+		he.msg(3, &be)
+	}
+
+	l2, ok := h.(*hist.Log2)
+	if !ok {
+		return &he
+	}
+	shift := 0
+	if f.Scale != 0 {
+		frac, exp := math.Frexp(f.Scale)
+		if frac != 0.5 {
+			// Not a power of two.
+			return &he
+		}
+		shift = exp - 1
+	}
+	// Schema 0 and a zero threshold of 0 are the defaults.
+	he.uint(7, l2.Counts[0])
+	// Each span is a run of non-empty buckets. The first span's
+	// offset is the index of its first bucket and each later
+	// span's offset is the gap from the end of the one before.
+	// The counts of the buckets in the spans are delta encoded.
+	var deltas []int64
+	var prev int64
+	end := 0 // Index following the last span, or 0 if none
+	for i := 1; i < len(l2.Counts); {
+		if l2.Counts[i] == 0 {
+			i++
+			continue
+		}
+		start := i
+		for ; i < len(l2.Counts) && l2.Counts[i] != 0; i++ {
+			deltas = append(deltas, int64(l2.Counts[i])-prev)
+			prev = int64(l2.Counts[i])
+		}
+		offset := start - end
+		if end == 0 {
+			offset = start + shift
+		}
+		var se encoder
+		se.sint(1, int64(offset))
+		se.uint(2, uint64(i-start))
+		he.msg(12, &se)
+		end = i
+	}
+	if len(deltas) > 0 {
+		he.packedSints(13, deltas)
+	} else if l2.Counts[0] == 0 {
+		// Prometheus recognizes a native histogram by its
+		// spans or zero bucket, so an empty histogram needs
+		// an empty span.
+		he.bytes(12, nil)
+	}
+	return &he
+}
+
+// encoder encodes protobuf messages.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) varint(x uint64) {
+	for x >= 0x80 {
+		e.buf = append(e.buf, byte(x)|0x80)
+		x >>= 7
+	}
+	e.buf = append(e.buf, byte(x))
+}
+
+func (e *encoder) key(field, wireType int) {
+	e.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (e *encoder) uint(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	e.key(field, 0)
+	e.varint(x)
+}
+
+// sint encodes x as a zigzag-encoded sint32 or sint64.
+func (e *encoder) sint(field int, x int64) {
+	e.uint(field, uint64(x<<1)^uint64(x>>63))
+}
+
+func (e *encoder) double(field int, x float64) {
+	if x == 0 {
+		return
+	}
+	e.key(field, 1)
+	e.buf = append(e.buf, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(e.buf[len(e.buf)-8:], math.Float64bits(x))
+}
+
+func (e *encoder) bytes(field int, b []byte) {
+	e.key(field, 2)
+	e.varint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) msg(field int, m *encoder) {
+	e.bytes(field, m.buf)
+}
+
+func (e *encoder) packedSints(field int, xs []int64) {
+	var p encoder
+	for _, x := range xs {
+		p.varint(uint64(x<<1) ^ uint64(x>>63))
+	}
+	e.bytes(field, p.buf)
+}
+
+// promLabels formats labels in Prometheus syntax, adding an "le"
+// label if le != "".
+func promLabels(labels map[string]string, le string) string {
+	keys := sortedKeys(labels)
+	if len(keys) == 0 && le == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", k, escapeLabel(labels[k]))
+	}
+	if le != "" {
+		if len(keys) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "le=\"%s\"", le)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func promFloat(x float64) string {
+	switch {
+	case math.IsInf(x, 1):
+		return "+Inf"
+	case math.IsInf(x, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteOTLP writes fams to w as an OTLP ExportMetricsServiceRequest in
+// the OTLP/JSON encoding, which can be posted to an OpenTelemetry
+// collector's /v1/metrics endpoint. resource gives the attributes of
+// the resource that produced the metrics, such as the host. The
+// metrics are cumulative from start to end.
+func WriteOTLP(w io.Writer, fams []*Family, resource map[string]string, start, end time.Time) error {
+	type (
+		anyValue struct {
+			StringValue string `json:"stringValue"`
+		}
+		keyValue struct {
+			Key   string   `json:"key"`
+			Value anyValue `json:"value"`
+		}
+		// Per the protobuf JSON mapping, 64-bit integers are
+		// encoded as strings.
+		dataPoint struct {
+			Attributes        []keyValue `json:"attributes,omitempty"`
+			StartTimeUnixNano string     `json:"startTimeUnixNano"`
+			TimeUnixNano      string     `json:"timeUnixNano"`
+			AsDouble          *float64   `json:"asDouble,omitempty"`
+			Count             string     `json:"count,omitempty"`
+			Sum               *float64   `json:"sum,omitempty"`
+			Min               *float64   `json:"min,omitempty"`
+			Max               *float64   `json:"max,omitempty"`
+			BucketCounts      []string   `json:"bucketCounts,omitempty"`
+			ExplicitBounds    []float64  `json:"explicitBounds,omitempty"`
+		}
+		data struct {
+			AggregationTemporality int         `json:"aggregationTemporality"`
+			IsMonotonic            bool        `json:"isMonotonic,omitempty"`
+			DataPoints             []dataPoint `json:"dataPoints"`
+		}
+		metric struct {
+			Name        string `json:"name"`
+			Description string `json:"description,omitempty"`
+			Unit        string `json:"unit,omitempty"`
+			Histogram   *data  `json:"histogram,omitempty"`
+			Sum         *data  `json:"sum,omitempty"`
+		}
+	)
+	const cumulative = 2 // AGGREGATION_TEMPORALITY_CUMULATIVE
+
+	attrs := func(m map[string]string) []keyValue {
+		var out []keyValue
+		for _, k := range sortedKeys(m) {
+			out = append(out, keyValue{k, anyValue{m[k]}})
+		}
+		return out
+	}
+	u64 := func(x uint64) string { return strconv.FormatUint(x, 10) }
+	f64 := func(x float64) *float64 { return &x }
+	startNS, endNS := u64(uint64(start.UnixNano())), u64(uint64(end.UnixNano()))
+
+	var metrics []metric
+	for _, f := range fams {
+		m := metric{Name: f.Name, Description: f.Help, Unit: f.Unit}
+		d := &data{AggregationTemporality: cumulative}
+		if f.isHist() {
+			m.Histogram = d
+		} else {
+			m.Sum, d.IsMonotonic = d, true
+		}
+		for _, s := range f.Series {
+			dp := dataPoint{Attributes: attrs(s.Labels), StartTimeUnixNano: startNS, TimeUnixNano: endNS}
+			if s.Hist == nil {
+				dp.AsDouble = f64(s.Value)
+				d.DataPoints = append(d.DataPoints, dp)
+				continue
+			}
+			st := s.Hist.Stats()
+			dp.Count = u64(st.Count)
+			dp.Sum = f64(f.scale(float64(st.Sum)))
+			if st.Count > 0 {
+				dp.Min, dp.Max = f64(f.scale(float64(st.Min))), f64(f.scale(float64(st.Max)))
+			}
+			// Bucket i counts values in (bounds[i-1],
+			// bounds[i]], with a final bucket for values
+			// above the last bound.
+			for _, b := range s.Hist.Buckets() {
+				dp.BucketCounts = append(dp.BucketCounts, u64(b.Count))
+				dp.ExplicitBounds = append(dp.ExplicitBounds, f.scale(float64(b.Hi)))
+			}
+			dp.BucketCounts = append(dp.BucketCounts, "0")
+			d.DataPoints = append(d.DataPoints, dp)
+		}
+		metrics = append(metrics, m)
+	}
+
+	req := map[string]interface{}{
+		"resourceMetrics": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{"attributes": attrs(resource)},
+				"scopeMetrics": []interface{}{
+					map[string]interface{}{
+						"scope":   map[string]string{"name": "github.com/aclements/go-perf"},
+						"metrics": metrics,
+					},
+				},
+			},
+		},
+	}
+	return json.NewEncoder(w).Encode(req)
+}
@@ -0,0 +1,284 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aclements/go-perf/internal/hist"
+)
+
+func testFamilies() []*Family {
+	var h hist.Log2
+	for _, x := range []uint64{1, 2, 3, 6} {
+		h.Add(x)
+	}
+	return []*Family{
+		{
+			Name:  "latency_seconds",
+			Help:  "Latency.",
+			Unit:  "s",
+			Scale: 0.5,
+			Series: []Series{
+				{Labels: map[string]string{"func": `a"b`}, Hist: &h},
+			},
+		},
+		{
+			Name: "errors_total",
+			Series: []Series{
+				{Labels: map[string]string{"func": "f", "errno": "-2"}, Value: 3},
+			},
+		},
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf, testFamilies()); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{func="a\"b",le="0.5"} 1
+latency_seconds_bucket{func="a\"b",le="1.5"} 3
+latency_seconds_bucket{func="a\"b",le="3.5"} 4
+latency_seconds_bucket{func="a\"b",le="+Inf"} 4
+latency_seconds_sum{func="a\"b"} 6
+latency_seconds_count{func="a\"b"} 4
+# TYPE errors_total counter
+errors_total{errno="-2",func="f"} 3
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteOTLP(t *testing.T) {
+	var buf bytes.Buffer
+	start := time.Unix(10, 0)
+	if err := WriteOTLP(&buf, testFamilies(), map[string]string{"host.name": "gopher"}, start, start.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	var req struct {
+		ResourceMetrics []struct {
+			ScopeMetrics []struct {
+				Metrics []struct {
+					Name      string
+					Histogram *struct {
+						DataPoints []struct {
+							Count          string
+							Sum            float64
+							BucketCounts   []string
+							ExplicitBounds []float64
+						}
+					}
+					Sum *struct {
+						IsMonotonic bool
+						DataPoints  []struct{ AsDouble float64 }
+					}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		t.Fatal(err)
+	}
+	ms := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(ms) != 2 || ms[0].Histogram == nil || ms[1].Sum == nil {
+		t.Fatalf("bad metrics: %s", buf.String())
+	}
+	dp := ms[0].Histogram.DataPoints[0]
+	if dp.Count != "4" || dp.Sum != 6 || len(dp.BucketCounts) != 4 || len(dp.ExplicitBounds) != 3 || dp.ExplicitBounds[2] != 3.5 {
+		t.Errorf("bad histogram data point %+v", dp)
+	}
+	if !ms[1].Sum.IsMonotonic || ms[1].Sum.DataPoints[0].AsDouble != 3 {
+		t.Errorf("bad counter %+v", ms[1].Sum)
+	}
+}
+
+// pbMsg is a decoded protobuf message, mapping each field number to
+// its values. Varint and fixed64 values are uint64s and
+// length-delimited values are []bytes.
+type pbMsg map[int][]interface{}
+
+func decodePB(t *testing.T, b []byte) pbMsg {
+	t.Helper()
+	m := make(pbMsg)
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad key in %x", b)
+		}
+		b = b[n:]
+		var v interface{}
+		switch key & 7 {
+		case 0:
+			x, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("bad varint in %x", b)
+			}
+			v, b = x, b[n:]
+		case 1:
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				t.Fatalf("bad length in %x", b)
+			}
+			v, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		m[int(key>>3)] = append(m[int(key>>3)], v)
+	}
+	return m
+}
+
+func (m pbMsg) uint(field int) uint64 {
+	if len(m[field]) == 0 {
+		return 0
+	}
+	return m[field][0].(uint64)
+}
+
+func (m pbMsg) double(field int) float64 {
+	return math.Float64frombits(m.uint(field))
+}
+
+func (m pbMsg) msgs(t *testing.T, field int) []pbMsg {
+	var out []pbMsg
+	for _, v := range m[field] {
+		out = append(out, decodePB(t, v.([]byte)))
+	}
+	return out
+}
+
+func unzigzag(x uint64) int64 {
+	return int64(x>>1) ^ -int64(x&1)
+}
+
+// nativeBuckets decodes the positive spans and bucket deltas of a
+// native histogram into a map from bucket index to count.
+func nativeBuckets(t *testing.T, h pbMsg) map[int64]int64 {
+	buckets := make(map[int64]int64)
+	var deltas []int64
+	for _, v := range h[13] {
+		for b := v.([]byte); len(b) > 0; {
+			x, n := binary.Uvarint(b)
+			deltas, b = append(deltas, unzigzag(x)), b[n:]
+		}
+	}
+	var idx, count int64
+	for i, span := range h.msgs(t, 12) {
+		if i == 0 {
+			idx = unzigzag(span.uint(1))
+		} else {
+			idx += unzigzag(span.uint(1))
+		}
+		for j := uint64(0); j < span.uint(2); j++ {
+			count += deltas[0]
+			deltas = deltas[1:]
+			buckets[idx] = count
+			idx++
+		}
+	}
+	return buckets
+}
+
+func TestWritePrometheusProto(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WritePrometheusProto(&buf, testFamilies()); err != nil {
+		t.Fatal(err)
+	}
+	var fams []pbMsg
+	for b := buf.Bytes(); len(b) > 0; {
+		l, n := binary.Uvarint(b)
+		fams = append(fams, decodePB(t, b[n:n+int(l)]))
+		b = b[n+int(l):]
+	}
+	if len(fams) != 2 {
+		t.Fatalf("got %d metric families, want 2", len(fams))
+	}
+
+	lat := fams[0]
+	if name := string(lat[1][0].([]byte)); name != "latency_seconds" || lat.uint(3) != 4 {
+		t.Fatalf("got family %q of type %d, want latency_seconds of type 4", name, lat.uint(3))
+	}
+	m := lat.msgs(t, 4)[0]
+	label := m.msgs(t, 1)[0]
+	if k, v := string(label[1][0].([]byte)), string(label[2][0].([]byte)); k != "func" || v != `a"b` {
+		t.Errorf("got label %s=%q, want func=%q", k, v, `a"b`)
+	}
+	h := m.msgs(t, 7)[0]
+	if h.uint(1) != 4 || h.double(2) != 6 {
+		t.Errorf("got count %d, sum %v, want 4, 6", h.uint(1), h.double(2))
+	}
+	var classic [][2]float64
+	for _, b := range h.msgs(t, 3) {
+		classic = append(classic, [2]float64{b.double(2), float64(b.uint(1))})
+	}
+	if want := [][2]float64{{0.5, 1}, {1.5, 3}, {3.5, 4}}; !reflect.DeepEqual(classic, want) {
+		t.Errorf("got classic buckets %v, want %v", classic, want)
+	}
+	// Values 1, 2, 3, and 6 are in Log2 buckets 1, 2, and 3.
+	// Scaled by 1/2, these are native buckets 0, 1, and 2.
+	if got, want := nativeBuckets(t, h), map[int64]int64{0: 1, 1: 2, 2: 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got native buckets %v, want %v", got, want)
+	}
+
+	errs := fams[1]
+	if errs.uint(3) != 0 || errs.msgs(t, 4)[0].msgs(t, 3)[0].double(1) != 3 {
+		t.Errorf("bad counter family %v", errs)
+	}
+}
+
+func TestNativeHistogram(t *testing.T) {
+	var l2 hist.Log2
+	for _, x := range []uint64{0, 1, 8, 9} {
+		l2.Add(x)
+	}
+	hdr := hist.NewHDR(2)
+	hdr.Add(5)
+	tests := []struct {
+		name  string
+		h     hist.Histogram
+		scale float64
+		zero  uint64
+		want  map[int64]int64 // nil if not native
+	}{
+		{"gap", &l2, 0, 1, map[int64]int64{1: 1, 4: 2}},
+		{"scaled", &l2, 1024, 1, map[int64]int64{11: 1, 14: 2}},
+		{"empty", new(hist.Log2), 0, 0, map[int64]int64{}},
+		{"non-power-of-two", &l2, 1e-9, 0, nil},
+		{"hdr", hdr, 0, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &Family{Scale: tt.scale}
+			h := decodePB(t, protoHist(f, tt.h).buf)
+			if tt.want == nil {
+				if len(h[7]) != 0 || len(h[12]) != 0 || len(h[13]) != 0 {
+					t.Errorf("unexpected native histogram fields %v", h)
+				}
+				return
+			}
+			if len(h[12]) == 0 {
+				t.Fatal("no spans")
+			}
+			if h.uint(7) != tt.zero {
+				t.Errorf("got zero count %d, want %d", h.uint(7), tt.zero)
+			}
+			if got := nativeBuckets(t, h); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got native buckets %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package pprof writes profiles in the pprof format.
+//
+// This implements just enough of the profile.proto encoding to write
+// symbolized stack profiles, without depending on a protobuf library.
+// See https://github.com/google/pprof/blob/main/proto/profile.proto.
+package pprof
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// A ValueType describes one value recorded for each sample, such as
+// ("samples", "count") or ("contention", "nanoseconds").
+type ValueType struct {
+	Type, Unit string
+}
+
+// A Frame is one symbolized frame of a stack.
+type Frame struct {
+	Func string
+	File string
+	Line int
+	Addr uint64
+}
+
+// A Builder accumulates samples into a profile.
+type Builder struct {
+	types    []ValueType
+	samples  []sample
+	comments []int64
+
+	strings   []string
+	stringIDs map[string]int64
+	funcs     map[[2]int64]uint64 // Name, file -> ID
+	locs      map[Frame]uint64
+	funcList  []function
+	locList   []location
+}
+
+type sample struct {
+	locs   []uint64
+	values []int64
+}
+
+type function struct {
+	id, name, file uint64
+}
+
+type location struct {
+	id, addr, fn uint64
+	line         int
+}
+
+// NewBuilder returns a Builder for a profile with the given sample
+// value types.
+func NewBuilder(types ...ValueType) *Builder {
+	b := &Builder{
+		types:     types,
+		stringIDs: make(map[string]int64),
+		funcs:     make(map[[2]int64]uint64),
+		locs:      make(map[Frame]uint64),
+	}
+	b.str("") // String 0 must be ""
+	return b
+}
+
+// Add adds a sample with the given stack, starting from the leaf, and
+// values, which correspond to the Builder's value types.
+func (b *Builder) Add(stack []Frame, values ...int64) {
+	s := sample{values: append([]int64(nil), values...)}
+	for _, f := range stack {
+		s.locs = append(s.locs, b.loc(f))
+	}
+	b.samples = append(b.samples, s)
+}
+
+// Comment adds a free-form comment to the profile, such as a note
+// about its accuracy. pprof shows comments with -comments.
+func (b *Builder) Comment(text string) {
+	b.comments = append(b.comments, b.str(text))
+}
+
+func (b *Builder) str(s string) int64 {
+	if id, ok := b.stringIDs[s]; ok {
+		return id
+	}
+	id := int64(len(b.strings))
+	b.strings = append(b.strings, s)
+	b.stringIDs[s] = id
+	return id
+}
+
+func (b *Builder) loc(f Frame) uint64 {
+	if id, ok := b.locs[f]; ok {
+		return id
+	}
+	key := [2]int64{b.str(f.Func), b.str(f.File)}
+	fn, ok := b.funcs[key]
+	if !ok {
+		fn = uint64(len(b.funcList) + 1)
+		b.funcs[key] = fn
+		b.funcList = append(b.funcList, function{fn, uint64(key[0]), uint64(key[1])})
+	}
+	id := uint64(len(b.locList) + 1)
+	b.locs[f] = id
+	b.locList = append(b.locList, location{id, f.Addr, fn, f.Line})
+	return id
+}
+
+// Write writes the profile to w in gzipped profile.proto format.
+func (b *Builder) Write(w io.Writer) error {
+	var p encoder
+	for _, t := range b.types {
+		var vt encoder
+		vt.int(1, b.str(t.Type))
+		vt.int(2, b.str(t.Unit))
+		p.msg(1, &vt)
+	}
+	for _, s := range b.samples {
+		var se encoder
+		se.packedUints(1, s.locs)
+		se.packedInts(2, s.values)
+		p.msg(2, &se)
+	}
+	for _, l := range b.locList {
+		var le, line encoder
+		le.uint(1, l.id)
+		le.uint(3, l.addr)
+		line.uint(1, l.fn)
+		line.int(2, int64(l.line))
+		le.msg(4, &line)
+		p.msg(4, &le)
+	}
+	for _, f := range b.funcList {
+		var fe encoder
+		fe.uint(1, f.id)
+		fe.uint(2, f.name)
+		fe.uint(3, f.name)
+		fe.uint(4, f.file)
+		p.msg(5, &fe)
+	}
+	if len(b.comments) > 0 {
+		p.packedInts(13, b.comments)
+	}
+	// The string table must be written last because the other
+	// messages may have added to it.
+	for _, s := range b.strings {
+		p.bytes(6, []byte(s))
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(p.buf); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// encoder encodes protobuf messages.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) varint(x uint64) {
+	for x >= 0x80 {
+		e.buf = append(e.buf, byte(x)|0x80)
+		x >>= 7
+	}
+	e.buf = append(e.buf, byte(x))
+}
+
+func (e *encoder) key(field, wireType int) {
+	e.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (e *encoder) uint(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	e.key(field, 0)
+	e.varint(x)
+}
+
+func (e *encoder) int(field int, x int64) {
+	e.uint(field, uint64(x))
+}
+
+func (e *encoder) bytes(field int, b []byte) {
+	e.key(field, 2)
+	e.varint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) msg(field int, m *encoder) {
+	e.bytes(field, m.buf)
+}
+
+func (e *encoder) packedUints(field int, xs []uint64) {
+	var p encoder
+	for _, x := range xs {
+		p.varint(x)
+	}
+	e.bytes(field, p.buf)
+}
+
+func (e *encoder) packedInts(field int, xs []int64) {
+	var p encoder
+	for _, x := range xs {
+		p.varint(uint64(x))
+	}
+	e.bytes(field, p.buf)
+}
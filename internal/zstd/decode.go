@@ -0,0 +1,595 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package zstd implements the Zstandard compression format described
+// in RFC 8878.
+//
+// The decoder supports the full format except dictionaries. The
+// encoder favors simplicity over compression ratio: it finds matches
+// with a single hash table and encodes them with the predefined FSE
+// tables, leaving literals uncompressed.
+//
+// Both sides work on streams that arrive in pieces, as in the
+// compressed records of "perf record -z" profiles, where a single
+// frame spans many records.
+//
+// This is a separate implementation rather than a dependency so that
+// perffile stays free of cgo (which wrapping libzstd requires) and of
+// a general-purpose compression module much larger than the subset
+// perf uses.
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	frameMagic     = 0xfd2fb528
+	skippableMask  = 0xfffffff0
+	skippableMagic = 0x184d2a50
+
+	maxBlockSize = 128 << 10
+
+	// maxWindowSize is the largest window the decoder accepts.
+	// The format allows larger windows, but the reference
+	// implementation rejects them by default too.
+	maxWindowSize = 1 << 27
+)
+
+// ErrCorrupt is wrapped by errors for malformed input.
+var ErrCorrupt = errors.New("corrupt zstd stream")
+
+func corrupt(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...))
+}
+
+// A Decoder decompresses a zstd stream that may arrive in pieces.
+type Decoder struct {
+	// MaxOutput, if non-zero, limits the number of bytes a single
+	// call to Decode may produce, to guard against input that
+	// decompresses to an unreasonable size.
+	MaxOutput int
+
+	in  []byte // Buffered input
+	err error
+
+	state      decoderState
+	skip       int64 // Bytes left of a skippable frame
+	windowSize int
+	checksum   bool
+	hash       xxhash64
+
+	// hist is the decompressed data of the current frame,
+	// trimmed to the window size.
+	hist []byte
+
+	// Entropy tables and repeat offsets carried between the
+	// blocks of a frame.
+	huff          huffTable
+	llT, ofT, mlT []fseEntry
+	rep           [3]int
+
+	lits []byte
+	seqs []seq
+}
+
+type decoderState int
+
+const (
+	stateMagic decoderState = iota
+	stateFrameHeader
+	stateBlock
+	stateChecksum
+	stateSkip
+)
+
+// NewDecoder returns a new Decoder.
+func NewDecoder() *Decoder {
+	return &Decoder{}
+}
+
+// Decode decompresses src, which continues the stream passed to
+// earlier calls, and appends the decompressed data to dst. Data that
+// doesn't yet form a complete block is buffered until later calls
+// complete it.
+//
+// Once Decode returns an error, all later calls return that error.
+func (d *Decoder) Decode(dst, src []byte) ([]byte, error) {
+	if d.err != nil {
+		return dst, d.err
+	}
+	d.in = append(d.in, src...)
+	in := d.in
+	produced := 0
+	for d.err == nil {
+		n, out, err := d.step(in)
+		if err != nil {
+			d.err = err
+			break
+		}
+		if n == 0 {
+			// Need more input.
+			break
+		}
+		in = in[n:]
+		dst = append(dst, out...)
+		produced += len(out)
+		if d.MaxOutput > 0 && produced > d.MaxOutput {
+			d.err = fmt.Errorf("zstd stream decompresses to more than %d bytes", d.MaxOutput)
+		}
+	}
+	d.in = append(d.in[:0], in...)
+	return dst, d.err
+}
+
+// Pending reports whether the Decoder has buffered input that it
+// couldn't decode yet, or is in the middle of a frame.
+func (d *Decoder) Pending() bool {
+	return len(d.in) > 0 || d.state != stateMagic
+}
+
+// step decodes the next unit of the stream from in. It returns the
+// number of bytes consumed, which is 0 if in doesn't contain the
+// whole unit, and any decompressed data.
+func (d *Decoder) step(in []byte) (int, []byte, error) {
+	switch d.state {
+	case stateMagic:
+		if len(in) < 4 {
+			return 0, nil, nil
+		}
+		magic := binary.LittleEndian.Uint32(in)
+		if magic&skippableMask == skippableMagic {
+			if len(in) < 8 {
+				return 0, nil, nil
+			}
+			d.skip = int64(binary.LittleEndian.Uint32(in[4:]))
+			if d.skip > 0 {
+				d.state = stateSkip
+			}
+			return 8, nil, nil
+		}
+		if magic != frameMagic {
+			return 0, nil, corrupt("bad magic number %#x", magic)
+		}
+		d.state = stateFrameHeader
+		return 4, nil, nil
+
+	case stateSkip:
+		if len(in) == 0 {
+			return 0, nil, nil
+		}
+		n := len(in)
+		if int64(n) > d.skip {
+			n = int(d.skip)
+		}
+		d.skip -= int64(n)
+		if d.skip == 0 {
+			d.state = stateMagic
+		}
+		return n, nil, nil
+
+	case stateFrameHeader:
+		return d.frameHeader(in)
+
+	case stateBlock:
+		return d.block(in)
+
+	case stateChecksum:
+		if len(in) < 4 {
+			return 0, nil, nil
+		}
+		if binary.LittleEndian.Uint32(in) != uint32(d.hash.sum()) {
+			return 0, nil, corrupt("checksum mismatch")
+		}
+		d.state = stateMagic
+		return 4, nil, nil
+	}
+	panic("bad decoder state")
+}
+
+// frameHeader decodes a frame header. See RFC 8878, section 3.1.1.1.
+func (d *Decoder) frameHeader(in []byte) (int, []byte, error) {
+	if len(in) < 1 {
+		return 0, nil, nil
+	}
+	desc := in[0]
+	fcsSize := [4]int{0, 2, 4, 8}[desc>>6]
+	single := desc&(1<<5) != 0
+	if desc&(1<<3) != 0 {
+		return 0, nil, corrupt("reserved frame header bit set")
+	}
+	dictSize := [4]int{0, 1, 2, 4}[desc&3]
+	if single && fcsSize == 0 {
+		fcsSize = 1
+	}
+	n := 1 + dictSize + fcsSize
+	if !single {
+		n++
+	}
+	if len(in) < n {
+		return 0, nil, nil
+	}
+	pos := 1
+	var window uint64
+	if !single {
+		wd := in[pos]
+		pos++
+		exp, mantissa := wd>>3, wd&7
+		base := uint64(1) << (10 + exp)
+		window = base + base/8*uint64(mantissa)
+	}
+	var dictID uint32
+	for i := 0; i < dictSize; i++ {
+		dictID |= uint32(in[pos+i]) << (8 * i)
+	}
+	pos += dictSize
+	if dictID != 0 {
+		return 0, nil, fmt.Errorf("zstd dictionaries are not supported")
+	}
+	if single {
+		var fcs uint64
+		for i := 0; i < fcsSize; i++ {
+			fcs |= uint64(in[pos+i]) << (8 * i)
+		}
+		if fcsSize == 2 {
+			fcs += 256
+		}
+		window = fcs
+	}
+	if window > maxWindowSize {
+		return 0, nil, fmt.Errorf("zstd window size %d too large", window)
+	}
+
+	d.windowSize = int(window)
+	d.checksum = desc&(1<<2) != 0
+	d.hash.reset()
+	d.hist = d.hist[:0]
+	d.huff = huffTable{}
+	d.llT, d.ofT, d.mlT = nil, nil, nil
+	d.rep = [3]int{1, 4, 8}
+	d.state = stateBlock
+	return n, nil, nil
+}
+
+// block decodes a block. See RFC 8878, section 3.1.1.2.
+func (d *Decoder) block(in []byte) (int, []byte, error) {
+	if len(in) < 3 {
+		return 0, nil, nil
+	}
+	hdr := uint32(in[0]) | uint32(in[1])<<8 | uint32(in[2])<<16
+	last := hdr&1 != 0
+	typ := hdr >> 1 & 3
+	size := int(hdr >> 3)
+	maxSize := d.windowSize
+	if maxSize > maxBlockSize || maxSize == 0 {
+		maxSize = maxBlockSize
+	}
+	if size > maxSize {
+		return 0, nil, corrupt("block size %d too large", size)
+	}
+
+	start := len(d.hist)
+	var n int
+	switch typ {
+	case 0: // Raw
+		n = 3 + size
+		if len(in) < n {
+			return 0, nil, nil
+		}
+		d.hist = append(d.hist, in[3:n]...)
+	case 1: // RLE
+		n = 4
+		if len(in) < n {
+			return 0, nil, nil
+		}
+		for i := 0; i < size; i++ {
+			d.hist = append(d.hist, in[3])
+		}
+	case 2: // Compressed
+		n = 3 + size
+		if len(in) < n {
+			return 0, nil, nil
+		}
+		if err := d.compressedBlock(in[3:n]); err != nil {
+			return 0, nil, err
+		}
+	default:
+		return 0, nil, corrupt("reserved block type")
+	}
+
+	out := d.hist[start:]
+	if d.checksum {
+		d.hash.write(out)
+	}
+	if last {
+		if d.checksum {
+			d.state = stateChecksum
+		} else {
+			d.state = stateMagic
+		}
+	}
+
+	// Keep only the window. Trim lazily to amortize copying.
+	if len(d.hist) > 2*d.windowSize+maxBlockSize {
+		keep := d.windowSize
+		if keep < len(out) {
+			keep = len(out)
+		}
+		k := copy(d.hist, d.hist[len(d.hist)-keep:])
+		d.hist = d.hist[:k]
+		out = d.hist[k-len(out):]
+	}
+	return n, out, nil
+}
+
+// A seq is a decoded sequence.
+type seq struct {
+	litLen, matchLen, offset int
+}
+
+// compressedBlock decodes a compressed block and appends its contents
+// to d.hist. See RFC 8878, section 3.1.1.3.
+func (d *Decoder) compressedBlock(data []byte) error {
+	n, err := d.readLiterals(data)
+	if err != nil {
+		return err
+	}
+	data = data[n:]
+	if err := d.readSequences(data); err != nil {
+		return err
+	}
+
+	// Execute the sequences.
+	lits := d.lits
+	for _, s := range d.seqs {
+		if s.litLen > len(lits) {
+			return corrupt("literal length exceeds literals")
+		}
+		d.hist = append(d.hist, lits[:s.litLen]...)
+		lits = lits[s.litLen:]
+		if s.offset > len(d.hist) || s.offset > d.windowSize && d.windowSize > 0 {
+			return corrupt("match offset %d out of range", s.offset)
+		}
+		pos := len(d.hist) - s.offset
+		if s.offset >= s.matchLen {
+			d.hist = append(d.hist, d.hist[pos:pos+s.matchLen]...)
+		} else {
+			// Overlapping match.
+			for i := 0; i < s.matchLen; i++ {
+				d.hist = append(d.hist, d.hist[pos+i])
+			}
+		}
+	}
+	d.hist = append(d.hist, lits...)
+	return nil
+}
+
+// readSequences decodes the sequences section in data into d.seqs.
+func (d *Decoder) readSequences(data []byte) error {
+	d.seqs = d.seqs[:0]
+	if len(data) < 1 {
+		return corrupt("missing sequences section")
+	}
+	var nseqs int
+	switch b0 := int(data[0]); {
+	case b0 == 0:
+		if len(data) != 1 {
+			return corrupt("data after empty sequences section")
+		}
+		return nil
+	case b0 < 128:
+		nseqs, data = b0, data[1:]
+	case b0 < 255:
+		if len(data) < 2 {
+			return corrupt("truncated sequences header")
+		}
+		nseqs, data = (b0-128)<<8|int(data[1]), data[2:]
+	default:
+		if len(data) < 3 {
+			return corrupt("truncated sequences header")
+		}
+		nseqs, data = int(data[1])|int(data[2])<<8+0x7f00, data[3:]
+	}
+	if len(data) < 1 {
+		return corrupt("truncated sequences header")
+	}
+	modes := data[0]
+	if modes&3 != 0 {
+		return corrupt("reserved sequence mode bits set")
+	}
+	data = data[1:]
+
+	var err error
+	var n int
+	if d.llT, n, err = readSeqTable(data, modes>>6, d.llT, llCodes); err != nil {
+		return err
+	}
+	data = data[n:]
+	if d.ofT, n, err = readSeqTable(data, modes>>4&3, d.ofT, ofCodes); err != nil {
+		return err
+	}
+	data = data[n:]
+	if d.mlT, n, err = readSeqTable(data, modes>>2&3, d.mlT, mlCodes); err != nil {
+		return err
+	}
+	data = data[n:]
+
+	br, err := newReverseBitReader(data)
+	if err != nil {
+		return err
+	}
+	readState := func(t []fseEntry) uint32 {
+		v, _ := br.read(uint(logOf(len(t))))
+		return v
+	}
+	llState := readState(d.llT)
+	ofState := readState(d.ofT)
+	mlState := readState(d.mlT)
+	for i := 0; i < nseqs; i++ {
+		llCode := d.llT[llState].sym
+		ofCode := d.ofT[ofState].sym
+		mlCode := d.mlT[mlState].sym
+		if int(llCode) >= len(llBase) || int(mlCode) >= len(mlBase) || ofCode > 31 {
+			return corrupt("bad sequence code")
+		}
+
+		v, _ := br.read(uint(ofCode))
+		offsetValue := 1<<ofCode + int(v)
+		v, _ = br.read(uint(mlBits[mlCode]))
+		matchLen := int(mlBase[mlCode]) + int(v)
+		v, _ = br.read(uint(llBits[llCode]))
+		litLen := int(llBase[llCode]) + int(v)
+
+		// Resolve repeat offsets. See RFC 8878, section
+		// 3.1.1.5.
+		var offset int
+		if offsetValue > 3 {
+			offset = offsetValue - 3
+			d.rep = [3]int{offset, d.rep[0], d.rep[1]}
+		} else {
+			idx := offsetValue
+			if litLen == 0 {
+				idx++
+			}
+			switch idx {
+			case 1:
+				offset = d.rep[0]
+			case 2:
+				offset = d.rep[1]
+				d.rep[0], d.rep[1] = d.rep[1], d.rep[0]
+			case 3:
+				offset = d.rep[2]
+				d.rep = [3]int{offset, d.rep[0], d.rep[1]}
+			case 4:
+				offset = d.rep[0] - 1
+				if offset == 0 {
+					return corrupt("zero repeat offset")
+				}
+				d.rep = [3]int{offset, d.rep[0], d.rep[1]}
+			}
+		}
+		d.seqs = append(d.seqs, seq{litLen, matchLen, offset})
+
+		if i < nseqs-1 {
+			e := d.llT[llState]
+			v, _ := br.read(uint(e.bits))
+			llState = uint32(e.base) + v
+			e = d.mlT[mlState]
+			v, _ = br.read(uint(e.bits))
+			mlState = uint32(e.base) + v
+			e = d.ofT[ofState]
+			v, _ = br.read(uint(e.bits))
+			ofState = uint32(e.base) + v
+		}
+	}
+	if !br.done() {
+		return corrupt("sequence bit stream not fully consumed")
+	}
+	return nil
+}
+
+// A seqCodes describes one of the three sequence symbol types.
+type seqCodes struct {
+	maxSym, maxLog int
+	predef         []fseEntry
+}
+
+// readSeqTable reads the FSE table for a sequence symbol type with
+// mode mode from data. prev is the previous block's table. It returns
+// the table and the number of bytes consumed.
+func readSeqTable(data []byte, mode uint8, prev []fseEntry, c *seqCodes) ([]fseEntry, int, error) {
+	switch mode {
+	case 0: // Predefined
+		return c.predef, 0, nil
+	case 1: // RLE
+		if len(data) < 1 {
+			return nil, 0, corrupt("truncated RLE sequence table")
+		}
+		if int(data[0]) > c.maxSym {
+			return nil, 0, corrupt("bad RLE sequence symbol")
+		}
+		return rleFSE(data[0]), 1, nil
+	case 2: // FSE compressed
+		counts, accuracyLog, n, err := readFSECounts(data, c.maxSym, c.maxLog)
+		if err != nil {
+			return nil, 0, err
+		}
+		t, err := buildFSE(counts, accuracyLog)
+		return t, n, err
+	default: // Repeat
+		if prev == nil {
+			return nil, 0, corrupt("repeated sequence table without a previous table")
+		}
+		return prev, 0, nil
+	}
+}
+
+// logOf returns the accuracy log of an FSE table of size n.
+func logOf(n int) int {
+	l := 0
+	for 1<<l < n {
+		l++
+	}
+	return l
+}
+
+// Baselines and extra bits of literal length and match length codes.
+// See RFC 8878, section 3.1.1.3.2.1.1.
+var (
+	llBase = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	llBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	mlBase = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	mlBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+// Predefined distributions. See RFC 8878, section 3.1.1.3.2.2.
+var (
+	llDefault = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	mlDefault = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+	ofDefault = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+
+	llCodes = &seqCodes{35, 9, mustBuildFSE(llDefault, 6)}
+	ofCodes = &seqCodes{31, 8, mustBuildFSE(ofDefault, 5)}
+	mlCodes = &seqCodes{52, 9, mustBuildFSE(mlDefault, 6)}
+)
+
+func mustBuildFSE(counts []int16, accuracyLog int) []fseEntry {
+	t, err := buildFSE(counts, accuracyLog)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
@@ -0,0 +1,326 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	// encWindowLog is the log of the window size the Encoder
+	// declares in its frame header and limits match offsets to.
+	encWindowLog = 20
+	encWindow    = 1 << encWindowLog
+
+	hashLog  = 16
+	minMatch = 4
+)
+
+// An Encoder compresses a stream into a single zstd frame. Each call
+// to Encode emits complete blocks, so everything passed to Encode so
+// far can be decoded from its output without waiting for the rest of
+// the stream.
+type Encoder struct {
+	started bool
+
+	// hist holds the most recent input, which matches may refer
+	// to. hist[0] is at position base in the stream.
+	hist []byte
+	base int
+
+	// table maps the hash of 4 bytes to one more than the stream
+	// position where they last occurred, or 0.
+	table []int
+
+	seqs []seq
+	bw   bitWriter
+}
+
+// NewEncoder returns a new Encoder.
+func NewEncoder() *Encoder {
+	return &Encoder{table: make([]int, 1<<hashLog)}
+}
+
+// Encode compresses src, which continues the stream passed to earlier
+// calls, and appends the result to dst. The first call also emits the
+// frame header.
+func (e *Encoder) Encode(dst, src []byte) []byte {
+	if !e.started {
+		e.started = true
+		// The magic number, then a frame header with no
+		// content size, checksum, or dictionary, and a window
+		// descriptor for a 1 MiB window.
+		var hdr [6]byte
+		binary.LittleEndian.PutUint32(hdr[:], frameMagic)
+		hdr[5] = (encWindowLog - 10) << 3
+		dst = append(dst, hdr[:]...)
+	}
+
+	// Drop history that's out of the window.
+	if len(e.hist) > 2*encWindow {
+		drop := len(e.hist) - encWindow
+		n := copy(e.hist, e.hist[drop:])
+		e.hist = e.hist[:n]
+		e.base += drop
+	}
+
+	for len(src) > 0 {
+		n := len(src)
+		if n > maxBlockSize {
+			n = maxBlockSize
+		}
+		start := len(e.hist)
+		e.hist = append(e.hist, src[:n]...)
+		src = src[n:]
+		dst = e.block(dst, start)
+	}
+	return dst
+}
+
+// Close ends the frame and appends the end to dst.
+func (e *Encoder) Close(dst []byte) []byte {
+	if !e.started {
+		dst = e.Encode(dst, nil)
+	}
+	// An empty, last raw block.
+	return append(dst, 1, 0, 0)
+}
+
+// block appends a block encoding e.hist[start:].
+func (e *Encoder) block(dst []byte, start int) []byte {
+	lits := e.findSequences(start)
+	if len(e.seqs) == 0 {
+		return rawBlock(dst, e.hist[start:])
+	}
+
+	hdr := len(dst)
+	dst = append(dst, 0, 0, 0)
+	dst = appendRawLiterals(dst, lits)
+	dst = e.appendSequences(dst)
+	size := len(dst) - hdr - 3
+	if size >= len(e.hist)-start {
+		// Compression didn't help.
+		return rawBlock(dst[:hdr], e.hist[start:])
+	}
+	putBlockHeader(dst[hdr:], 2, size)
+	return dst
+}
+
+func rawBlock(dst, data []byte) []byte {
+	var hdr [3]byte
+	putBlockHeader(hdr[:], 0, len(data))
+	dst = append(dst, hdr[:]...)
+	return append(dst, data...)
+}
+
+func putBlockHeader(b []byte, typ uint32, size int) {
+	v := typ<<1 | uint32(size)<<3
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// findSequences finds matches for e.hist[start:] and stores them in
+// e.seqs. It returns the literals of the block.
+func (e *Encoder) findSequences(start int) []byte {
+	e.seqs = e.seqs[:0]
+	var lits []byte
+	h := e.hist
+	lit := start
+	for i := start; i+minMatch <= len(h); {
+		v := binary.LittleEndian.Uint32(h[i:])
+		slot := v * 2654435761 >> (32 - hashLog)
+		cand := e.table[slot] - 1 - e.base
+		e.table[slot] = e.base + i + 1
+		if cand < 0 || i-cand > encWindow || binary.LittleEndian.Uint32(h[cand:]) != v {
+			i++
+			continue
+		}
+		n := minMatch
+		for i+n < len(h) && h[cand+n] == h[i+n] {
+			n++
+		}
+		lits = append(lits, h[lit:i]...)
+		e.seqs = append(e.seqs, seq{litLen: i - lit, matchLen: n, offset: i - cand})
+		i += n
+		lit = i
+	}
+	return append(lits, h[lit:]...)
+}
+
+func appendRawLiterals(dst, lits []byte) []byte {
+	n := len(lits)
+	switch {
+	case n < 32:
+		dst = append(dst, byte(n<<3))
+	case n < 4096:
+		dst = append(dst, byte(1<<2|n<<4), byte(n>>4))
+	default:
+		dst = append(dst, byte(3<<2|n<<4), byte(n>>4), byte(n>>12))
+	}
+	return append(dst, lits...)
+}
+
+// appendSequences appends the sequences section for e.seqs, using
+// the predefined FSE tables. See RFC 8878, section 3.1.1.3.2.
+func (e *Encoder) appendSequences(dst []byte) []byte {
+	n := len(e.seqs)
+	switch {
+	case n < 128:
+		dst = append(dst, byte(n))
+	case n < 0x7f00:
+		dst = append(dst, byte(n>>8+128), byte(n))
+	default:
+		dst = append(dst, 255, byte(n-0x7f00), byte((n-0x7f00)>>8))
+	}
+	// All three tables use predefined mode.
+	dst = append(dst, 0)
+
+	// Sequences are encoded last to first, so the decoder reads
+	// them first to last.
+	bw := &e.bw
+	bw.reset(dst)
+	var llS, ofS, mlS fseEncState
+	for i := n - 1; i >= 0; i-- {
+		s := e.seqs[i]
+		llCode := lengthCode(s.litLen, llBase[:])
+		mlCode := lengthCode(s.matchLen, mlBase[:])
+		ofValue := s.offset + 3
+		ofCode := uint8(bits.Len(uint(ofValue)) - 1)
+		if i == n-1 {
+			llS.init(llEnc, llCode)
+			mlS.init(mlEnc, mlCode)
+			ofS.init(ofEnc, ofCode)
+		} else {
+			ofS.encode(bw, ofCode)
+			mlS.encode(bw, mlCode)
+			llS.encode(bw, llCode)
+		}
+		bw.add(uint64(s.litLen-int(llBase[llCode])), uint(llBits[llCode]))
+		bw.add(uint64(s.matchLen-int(mlBase[mlCode])), uint(mlBits[mlCode]))
+		bw.add(uint64(ofValue-1<<ofCode), uint(ofCode))
+	}
+	mlS.flush(bw)
+	ofS.flush(bw)
+	llS.flush(bw)
+	return bw.close()
+}
+
+// lengthCode returns the literal or match length code for v given
+// the code baselines.
+func lengthCode(v int, base []uint32) uint8 {
+	c := len(base) - 1
+	for int(base[c]) > v {
+		c--
+	}
+	return uint8(c)
+}
+
+// An fseEnc is an FSE encoding table. See the reference
+// implementation's FSE_buildCTable.
+type fseEnc struct {
+	accuracyLog uint
+	states      []uint16 // next states, indexed by cumulative count
+	syms        []fseSymEnc
+}
+
+type fseSymEnc struct {
+	deltaBits      uint32
+	deltaFindState int32
+}
+
+func buildFSEEnc(counts []int16, accuracyLog int) *fseEnc {
+	spread, ok := fseSpread(counts, accuracyLog)
+	if !ok {
+		panic("bad FSE counts")
+	}
+	size := 1 << accuracyLog
+	cumul := make([]int, len(counts)+1)
+	for s, c := range counts {
+		if c == -1 {
+			c = 1
+		}
+		cumul[s+1] = cumul[s] + int(c)
+	}
+	t := &fseEnc{accuracyLog: uint(accuracyLog), states: make([]uint16, size), syms: make([]fseSymEnc, len(counts))}
+	next := append([]int(nil), cumul...)
+	for u, s := range spread {
+		t.states[next[s]] = uint16(size + u)
+		next[s]++
+	}
+	for s, c := range counts {
+		switch {
+		case c == 0:
+		case c == -1 || c == 1:
+			t.syms[s] = fseSymEnc{uint32(accuracyLog<<16 - size), int32(cumul[s] - 1)}
+		default:
+			maxBits := accuracyLog - (bits.Len(uint(c-1)) - 1)
+			minState := int(c) << maxBits
+			t.syms[s] = fseSymEnc{uint32(maxBits<<16 - minState), int32(cumul[s] - int(c))}
+		}
+	}
+	return t
+}
+
+var (
+	llEnc = buildFSEEnc(llDefault, 6)
+	ofEnc = buildFSEEnc(ofDefault, 5)
+	mlEnc = buildFSEEnc(mlDefault, 6)
+)
+
+// An fseEncState is the state of an FSE encoder.
+type fseEncState struct {
+	t     *fseEnc
+	state uint32
+}
+
+func (s *fseEncState) init(t *fseEnc, sym uint8) {
+	se := t.syms[sym]
+	nbits := (se.deltaBits + 1<<15) >> 16
+	v := nbits<<16 - se.deltaBits
+	*s = fseEncState{t, uint32(t.states[int32(v>>nbits)+se.deltaFindState])}
+}
+
+func (s *fseEncState) encode(bw *bitWriter, sym uint8) {
+	se := s.t.syms[sym]
+	nbits := (s.state + se.deltaBits) >> 16
+	bw.add(uint64(s.state), uint(nbits))
+	s.state = uint32(s.t.states[int32(s.state>>nbits)+se.deltaFindState])
+}
+
+func (s *fseEncState) flush(bw *bitWriter) {
+	bw.add(uint64(s.state), s.t.accuracyLog)
+}
+
+// A bitWriter writes a zstd backward bit stream, which is read
+// starting from the last bit written.
+type bitWriter struct {
+	out []byte
+	acc uint64
+	n   uint
+}
+
+func (bw *bitWriter) reset(out []byte) {
+	*bw = bitWriter{out: out}
+}
+
+// add writes the low n bits of v, where n <= 32.
+func (bw *bitWriter) add(v uint64, n uint) {
+	bw.acc |= (v & (1<<n - 1)) << bw.n
+	bw.n += n
+	for bw.n >= 8 {
+		bw.out = append(bw.out, byte(bw.acc))
+		bw.acc >>= 8
+		bw.n -= 8
+	}
+}
+
+// close writes the end marker and returns the output.
+func (bw *bitWriter) close() []byte {
+	bw.add(1, 1)
+	if bw.n > 0 {
+		bw.out = append(bw.out, byte(bw.acc))
+	}
+	return bw.out
+}
@@ -0,0 +1,253 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zstd
+
+import "math/bits"
+
+// An fseEntry is one state of an FSE decoding table. Decoding from
+// a state produces sym, then moves to state base plus the next bits
+// bits of the stream.
+type fseEntry struct {
+	sym  uint8
+	bits uint8
+	base uint16
+}
+
+// readFSECounts reads an FSE table description from the start of
+// data. It returns the normalized counts of each symbol, where -1
+// means "less than 1", the accuracy log, and the number of bytes
+// consumed. See RFC 8878, section 4.1.1.
+func readFSECounts(data []byte, maxSym, maxLog int) (counts []int16, accuracyLog int, n int, err error) {
+	br := forwardBitReader{data: data}
+	accuracyLog = int(br.read(4)) + 5
+	if accuracyLog > maxLog {
+		return nil, 0, 0, corrupt("FSE accuracy log %d too large", accuracyLog)
+	}
+	remaining := (1 << accuracyLog) + 1
+	threshold := 1 << accuracyLog
+	nbits := accuracyLog + 1
+	counts = make([]int16, 0, maxSym+1)
+	prev0 := false
+	for remaining > 1 {
+		if br.overrun() {
+			return nil, 0, 0, corrupt("truncated FSE table")
+		}
+		if prev0 {
+			// A zero count is followed by 2-bit repeat
+			// counts of further zeros.
+			for {
+				r := br.read(2)
+				for i := uint32(0); i < r; i++ {
+					counts = append(counts, 0)
+				}
+				if r != 3 || br.overrun() {
+					break
+				}
+			}
+		}
+		if len(counts) > maxSym {
+			return nil, 0, 0, corrupt("too many FSE symbols")
+		}
+		max := uint32(2*threshold - 1 - remaining)
+		var count int
+		if v := br.peek(uint(nbits - 1)); v < max {
+			count = int(v)
+			br.skip(uint(nbits - 1))
+		} else {
+			v = br.peek(uint(nbits))
+			br.skip(uint(nbits))
+			count = int(v)
+			if count >= threshold {
+				count -= int(max)
+			}
+		}
+		count--
+		if count < 0 {
+			remaining--
+		} else {
+			remaining -= count
+		}
+		counts = append(counts, int16(count))
+		prev0 = count == 0
+		for remaining < threshold {
+			nbits--
+			threshold >>= 1
+		}
+	}
+	if remaining != 1 || br.overrun() {
+		return nil, 0, 0, corrupt("bad FSE table")
+	}
+	return counts, accuracyLog, br.bytesRead(), nil
+}
+
+// fseSpread returns the symbol of each state of an FSE table with
+// the given normalized counts, which is shared by the encoder and
+// decoder.
+func fseSpread(counts []int16, accuracyLog int) ([]uint8, bool) {
+	size := 1 << accuracyLog
+	syms := make([]uint8, size)
+	high := size - 1
+	for s, c := range counts {
+		if c == -1 {
+			syms[high] = uint8(s)
+			high--
+		}
+	}
+	pos, step, mask := 0, (size>>1)+(size>>3)+3, size-1
+	for s, c := range counts {
+		for i := 0; i < int(c); i++ {
+			syms[pos] = uint8(s)
+			for {
+				pos = (pos + step) & mask
+				if pos <= high {
+					break
+				}
+			}
+		}
+	}
+	// Every state must have been filled exactly once.
+	return syms, pos == 0
+}
+
+// buildFSE builds an FSE decoding table from normalized counts.
+func buildFSE(counts []int16, accuracyLog int) ([]fseEntry, error) {
+	syms, ok := fseSpread(counts, accuracyLog)
+	if !ok {
+		return nil, corrupt("bad FSE counts")
+	}
+	next := make([]int, len(counts))
+	for s, c := range counts {
+		if c == -1 {
+			next[s] = 1
+		} else {
+			next[s] = int(c)
+		}
+	}
+	size := 1 << accuracyLog
+	table := make([]fseEntry, size)
+	for i, s := range syms {
+		n := next[s]
+		next[s]++
+		nbits := accuracyLog - (bits.Len(uint(n)) - 1)
+		table[i] = fseEntry{sym: s, bits: uint8(nbits), base: uint16(n<<nbits - size)}
+	}
+	return table, nil
+}
+
+// rleFSE returns an FSE decoding table that always produces sym.
+func rleFSE(sym uint8) []fseEntry {
+	return []fseEntry{{sym: sym}}
+}
+
+// A forwardBitReader reads bits from a byte slice starting with the
+// least significant bit of the first byte.
+type forwardBitReader struct {
+	data []byte
+	pos  uint // bit position
+}
+
+func (br *forwardBitReader) peek(n uint) uint32 {
+	var v uint32
+	for i := uint(0); i < n; i++ {
+		p := br.pos + i
+		if int(p/8) < len(br.data) {
+			v |= uint32(br.data[p/8]>>(p%8)&1) << i
+		}
+	}
+	return v
+}
+
+func (br *forwardBitReader) skip(n uint) {
+	br.pos += n
+}
+
+func (br *forwardBitReader) read(n uint) uint32 {
+	v := br.peek(n)
+	br.skip(n)
+	return v
+}
+
+func (br *forwardBitReader) overrun() bool {
+	return int(br.pos) > 8*len(br.data)
+}
+
+func (br *forwardBitReader) bytesRead() int {
+	return int((br.pos + 7) / 8)
+}
+
+// A reverseBitReader reads a zstd backward bit stream. The stream is
+// read starting from the most significant bit of the last byte,
+// after the highest 1 bit, which marks the end of the stream.
+type reverseBitReader struct {
+	data []byte
+	off  int    // bytes data[:off] have not been loaded into bits
+	bits uint64 // the low cnt bits are unread
+	cnt  uint
+}
+
+func newReverseBitReader(data []byte) (reverseBitReader, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return reverseBitReader{}, corrupt("missing bit stream end marker")
+	}
+	last := data[len(data)-1]
+	br := reverseBitReader{data: data, off: len(data) - 1, bits: uint64(last), cnt: uint(bits.Len8(last) - 1)}
+	br.fill()
+	return br, nil
+}
+
+func (br *reverseBitReader) fill() {
+	for br.cnt <= 56 && br.off > 0 {
+		br.off--
+		br.bits = br.bits<<8 | uint64(br.data[br.off])
+		br.cnt += 8
+	}
+}
+
+// read reads n bits, where n <= 32. If fewer than n bits remain, the
+// missing low bits are zero and ok is false.
+func (br *reverseBitReader) read(n uint) (v uint32, ok bool) {
+	if n == 0 {
+		return 0, true
+	}
+	if br.cnt < n {
+		br.fill()
+		if br.cnt < n {
+			v = uint32(br.bits<<(n-br.cnt)) & (1<<n - 1)
+			br.cnt = 0
+			return v, false
+		}
+	}
+	br.cnt -= n
+	v = uint32(br.bits>>br.cnt) & (1<<n - 1)
+	return v, true
+}
+
+// peek returns the next n bits without consuming them, padding with
+// zero bits past the end of the stream.
+func (br *reverseBitReader) peek(n uint) uint32 {
+	if br.cnt < n {
+		br.fill()
+		if br.cnt < n {
+			return uint32(br.bits<<(n-br.cnt)) & (1<<n - 1)
+		}
+	}
+	return uint32(br.bits>>(br.cnt-n)) & (1<<n - 1)
+}
+
+// skip consumes n bits previously returned by peek. It reports
+// whether that many bits remained.
+func (br *reverseBitReader) skip(n uint) bool {
+	if br.cnt < n {
+		br.cnt = 0
+		return false
+	}
+	br.cnt -= n
+	return true
+}
+
+// done reports whether the stream has been read exactly.
+func (br *reverseBitReader) done() bool {
+	return br.cnt == 0 && br.off == 0
+}
@@ -0,0 +1,301 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const maxHuffBits = 11
+
+// A huffEntry is an entry in a Huffman decoding table, which is
+// indexed by the next maxBits bits of the stream.
+type huffEntry struct {
+	sym  uint8
+	bits uint8
+}
+
+type huffTable struct {
+	entries []huffEntry
+	maxBits uint
+}
+
+// readLiterals decodes the literals section at the start of data
+// into d.lits. It returns the number of bytes consumed. See RFC 8878,
+// section 3.1.1.3.1.
+func (d *Decoder) readLiterals(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, corrupt("missing literals section")
+	}
+	typ := data[0] & 3
+	sizeFormat := data[0] >> 2 & 3
+
+	if typ == 0 || typ == 1 {
+		// Raw or RLE literals.
+		var size, hdrLen int
+		switch sizeFormat {
+		case 0, 2:
+			size, hdrLen = int(data[0]>>3), 1
+		case 1:
+			if len(data) < 2 {
+				return 0, corrupt("truncated literals header")
+			}
+			size, hdrLen = int(data[0]>>4)|int(data[1])<<4, 2
+		case 3:
+			if len(data) < 3 {
+				return 0, corrupt("truncated literals header")
+			}
+			size, hdrLen = int(data[0]>>4)|int(data[1])<<4|int(data[2])<<12, 3
+		}
+		if size > maxBlockSize {
+			return 0, corrupt("literals too large")
+		}
+		if typ == 0 {
+			if len(data) < hdrLen+size {
+				return 0, corrupt("truncated literals")
+			}
+			d.lits = append(d.lits[:0], data[hdrLen:hdrLen+size]...)
+			return hdrLen + size, nil
+		}
+		if len(data) < hdrLen+1 {
+			return 0, corrupt("truncated literals")
+		}
+		d.lits = d.lits[:0]
+		for i := 0; i < size; i++ {
+			d.lits = append(d.lits, data[hdrLen])
+		}
+		return hdrLen + 1, nil
+	}
+
+	// Huffman-coded literals, either with a new table (type 2)
+	// or the previous block's table (type 3).
+	var regen, comp, hdrLen int
+	streams := 4
+	switch sizeFormat {
+	case 0, 1:
+		if len(data) < 3 {
+			return 0, corrupt("truncated literals header")
+		}
+		if sizeFormat == 0 {
+			streams = 1
+		}
+		v := int(data[0]>>4) | int(data[1])<<4 | int(data[2])<<12
+		regen, comp, hdrLen = v&0x3ff, v>>10, 3
+	case 2:
+		if len(data) < 4 {
+			return 0, corrupt("truncated literals header")
+		}
+		v := int(data[0]>>4) | int(data[1])<<4 | int(data[2])<<12 | int(data[3])<<20
+		regen, comp, hdrLen = v&0x3fff, v>>14, 4
+	case 3:
+		if len(data) < 5 {
+			return 0, corrupt("truncated literals header")
+		}
+		v := int(data[0]>>4) | int(data[1])<<4 | int(data[2])<<12 | int(data[3])<<20 | int(data[4])<<28
+		regen, comp, hdrLen = v&0x3ffff, v>>18, 5
+	}
+	if regen > maxBlockSize {
+		return 0, corrupt("literals too large")
+	}
+	if len(data) < hdrLen+comp {
+		return 0, corrupt("truncated literals")
+	}
+	in := data[hdrLen : hdrLen+comp]
+	if typ == 2 {
+		n, err := d.readHuffTable(in)
+		if err != nil {
+			return 0, err
+		}
+		in = in[n:]
+	} else if d.huff.entries == nil {
+		return 0, corrupt("treeless literals without a previous Huffman table")
+	}
+
+	d.lits = d.lits[:0]
+	if streams == 1 {
+		if err := d.huff.decode(&d.lits, in, regen); err != nil {
+			return 0, err
+		}
+		return hdrLen + comp, nil
+	}
+	if len(in) < 6 {
+		return 0, corrupt("truncated literals jump table")
+	}
+	var sizes [4]int
+	sizes[0] = int(binary.LittleEndian.Uint16(in[0:]))
+	sizes[1] = int(binary.LittleEndian.Uint16(in[2:]))
+	sizes[2] = int(binary.LittleEndian.Uint16(in[4:]))
+	sizes[3] = len(in) - 6 - sizes[0] - sizes[1] - sizes[2]
+	if sizes[3] < 0 {
+		return 0, corrupt("bad literals jump table")
+	}
+	in = in[6:]
+	each := (regen + 3) / 4
+	for i, size := range sizes {
+		n := each
+		if i == 3 {
+			n = regen - 3*each
+		}
+		if n < 0 {
+			return 0, corrupt("bad literals size")
+		}
+		if err := d.huff.decode(&d.lits, in[:size], n); err != nil {
+			return 0, err
+		}
+		in = in[size:]
+	}
+	return hdrLen + comp, nil
+}
+
+// readHuffTable reads a Huffman tree description from the start of
+// data into d.huff and returns the number of bytes consumed. See RFC
+// 8878, section 4.2.1.
+func (d *Decoder) readHuffTable(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, corrupt("missing Huffman table")
+	}
+	var weights [256]uint8
+	var nweights, n int
+	if hdr := int(data[0]); hdr < 128 {
+		// FSE-compressed weights.
+		if len(data) < 1+hdr {
+			return 0, corrupt("truncated Huffman table")
+		}
+		in := data[1 : 1+hdr]
+		counts, accuracyLog, cn, err := readFSECounts(in, 255, 6)
+		if err != nil {
+			return 0, err
+		}
+		table, err := buildFSE(counts, accuracyLog)
+		if err != nil {
+			return 0, err
+		}
+		if nweights, err = decodeWeights(weights[:], table, accuracyLog, in[cn:]); err != nil {
+			return 0, err
+		}
+		n = 1 + hdr
+	} else {
+		// Weights stored directly as 4-bit values.
+		nweights = hdr - 127
+		n = 1 + (nweights+1)/2
+		if len(data) < n {
+			return 0, corrupt("truncated Huffman table")
+		}
+		for i := 0; i < nweights; i++ {
+			b := data[1+i/2]
+			if i%2 == 0 {
+				weights[i] = b >> 4
+			} else {
+				weights[i] = b & 15
+			}
+		}
+	}
+
+	// The weight of the last symbol is implied by the others.
+	total := 0
+	for _, w := range weights[:nweights] {
+		if w > maxHuffBits {
+			return 0, corrupt("bad Huffman weight")
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return 0, corrupt("empty Huffman table")
+	}
+	maxBits := bits.Len(uint(total))
+	if maxBits > maxHuffBits {
+		return 0, corrupt("Huffman table too deep")
+	}
+	rest := 1<<maxBits - total
+	if rest&(rest-1) != 0 {
+		return 0, corrupt("bad Huffman weights")
+	}
+	weights[nweights] = uint8(bits.Len(uint(rest)))
+	nweights++
+
+	// Assign codes in order of increasing weight, then symbol.
+	var start [maxHuffBits + 2]int
+	for _, w := range weights[:nweights] {
+		if w > 0 {
+			start[w] += 1 << (w - 1)
+		}
+	}
+	next := 0
+	for w := 1; w <= maxHuffBits+1; w++ {
+		next, start[w] = next+start[w], next
+	}
+	entries := make([]huffEntry, 1<<maxBits)
+	for sym, w := range weights[:nweights] {
+		if w == 0 {
+			continue
+		}
+		e := huffEntry{sym: uint8(sym), bits: uint8(maxBits + 1 - int(w))}
+		for i := 0; i < 1<<(w-1); i++ {
+			entries[start[w]+i] = e
+		}
+		start[w] += 1 << (w - 1)
+	}
+	d.huff = huffTable{entries, uint(maxBits)}
+	return n, nil
+}
+
+// decodeWeights decodes FSE-compressed Huffman weights, which use
+// two interleaved FSE states.
+func decodeWeights(weights []uint8, table []fseEntry, accuracyLog int, data []byte) (int, error) {
+	br, err := newReverseBitReader(data)
+	if err != nil {
+		return 0, err
+	}
+	v1, ok1 := br.read(uint(accuracyLog))
+	v2, ok2 := br.read(uint(accuracyLog))
+	if !ok1 || !ok2 {
+		return 0, corrupt("truncated Huffman weights")
+	}
+	state := [2]uint32{v1, v2}
+	n := 0
+	for i := 0; ; i ^= 1 {
+		if n >= 255 {
+			return 0, corrupt("too many Huffman weights")
+		}
+		e := table[state[i]]
+		weights[n] = e.sym
+		n++
+		v, ok := br.read(uint(e.bits))
+		state[i] = uint32(e.base) + v
+		if !ok {
+			// The stream is exhausted. The other state
+			// holds the last weight.
+			if n >= 255 {
+				return 0, corrupt("too many Huffman weights")
+			}
+			weights[n] = table[state[i^1]].sym
+			n++
+			return n, nil
+		}
+	}
+}
+
+// decode appends n symbols decoded from the backward bit stream data
+// to out.
+func (t *huffTable) decode(out *[]byte, data []byte, n int) error {
+	br, err := newReverseBitReader(data)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		e := t.entries[br.peek(t.maxBits)]
+		if !br.skip(uint(e.bits)) {
+			return corrupt("truncated Huffman stream")
+		}
+		*out = append(*out, e.sym)
+	}
+	if !br.done() {
+		return corrupt("Huffman stream not fully consumed")
+	}
+	return nil
+}
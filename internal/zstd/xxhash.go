@@ -0,0 +1,104 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// xxhash64 computes the XXH64 hash with seed 0, which zstd uses for
+// frame checksums. See https://github.com/Cyan4973/xxHash.
+type xxhash64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	nbuf  int
+}
+
+const (
+	prime64_1 = 11400714785074694791
+	prime64_2 = 14029467366897019727
+	prime64_3 = 1609587929392839161
+	prime64_4 = 9650029242287828579
+	prime64_5 = 2870177450012600261
+)
+
+func (h *xxhash64) reset() {
+	*h = xxhash64{}
+	p1, p2 := uint64(prime64_1), uint64(prime64_2)
+	h.v = [4]uint64{p1 + p2, p2, 0, -p1}
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * prime64_2
+	return bits.RotateLeft64(acc, 31) * prime64_1
+}
+
+func xxMerge(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*prime64_1 + prime64_4
+}
+
+func (h *xxhash64) write(p []byte) {
+	h.total += uint64(len(p))
+	if h.nbuf > 0 {
+		n := copy(h.buf[h.nbuf:], p)
+		h.nbuf += n
+		p = p[n:]
+		if h.nbuf < 32 {
+			return
+		}
+		h.stripes(h.buf[:])
+		h.nbuf = 0
+	}
+	n := len(p) &^ 31
+	h.stripes(p[:n])
+	h.nbuf = copy(h.buf[:], p[n:])
+}
+
+func (h *xxhash64) stripes(p []byte) {
+	for ; len(p) >= 32; p = p[32:] {
+		for i := range h.v {
+			h.v[i] = xxRound(h.v[i], binary.LittleEndian.Uint64(p[8*i:]))
+		}
+	}
+}
+
+func (h *xxhash64) sum() uint64 {
+	var x uint64
+	if h.total >= 32 {
+		v := h.v
+		x = bits.RotateLeft64(v[0], 1) + bits.RotateLeft64(v[1], 7) + bits.RotateLeft64(v[2], 12) + bits.RotateLeft64(v[3], 18)
+		for _, vi := range v {
+			x = xxMerge(x, vi)
+		}
+	} else {
+		x = prime64_5
+	}
+	x += h.total
+
+	p := h.buf[:h.nbuf]
+	for ; len(p) >= 8; p = p[8:] {
+		x ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		x = bits.RotateLeft64(x, 27)*prime64_1 + prime64_4
+	}
+	if len(p) >= 4 {
+		x ^= uint64(binary.LittleEndian.Uint32(p)) * prime64_1
+		x = bits.RotateLeft64(x, 23)*prime64_2 + prime64_3
+		p = p[4:]
+	}
+	for _, b := range p {
+		x ^= uint64(b) * prime64_5
+		x = bits.RotateLeft64(x, 11) * prime64_1
+	}
+
+	x ^= x >> 33
+	x *= prime64_2
+	x ^= x >> 29
+	x *= prime64_3
+	x ^= x >> 32
+	return x
+}
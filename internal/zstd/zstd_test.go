@@ -0,0 +1,228 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zstd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sampleText() []byte {
+	var buf bytes.Buffer
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&buf, "sample %d: the quick brown fox jumps over %d lazy dogs\n", i, i*i%97)
+	}
+	return buf.Bytes()
+}
+
+// sampleZstd is sampleText compressed by "zstd -19 --check", which
+// uses Huffman-coded literals, FSE-compressed sequence tables, and a
+// checksum.
+var sampleZstd = strings.Join(strings.Fields(`
+	28b52ffd640140e51800ca423c081a5035a8e40f253d94f45012a8aa4a6bb95b
+	56444aeceecc8859039a00710071003ad9f50a11641e1e99ccb8115b3f941794
+	143cb7672aa347e1f28cd9452121e49409918b6382af39daa869a8ef19498296
+	e3d38d8dcd481618fe4c08e9cd86de96fe189ac2829c9cb8cc16439d50ba4e0c
+	d2bc9e574cc7c2ead9490050800004051c68b081000d1c8483090cb80082030a
+	2270c082050e3280e080830730806082010e182040010b24383020810a0e0208
+	0706341081030250108cd1c20a3e44cc7b9986485d4a34a4bdb0312baf3a7474
+	8ec3a9d8f404a53248cae347dc021bdfcc4c260b7b130bd1f51cbbe95a1be65f
+	8cd1240a6291a1783553e2a44990f4dd5034aee3adc9d882a587a05e13446ebc
+	166333f586d7d70ca5b334261dc5cd8a87211f642661d88fb601db640d6f2626
+	ebc2dc6c21b43e8cbdf4512bf22d4668aa8250e41497e620f13311a9bb6035ac
+	f7ca0c61b1df9a5f5e5ff1d08bef7edd0a8f7dcc9957a6f66862d8e938d28966
+	61c4cb3c1217212d41a632e8af951e84bdfb7108f1d8e1b0ac9ea11bf3267f82
+	e54770429271d811d3c6187fe7a63ce65bf1f7e5b5075de1fd7cc6928979cc98
+	b75373341b6aba30d2cbc84444cb1c12af9094209349c208e2dfed5817b3761f
+	0e510f1d9e65f24c70e3b14d7c24644730426a7818f662aa18438cee292f8d71
+	2fd19096a5ac21ea2534e6e487168ecc31382d6dd2334a623050fe3e138254a8
+	2228f5edff1b32e7b475121841e087702b84e0ef17360e1037153b9823a81a7c
+	c1336a083883bee2c453b7e2310523c9b9e0d8086b8e9e21c39a5d71b38034d2
+	3968cf494506082ce5ca63a2a479ba8a9e01a6c997f68a172f5f5d412e267323
+	789f145979324445938073c68a0a730cf678eb9134bc7d698008b483ec1c78d4
+	f22d9465cd32300394a5c6c9e2385c7217383052222b9e1639a1e335036bb7aa
+	7df6d0d9ab6767951d5f991c2b4e24b861e35746732467901e93938ce9fa423e
+	85058cf3ab7615c42d78a0850d086051e34e190c91e9613b7e8a859909317d03
+	438417b918c99335dd1dc232442150c14b9574edb04dba0c57dd321d1dec962e
+	2e5661c0a115e60ee961
+`), "")
+
+// decodeChunks decodes src by passing it to Decode in pieces of size
+// chunk.
+func decodeChunks(src []byte, chunk int) ([]byte, error) {
+	d := NewDecoder()
+	var out []byte
+	var err error
+	for i := 0; i < len(src) && err == nil; i += chunk {
+		j := i + chunk
+		if j > len(src) {
+			j = len(src)
+		}
+		out, err = d.Decode(out, src[i:j])
+	}
+	if err == nil && d.Pending() {
+		err = errors.New("stream ended mid-frame")
+	}
+	return out, err
+}
+
+func TestDecode(t *testing.T) {
+	src, err := hex.DecodeString(sampleZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sampleText()
+	for _, chunk := range []int{len(src), 100, 1} {
+		got, err := decodeChunks(src, chunk)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", chunk, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("chunk %d: got %q, want %q", chunk, got, want)
+		}
+	}
+
+	// Corrupting the content must be caught, at the latest by
+	// the checksum.
+	for i := 10; i < len(src); i += 37 {
+		bad := append([]byte(nil), src...)
+		bad[i] ^= 0x10
+		if got, err := decodeChunks(bad, len(bad)); err == nil && bytes.Equal(got, want) {
+			t.Errorf("corrupting byte %d not detected", i)
+		}
+	}
+}
+
+func testInputs() map[string][]byte {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 300<<10)
+	r.Read(random)
+	// Text with matches far apart, across blocks.
+	long := bytes.Repeat(sampleText(), 40)
+	// Random runs separated by repeats of earlier runs.
+	var mixed []byte
+	for len(mixed) < 1<<20 {
+		if len(mixed) > 0 && r.Intn(2) == 0 {
+			off := r.Intn(len(mixed))
+			n := r.Intn(1000)
+			if off+n > len(mixed) {
+				n = len(mixed) - off
+			}
+			mixed = append(mixed, mixed[off:off+n]...)
+		} else {
+			mixed = append(mixed, random[:r.Intn(100)]...)
+		}
+	}
+	return map[string][]byte{
+		"empty":  nil,
+		"byte":   []byte("x"),
+		"text":   sampleText(),
+		"zeros":  make([]byte, 200<<10),
+		"random": random,
+		"long":   long,
+		"mixed":  mixed,
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, data := range testInputs() {
+		for _, chunk := range []int{1 << 30, 1000, 3} {
+			if chunk == 3 && len(data) > 20000 {
+				continue
+			}
+			e := NewEncoder()
+			var enc []byte
+			for i := 0; i < len(data); i += chunk {
+				j := i + chunk
+				if j > len(data) {
+					j = len(data)
+				}
+				enc = e.Encode(enc, data[i:j])
+
+				// Everything encoded so far must be
+				// decodable without the rest.
+				if chunk == 1000 && i%(64*chunk) == 0 {
+					got, err := NewDecoder().Decode(nil, enc)
+					if err != nil || !bytes.Equal(got, data[:j]) {
+						t.Fatalf("%s: prefix of %d bytes: err %v, got %d bytes", name, j, err, len(got))
+					}
+				}
+			}
+			enc = e.Close(enc)
+			got, err := decodeChunks(enc, 777)
+			if err != nil {
+				t.Fatalf("%s, chunk %d: %v", name, chunk, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%s, chunk %d: round trip mismatch", name, chunk)
+			}
+		}
+	}
+}
+
+func TestMaxOutput(t *testing.T) {
+	enc := NewEncoder().Encode(nil, make([]byte, 100<<10))
+	d := NewDecoder()
+	d.MaxOutput = 10 << 10
+	if _, err := d.Decode(nil, enc); err == nil {
+		t.Fatal("want error for output over MaxOutput")
+	}
+}
+
+// TestInterop checks the encoder and decoder against the zstd
+// command, if it's installed.
+func TestInterop(t *testing.T) {
+	zstd, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd command not found")
+	}
+	dir := t.TempDir()
+	for name, data := range testInputs() {
+		in := filepath.Join(dir, name)
+		if err := os.WriteFile(in, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+		for _, level := range []string{"-1", "-3", "-19", "--ultra", "--long"} {
+			args := []string{"-q", "-c", "--check", level}
+			if level == "--ultra" {
+				args = append(args, "-22")
+			}
+			args = append(args, in)
+			enc, err := exec.Command(zstd, args...).Output()
+			if err != nil {
+				t.Fatalf("zstd %v: %v", args, err)
+			}
+			for _, chunk := range []int{len(enc) + 1, 1000} {
+				got, err := decodeChunks(enc, chunk)
+				if err != nil {
+					t.Fatalf("%s %s: %v", name, level, err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Fatalf("%s %s: mismatch", name, level)
+				}
+			}
+		}
+
+		e := NewEncoder()
+		ours := e.Close(e.Encode(nil, data))
+		cmd := exec.Command(zstd, "-q", "-d", "-c")
+		cmd.Stdin = bytes.NewReader(ours)
+		got, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: zstd -d: %v", name, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s: zstd -d output mismatch", name)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jitdump
+
+import "debug/elf"
+
+// magic is the jitdump magic number, "JiTD" in big endian.
+const magic = 0x4A695444
+
+// headerSize is the size of the on-disk file header.
+const headerSize = 40
+
+// A Header is the header of a jitdump file.
+type Header struct {
+	// Version is the format version. Writers always write
+	// version 1.
+	Version uint32
+
+	// Machine is the ELF machine architecture of the JIT code.
+	Machine elf.Machine
+
+	// PID is the process ID of the JIT runtime.
+	PID int
+
+	// Timestamp is the time the file was created.
+	Timestamp uint64
+
+	Flags Flags
+}
+
+// Flags are flags in a jitdump file header.
+type Flags uint64
+
+const (
+	// FlagArchTimestamp indicates that timestamps use an
+	// architecture-specific clock, such as TSC on x86, rather
+	// than the profile's clock.
+	FlagArchTimestamp Flags = 1 << iota
+)
+
+// A RecordType is the type of a jitdump record.
+type RecordType uint32
+
+const (
+	RecordTypeCodeLoad RecordType = iota
+	RecordTypeCodeMove
+	RecordTypeDebugInfo
+	RecordTypeCodeClose
+	RecordTypeUnwindingInfo
+)
+
+// A Record is a single record in a jitdump file. Its concrete type
+// is one of the Record* types.
+type Record interface {
+	Type() RecordType
+	Common() *RecordCommon
+}
+
+// RecordCommon is the common prefix of all records.
+type RecordCommon struct {
+	// Timestamp is the time this record was emitted.
+	Timestamp uint64
+}
+
+func (r *RecordCommon) Common() *RecordCommon {
+	return r
+}
+
+// A RecordUnknown is a record of a type this package doesn't
+// understand.
+type RecordUnknown struct {
+	RecordCommon
+	RecordType RecordType
+	Data       []byte
+}
+
+func (r *RecordUnknown) Type() RecordType {
+	return r.RecordType
+}
+
+// A RecordCodeLoad records that a function was compiled and loaded
+// into memory.
+type RecordCodeLoad struct {
+	RecordCommon
+	PID, TID int
+
+	// VMA is the virtual address of the code. This is usually
+	// the same as CodeAddr.
+	VMA uint64
+
+	// CodeAddr is the address of the first byte of the code.
+	CodeAddr uint64
+
+	// CodeIndex uniquely identifies this code load.
+	CodeIndex uint64
+
+	// Name is the function name.
+	Name string
+
+	// Code is the generated code.
+	Code []byte
+}
+
+func (r *RecordCodeLoad) Type() RecordType {
+	return RecordTypeCodeLoad
+}
+
+// A RecordCodeMove records that previously loaded code moved.
+type RecordCodeMove struct {
+	RecordCommon
+	PID, TID int
+
+	VMA                      uint64
+	OldCodeAddr, NewCodeAddr uint64
+	CodeSize                 uint64
+	CodeIndex                uint64 // CodeIndex of the RecordCodeLoad
+}
+
+func (r *RecordCodeMove) Type() RecordType {
+	return RecordTypeCodeMove
+}
+
+// A RecordDebugInfo records the source line table for a function. It
+// precedes the RecordCodeLoad for the same code.
+type RecordDebugInfo struct {
+	RecordCommon
+
+	// CodeAddr is the address of the code this applies to.
+	CodeAddr uint64
+
+	Entries []DebugEntry
+}
+
+func (r *RecordDebugInfo) Type() RecordType {
+	return RecordTypeDebugInfo
+}
+
+// A DebugEntry maps a code address to a source location.
+type DebugEntry struct {
+	Addr    uint64
+	Line    int
+	Discrim int
+	File    string
+}
+
+// A RecordCodeClose records that the runtime is done writing the
+// file.
+type RecordCodeClose struct {
+	RecordCommon
+}
+
+func (r *RecordCodeClose) Type() RecordType {
+	return RecordTypeCodeClose
+}
+
+// A RecordUnwindingInfo records the unwinding information for the
+// following RecordCodeLoad.
+type RecordUnwindingInfo struct {
+	RecordCommon
+
+	// Data contains the .eh_frame_hdr followed by the .eh_frame
+	// data for the code.
+	Data []byte
+
+	// EHFrameHdrSize is the size of the .eh_frame_hdr at the
+	// start of Data.
+	EHFrameHdrSize uint64
+
+	// MappedSize is the size of the unwinding data mapped into
+	// the process.
+	MappedSize uint64
+}
+
+func (r *RecordUnwindingInfo) Type() RecordType {
+	return RecordTypeUnwindingInfo
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jitdump
+
+import (
+	"bytes"
+	"debug/elf"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	hdr := Header{Version: 1, Machine: elf.EM_X86_64, PID: 1234, Timestamp: 100}
+	recs := []Record{
+		&RecordDebugInfo{RecordCommon{101}, 0x1000, []DebugEntry{
+			{0x1000, 10, 0, "a.js"},
+			{0x1004, 11, 0, "a.js"},
+			{0x1008, 3, 1, "b.js"},
+		}},
+		&RecordUnwindingInfo{RecordCommon{102}, []byte{1, 2, 3}, 1, 3},
+		&RecordCodeLoad{RecordCommon{103}, 1234, 1235, 0x1000, 0x1000, 1, "hot", []byte{0x90, 0xc3}},
+		&RecordCodeMove{RecordCommon{104}, 1234, 1235, 0x2000, 0x1000, 0x2000, 2, 1},
+		&RecordCodeClose{RecordCommon{105}},
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, &hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range recs {
+		if err := w.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := New(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Header != hdr {
+		t.Errorf("header: got %+v, want %+v", f.Header, hdr)
+	}
+	rs := f.Records()
+	var got []Record
+	for rs.Next() {
+		got = append(got, rs.Record)
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, recs) {
+		t.Errorf("records: got %+v, want %+v", got, recs)
+	}
+}
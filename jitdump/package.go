@@ -0,0 +1,21 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package jitdump reads and writes perf jitdump files.
+//
+// A jitdump file describes code generated at run time by a JIT
+// compiler: where each function was loaded, where it moved, and
+// optionally its source line table and unwinding information. perf
+// uses these files to symbolize samples in JIT-compiled code.
+//
+// A runtime records its JIT code by creating a file named
+// "jit-<pid>.dump", writing it with a Writer, and mapping the first
+// page of the file with PROT_READ|PROT_EXEC so that the mmap is
+// recorded in the profile. The timestamps in the file must use the
+// same clock as the profile, which is typically CLOCK_MONOTONIC (see
+// "perf record -k").
+//
+// The format is described in
+// tools/perf/Documentation/jitdump-specification.txt.
+package jitdump // import "github.com/aclements/go-perf/jitdump"
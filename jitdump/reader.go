@@ -0,0 +1,234 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jitdump
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A File is a jitdump file.
+type File struct {
+	Header Header
+
+	// ByteOrder is the byte order of the file, which is the
+	// native byte order of the runtime that wrote it.
+	ByteOrder binary.ByteOrder
+
+	r      *bufio.Reader
+	closer io.Closer
+}
+
+// New reads a jitdump file from r.
+func New(r io.Reader) (*File, error) {
+	// See jit_open in tools/perf/util/jitdump.c.
+	f := &File{r: bufio.NewReader(r)}
+
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(f.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	switch {
+	case binary.LittleEndian.Uint32(hdr[:]) == magic:
+		f.ByteOrder = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[:]) == magic:
+		f.ByteOrder = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("bad jitdump magic %#x", hdr[:4])
+	}
+	bd := &decoder{hdr[4:], f.ByteOrder}
+	f.Header.Version = bd.u32()
+	size := bd.u32()
+	f.Header.Machine = elf.Machine(bd.u32())
+	bd.u32() // pad
+	f.Header.PID = int(bd.u32())
+	f.Header.Timestamp = bd.u64()
+	f.Header.Flags = Flags(bd.u64())
+	if size < headerSize {
+		return nil, fmt.Errorf("bad jitdump header size %d", size)
+	}
+	// Later versions may extend the header.
+	if _, err := f.r.Discard(int(size - headerSize)); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Open opens the named jitdump file.
+func Open(name string) (*File, error) {
+	r, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := New(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	f.closer = r
+	return f, nil
+}
+
+// Close closes the File. If the File was created using New directly
+// instead of Open, Close has no effect.
+func (f *File) Close() error {
+	var err error
+	if f.closer != nil {
+		err = f.closer.Close()
+		f.closer = nil
+	}
+	return err
+}
+
+// Records returns an iterator over the records in f. The records
+// are read from the underlying reader as they are iterated over, so
+// this can be called only once.
+func (f *File) Records() *Records {
+	return &Records{f: f}
+}
+
+// Records is an iterator over the records in a jitdump file.
+type Records struct {
+	// The current record. Determine which type of record this
+	// is using a type switch.
+	Record Record
+
+	f   *File
+	err error
+}
+
+// Err returns the first error encountered by Records.
+func (r *Records) Err() error {
+	return r.err
+}
+
+// Next fetches the next record into r.Record. It returns true if
+// successful and false if it reaches the end of the file or
+// encounters an error.
+func (r *Records) Next() bool {
+	if r.err != nil {
+		return false
+	}
+
+	var prefix [16]byte
+	if _, err := io.ReadFull(r.f.r, prefix[:]); err != nil {
+		if err != io.EOF {
+			r.err = err
+		}
+		return false
+	}
+	order := r.f.ByteOrder
+	typ := RecordType(order.Uint32(prefix[0:]))
+	size := order.Uint32(prefix[4:])
+	common := RecordCommon{order.Uint64(prefix[8:])}
+	if size < 16 {
+		r.err = fmt.Errorf("bad jitdump record size %d", size)
+		return false
+	}
+	buf := make([]byte, size-16)
+	if _, err := io.ReadFull(r.f.r, buf); err != nil {
+		r.err = err
+		return false
+	}
+
+	bd := &decoder{buf, order}
+	switch typ {
+	default:
+		r.Record = &RecordUnknown{common, typ, buf}
+
+	case RecordTypeCodeLoad:
+		o := &RecordCodeLoad{RecordCommon: common}
+		o.PID, o.TID = int(bd.u32()), int(bd.u32())
+		o.VMA, o.CodeAddr = bd.u64(), bd.u64()
+		codeSize := bd.u64()
+		o.CodeIndex = bd.u64()
+		o.Name = bd.cstring()
+		if codeSize > uint64(len(bd.buf)) {
+			r.err = fmt.Errorf("jitdump code load for %s has bad code size %d", o.Name, codeSize)
+			return false
+		}
+		o.Code = bd.buf[:codeSize]
+		r.Record = o
+
+	case RecordTypeCodeMove:
+		o := &RecordCodeMove{RecordCommon: common}
+		o.PID, o.TID = int(bd.u32()), int(bd.u32())
+		o.VMA = bd.u64()
+		o.OldCodeAddr, o.NewCodeAddr = bd.u64(), bd.u64()
+		o.CodeSize, o.CodeIndex = bd.u64(), bd.u64()
+		r.Record = o
+
+	case RecordTypeDebugInfo:
+		o := &RecordDebugInfo{RecordCommon: common}
+		o.CodeAddr = bd.u64()
+		n := bd.u64()
+		prevFile := ""
+		for i := uint64(0); i < n && len(bd.buf) > 0; i++ {
+			e := DebugEntry{
+				Addr:    bd.u64(),
+				Line:    int(int32(bd.u32())),
+				Discrim: int(int32(bd.u32())),
+				File:    bd.cstring(),
+			}
+			if e.File == "\xff" {
+				// Same file as the previous entry.
+				e.File = prevFile
+			}
+			prevFile = e.File
+			o.Entries = append(o.Entries, e)
+		}
+		r.Record = o
+
+	case RecordTypeCodeClose:
+		r.Record = &RecordCodeClose{common}
+
+	case RecordTypeUnwindingInfo:
+		o := &RecordUnwindingInfo{RecordCommon: common}
+		unwindingSize := bd.u64()
+		o.EHFrameHdrSize, o.MappedSize = bd.u64(), bd.u64()
+		if unwindingSize > uint64(len(bd.buf)) {
+			r.err = fmt.Errorf("jitdump unwinding info has bad size %d", unwindingSize)
+			return false
+		}
+		o.Data = bd.buf[:unwindingSize]
+		r.Record = o
+	}
+	return true
+}
+
+type decoder struct {
+	buf   []byte
+	order binary.ByteOrder
+}
+
+func (d *decoder) u32() uint32 {
+	x := d.order.Uint32(d.buf)
+	d.buf = d.buf[4:]
+	return x
+}
+
+func (d *decoder) u64() uint64 {
+	x := d.order.Uint64(d.buf)
+	d.buf = d.buf[8:]
+	return x
+}
+
+func (d *decoder) cstring() string {
+	i := bytes.IndexByte(d.buf, 0)
+	if i < 0 {
+		i = len(d.buf)
+		s := string(d.buf)
+		d.buf = d.buf[i:]
+		return s
+	}
+	s := string(d.buf[:i])
+	d.buf = d.buf[i+1:]
+	return s
+}
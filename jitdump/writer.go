@@ -0,0 +1,133 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jitdump
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A Writer writes a jitdump file.
+//
+// Files are always written in little endian byte order. perf reads
+// jitdump files in either byte order.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewWriter writes the jitdump file header hdr to w and returns a
+// Writer for writing records to w. hdr.Version is ignored.
+func NewWriter(w io.Writer, hdr *Header) (*Writer, error) {
+	jw := &Writer{w: w}
+	jw.u32(magic)
+	jw.u32(1) // version
+	jw.u32(headerSize)
+	jw.u32(uint32(hdr.Machine))
+	jw.u32(0) // pad
+	jw.u32(uint32(hdr.PID))
+	jw.u64(hdr.Timestamp)
+	jw.u64(uint64(hdr.Flags))
+	if err := jw.flush(); err != nil {
+		return nil, err
+	}
+	return jw, nil
+}
+
+// Write writes record r. r must be one of the Record* types.
+//
+// Runtimes should write the RecordDebugInfo and RecordUnwindingInfo
+// for a function before its RecordCodeLoad.
+func (w *Writer) Write(r Record) error {
+	w.u32(uint32(r.Type()))
+	w.u32(0) // size, filled in by flush
+	w.u64(r.Common().Timestamp)
+
+	switch r := r.(type) {
+	default:
+		w.buf = w.buf[:0]
+		return fmt.Errorf("unknown jitdump record type %T", r)
+
+	case *RecordUnknown:
+		w.bytes(r.Data)
+
+	case *RecordCodeLoad:
+		w.u32(uint32(r.PID))
+		w.u32(uint32(r.TID))
+		w.u64(r.VMA)
+		w.u64(r.CodeAddr)
+		w.u64(uint64(len(r.Code)))
+		w.u64(r.CodeIndex)
+		w.cstring(r.Name)
+		w.bytes(r.Code)
+
+	case *RecordCodeMove:
+		w.u32(uint32(r.PID))
+		w.u32(uint32(r.TID))
+		w.u64(r.VMA)
+		w.u64(r.OldCodeAddr)
+		w.u64(r.NewCodeAddr)
+		w.u64(r.CodeSize)
+		w.u64(r.CodeIndex)
+
+	case *RecordDebugInfo:
+		w.u64(r.CodeAddr)
+		w.u64(uint64(len(r.Entries)))
+		for i, e := range r.Entries {
+			w.u64(e.Addr)
+			w.u32(uint32(e.Line))
+			w.u32(uint32(e.Discrim))
+			if i > 0 && e.File == r.Entries[i-1].File {
+				// Abbreviate repeated file names.
+				w.cstring("\xff")
+			} else {
+				w.cstring(e.File)
+			}
+		}
+
+	case *RecordCodeClose:
+
+	case *RecordUnwindingInfo:
+		w.u64(uint64(len(r.Data)))
+		w.u64(r.EHFrameHdrSize)
+		w.u64(r.MappedSize)
+		w.bytes(r.Data)
+		// Pad the record to 8 bytes.
+		for len(w.buf)%8 != 0 {
+			w.buf = append(w.buf, 0)
+		}
+	}
+
+	binary.LittleEndian.PutUint32(w.buf[4:], uint32(len(w.buf)))
+	return w.flush()
+}
+
+func (w *Writer) flush() error {
+	_, err := w.w.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+func (w *Writer) u32(x uint32) {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], x)
+	w.buf = append(w.buf, tmp[:]...)
+}
+
+func (w *Writer) u64(x uint64) {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], x)
+	w.buf = append(w.buf, tmp[:]...)
+}
+
+func (w *Writer) bytes(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+func (w *Writer) cstring(s string) {
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, 0)
+}
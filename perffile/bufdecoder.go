@@ -124,3 +124,19 @@ func (b *bufDecoder) stringList() []string {
 	}
 	return out
 }
+
+// swapBitfield converts a 64-bit C bitfield from big endian layout to
+// little endian layout. Big endian compilers allocate bitfields
+// starting from the most significant bit, so simply byte-swapping the
+// word is not enough. widths gives the width of each field in
+// declaration order. Bits past the last field are dropped.
+func swapBitfield(x uint64, widths []int) uint64 {
+	var out uint64
+	off := 0
+	for _, w := range widths {
+		mask := uint64(1)<<uint(w) - 1
+		out |= (x >> uint(64-off-w) & mask) << uint(off)
+		off += w
+	}
+	return out
+}
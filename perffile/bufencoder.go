@@ -0,0 +1,91 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import "encoding/binary"
+
+// bufEncoder is the inverse of bufDecoder.
+type bufEncoder struct {
+	buf   []byte
+	order binary.ByteOrder
+}
+
+func (b *bufEncoder) bytes(x []byte) {
+	b.buf = append(b.buf, x...)
+}
+
+func (b *bufEncoder) zeros(n int) {
+	for i := 0; i < n; i++ {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+func (b *bufEncoder) u16(x uint16) {
+	var tmp [2]byte
+	b.order.PutUint16(tmp[:], x)
+	b.buf = append(b.buf, tmp[:]...)
+}
+
+func (b *bufEncoder) u32(x uint32) {
+	var tmp [4]byte
+	b.order.PutUint32(tmp[:], x)
+	b.buf = append(b.buf, tmp[:]...)
+}
+
+func (b *bufEncoder) i32(x int32) {
+	b.u32(uint32(x))
+}
+
+func (b *bufEncoder) u64(x uint64) {
+	var tmp [8]byte
+	b.order.PutUint64(tmp[:], x)
+	b.buf = append(b.buf, tmp[:]...)
+}
+
+func (b *bufEncoder) u64s(x []uint64) {
+	for _, v := range x {
+		b.u64(v)
+	}
+}
+
+// nameAlign is the alignment of strings in feature sections.
+const nameAlign = 64
+
+// paddedString writes str, NUL-terminated and padded with NULs to a
+// multiple of nameAlign bytes.
+func (b *bufEncoder) paddedString(str string) {
+	n := (len(str) + 1 + nameAlign - 1) &^ (nameAlign - 1)
+	b.buf = append(b.buf, str...)
+	b.zeros(n - len(str))
+}
+
+// lenString is the inverse of bufDecoder.lenString.
+func (b *bufEncoder) lenString(str string) {
+	// See do_write_string in tools/perf/util/header.c.
+	n := (len(str) + 1 + nameAlign - 1) &^ (nameAlign - 1)
+	b.u32(uint32(n))
+	b.paddedString(str)
+}
+
+// stringList is the inverse of bufDecoder.stringList.
+func (b *bufEncoder) stringList(strs []string) {
+	b.u32(uint32(len(strs)))
+	for _, str := range strs {
+		b.lenString(str)
+	}
+}
+
+// unswapBitfield is the inverse of swapBitfield. It converts a 64-bit
+// C bitfield from little endian layout to big endian layout.
+func unswapBitfield(x uint64, widths []int) uint64 {
+	var out uint64
+	off := 0
+	for _, w := range widths {
+		mask := uint64(1)<<uint(w) - 1
+		out |= (x >> uint(off) & mask) << uint(64-off-w)
+		off += w
+	}
+	return out
+}
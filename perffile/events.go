@@ -9,6 +9,8 @@ package perffile
 //go:generate stringer -type=EventHardwareID,EventSoftware,HWCache,HWCacheOp,HWCacheResult
 //go:generate bitstringer -type=BreakpointOp -strip=BreakpointOp
 
+import "fmt"
+
 // EventGeneric is a generic representation of a performance event.
 //
 // Any perf event can be represented by EventGeneric, but some
@@ -147,6 +149,11 @@ func (e EventSoftware) Generic() EventGeneric {
 //
 // The IDs of the tracepoint events are given by the
 // tracing/events/*/*/id files under debugfs.
+//
+// Dynamic probes, such as kprobes and uprobes defined with "perf
+// probe" or through tracefs, are also tracepoint events. Their
+// fetch-args are fields of the tracepoint's raw data, which can be
+// decoded using FileMeta.TracepointFormats.
 type EventTracepoint uint64
 
 func (e EventTracepoint) Generic() EventGeneric {
@@ -253,3 +260,71 @@ const (
 	BreakpointOpRW              = BreakpointOpR | BreakpointOpW
 	BreakpointOpX               = 4
 )
+
+// hardwareNames and softwareNames are perf's names for the generic
+// events.
+var hardwareNames = map[EventHardwareID]string{
+	EventHardwareIDCPUCycles:             "cycles",
+	EventHardwareIDInstructions:          "instructions",
+	EventHardwareIDCacheReferences:       "cache-references",
+	EventHardwareIDCacheMisses:           "cache-misses",
+	EventHardwareIDBranchInstructions:    "branches",
+	EventHardwareIDBranchMisses:          "branch-misses",
+	EventHardwareIDBusCycles:             "bus-cycles",
+	EventHardwareIDStalledCyclesFrontend: "stalled-cycles-frontend",
+	EventHardwareIDStalledCyclesBackend:  "stalled-cycles-backend",
+	EventHardwareIDRefCPUCycles:          "ref-cycles",
+}
+
+var softwareNames = map[EventSoftware]string{
+	EventSoftwareCPUClock:        "cpu-clock",
+	EventSoftwareTaskClock:       "task-clock",
+	EventSoftwarePageFaults:      "page-faults",
+	EventSoftwareContextSwitches: "context-switches",
+	EventSoftwareCPUMigrations:   "cpu-migrations",
+	EventSoftwarePageFaultsMin:   "minor-faults",
+	EventSoftwarePageFaultsMaj:   "major-faults",
+	EventSoftwareAlignmentFaults: "alignment-faults",
+	EventSoftwareEmulationFaults: "emulation-faults",
+	EventSoftwareDummy:           "dummy",
+	EventSoftwareBpfOutput:       "bpf-output",
+	EventSoftwareCGroupSwitches:  "cgroup-switches",
+}
+
+// Name returns perf's name for the event described by a, such as
+// "cycles", "page-faults:u", or "sched:sched_switch". The name has a
+// ":u" or ":k" modifier if the event counts only user or only kernel
+// code.
+//
+// tracepoints gives the names of tracepoint events, as returned by
+// FileMeta.TracepointFormats. It may be nil, in which case tracepoint
+// events are named by ID.
+func (a *EventAttr) Name(tracepoints map[EventTracepoint]*TracepointFormat) string {
+	var name string
+	switch ev := a.Event.(type) {
+	case EventHardware:
+		name = hardwareNames[ev.ID]
+	case EventSoftware:
+		name = softwareNames[ev]
+	case EventTracepoint:
+		if tf := tracepoints[ev]; tf != nil {
+			name = tf.String()
+		}
+	case EventRaw:
+		name = fmt.Sprintf("r%x", uint64(ev))
+	}
+	if name == "" {
+		name = fmt.Sprint(a.Event)
+	}
+
+	// Add the privilege level modifier.
+	user := a.Flags&EventFlagExcludeUser == 0
+	kernel := a.Flags&EventFlagExcludeKernel == 0
+	switch {
+	case user && !kernel:
+		name += ":u"
+	case kernel && !user:
+		name += ":k"
+	}
+	return name
+}
@@ -0,0 +1,31 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import "testing"
+
+func TestEventAttrName(t *testing.T) {
+	tracepoints := map[EventTracepoint]*TracepointFormat{
+		42: {ID: 42, System: "sched", Name: "sched_switch"},
+	}
+	tests := []struct {
+		event Event
+		flags EventFlags
+		want  string
+	}{
+		{EventHardware{ID: EventHardwareIDCPUCycles}, 0, "cycles"},
+		{EventHardware{ID: EventHardwareIDBranchMisses}, EventFlagExcludeKernel, "branch-misses:u"},
+		{EventSoftware(EventSoftwarePageFaultsMin), EventFlagExcludeUser, "minor-faults:k"},
+		{EventTracepoint(42), 0, "sched:sched_switch"},
+		{EventTracepoint(43), 0, "43"},
+		{EventRaw(0x1c0), 0, "r1c0"},
+	}
+	for _, test := range tests {
+		attr := &EventAttr{Event: test.event, Flags: test.flags}
+		if got := attr.Name(tracepoints); got != test.want {
+			t.Errorf("name of %v with flags %v is %q, want %q", test.event, test.flags, got, test.want)
+		}
+	}
+}
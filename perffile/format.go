@@ -77,12 +77,28 @@ const (
 	featureBranchStack
 	featurePMUMappings
 	featureGroupDesc
+	featureAuxtrace
+	featureStat
+	featureCache
+	featureSampleTime
+	featureMemTopology
+	featureClockID
+	featureDirFormat
+	featureBPFProgInfo
+	featureBPFBTF
+	featureCompressed
+	featureCPUPMUCaps
+	featureClockData
+	featureHybridTopology
+	featurePMUCaps
 )
 
 // perf_file_attr from tools/perf/util/header.c
 type fileAttr struct {
 	Attr EventAttr
 	IDs  fileSection // array of attrID, one per core/thread
+
+	raw []byte // on-disk perf_event_attr
 }
 
 // eventAttrV0 is on-disk version 0 of the perf_event_attr structure.
@@ -452,6 +468,21 @@ const (
 	eventFlagPreciseMask  = 0x3 << eventFlagPreciseShift
 )
 
+// eventFlagWidths gives the widths of the perf_event_attr bitfield
+// in declaration order. All flags are one bit except precise_ip.
+var eventFlagWidths = func() []int {
+	w := make([]int, 0, 64)
+	for bit := 0; bit < 64; bit++ {
+		if bit == eventFlagPreciseShift {
+			w = append(w, 2)
+			bit++
+		} else {
+			w = append(w, 1)
+		}
+	}
+	return w
+}()
+
 // An EventPrecision indicates the precision of instruction pointers
 // recorded by an event. This can vary depending on the exact method
 // used to capture IPs.
@@ -569,6 +600,9 @@ const (
 	recordTypeEventUpdate
 	recordTypeTimeConv
 	recordTypeHeaderFeature
+	recordTypeCompressed
+	recordTypeFinishedInit
+	recordTypeCompressed2
 )
 
 // PERF_RECORD_MISC_* from include/uapi/linux/perf_event.h
@@ -616,7 +650,9 @@ type Record interface {
 // some of these fields will be filled.
 type RecordCommon struct {
 	// Offset is the byte offset of this event in the perf.data
-	// file.
+	// file. In profiles with compressed records, this counts
+	// compressed records by their decompressed size, so it is
+	// the offset the event would have in the decompressed file.
 	Offset int64
 
 	// Format is a bit mask of SampleFormat* values that indicate
@@ -657,7 +693,8 @@ type RecordMmap struct {
 	// RecordCommon.PID and .TID will always be filled
 	RecordCommon
 
-	Data bool // from header.misc
+	CPUMode CPUMode // from header.misc
+	Data    bool    // from header.misc
 
 	// Addr and Len are the virtual address of the start of this
 	// mapping and its length in bytes.
@@ -866,6 +903,21 @@ type Namespace struct {
 	Dev, Inode uint64
 }
 
+// Indexes of namespaces in RecordNamespaces.Namespaces.
+//
+// These correspond to the *_NS_INDEX enum from
+// include/uapi/linux/perf_event.h
+const (
+	NamespaceNet = iota
+	NamespaceUTS
+	NamespaceIPC
+	NamespacePID
+	NamespaceUser
+	NamespaceMnt
+	NamespaceCGroup
+	NamespaceTime
+)
+
 // RecordKsymbol record kernel symbol register/unregister information, for
 // dynamically loaded or JITed kernel functions.
 type RecordKsymbol struct {
@@ -901,7 +953,7 @@ type KsymbolFlags uint64
 
 const (
 	// Ksymbol was unregistered.
-	KsymbolFlagUnregister KsymbolFlags = iota
+	KsymbolFlagUnregister KsymbolFlags = 1 << iota
 )
 
 // RecordBPFEvent records BPF program load/unload information.
@@ -1049,6 +1101,12 @@ type RecordSample struct {
 	// constant indicating the stack type for the following IPs.
 	Callchain []uint64 // if SampleFormatCallchain
 
+	// Raw is the raw data of the event. For tracepoint events,
+	// this can be decoded using FileMeta.TracepointFormats. The
+	// kernel pads this to 8 byte alignment, so it may be longer
+	// than the tracepoint's fields.
+	Raw []byte // if SampleFormatRaw
+
 	// BranchHWIndex is the low level index of the raw hardware branch
 	// record (e.g., LBR) for BranchStack[0].
 	//
@@ -1138,6 +1196,9 @@ func (r *RecordSample) String() string {
 	if f&SampleFormatCallchain != 0 {
 		s += fmt.Sprintf(" Callchain:%#x", r.Callchain)
 	}
+	if f&SampleFormatRaw != 0 {
+		s += fmt.Sprintf(" Raw:%x", r.Raw)
+	}
 	if f&SampleFormatBranchStack != 0 {
 		s += fmt.Sprintf(" BranchStack:%v", r.BranchStack)
 	}
@@ -1215,6 +1276,9 @@ func (r *RecordSample) Fields() []string {
 	if f&SampleFormatCallchain != 0 {
 		fs = append(fs, "Callchain")
 	}
+	if f&SampleFormatRaw != 0 {
+		fs = append(fs, "Raw")
+	}
 	if f&SampleFormatBranchStack != 0 {
 		fs = append(fs, "BranchStack")
 	}
@@ -1327,6 +1391,11 @@ const (
 	BranchFlagAbort
 )
 
+// branchFlagWidths gives the widths of the perf_branch_entry
+// bitfield in declaration order: mispred, predicted, in_tx, abort,
+// cycles, type, spec, new_type, priv.
+var branchFlagWidths = []int{1, 1, 1, 1, 16, 4, 2, 4, 3}
+
 type BranchType uint8
 
 //gendefs PERF_BR_* BranchType -omit-max
@@ -0,0 +1,60 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import "fmt"
+
+// HostInfo describes the machine that recorded this profile as a list
+// of "key: value" strings, omitting anything unknown. Profiles from
+// different machines often aren't comparable, so tools can attach
+// this to reports derived from the profile.
+//
+// This is limited to what perf records in the profile. In particular,
+// perf doesn't record the CPU frequency governor, microcode version,
+// or speculative execution mitigations.
+func (m *FileMeta) HostInfo() []string {
+	var out []string
+	add := func(key, val string) {
+		if val != "" {
+			out = append(out, key+": "+val)
+		}
+	}
+	add("hostname", m.Hostname)
+	add("os release", m.OSRelease)
+	add("arch", m.Arch)
+	add("cpu", m.CPUDesc)
+	add("cpuid", m.CPUID)
+	if m.CPUsAvail != 0 {
+		add("cpus", fmt.Sprintf("%d online, %d available", m.CPUsOnline, m.CPUsAvail))
+	}
+	if smt, ok := m.SMT(); ok {
+		if smt {
+			add("smt", "on")
+		} else {
+			add("smt", "off")
+		}
+	}
+	if m.TotalMem != 0 {
+		add("memory", fmt.Sprintf("%d MiB", m.TotalMem>>20))
+	}
+	add("perf version", m.Version)
+	return out
+}
+
+// SMT reports whether simultaneous multithreading was enabled on the
+// machine that recorded this profile, that is, whether any core had
+// more than one online hardware thread. ok is false if the CPU
+// topology is unknown.
+func (m *FileMeta) SMT() (smt, ok bool) {
+	if m.ThreadGroups == nil {
+		return false, false
+	}
+	for _, g := range m.ThreadGroups {
+		if len(g) > 1 {
+			return true, true
+		}
+	}
+	return false, true
+}
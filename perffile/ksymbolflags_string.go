@@ -6,10 +6,13 @@ import "strconv"
 
 func (i KsymbolFlags) String() string {
 	if i == 0 {
-		return "Unregister"
+		return "0"
 	}
 	s := ""
-	i &^= 0
+	if i&KsymbolFlagUnregister != 0 {
+		s += "Unregister|"
+	}
+	i &^= 1
 	if i == 0 {
 		return s[:len(s)-1]
 	}
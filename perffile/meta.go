@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"sort"
+	"strconv"
 )
 
 type FileMeta struct {
@@ -79,6 +81,26 @@ type FileMeta struct {
 	// Groups is the descriptions of each perf event group in this
 	// profile, or nil if unknown.
 	Groups []GroupDesc
+
+	// MemTopology describes the physical memory layout of the
+	// machine that recorded this profile, or nil if unknown.
+	MemTopology *MemTopology
+
+	// Compression describes how the records in this profile were
+	// compressed, or nil if they are not compressed. Records
+	// decompresses records transparently, and profiles written
+	// by this package are compressed if this is set.
+	Compression *Compression
+
+	// Caches describes the CPU caches of the machine that
+	// recorded this profile, or nil if unknown.
+	Caches []CacheInfo
+
+	// raw loads the contents of feature sections that don't have
+	// a parser, so they can be written back out unchanged.
+	// rawOrder is the byte order of these sections.
+	raw      map[feature]func() ([]byte, error)
+	rawOrder binary.ByteOrder
 }
 
 // A BuildIDInfo records the mapping between a single build ID and the
@@ -120,6 +142,95 @@ type GroupDesc struct {
 	NumMembers int
 }
 
+// A MemTopology describes how physical memory is divided among NUMA
+// nodes.
+//
+// Physical memory is divided into fixed-size blocks, each of which
+// belongs to one NUMA node. This corresponds to the memory block
+// devices in /sys/devices/system/memory.
+type MemTopology struct {
+	// BlockSize is the size in bytes of each memory block.
+	BlockSize uint64
+
+	// Nodes lists the NUMA nodes that have memory.
+	Nodes []MemNode
+}
+
+// A MemNode describes the physical memory of a single NUMA node.
+type MemNode struct {
+	// Node is the system identifier of this NUMA node.
+	Node int
+
+	// Size is the total size in bytes of memory in this node.
+	Size int64
+
+	// Blocks is a bitmap of the memory blocks in this node. Bit
+	// i%64 of Blocks[i/64] is set if the i'th memory block is in
+	// this node.
+	Blocks []uint64
+}
+
+// NodeOf returns the NUMA node containing physical address addr,
+// such as RecordSample.PhysAddr. If addr isn't in any known node, it
+// returns -1, false.
+func (t *MemTopology) NodeOf(addr uint64) (node int, ok bool) {
+	if t == nil || t.BlockSize == 0 {
+		return -1, false
+	}
+	block := addr / t.BlockSize
+	for _, n := range t.Nodes {
+		if block/64 < uint64(len(n.Blocks)) && n.Blocks[block/64]&(1<<(block%64)) != 0 {
+			return n.Node, true
+		}
+	}
+	return -1, false
+}
+
+// A CacheInfo describes a CPU cache.
+type CacheInfo struct {
+	Level int
+	Type  string // "Data", "Instruction", or "Unified"
+	Size  int64  // Size in bytes
+
+	LineSize   int // Line size in bytes
+	Sets, Ways int
+
+	// CPUs is the set of CPUs that share this cache.
+	CPUs CPUSet
+}
+
+// A Compression describes the compression of records in a profile
+// recorded with "perf record -z".
+type Compression struct {
+	Type  CompressionType
+	Level int // Compression level
+
+	// Ratio is the overall compression ratio achieved while
+	// recording.
+	Ratio int
+
+	// MmapLen is the size of the buffer each compressed record
+	// decompresses into.
+	MmapLen int
+}
+
+type CompressionType uint32
+
+const (
+	CompressionNone CompressionType = iota
+	CompressionZstd
+)
+
+func (t CompressionType) String() string {
+	switch t {
+	case CompressionNone:
+		return "none"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("CompressionType(%d)", uint32(t))
+}
+
 var featureParsers = map[feature]func(*FileMeta, bufDecoder) error{
 	featureBuildID:      (*FileMeta).parseBuildID,
 	featureHostname:     stringFeature("Hostname"),
@@ -135,11 +246,17 @@ var featureParsers = map[feature]func(*FileMeta, bufDecoder) error{
 	featureNUMATopology: (*FileMeta).parseNUMATopology,
 	featurePMUMappings:  (*FileMeta).parsePMUMappings,
 	featureGroupDesc:    (*FileMeta).parseGroupDesc,
+	featureMemTopology:  (*FileMeta).parseMemTopology,
+	featureCompressed:   (*FileMeta).parseCompressed,
+	featureCache:        (*FileMeta).parseCache,
 }
 
-func (m *FileMeta) parse(f feature, sec fileSection, r io.ReaderAt) error {
+func (m *FileMeta) parse(f feature, sec fileSection, r io.ReaderAt, order binary.ByteOrder) error {
 	parser := featureParsers[f]
 	if parser == nil {
+		// Some unparsed sections, like the tracing data, can
+		// be large, so load them only if they're needed.
+		m.addRaw(f, order, func() ([]byte, error) { return sec.data(r) })
 		return nil
 	}
 
@@ -148,10 +265,28 @@ func (m *FileMeta) parse(f feature, sec fileSection, r io.ReaderAt) error {
 	if err != nil {
 		return err
 	}
-	bd := bufDecoder{data, binary.LittleEndian}
+	return m.parseData(f, data, order)
+}
+
+// parseData parses the contents of feature section f.
+func (m *FileMeta) parseData(f feature, data []byte, order binary.ByteOrder) error {
+	parser := featureParsers[f]
+	if parser == nil {
+		m.addRaw(f, order, func() ([]byte, error) { return data, nil })
+		return nil
+	}
+	return parser(m, bufDecoder{data, order})
+}
 
-	// Parse the section.
-	return parser(m, bd)
+func (m *FileMeta) addRaw(f feature, order binary.ByteOrder, load func() ([]byte, error)) {
+	if f == featureReserved {
+		return
+	}
+	if m.raw == nil {
+		m.raw = make(map[feature]func() ([]byte, error))
+	}
+	m.raw[f] = load
+	m.rawOrder = order
 }
 
 func stringFeature(name string) func(*FileMeta, bufDecoder) error {
@@ -267,3 +402,313 @@ func (m *FileMeta) parseGroupDesc(bd bufDecoder) error {
 	}
 	return nil
 }
+
+func (m *FileMeta) parseMemTopology(bd bufDecoder) error {
+	// See write_mem_topology in tools/perf/util/header.c.
+	version := bd.u64()
+	if version != 1 {
+		return fmt.Errorf("unsupported memory topology version %d", version)
+	}
+	t := &MemTopology{BlockSize: bd.u64()}
+	count := bd.u64()
+	for i := uint64(0); i < count; i++ {
+		node := MemNode{
+			Node: int(bd.u64()),
+			Size: int64(bd.u64()),
+		}
+		nbits := bd.u64()
+		nwords := nbits/64 + (nbits%64+63)/64
+		if nwords > uint64(len(bd.buf)/8) {
+			return fmt.Errorf("memory topology node %d has %d blocks, but only %d bytes remain", node.Node, nbits, len(bd.buf))
+		}
+		node.Blocks = make([]uint64, nwords)
+		bd.u64s(node.Blocks)
+		t.Nodes = append(t.Nodes, node)
+	}
+	m.MemTopology = t
+	return nil
+}
+
+func (m *FileMeta) parseCompressed(bd bufDecoder) error {
+	// See write_compressed in tools/perf/util/header.c.
+	version := bd.u32()
+	if version != 0 {
+		return fmt.Errorf("unsupported compression header version %d", version)
+	}
+	m.Compression = &Compression{
+		Type:    CompressionType(bd.u32()),
+		Level:   int(bd.u32()),
+		Ratio:   int(bd.u32()),
+		MmapLen: int(bd.u32()),
+	}
+	return nil
+}
+
+func (m *FileMeta) parseCache(bd bufDecoder) error {
+	// See write_cache in tools/perf/util/header.c.
+	version := bd.u32()
+	if version != 1 {
+		return fmt.Errorf("unsupported cache info version %d", version)
+	}
+	count := bd.u32()
+	m.Caches = []CacheInfo{}
+	for i := uint32(0); i < count; i++ {
+		c := CacheInfo{
+			Level:    int(bd.u32()),
+			LineSize: int(bd.u32()),
+			Sets:     int(bd.u32()),
+			Ways:     int(bd.u32()),
+			Type:     bd.lenString(),
+		}
+		var err error
+		c.Size, err = parseCacheSize(bd.lenString())
+		if err != nil {
+			return err
+		}
+		c.CPUs, err = parseCPUSet(bd.lenString())
+		if err != nil {
+			return err
+		}
+		m.Caches = append(m.Caches, c)
+	}
+	return nil
+}
+
+// parseCacheSize parses a cache size from sysfs, such as "32K".
+func parseCacheSize(str string) (int64, error) {
+	shift := 0
+	if str != "" {
+		switch str[len(str)-1] {
+		case 'K':
+			shift = 10
+		case 'M':
+			shift = 20
+		case 'G':
+			shift = 30
+		}
+		if shift != 0 {
+			str = str[:len(str)-1]
+		}
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad cache size %q", str)
+	}
+	return n << uint(shift), nil
+}
+
+// featureEncoders are the inverses of featureParsers. Each returns
+// false if m doesn't have the information for that feature.
+//
+// Some sections contain information that FileMeta doesn't represent,
+// such as the per-CPU core and socket IDs in the CPU topology. These
+// are omitted when re-encoding, which perf accepts.
+var featureEncoders = map[feature]func(*FileMeta, *bufEncoder) bool{
+	featureBuildID:      (*FileMeta).encodeBuildID,
+	featureHostname:     stringFeatureEncoder("Hostname"),
+	featureOSRelease:    stringFeatureEncoder("OSRelease"),
+	featureVersion:      stringFeatureEncoder("Version"),
+	featureArch:         stringFeatureEncoder("Arch"),
+	featureNrCpus:       (*FileMeta).encodeNrCPUs,
+	featureCPUDesc:      stringFeatureEncoder("CPUDesc"),
+	featureCPUID:        stringFeatureEncoder("CPUID"),
+	featureTotalMem:     (*FileMeta).encodeTotalMem,
+	featureCmdline:      (*FileMeta).encodeCmdLine,
+	featureCPUTopology:  (*FileMeta).encodeCPUTopology,
+	featureNUMATopology: (*FileMeta).encodeNUMATopology,
+	featurePMUMappings:  (*FileMeta).encodePMUMappings,
+	featureGroupDesc:    (*FileMeta).encodeGroupDesc,
+	featureMemTopology:  (*FileMeta).encodeMemTopology,
+	featureCompressed:   (*FileMeta).encodeCompressed,
+	featureCache:        (*FileMeta).encodeCache,
+}
+
+// sections returns the encoded feature sections of m in byte order
+// order. This includes both the sections represented by FileMeta's
+// fields and any unparsed sections that were read from the original
+// profile. Unparsed sections can't be byte-swapped, so they are only
+// included if order matches the original profile.
+func (m *FileMeta) sections(order binary.ByteOrder) (map[feature][]byte, error) {
+	out := make(map[feature][]byte)
+	if order == m.rawOrder {
+		for f, load := range m.raw {
+			data, err := load()
+			if err != nil {
+				return nil, err
+			}
+			out[f] = data
+		}
+	}
+	for f, enc := range featureEncoders {
+		be := &bufEncoder{nil, order}
+		if enc(m, be) {
+			out[f] = be.buf
+		}
+	}
+	return out, nil
+}
+
+func stringFeatureEncoder(name string) func(*FileMeta, *bufEncoder) bool {
+	return func(m *FileMeta, be *bufEncoder) bool {
+		str := reflect.ValueOf(m).Elem().FieldByName(name).String()
+		if str == "" {
+			return false
+		}
+		be.lenString(str)
+		return true
+	}
+}
+
+func (m *FileMeta) encodeBuildID(be *bufEncoder) bool {
+	if m.BuildIDs == nil {
+		return false
+	}
+	for _, bid := range m.BuildIDs {
+		// See write_buildid in tools/perf/util/build-id.c.
+		start := len(be.buf)
+		be.u32(0) // type, unused
+		be.u16(uint16(bid.CPUMode))
+		be.u16(0) // size, filled in below
+		be.i32(int32(bid.PID))
+		var buildID [24]byte
+		copy(buildID[:20], bid.BuildID)
+		be.bytes(buildID[:])
+		be.paddedString(bid.Filename)
+		be.order.PutUint16(be.buf[start+6:], uint16(len(be.buf)-start))
+	}
+	return true
+}
+
+func (m *FileMeta) encodeNrCPUs(be *bufEncoder) bool {
+	if m.CPUsOnline == 0 && m.CPUsAvail == 0 {
+		return false
+	}
+	be.u32(uint32(m.CPUsOnline))
+	be.u32(uint32(m.CPUsAvail))
+	return true
+}
+
+func (m *FileMeta) encodeTotalMem(be *bufEncoder) bool {
+	if m.TotalMem == 0 {
+		return false
+	}
+	be.u64(uint64(m.TotalMem / 1024))
+	return true
+}
+
+func (m *FileMeta) encodeCmdLine(be *bufEncoder) bool {
+	if m.CmdLine == nil {
+		return false
+	}
+	be.stringList(m.CmdLine)
+	return true
+}
+
+func cpuSetStrings(sets []CPUSet) []string {
+	strs := make([]string, len(sets))
+	for i, set := range sets {
+		strs[i] = set.String()
+	}
+	return strs
+}
+
+func (m *FileMeta) encodeCPUTopology(be *bufEncoder) bool {
+	if m.CoreGroups == nil && m.ThreadGroups == nil {
+		return false
+	}
+	be.stringList(cpuSetStrings(m.CoreGroups))
+	be.stringList(cpuSetStrings(m.ThreadGroups))
+	return true
+}
+
+func (m *FileMeta) encodeNUMATopology(be *bufEncoder) bool {
+	if m.NUMANodes == nil {
+		return false
+	}
+	be.u32(uint32(len(m.NUMANodes)))
+	for _, node := range m.NUMANodes {
+		be.u32(uint32(node.Node))
+		be.u64(uint64(node.MemTotal / 1024))
+		be.u64(uint64(node.MemFree / 1024))
+		be.lenString(node.CPUs.String())
+	}
+	return true
+}
+
+func (m *FileMeta) encodePMUMappings(be *bufEncoder) bool {
+	if m.PMUMappings == nil {
+		return false
+	}
+	ids := make([]PMUTypeID, 0, len(m.PMUMappings))
+	for id := range m.PMUMappings {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	be.u32(uint32(len(ids)))
+	for _, id := range ids {
+		be.u32(uint32(id))
+		be.lenString(m.PMUMappings[id])
+	}
+	return true
+}
+
+func (m *FileMeta) encodeGroupDesc(be *bufEncoder) bool {
+	if m.Groups == nil {
+		return false
+	}
+	be.u32(uint32(len(m.Groups)))
+	for _, g := range m.Groups {
+		be.lenString(g.Name)
+		be.u32(uint32(g.Leader))
+		be.u32(uint32(g.NumMembers))
+	}
+	return true
+}
+
+func (m *FileMeta) encodeMemTopology(be *bufEncoder) bool {
+	t := m.MemTopology
+	if t == nil {
+		return false
+	}
+	be.u64(1) // version
+	be.u64(t.BlockSize)
+	be.u64(uint64(len(t.Nodes)))
+	for _, node := range t.Nodes {
+		be.u64(uint64(node.Node))
+		be.u64(uint64(node.Size))
+		be.u64(uint64(len(node.Blocks) * 64))
+		be.u64s(node.Blocks)
+	}
+	return true
+}
+
+func (m *FileMeta) encodeCompressed(be *bufEncoder) bool {
+	c := m.Compression
+	if c == nil {
+		return false
+	}
+	be.u32(0) // version
+	be.u32(uint32(c.Type))
+	be.u32(uint32(c.Level))
+	be.u32(uint32(c.Ratio))
+	be.u32(uint32(c.MmapLen))
+	return true
+}
+
+func (m *FileMeta) encodeCache(be *bufEncoder) bool {
+	if m.Caches == nil {
+		return false
+	}
+	be.u32(1) // version
+	be.u32(uint32(len(m.Caches)))
+	for _, c := range m.Caches {
+		be.u32(uint32(c.Level))
+		be.u32(uint32(c.LineSize))
+		be.u32(uint32(c.Sets))
+		be.u32(uint32(c.Ways))
+		be.lenString(c.Type)
+		be.lenString(fmt.Sprintf("%dK", c.Size>>10))
+		be.lenString(c.CPUs.String())
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestMemTopology(t *testing.T) {
+	// Two nodes with 128MB blocks. Node 0 has blocks 0-1 and
+	// node 1 has blocks 2 and 65.
+	words := []uint64{
+		1, 128 << 20, 2,
+		0, 256 << 20, 2, 0x3,
+		1, 256 << 20, 66, 0x4, 0x2,
+	}
+	data := make([]byte, 8*len(words))
+	for i, x := range words {
+		binary.LittleEndian.PutUint64(data[i*8:], x)
+	}
+
+	var m FileMeta
+	if err := m.parseMemTopology(bufDecoder{data, binary.LittleEndian}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		addr uint64
+		node int
+		ok   bool
+	}{
+		{0, 0, true},
+		{200 << 20, 0, true},
+		{256 << 20, 1, true},
+		{384 << 20, -1, false},
+		{65 * 128 << 20, 1, true},
+		{1 << 40, -1, false},
+	} {
+		node, ok := m.MemTopology.NodeOf(test.addr)
+		if node != test.node || ok != test.ok {
+			t.Errorf("NodeOf(%#x) = %d, %v; want %d, %v", test.addr, node, ok, test.node, test.ok)
+		}
+	}
+
+	// A bitmap size larger than the section must not be trusted.
+	binary.LittleEndian.PutUint64(data[5*8:], 1<<62)
+	if err := m.parseMemTopology(bufDecoder{data, binary.LittleEndian}); err == nil {
+		t.Error("want error for oversized bitmap")
+	}
+}
+
+func TestMetaRoundTrip(t *testing.T) {
+	want := FileMeta{
+		BuildIDs: []BuildIDInfo{
+			{CPUModeKernel, -1, BuildID(make([]byte, 20)), "[kernel.kallsyms]"},
+			{CPUModeUser, 42, BuildID([]byte("0123456789abcdefghij")), "/usr/bin/true"},
+		},
+		Hostname:     "gopher",
+		OSRelease:    "6.1.0",
+		Version:      "6.1",
+		Arch:         "x86_64",
+		CPUsOnline:   4,
+		CPUsAvail:    8,
+		CPUDesc:      "Gopher CPU",
+		CPUID:        "GenuineIntel,6,69,1",
+		TotalMem:     16 << 30,
+		CmdLine:      []string{"perf", "record", "-a"},
+		CoreGroups:   []CPUSet{{0, 1, 2, 3}},
+		ThreadGroups: []CPUSet{{0, 2}, {1, 3}},
+		NUMANodes:    []NUMANode{{0, 16 << 30, 1 << 30, CPUSet{0, 1, 2, 3}}},
+		PMUMappings:  map[PMUTypeID]string{4: "cpu", 1: "software"},
+		Groups:       []GroupDesc{{"{cycles,instructions}", 0, 2}},
+		MemTopology:  &MemTopology{128 << 20, []MemNode{{0, 256 << 20, []uint64{3}}}},
+		Compression:  &Compression{CompressionZstd, 1, 10, 512 << 10},
+		Caches:       []CacheInfo{{1, "Data", 32 << 10, 64, 64, 8, CPUSet{0, 2}}},
+	}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		secs, err := want.sections(order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got FileMeta
+		for f, data := range secs {
+			if err := got.parseData(f, data, order); err != nil {
+				t.Fatalf("%s: parsing feature %d: %v", order, f, err)
+			}
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("%s: round trip mismatch:\nwant %+v\ngot  %+v", order, want, got)
+		}
+	}
+}
+
+func TestHostInfo(t *testing.T) {
+	m := FileMeta{
+		Hostname:     "gopher",
+		OSRelease:    "6.1.0",
+		CPUsOnline:   4,
+		CPUsAvail:    8,
+		ThreadGroups: []CPUSet{{0, 2}, {1, 3}},
+		TotalMem:     16 << 30,
+	}
+	want := []string{
+		"hostname: gopher",
+		"os release: 6.1.0",
+		"cpus: 4 online, 8 available",
+		"smt: on",
+		"memory: 16384 MiB",
+	}
+	if got := m.HostInfo(); !reflect.DeepEqual(got, want) {
+		t.Errorf("HostInfo() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package perffiletest builds in-memory profiles for testing code
+// that consumes perffile profiles, without recording a profile with
+// perf.
+//
+// A test describes the events and records of a profile and then opens
+// it as a *perffile.File, which behaves like a profile read from
+// disk:
+//
+//	var p perffiletest.Profile
+//	cycles := p.Event(perffile.EventHardware{ID: perffile.EventHardwareIDCPUCycles}, perffile.SampleFormatCallchain)
+//	p.Comm(100, 100, 0, "server")
+//	p.Mmap(100, 0, 0x400000, 0x10000, 0, "/usr/bin/server")
+//	p.Sample(cycles, 100, 100, 1000, 0x401000, 0x402000)
+//	f, err := p.File()
+//
+// Counter values can be scripted by setting the SampleRead field of
+// the samples returned by Sample.
+package perffiletest
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// A Profile is an in-memory profile under construction. The zero
+// value is an empty profile.
+type Profile struct {
+	// ByteOrder is the byte order of the profile. If nil, it is
+	// little endian.
+	ByteOrder binary.ByteOrder
+
+	// Meta is the metadata of the profile.
+	Meta perffile.FileMeta
+
+	// Events and Records are the events and records of the
+	// profile, in order. Records may refer only to events in
+	// Events.
+	Events  []*perffile.EventAttr
+	Records []perffile.Record
+}
+
+// Event adds an event to p and returns its attributes. Every sample
+// of the event records its period, time, CPU, and process and thread
+// IDs, plus the fields in format.
+//
+// The attributes can be modified before the profile is opened, for
+// example to set a ReadFormat.
+func (p *Profile) Event(ev perffile.Event, format perffile.SampleFormat) *perffile.EventAttr {
+	attr := &perffile.EventAttr{
+		Event:        ev,
+		SamplePeriod: 1,
+		// Identifier lets samples and sideband records be
+		// attributed to the right event.
+		SampleFormat: format | perffile.SampleFormatIdentifier | perffile.SampleFormatIP | perffile.SampleFormatTID | perffile.SampleFormatTime | perffile.SampleFormatCPU | perffile.SampleFormatPeriod,
+		Flags:        perffile.EventFlagSampleIDAll,
+	}
+	if len(p.Events) == 0 {
+		// The first event carries the sideband records.
+		attr.Flags |= perffile.EventFlagComm | perffile.EventFlagMmap | perffile.EventFlagTask
+	}
+	p.Events = append(p.Events, attr)
+	return attr
+}
+
+// Add adds records to p.
+func (p *Profile) Add(rs ...perffile.Record) {
+	p.Records = append(p.Records, rs...)
+}
+
+// Sample adds a sample of event attr on thread tid of process pid at
+// time t and returns it. If stack is not empty, stack[0] is the
+// sample's IP, and if attr records callchains, stack is also the
+// sample's callchain, from the innermost frame outward.
+func (p *Profile) Sample(attr *perffile.EventAttr, pid, tid int, t uint64, stack ...uint64) *perffile.RecordSample {
+	r := &perffile.RecordSample{
+		RecordCommon: perffile.RecordCommon{EventAttr: attr, PID: pid, TID: tid, Time: t},
+		CPUMode:      perffile.CPUModeUser,
+		Period:       1,
+	}
+	if len(stack) > 0 {
+		r.IP = stack[0]
+		if attr.SampleFormat&perffile.SampleFormatCallchain != 0 {
+			r.Callchain = append([]uint64{uint64(perffile.CallchainUser)}, stack...)
+		}
+	}
+	p.Add(r)
+	return r
+}
+
+// Comm adds a record that sets the command name of thread tid of
+// process pid at time t.
+func (p *Profile) Comm(pid, tid int, t uint64, comm string) {
+	p.Add(&perffile.RecordComm{
+		RecordCommon: perffile.RecordCommon{PID: pid, TID: tid, Time: t},
+		Comm:         comm,
+	})
+}
+
+// Mmap adds a record that maps file filename at offset off into
+// process pid at address addr with length len, at time t.
+func (p *Profile) Mmap(pid int, t uint64, addr, len, off uint64, filename string) {
+	p.Add(&perffile.RecordMmap{
+		RecordCommon: perffile.RecordCommon{PID: pid, TID: pid, Time: t},
+		CPUMode:      perffile.CPUModeUser,
+		Addr:         addr,
+		Len:          len,
+		FileOffset:   off,
+		Prot:         5, // PROT_READ|PROT_EXEC
+		Filename:     filename,
+	})
+}
+
+// Fork adds a record that forks thread tid of process pid from thread
+// ptid of process ppid at time t.
+func (p *Profile) Fork(pid, tid, ppid, ptid int, t uint64) {
+	p.Add(&perffile.RecordFork{
+		RecordCommon: perffile.RecordCommon{PID: pid, TID: tid, Time: t},
+		PPID:         ppid,
+		PTID:         ptid,
+	})
+}
+
+// Exit adds a record that thread tid of process pid exited at time t.
+func (p *Profile) Exit(pid, tid int, t uint64) {
+	p.Add(&perffile.RecordExit{
+		RecordCommon: perffile.RecordCommon{PID: pid, TID: tid, Time: t},
+		PPID:         pid,
+		PTID:         tid,
+	})
+}
+
+// Bytes returns p encoded as a pipe-mode "perf.data" profile.
+func (p *Profile) Bytes() ([]byte, error) {
+	order := p.ByteOrder
+	if order == nil {
+		order = binary.LittleEndian
+	}
+	var buf bytes.Buffer
+	w := perffile.NewPipeWriter(&buf, order)
+	for _, attr := range p.Events {
+		if err := w.AddEvent(attr); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.WriteMeta(&p.Meta); err != nil {
+		return nil, err
+	}
+	for _, r := range p.Records {
+		if err := w.WriteRecord(r); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// File returns p as an open profile. Unlike a streamed profile, its
+// records can be read more than once and in any order.
+func (p *Profile) File() (*perffile.File, error) {
+	data, err := p.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return perffile.New(bytes.NewReader(data))
+}
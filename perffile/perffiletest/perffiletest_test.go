@@ -0,0 +1,66 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffiletest
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perfsession"
+)
+
+func TestProfile(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		p := Profile{ByteOrder: order}
+		p.Meta.Hostname = "gopher"
+		cycles := p.Event(perffile.EventHardware{ID: perffile.EventHardwareIDCPUCycles}, perffile.SampleFormatCallchain)
+		instrs := p.Event(perffile.EventHardware{ID: perffile.EventHardwareIDInstructions}, 0)
+		p.Comm(100, 100, 1, "server")
+		p.Mmap(100, 2, 0x400000, 0x10000, 0, "/usr/bin/server")
+		p.Sample(cycles, 100, 100, 3, 0x401000, 0x402000)
+		p.Sample(instrs, 100, 100, 4, 0x403000).Period = 1000
+		p.Fork(100, 101, 100, 100, 5)
+		p.Exit(100, 101, 6)
+
+		f, err := p.File()
+		if err != nil {
+			t.Fatalf("%s: %v", order, err)
+		}
+		if f.ByteOrder != order || f.Meta.Hostname != "gopher" || len(f.Events) != 2 {
+			t.Fatalf("%s: bad profile %+v", order, f)
+		}
+
+		s := perfsession.New(f)
+		var samples []*perffile.RecordSample
+		rs := f.Records(perffile.RecordsTimeOrder)
+		for rs.Next() {
+			s.Update(rs.Record)
+			if r, ok := rs.Record.(*perffile.RecordSample); ok {
+				r2 := *r
+				samples = append(samples, &r2)
+
+				info := s.LookupPID(r.PID)
+				if info == nil || info.Comm != "server" {
+					t.Errorf("%s: bad PID info %+v", order, info)
+				} else if m := info.LookupMmap(r.IP); m == nil || m.Filename != "/usr/bin/server" {
+					t.Errorf("%s: IP %#x: bad mmap %+v", order, r.IP, m)
+				}
+			}
+		}
+		if err := rs.Err(); err != nil {
+			t.Fatalf("%s: %v", order, err)
+		}
+		if len(samples) != 2 {
+			t.Fatalf("%s: got %d samples, want 2", order, len(samples))
+		}
+		if r := samples[0]; r.EventAttr != f.Events[0] || len(r.Callchain) != 3 || r.Callchain[2] != 0x402000 {
+			t.Errorf("%s: bad cycles sample %+v", order, r)
+		}
+		if r := samples[1]; r.EventAttr != f.Events[1] || r.Period != 1000 || r.Callchain != nil {
+			t.Errorf("%s: bad instructions sample %+v", order, r)
+		}
+	}
+}
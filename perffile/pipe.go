@@ -0,0 +1,216 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Pipe-mode profiles, such as those written by "perf record -o -",
+// consist of a short header followed directly by records. The event
+// attributes and metadata that would normally be in the file header
+// and feature sections are instead delivered as synthetic records at
+// the start of the stream.
+//
+// See perf_file_header__read_pipe in tools/perf/util/header.c.
+
+// pipeHeaderSize is the size of perf_pipe_file_header.
+const pipeHeaderSize = 16
+
+var errPipeSeek = errors.New("cannot seek in streamed profile")
+
+// NewPipe reads a pipe-mode "perf.data" stream from r, such as the
+// output of "perf record -o -".
+//
+// NewPipe consumes the event attributes and metadata at the start of
+// the stream. The records themselves are read as the caller iterates
+// over them, so Records may only be called once, and only with
+// RecordsFileOrder.
+//
+// Pipe-mode profiles written to a file can also be read with New or
+// Open, which do not have these restrictions.
+func NewPipe(r io.Reader) (*File, error) {
+	file := &File{Events: make([]*EventAttr, 0)}
+	s := &streamReader{br: bufio.NewReader(r)}
+	if err := file.readMagic(s); err != nil {
+		return nil, err
+	}
+	if file.hdr.Size != pipeHeaderSize {
+		return nil, fmt.Errorf("not a pipe-mode profile")
+	}
+	if err := file.readPipeHeader(s); err != nil {
+		return nil, err
+	}
+	file.stream = s
+	return file, nil
+}
+
+// openPipe finishes opening a pipe-mode profile from r. The magic
+// has already been read.
+func (file *File) openPipe(r io.ReaderAt) error {
+	const maxSize = 1<<63 - 1
+	s := &streamReader{br: bufio.NewReader(io.NewSectionReader(r, pipeHeaderSize, maxSize-pipeHeaderSize)), pos: pipeHeaderSize}
+	if err := file.readPipeHeader(s); err != nil {
+		return err
+	}
+	// The data extends to the end of the file, which we don't
+	// know the size of.
+	file.hdr.Data = fileSection{uint64(s.pos), uint64(maxSize - s.pos)}
+	return nil
+}
+
+// readPipeHeader reads the synthetic header records from the start
+// of a pipe-mode profile, stopping at the first ordinary record.
+func (file *File) readPipeHeader(s *streamReader) error {
+	file.pipe = true
+	file.idToAttr = make(map[attrID]*EventAttr)
+	for {
+		buf, err := s.br.Peek(8)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if !isPipeHeaderRecord(RecordType(file.ByteOrder.Uint32(buf))) {
+			break
+		}
+
+		offset := s.pos
+		var hdr recordHeader
+		if err := binary.Read(s, file.ByteOrder, &hdr); err != nil {
+			return err
+		}
+		if hdr.Size < 8 {
+			return fmt.Errorf("%v record at offset %d has bad size %d", hdr.Type, offset, hdr.Size)
+		}
+		data := make([]byte, int(hdr.Size)-8)
+		if _, err := io.ReadFull(s, data); err != nil {
+			return err
+		}
+		if err := file.pipeRecord(offset, &hdr, data, s); err != nil {
+			return err
+		}
+	}
+	return file.checkAttrs()
+}
+
+func isPipeHeaderRecord(t RecordType) bool {
+	switch t {
+	case recordTypeAttr, recordTypeEventType, recordTypeTracingData, recordTypeHeaderFeature:
+		return true
+	}
+	return false
+}
+
+// pipeRecord processes a synthetic header record at offset, whose
+// body is data. Any payload following the record is read from r.
+//
+// The same record may be seen more than once if the records are
+// iterated over more than once, so this only applies each record
+// once.
+func (file *File) pipeRecord(offset int64, hdr *recordHeader, data []byte, r io.Reader) error {
+	if file.pipeSeen == nil {
+		file.pipeSeen = make(map[int64]bool)
+	}
+	seen := file.pipeSeen[offset]
+	file.pipeSeen[offset] = true
+
+	switch hdr.Type {
+	case recordTypeAttr:
+		// perf_event_attr, followed by the attr's IDs.
+		if seen {
+			break
+		}
+		fa := new(fileAttr)
+		br := bytes.NewReader(data)
+		if err := readEventAttr(br, file.ByteOrder, &fa.Attr); err != nil {
+			return err
+		}
+		fa.raw = append([]byte(nil), data[:len(data)-br.Len()]...)
+		ids := make([]attrID, br.Len()/8)
+		if err := binary.Read(br, file.ByteOrder, ids); err != nil {
+			return err
+		}
+		file.attrs = append(file.attrs, fa)
+		file.Events = append(file.Events, &fa.Attr)
+		for _, id := range ids {
+			file.idToAttr[id] = &fa.Attr
+		}
+		if len(file.attrs) > 1 {
+			// Attributes that arrive after the records
+			// started must agree with the earlier ones.
+			return file.checkAttrs()
+		}
+
+	case recordTypeHeaderFeature:
+		// u64 feature ID, followed by the feature section.
+		if seen {
+			break
+		}
+		if len(data) < 8 {
+			return fmt.Errorf("feature record at offset %d is too short", offset)
+		}
+		// data may be reused by the caller, so copy it in
+		// case FileMeta retains it.
+		bd := &bufDecoder{append([]byte(nil), data...), file.ByteOrder}
+		f := feature(bd.u64())
+		// Like New, ignore malformed feature sections so
+		// they don't make the records unreadable.
+		file.Meta.parseData(f, bd.buf, file.ByteOrder)
+		return nil
+
+	case recordTypeTracingData:
+		// The tracing data follows the record and isn't
+		// included in its size. This is always 8-byte aligned.
+		if len(data) < 4 {
+			return fmt.Errorf("tracing data record at offset %d is too short", offset)
+		}
+		bd := &bufDecoder{data, file.ByteOrder}
+		size := int64(bd.u32())
+		if seen {
+			_, err := io.CopyN(io.Discard, r, size)
+			return err
+		}
+		// The size comes from the stream, so don't trust it
+		// for an up-front allocation. Grow the buffer as the
+		// data actually arrives instead.
+		var buf bytes.Buffer
+		n, err := buf.ReadFrom(io.LimitReader(r, size))
+		if err == nil && n < size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		tracing := buf.Bytes()
+		file.Meta.addRaw(featureTracingData, file.ByteOrder, func() ([]byte, error) { return tracing, nil })
+	}
+	return nil
+}
+
+// streamReader is a buffered reader that tracks its offset in the
+// stream. It only supports seeking to find the current offset.
+type streamReader struct {
+	br  *bufio.Reader
+	pos int64
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	n, err := s.br.Read(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+func (s *streamReader) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekCurrent && offset == 0 {
+		return s.pos, nil
+	}
+	return s.pos, errPipeSeek
+}
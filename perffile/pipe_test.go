@@ -0,0 +1,185 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/aclements/go-perf/internal/zstd"
+)
+
+// pipeProfile returns a minimal pipe-mode profile with one event and
+// one sample in byte order order.
+func pipeProfile(order binary.ByteOrder) []byte {
+	var buf bytes.Buffer
+	w := func(v interface{}) { binary.Write(&buf, order, v) }
+
+	magic := "PERFILE2"
+	if order == binary.BigEndian {
+		magic = "2ELIFREP"
+	}
+	buf.WriteString(magic)
+	w(uint64(pipeHeaderSize))
+
+	// Attr record: a v0 perf_event_attr and one ID.
+	w(recordHeader{recordTypeAttr, 0, 8 + 64 + 8})
+	flags := uint64(EventFlagSampleIDAll)
+	if order == binary.BigEndian {
+		flags = swapBitfield(flags, eventFlagWidths)
+	}
+	w(eventAttrV0{
+		Type:         EventTypeHardware,
+		Size:         64,
+		SampleFormat: SampleFormatIP | SampleFormatTID,
+		Flags:        EventFlags(flags),
+	})
+	w(uint64(42))
+
+	// Hostname feature record.
+	w(recordHeader{recordTypeHeaderFeature, 0, 8 + 8 + 4 + 8})
+	w(uint64(featureHostname))
+	w(uint32(8))
+	buf.WriteString("gopher\x00\x00")
+
+	// Sample record.
+	w(recordHeader{RecordTypeSample, 0, 8 + 8 + 8})
+	w(uint64(0x1234))
+	w(int32(10))
+	w(int32(11))
+
+	return buf.Bytes()
+}
+
+func TestPipe(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		data := pipeProfile(order)
+
+		check := func(name string, f *File, err error) {
+			if err != nil {
+				t.Fatalf("%s/%s: %v", order, name, err)
+			}
+			if f.ByteOrder != order {
+				t.Errorf("%s/%s: ByteOrder = %v", order, name, f.ByteOrder)
+			}
+			if len(f.Events) != 1 || f.Events[0].Flags != EventFlagSampleIDAll {
+				t.Errorf("%s/%s: bad Events %+v", order, name, f.Events)
+			}
+			if f.Meta.Hostname != "gopher" {
+				t.Errorf("%s/%s: Hostname = %q", order, name, f.Meta.Hostname)
+			}
+			rs := f.Records(RecordsFileOrder)
+			n := 0
+			for rs.Next() {
+				r, ok := rs.Record.(*RecordSample)
+				if !ok {
+					t.Errorf("%s/%s: unexpected record %+v", order, name, rs.Record)
+					continue
+				}
+				if r.IP != 0x1234 || r.PID != 10 || r.TID != 11 {
+					t.Errorf("%s/%s: bad sample %+v", order, name, r)
+				}
+				n++
+			}
+			if err := rs.Err(); err != nil {
+				t.Errorf("%s/%s: %v", order, name, err)
+			}
+			if n != 1 {
+				t.Errorf("%s/%s: got %d samples, want 1", order, name, n)
+			}
+		}
+
+		f, err := NewPipe(bytes.NewBuffer(data))
+		check("NewPipe", f, err)
+		f, err = New(bytes.NewReader(data))
+		check("New", f, err)
+	}
+}
+
+func TestCompressedPipe(t *testing.T) {
+	// Append a sample in a COMPRESSED2 record, which is padded
+	// to 8 bytes, to a pipe-mode profile.
+	order := binary.LittleEndian
+	var rec bytes.Buffer
+	binary.Write(&rec, order, recordHeader{RecordTypeSample, 0, 8 + 8 + 8})
+	binary.Write(&rec, order, uint64(0x5678))
+	binary.Write(&rec, order, []int32{10, 11})
+	e := zstd.NewEncoder()
+	data := e.Encode(nil, rec.Bytes())
+	pad := -len(data) & 7
+
+	buf := bytes.NewBuffer(pipeProfile(order))
+	binary.Write(buf, order, recordHeader{recordTypeCompressed2, 0, uint16(8 + 8 + len(data) + pad)})
+	binary.Write(buf, order, uint64(len(data)))
+	buf.Write(data)
+	buf.Write(make([]byte, pad))
+
+	f, err := NewPipe(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []uint64
+	rs := f.Records(RecordsFileOrder)
+	for rs.Next() {
+		if r, ok := rs.Record.(*RecordSample); ok {
+			got = append(got, r.IP)
+		}
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{0x1234, 0x5678}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got sample IPs %#x, want %#x", got, want)
+	}
+}
+
+func TestPipeTruncatedTracingData(t *testing.T) {
+	// A tracing data record that claims a huge payload must fail
+	// without allocating it.
+	order := binary.LittleEndian
+	buf := bytes.NewBuffer(pipeProfile(order)[:16])
+	binary.Write(buf, order, recordHeader{recordTypeTracingData, 0, 8 + 8})
+	binary.Write(buf, order, []uint32{0xfffffff0, 0})
+	buf.WriteString("short")
+	if _, err := NewPipe(buf); err == nil {
+		t.Fatal("NewPipe succeeded, want error")
+	}
+}
+
+func TestPipeBadFeature(t *testing.T) {
+	// A malformed feature section is ignored, as it is in regular
+	// profiles, rather than ending the records.
+	order := binary.LittleEndian
+	buf := bytes.NewBuffer(pipeProfile(order))
+	binary.Write(buf, order, recordHeader{recordTypeHeaderFeature, 0, 8 + 8 + 4*5})
+	binary.Write(buf, order, uint64(featureCompressed))
+	binary.Write(buf, order, []uint32{99, 1, 1, 1, 1}) // Bad version
+	binary.Write(buf, order, recordHeader{RecordTypeSample, 0, 8 + 8 + 8})
+	binary.Write(buf, order, uint64(0x5678))
+	binary.Write(buf, order, []int32{10, 11})
+
+	f, err := NewPipe(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []uint64
+	rs := f.Records(RecordsFileOrder)
+	for rs.Next() {
+		if r, ok := rs.Record.(*RecordSample); ok {
+			got = append(got, r.IP)
+		}
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{0x1234, 0x5678}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got sample IPs %#x, want %#x", got, want)
+	}
+	if f.Meta.Compression != nil {
+		t.Errorf("Compression = %+v, want nil", f.Meta.Compression)
+	}
+}
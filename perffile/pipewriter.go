@@ -0,0 +1,431 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A PipeWriter writes a pipe-mode "perf.data" stream, which can be
+// read back with NewPipe, New, or Open.
+//
+// Records can be constructed from scratch, so this is useful for
+// synthesizing profiles to test tools that consume profiles without
+// recording one with perf. It can also save records read from another
+// profile, for example to capture a regression test input.
+//
+// All events must be added with AddEvent before writing records that
+// refer to them.
+type PipeWriter struct {
+	w     io.Writer
+	order binary.ByteOrder
+	ids   map[*EventAttr]attrID
+	first *EventAttr
+	err   error
+}
+
+// NewPipeWriter returns a PipeWriter that writes a profile in byte
+// order order to w.
+func NewPipeWriter(w io.Writer, order binary.ByteOrder) *PipeWriter {
+	pw := &PipeWriter{w: w, order: order, ids: make(map[*EventAttr]attrID)}
+	be := &bufEncoder{nil, order}
+	if order == binary.BigEndian {
+		be.bytes([]byte("2ELIFREP"))
+	} else {
+		be.bytes([]byte("PERFILE2"))
+	}
+	be.u64(pipeHeaderSize)
+	pw.write(be.buf)
+	return pw
+}
+
+func (w *PipeWriter) write(b []byte) error {
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+	return w.err
+}
+
+// record writes a record of type t with body body, padding the body
+// to a multiple of 8 bytes.
+func (w *PipeWriter) record(t RecordType, misc recordMisc, body []byte) error {
+	for len(body)%8 != 0 {
+		body = append(body, 0)
+	}
+	size := 8 + len(body)
+	if size > 0xffff {
+		return fmt.Errorf("%v record too large (%d bytes)", t, size)
+	}
+	be := &bufEncoder{nil, w.order}
+	be.u32(uint32(t))
+	be.u16(uint16(misc))
+	be.u16(uint16(size))
+	be.bytes(body)
+	return w.write(be.buf)
+}
+
+// AddEvent adds event attr to the profile. The events of a profile
+// must agree on the layout of samples; see the requirements in
+// perf_evlist__valid_sample_type. In particular, if there's more than
+// one event, their SampleFormats must include SampleFormatID or
+// SampleFormatIdentifier.
+func (w *PipeWriter) AddEvent(attr *EventAttr) error {
+	if _, ok := w.ids[attr]; ok {
+		return fmt.Errorf("event %v already added", attr.Event)
+	}
+	id := attrID(len(w.ids) + 1)
+	w.ids[attr] = id
+	if w.first == nil {
+		w.first = attr
+	}
+	be := &bufEncoder{encodeEventAttr(attr, w.order), w.order}
+	be.u64(uint64(id))
+	return w.record(recordTypeAttr, 0, be.buf)
+}
+
+// WriteMeta writes the profile metadata in m. This should be called
+// before writing any records.
+func (w *PipeWriter) WriteMeta(m *FileMeta) error {
+	secs, err := m.sections(w.order)
+	if err != nil {
+		return err
+	}
+	for f := feature(0); f < feature(numFeatureBits); f++ {
+		data, ok := secs[f]
+		if !ok {
+			continue
+		}
+		if f == featureTracingData {
+			// The tracing data is a separate record with
+			// the data following it. It must be 8-byte
+			// aligned.
+			for len(data)%8 != 0 {
+				data = append(data, 0)
+			}
+			be := &bufEncoder{nil, w.order}
+			be.u32(uint32(len(data)))
+			if err := w.record(recordTypeTracingData, 0, be.buf); err != nil {
+				return err
+			}
+			if err := w.write(data); err != nil {
+				return err
+			}
+			continue
+		}
+		be := &bufEncoder{nil, w.order}
+		be.u64(uint64(f))
+		be.bytes(data)
+		if err := w.record(recordTypeHeaderFeature, 0, be.buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteRecord writes r to the profile. It supports RecordSample,
+// RecordMmap, RecordComm, RecordFork, RecordExit, and RecordLost.
+//
+// Each record's fields are encoded according to the SampleFormat of
+// its EventAttr, which must have been added with AddEvent. The
+// EventAttr of non-sample records may be nil, in which case they use
+// the first event. The Offset, Format, and ID fields of r are ignored.
+func (w *PipeWriter) WriteRecord(r Record) error {
+	if w.err != nil {
+		return w.err
+	}
+	common := r.Common()
+	attr := common.EventAttr
+	if attr == nil && r.Type() != RecordTypeSample {
+		attr = w.first
+	}
+	id, ok := w.ids[attr]
+	if !ok {
+		return fmt.Errorf("%v record has an event that was not added", r.Type())
+	}
+
+	be := &bufEncoder{nil, w.order}
+	var misc recordMisc
+	switch r := r.(type) {
+	default:
+		return fmt.Errorf("writing %v records is not supported", r.Type())
+
+	case *RecordSample:
+		misc = recordMisc(r.CPUMode)
+		if r.ExactIP {
+			misc |= recordMiscExactIP
+		}
+		if err := w.encodeSample(be, r, id); err != nil {
+			return err
+		}
+		return w.record(RecordTypeSample, misc, be.buf)
+
+	case *RecordMmap:
+		misc = recordMisc(r.CPUMode)
+		if r.Data {
+			misc |= recordMiscMmapData
+		}
+		be.i32(int32(r.PID))
+		be.i32(int32(r.TID))
+		be.u64s([]uint64{r.Addr, r.Len, r.FileOffset})
+		if r.BuildID != nil {
+			if len(r.BuildID) > 20 {
+				return fmt.Errorf("mmap record build ID is %d bytes, but at most 20 fit", len(r.BuildID))
+			}
+			misc |= recordMiscMmapBuildID
+			var bid [20]byte
+			copy(bid[:], r.BuildID)
+			be.bytes([]byte{byte(len(r.BuildID)), 0, 0, 0})
+			be.bytes(bid[:])
+		} else {
+			be.u32(r.Major)
+			be.u32(r.Minor)
+			be.u64(r.Ino)
+			be.u64(r.InoGeneration)
+		}
+		be.u32(r.Prot)
+		be.u32(r.Flags)
+		w.cstring(be, r.Filename)
+		w.encodeTrailer(be, attr, common, id)
+		return w.record(recordTypeMmap2, misc, be.buf)
+
+	case *RecordComm:
+		if r.Exec {
+			misc |= recordMiscCommExec
+		}
+		be.i32(int32(r.PID))
+		be.i32(int32(r.TID))
+		w.cstring(be, r.Comm)
+		w.encodeTrailer(be, attr, common, id)
+		return w.record(RecordTypeComm, misc, be.buf)
+
+	case *RecordFork, *RecordExit:
+		var ppid, ptid int
+		switch r := r.(type) {
+		case *RecordFork:
+			ppid, ptid = r.PPID, r.PTID
+		case *RecordExit:
+			ppid, ptid = r.PPID, r.PTID
+		}
+		be.i32(int32(common.PID))
+		be.i32(int32(ppid))
+		be.i32(int32(common.TID))
+		be.i32(int32(ptid))
+		be.u64(common.Time)
+		w.encodeTrailer(be, attr, common, id)
+		return w.record(r.Type(), misc, be.buf)
+
+	case *RecordLost:
+		be.u64(uint64(id))
+		be.u64(r.NumLost)
+		w.encodeTrailer(be, attr, common, id)
+		return w.record(RecordTypeLost, misc, be.buf)
+	}
+}
+
+// cstring writes a NUL-terminated string padded to 8 bytes.
+func (w *PipeWriter) cstring(be *bufEncoder, s string) {
+	be.bytes([]byte(s))
+	be.zeros(8 - len(s)%8)
+}
+
+// encodeTrailer writes the sample_id trailer of a non-sample record.
+// This is the inverse of Records.parseCommon.
+func (w *PipeWriter) encodeTrailer(be *bufEncoder, attr *EventAttr, c *RecordCommon, id attrID) {
+	if attr.Flags&EventFlagSampleIDAll == 0 {
+		return
+	}
+	t := attr.SampleFormat
+	if t&SampleFormatTID != 0 {
+		be.i32(int32(c.PID))
+		be.i32(int32(c.TID))
+	}
+	if t&SampleFormatTime != 0 {
+		be.u64(c.Time)
+	}
+	if t&SampleFormatID != 0 {
+		be.u64(uint64(id))
+	}
+	if t&SampleFormatStreamID != 0 {
+		be.u64(c.StreamID)
+	}
+	if t&SampleFormatCPU != 0 {
+		be.u32(c.CPU)
+		be.u32(c.Res)
+	}
+	if t&SampleFormatIdentifier != 0 {
+		be.u64(uint64(id))
+	}
+}
+
+// encodeSample writes the body of sample r. This is the inverse of
+// Records.parseSample.
+func (w *PipeWriter) encodeSample(be *bufEncoder, r *RecordSample, id attrID) error {
+	attr := r.EventAttr
+	t := attr.SampleFormat
+	if t&SampleFormatDataSrc != 0 {
+		return fmt.Errorf("writing samples with %v is not supported", SampleFormatDataSrc)
+	}
+	u64If := func(cond bool, x uint64) {
+		if cond {
+			be.u64(x)
+		}
+	}
+	u64If(t&SampleFormatIdentifier != 0, uint64(id))
+	u64If(t&SampleFormatIP != 0, r.IP)
+	if t&SampleFormatTID != 0 {
+		be.i32(int32(r.PID))
+		be.i32(int32(r.TID))
+	}
+	u64If(t&SampleFormatTime != 0, r.Time)
+	u64If(t&SampleFormatAddr != 0, r.Addr)
+	u64If(t&SampleFormatID != 0, uint64(id))
+	u64If(t&SampleFormatStreamID != 0, r.StreamID)
+	if t&SampleFormatCPU != 0 {
+		be.u32(r.CPU)
+		be.u32(r.Res)
+	}
+	u64If(t&SampleFormatPeriod != 0, r.Period)
+	if t&SampleFormatRead != 0 {
+		if err := w.encodeReadFormat(be, attr.ReadFormat, r.SampleRead); err != nil {
+			return err
+		}
+	}
+	if t&SampleFormatCallchain != 0 {
+		be.u64(uint64(len(r.Callchain)))
+		be.u64s(r.Callchain)
+	}
+	if t&SampleFormatRaw != 0 {
+		be.u32(uint32(len(r.Raw)))
+		be.bytes(r.Raw)
+	}
+	u64If(attr.BranchSampleType&BranchSampleHWIndex != 0, uint64(r.BranchHWIndex))
+	if t&SampleFormatBranchStack != 0 {
+		be.u64(uint64(len(r.BranchStack)))
+		for _, br := range r.BranchStack {
+			flags := uint64(br.Flags)&0x0f | uint64(br.Cycles)<<4 | uint64(br.Type&0x0f)<<20
+			if w.order == binary.BigEndian {
+				flags = unswapBitfield(flags, branchFlagWidths)
+			}
+			be.u64s([]uint64{br.From, br.To, flags})
+		}
+	}
+	if t&SampleFormatRegsUser != 0 {
+		be.u64(uint64(r.RegsUserABI))
+		be.u64s(r.RegsUser)
+	}
+	if t&SampleFormatStackUser != 0 {
+		be.u64(uint64(len(r.StackUser)))
+		be.bytes(r.StackUser)
+		be.u64(r.StackUserDynSize)
+	}
+	if t&SampleFormatWeight != 0 {
+		be.u64(r.Weight)
+	} else if t&SampleFormatWeightStruct != 0 {
+		be.u64(uint64(r.Weights.Var1) | uint64(r.Weights.Var2)<<32 | uint64(r.Weights.Var3)<<48)
+	}
+	u64If(t&SampleFormatTransaction != 0, uint64(r.Transaction)|uint64(r.AbortCode)<<32)
+	if t&SampleFormatRegsIntr != 0 {
+		be.u64(uint64(r.RegsIntrABI))
+		be.u64s(r.RegsIntr)
+	}
+	u64If(t&SampleFormatPhysAddr != 0, r.PhysAddr)
+	u64If(t&SampleFormatCGroup != 0, r.CGroup)
+	u64If(t&SampleFormatDataPageSize != 0, r.DataPageSize)
+	u64If(t&SampleFormatCodePageSize != 0, r.CodePageSize)
+	if t&SampleFormatAux != 0 {
+		be.u64(uint64(len(r.Aux)))
+		be.bytes(r.Aux)
+	}
+	return nil
+}
+
+// encodeReadFormat writes counts in read format f. This is the
+// inverse of Records.parseReadFormat.
+func (w *PipeWriter) encodeReadFormat(be *bufEncoder, f ReadFormat, counts []Count) error {
+	if len(counts) == 0 || (f&ReadFormatGroup == 0 && len(counts) != 1) {
+		return fmt.Errorf("sample has %d counts, which does not match its read format %v", len(counts), f)
+	}
+	countID := func(c Count) error {
+		if f&ReadFormatID == 0 {
+			return nil
+		}
+		id, ok := w.ids[c.EventAttr]
+		if !ok {
+			return fmt.Errorf("count has an event that was not added")
+		}
+		be.u64(uint64(id))
+		return nil
+	}
+	c0 := counts[0]
+	if f&ReadFormatGroup == 0 {
+		be.u64(c0.Value)
+	} else {
+		be.u64(uint64(len(counts)))
+	}
+	if f&ReadFormatTotalTimeEnabled != 0 {
+		be.u64(c0.TimeEnabled)
+	}
+	if f&ReadFormatTotalTimeRunning != 0 {
+		be.u64(c0.TimeRunning)
+	}
+	if f&ReadFormatGroup == 0 {
+		return countID(c0)
+	}
+	for _, c := range counts {
+		be.u64(c.Value)
+		if err := countID(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeEventAttr encodes attr as a perf_event_attr. This is the
+// inverse of readEventAttr.
+func encodeEventAttr(ea *EventAttr, order binary.ByteOrder) []byte {
+	var attr eventAttrVN
+	g := ea.Event.Generic()
+	attr.Type, attr.Config = g.Type, g.ID
+	if g.Type == EventTypeBreakpoint {
+		attr.Config, attr.BPType = 0, uint32(g.ID)
+	}
+	if len(g.Config) > 0 {
+		attr.BPAddrOrConfig1 = g.Config[0]
+	}
+	if len(g.Config) > 1 {
+		attr.BPLenOrConfig2 = g.Config[1]
+	}
+	if ea.Flags&EventFlagFreq == 0 {
+		attr.SamplePeriodOrFreq = ea.SamplePeriod
+	} else {
+		attr.SamplePeriodOrFreq = ea.SampleFreq
+	}
+	attr.SampleFormat = ea.SampleFormat
+	attr.ReadFormat = ea.ReadFormat
+	flags := uint64(ea.Flags&^eventFlagPreciseMask) | uint64(ea.Precise)<<eventFlagPreciseShift
+	if order == binary.BigEndian {
+		flags = unswapBitfield(flags, eventFlagWidths)
+	}
+	attr.Flags = EventFlags(flags)
+	if ea.Flags&EventFlagWakeupWatermark == 0 {
+		attr.WakeupEventsOrWatermark = ea.WakeupEvents
+	} else {
+		attr.WakeupEventsOrWatermark = ea.WakeupWatermark
+	}
+	attr.BranchSampleType = ea.BranchSampleType
+	attr.SampleRegsUser = ea.SampleRegsUser
+	attr.SampleStackUser = ea.SampleStackUser
+	attr.SampleRegsIntr = ea.SampleRegsIntr
+	attr.AuxWatermark = ea.AuxWatermark
+	attr.SampleMaxStack = ea.SampleMaxStack
+	attr.Size = uint32(binary.Size(&attr))
+
+	var buf bytes.Buffer
+	binary.Write(&buf, order, &attr)
+	return buf.Bytes()
+}
@@ -0,0 +1,150 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPipeWriter(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		format := SampleFormatIdentifier | SampleFormatIP | SampleFormatTID | SampleFormatTime | SampleFormatCPU | SampleFormatPeriod | SampleFormatCallchain | SampleFormatRaw | SampleFormatBranchStack
+		cycles := &EventAttr{
+			Event:            EventHardware{ID: EventHardwareIDCPUCycles},
+			SampleFreq:       4000,
+			SampleFormat:     format,
+			Flags:            EventFlagFreq | EventFlagSampleIDAll | EventFlagComm | EventFlagMmap,
+			Precise:          EventPrecisionTryZeroSkid,
+			BranchSampleType: BranchSampleAny,
+		}
+		tp := &EventAttr{
+			Event:        EventTracepoint(42),
+			SamplePeriod: 1,
+			SampleFormat: format,
+			Flags:        EventFlagSampleIDAll,
+		}
+
+		var buf bytes.Buffer
+		w := NewPipeWriter(&buf, order)
+		for _, attr := range []*EventAttr{cycles, tp} {
+			if err := w.AddEvent(attr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.WriteMeta(&FileMeta{Hostname: "gopher", CPUsOnline: 8}); err != nil {
+			t.Fatal(err)
+		}
+		common := func(attr *EventAttr, time uint64) RecordCommon {
+			return RecordCommon{EventAttr: attr, PID: 10, TID: 11, Time: time, CPU: 3}
+		}
+		records := []Record{
+			&RecordComm{RecordCommon: common(nil, 1), Exec: true, Comm: "gopher"},
+			&RecordMmap{RecordCommon: common(nil, 2), Data: false, Addr: 0x400000, Len: 0x1000, Prot: 5, Filename: "/bin/gopher", BuildID: []byte{1, 2, 3, 4}},
+			&RecordSample{
+				RecordCommon: common(cycles, 3),
+				CPUMode:      CPUModeUser,
+				ExactIP:      true,
+				IP:           0x400010,
+				Period:       100,
+				Callchain:    []uint64{uint64(CallchainUser), 0x400010, 0x400100},
+				Raw:          []byte{},
+				BranchStack:  []BranchRecord{{From: 1, To: 2, Flags: BranchFlagPredicted, Cycles: 7, Type: BranchTypeCall}},
+			},
+			&RecordSample{
+				RecordCommon: common(tp, 4),
+				CPUMode:      CPUModeKernel,
+				Callchain:    []uint64{},
+				Raw:          []byte{1, 2, 3, 4},
+				BranchStack:  []BranchRecord{},
+			},
+			&RecordFork{RecordCommon: common(nil, 5), PPID: 10, PTID: 11},
+			&RecordExit{RecordCommon: common(nil, 6), PPID: 10, PTID: 11},
+			&RecordLost{RecordCommon: common(cycles, 7), NumLost: 9},
+		}
+		for _, r := range records {
+			if err := w.WriteRecord(r); err != nil {
+				t.Fatalf("%s: writing %v: %v", order, r.Type(), err)
+			}
+		}
+
+		f, err := NewPipe(&buf)
+		if err != nil {
+			t.Fatalf("%s: %v", order, err)
+		}
+		if f.ByteOrder != order || f.Meta.Hostname != "gopher" || f.Meta.CPUsOnline != 8 {
+			t.Errorf("%s: bad profile %+v", order, f)
+		}
+		if len(f.Events) != 2 {
+			t.Fatalf("%s: got %d events, want 2", order, len(f.Events))
+		}
+		for i, want := range []*EventAttr{cycles, tp} {
+			if got := f.Events[i]; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: event %d:\ngot  %+v\nwant %+v", order, i, got, want)
+			}
+		}
+
+		rs := f.Records(RecordsFileOrder)
+		i := 0
+		for ; rs.Next(); i++ {
+			if i >= len(records) {
+				t.Errorf("%s: unexpected record %+v", order, rs.Record)
+				continue
+			}
+			got, want := rs.Record, records[i]
+			if got.Type() != want.Type() {
+				t.Errorf("%s: record %d: got %v, want %v", order, i, got.Type(), want.Type())
+				continue
+			}
+			// Fill in the fields the reader derives.
+			wc, gc := want.Common(), got.Common()
+			if wc.EventAttr == tp {
+				wc.EventAttr = f.Events[1]
+			} else {
+				wc.EventAttr = f.Events[0]
+			}
+			wc.Offset, wc.Format, wc.ID = gc.Offset, gc.Format, gc.ID
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: record %d:\ngot  %+v\nwant %+v", order, i, got, want)
+			}
+		}
+		if err := rs.Err(); err != nil {
+			t.Errorf("%s: %v", order, err)
+		}
+		if i != len(records) {
+			t.Errorf("%s: got %d records, want %d", order, i, len(records))
+		}
+	}
+}
+
+func TestPipeWriterErrors(t *testing.T) {
+	attr := &EventAttr{
+		Event:        EventHardware{ID: EventHardwareIDCPUCycles},
+		SamplePeriod: 1,
+		SampleFormat: SampleFormatIP | SampleFormatTID,
+	}
+	w := NewPipeWriter(new(bytes.Buffer), binary.LittleEndian)
+	if err := w.AddEvent(attr); err != nil {
+		t.Fatal(err)
+	}
+
+	// A feature section doesn't fit in a record.
+	if err := w.WriteMeta(&FileMeta{Hostname: strings.Repeat("x", 70000)}); err == nil {
+		t.Error("WriteMeta with a 70,000 byte hostname succeeded")
+	}
+
+	// perf's mmap records have room for 20 build ID bytes.
+	mmap := &RecordMmap{Addr: 0x1000, Len: 0x1000, BuildID: make([]byte, 21), Filename: "/bin/x"}
+	if err := w.WriteRecord(mmap); err == nil {
+		t.Error("WriteRecord with a 21 byte build ID succeeded")
+	}
+	mmap.BuildID = mmap.BuildID[:20]
+	if err := w.WriteRecord(mmap); err != nil {
+		t.Errorf("WriteRecord with a 20 byte build ID failed: %v", err)
+	}
+}
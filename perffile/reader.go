@@ -5,6 +5,7 @@
 package perffile
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -26,17 +27,34 @@ type File struct {
 	// Events lists all events that may appear in this profile.
 	Events []*EventAttr
 
+	// ByteOrder is the byte order of the machine that recorded
+	// this profile. Records and metadata are converted to host
+	// form by this package, but payloads that are returned as
+	// raw bytes, such as RecordUnknown.Data, RecordAux data, and
+	// RecordSample.StackUser, are in this byte order.
+	ByteOrder binary.ByteOrder
+
 	r      io.ReaderAt
 	closer io.Closer
 	hdr    fileHeader
 
-	attrs    []fileAttr
+	attrs    []*fileAttr
 	idToAttr map[attrID]*EventAttr
 
 	sampleIDOffset int // byte offset of AttrID in sample
 
 	sampleIDAll    bool // non-samples have sample_id trailer
 	recordIDOffset int  // byte offset of AttrID in non-sample, from end
+
+	// pipe indicates this is a pipe-mode profile. pipeSeen
+	// records the offsets of header records that have already
+	// been processed.
+	pipe     bool
+	pipeSeen map[int64]bool
+
+	// stream is the input stream for a profile opened with
+	// NewPipe. It is nil once Records has consumed it.
+	stream *streamReader
 }
 
 // New reads a "perf.data" file from r.
@@ -52,23 +70,19 @@ func New(r io.ReaderAt) (*File, error) {
 	// See perf_session__read_header in tools/perf/util/header.c
 
 	sr := io.NewSectionReader(r, 0, 1024)
-	if err := binary.Read(sr, binary.LittleEndian, &file.hdr); err != nil {
+	if err := file.readMagic(sr); err != nil {
 		return nil, err
 	}
-	switch string(file.hdr.Magic[:]) {
-	case "PERFILE2":
-		// Version 2, little endian.
-		break
-	case "2ELIFREP":
-		// Version 2, big endian.
-		//
-		// TODO: Support big endian profiles.
-		return nil, fmt.Errorf("big endian profiles not supported")
-	case "PERFFILE":
-		// Version 1 file.
-		return nil, fmt.Errorf("version 1 profiles not supported")
-	default:
-		return nil, fmt.Errorf("bad or unsupported file magic %q", string(file.hdr.Magic[:]))
+	if file.hdr.Size == pipeHeaderSize {
+		// Pipe-mode profile written to a file.
+		if err := file.openPipe(r); err != nil {
+			return nil, err
+		}
+		return file, nil
+	}
+	sr.Seek(0, io.SeekStart)
+	if err := binary.Read(sr, file.ByteOrder, &file.hdr); err != nil {
+		return nil, err
 	}
 	if file.hdr.Size != uint64(binary.Size(&file.hdr)) {
 		return nil, fmt.Errorf("bad header size %d", file.hdr.Size)
@@ -92,10 +106,11 @@ func New(r io.ReaderAt) (*File, error) {
 	} else if nAttrs > 64*1024 {
 		return nil, fmt.Errorf("too many attrs or bad attr size")
 	}
-	file.attrs = make([]fileAttr, nAttrs)
+	file.attrs = make([]*fileAttr, nAttrs)
 	attrSR := file.hdr.Attrs.sectionReader(r)
 	for i := 0; i < nAttrs; i++ {
-		if err := readFileAttr(attrSR, &file.attrs[i]); err != nil {
+		file.attrs[i] = new(fileAttr)
+		if err := readFileAttr(attrSR, file.ByteOrder, file.attrs[i]); err != nil {
 			return nil, err
 		}
 		file.Events = append(file.Events, &file.attrs[i].Attr)
@@ -105,7 +120,7 @@ func New(r io.ReaderAt) (*File, error) {
 	file.idToAttr = make(map[attrID]*EventAttr)
 	for _, attr := range file.attrs {
 		var ids []attrID
-		if err := readSlice(attr.IDs.sectionReader(r), &ids); err != nil {
+		if err := readSlice(attr.IDs.sectionReader(r), file.ByteOrder, &ids); err != nil {
 			return nil, err
 		}
 		for _, id := range ids {
@@ -113,63 +128,100 @@ func New(r io.ReaderAt) (*File, error) {
 		}
 	}
 
-	// Check that sample formats are consistent across all event
-	// types and record cross-event sample format information.
+	if err := file.checkAttrs(); err != nil {
+		return nil, err
+	}
+
+	// Load feature sections.
+	sr = io.NewSectionReader(r, int64(file.hdr.Data.Offset+file.hdr.Data.Size), int64(numFeatureBits*binary.Size(fileSection{})))
+	for bit := feature(0); bit < feature(numFeatureBits); bit++ {
+		if !file.hdr.hasFeature(bit) {
+			continue
+		}
+		sec := fileSection{}
+		if err := binary.Read(sr, file.ByteOrder, &sec); err != nil {
+			return nil, err
+		}
+		file.Meta.parse(bit, sec, file.r, file.ByteOrder)
+	}
+
+	return file, nil
+}
+
+// readMagic reads the magic number and header size common to
+// regular and pipe-mode profiles and sets file.ByteOrder.
+func (file *File) readMagic(r io.Reader) error {
+	var buf [16]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return err
+	}
+	copy(file.hdr.Magic[:], buf[:8])
+	switch string(file.hdr.Magic[:]) {
+	case "PERFILE2":
+		// Version 2, little endian.
+		file.ByteOrder = binary.LittleEndian
+	case "2ELIFREP":
+		// Version 2, big endian. The magic is written as a
+		// 64-bit integer, so it appears reversed.
+		file.ByteOrder = binary.BigEndian
+	case "PERFFILE":
+		// Version 1 file.
+		return fmt.Errorf("version 1 profiles not supported")
+	default:
+		return fmt.Errorf("bad or unsupported file magic %q", string(file.hdr.Magic[:]))
+	}
+	file.hdr.Size = file.ByteOrder.Uint64(buf[8:])
+	return nil
+}
+
+// checkAttrs checks that sample formats are consistent across all
+// event types and records cross-event sample format information.
+func (file *File) checkAttrs() error {
+	if len(file.attrs) == 0 {
+		return fmt.Errorf("no event types")
+	}
 	firstEvent := &file.attrs[0].Attr
 	file.sampleIDOffset = firstEvent.SampleFormat.sampleIDOffset()
 	file.recordIDOffset = firstEvent.SampleFormat.recordIDOffset()
 	file.sampleIDAll = firstEvent.Flags&EventFlagSampleIDAll != 0
 	if len(file.attrs) > 1 {
 		if len(file.idToAttr) == 0 {
-			return nil, fmt.Errorf("file has multiple EventAttrs, but no IDs")
+			return fmt.Errorf("file has multiple EventAttrs, but no IDs")
 		}
 		for _, attr := range file.attrs {
 			// See perf_evlist__valid_sample_type.
 			x := attr.Attr.SampleFormat.sampleIDOffset()
 			if x == -1 {
-				return nil, fmt.Errorf("multiple events, but samples have no event ID field")
+				return fmt.Errorf("multiple events, but samples have no event ID field")
 			} else if file.sampleIDOffset != x {
-				return nil, fmt.Errorf("events have incompatible ID offsets %d and %d", file.sampleIDOffset, x)
+				return fmt.Errorf("events have incompatible ID offsets %d and %d", file.sampleIDOffset, x)
 			}
 
 			x = attr.Attr.SampleFormat.recordIDOffset()
 			if x == -1 {
-				return nil, fmt.Errorf("multiple events, but records have no event ID field")
+				return fmt.Errorf("multiple events, but records have no event ID field")
 			} else if file.recordIDOffset != x {
-				return nil, fmt.Errorf("records have incompatible ID offsets %d and %d", file.recordIDOffset, x)
+				return fmt.Errorf("records have incompatible ID offsets %d and %d", file.recordIDOffset, x)
 			}
 
 			// See perf_evlist__valid_sample_id_all.
 			idAll := attr.Attr.Flags&EventFlagSampleIDAll != 0
 			if file.sampleIDAll != idAll {
-				return nil, fmt.Errorf("events have incompatible SampleIDAll flags")
+				return fmt.Errorf("events have incompatible SampleIDAll flags")
 			}
 
 			// See perf_evlist__valid_read_format.
 			if firstEvent.ReadFormat != attr.Attr.ReadFormat {
-				return nil, fmt.Errorf("events have incompatible read formats")
+				return fmt.Errorf("events have incompatible read formats")
 			}
 		}
 		if firstEvent.SampleFormat&SampleFormatRead != 0 &&
 			firstEvent.ReadFormat&ReadFormatID == 0 {
-			return nil, fmt.Errorf("bad event read format")
-		}
-	}
-
-	// Load feature sections.
-	sr = io.NewSectionReader(r, int64(file.hdr.Data.Offset+file.hdr.Data.Size), int64(numFeatureBits*binary.Size(fileSection{})))
-	for bit := feature(0); bit < feature(numFeatureBits); bit++ {
-		if !file.hdr.hasFeature(bit) {
-			continue
-		}
-		sec := fileSection{}
-		if err := binary.Read(sr, binary.LittleEndian, &sec); err != nil {
-			return nil, err
+			return fmt.Errorf("bad event read format")
 		}
-		file.Meta.parse(bit, sec, file.r)
 	}
 
-	return file, nil
+	return nil
 }
 
 // Open opens the named "perf.data" file using os.Open.
@@ -190,14 +242,30 @@ func Open(name string) (*File, error) {
 	return ff, nil
 }
 
-func readFileAttr(sr *io.SectionReader, fa *fileAttr) error {
+func readFileAttr(sr *io.SectionReader, order binary.ByteOrder, fa *fileAttr) error {
+	var raw bytes.Buffer
+	if err := readEventAttr(io.TeeReader(sr, &raw), order, &fa.Attr); err != nil {
+		return err
+	}
+	fa.raw = raw.Bytes()
+
+	// Finally, read IDs fileSection, which follows the eventAttr.
+	return binary.Read(sr, order, &fa.IDs)
+}
+
+func readEventAttr(sr io.Reader, order binary.ByteOrder, ea *EventAttr) error {
 	// See read_attr in tools/perf/util/header.c.
 
 	// Read the common prefix of all event attr versions.
 	var attr eventAttrVN
-	if err := binary.Read(sr, binary.LittleEndian, &attr.eventAttrV0); err != nil {
+	if err := binary.Read(sr, order, &attr.eventAttrV0); err != nil {
 		return err
 	}
+	if order == binary.BigEndian {
+		// The flags are a C bitfield, which big endian
+		// compilers allocate from the most significant bit.
+		attr.Flags = EventFlags(swapBitfield(uint64(attr.Flags), eventFlagWidths))
+	}
 	if attr.Size == 0 {
 		// Assume ABI v0
 		attr.Size = 64
@@ -211,7 +279,7 @@ func readFileAttr(sr *io.SectionReader, fa *fileAttr) error {
 		rattr := reflect.ValueOf(&attr).Elem()
 		for i := 1; i < rattr.NumField() && left > 0; i++ {
 			field := rattr.Field(i).Addr().Interface()
-			err := binary.Read(sr, binary.LittleEndian, field)
+			err := binary.Read(sr, order, field)
 			if err != nil {
 				return err
 			}
@@ -224,18 +292,18 @@ func readFileAttr(sr *io.SectionReader, fa *fileAttr) error {
 	ev.Type = attr.Type
 	ev.ID = attr.Config
 	if attr.Flags&EventFlagFreq == 0 {
-		fa.Attr.SamplePeriod = attr.SamplePeriodOrFreq
+		ea.SamplePeriod = attr.SamplePeriodOrFreq
 	} else {
-		fa.Attr.SampleFreq = attr.SamplePeriodOrFreq
+		ea.SampleFreq = attr.SamplePeriodOrFreq
 	}
-	fa.Attr.SampleFormat = attr.SampleFormat
-	fa.Attr.ReadFormat = attr.ReadFormat
-	fa.Attr.Flags = attr.Flags &^ eventFlagPreciseMask
-	fa.Attr.Precise = EventPrecision((attr.Flags & eventFlagPreciseMask) >> eventFlagPreciseShift)
+	ea.SampleFormat = attr.SampleFormat
+	ea.ReadFormat = attr.ReadFormat
+	ea.Flags = attr.Flags &^ eventFlagPreciseMask
+	ea.Precise = EventPrecision((attr.Flags & eventFlagPreciseMask) >> eventFlagPreciseShift)
 	if attr.Flags&EventFlagWakeupWatermark == 0 {
-		fa.Attr.WakeupEvents = attr.WakeupEventsOrWatermark
+		ea.WakeupEvents = attr.WakeupEventsOrWatermark
 	} else {
-		fa.Attr.WakeupWatermark = attr.WakeupEventsOrWatermark
+		ea.WakeupWatermark = attr.WakeupEventsOrWatermark
 	}
 	if attr.Type == EventTypeBreakpoint {
 		// For EventTypeBreakpoint, attr.Config is 0 and the
@@ -246,15 +314,15 @@ func readFileAttr(sr *io.SectionReader, fa *fileAttr) error {
 	ev.Config = make([]uint64, 2)
 	ev.Config[0] = attr.BPAddrOrConfig1
 	ev.Config[1] = attr.BPLenOrConfig2
-	fa.Attr.SampleRegsUser = attr.SampleRegsUser
-	fa.Attr.SampleStackUser = attr.SampleStackUser
-	fa.Attr.AuxWatermark = attr.AuxWatermark
-	fa.Attr.SampleMaxStack = attr.SampleMaxStack
-
-	fa.Attr.Event = ev.Decode()
-
-	// Finally, read IDs fileSection, which follows the eventAttr.
-	return binary.Read(sr, binary.LittleEndian, &fa.IDs)
+	ea.BranchSampleType = attr.BranchSampleType
+	ea.SampleRegsUser = attr.SampleRegsUser
+	ea.SampleStackUser = attr.SampleStackUser
+	ea.SampleRegsIntr = attr.SampleRegsIntr
+	ea.AuxWatermark = attr.AuxWatermark
+	ea.SampleMaxStack = attr.SampleMaxStack
+
+	ea.Event = ev.Decode()
+	return nil
 }
 
 // Close closes the File.
@@ -273,7 +341,7 @@ func (f *File) Close() error {
 // readSlice reads an entire section into a slice.  v must be a
 // pointer to a slice; the slice itself may be nil.  The section size
 // must be an exact multiple of the size of the element type of v.
-func readSlice(sr *io.SectionReader, v interface{}) error {
+func readSlice(sr *io.SectionReader, order binary.ByteOrder, v interface{}) error {
 	// Figure out slice value size
 	vt := reflect.TypeOf(v)
 	if vt.Kind() != reflect.Ptr || vt.Elem().Kind() != reflect.Slice {
@@ -290,7 +358,7 @@ func readSlice(sr *io.SectionReader, v interface{}) error {
 	reflect.ValueOf(v).Elem().Set(reflect.MakeSlice(vt.Elem(), nelem, nelem))
 
 	// Read in to slice
-	return binary.Read(sr, binary.LittleEndian, v)
+	return binary.Read(sr, order, v)
 }
 
 //go:generate stringer -type=RecordsOrder
@@ -324,6 +392,19 @@ const (
 // records in this File. Callers should choose the least
 // resource-intensive iteration order that satisfies their needs.
 func (f *File) Records(order RecordsOrder) *Records {
+	if f.r == nil {
+		// Streamed pipe-mode profile.
+		if order != RecordsFileOrder {
+			return &Records{err: fmt.Errorf("streamed profiles support only RecordsFileOrder")}
+		}
+		if f.stream == nil {
+			return &Records{err: fmt.Errorf("streamed profile records already read")}
+		}
+		rs := &Records{f: f, sr: f.stream}
+		f.stream = nil
+		return rs
+	}
+
 	if order == RecordsCausalOrder || order == RecordsTimeOrder {
 		// Sort the records by making two passes: first record
 		// the offsets and time-stamps of all records, then
@@ -345,7 +426,21 @@ func (f *File) Records(order RecordsOrder) *Records {
 		// performing separately buffered reads of each
 		// sub-stream.
 
-		rs := f.Records(RecordsFileOrder)
+		newReader := func() io.ReadSeeker {
+			return newBufferedSectionReader(f.hdr.Data.sectionReader(f.r))
+		}
+		if f.Meta.Compression != nil {
+			// Records in compressed records can't be sought
+			// to in the file, so re-read them from the
+			// decompressed data.
+			data, err := f.decompressedData()
+			if err != nil {
+				return &Records{err: err}
+			}
+			newReader = func() io.ReadSeeker { return bytes.NewReader(data) }
+		}
+
+		rs := &Records{f: f, sr: newReader()}
 		pos, ts := make([]int64, 0), make([]uint64, 0)
 		for rs.Next() {
 			c := rs.Record.Common()
@@ -356,12 +451,33 @@ func (f *File) Records(order RecordsOrder) *Records {
 			return &Records{err: rs.Err()}
 		}
 		sort.Stable(&timeSorter{pos, ts})
-		return &Records{f: f, sr: newBufferedSectionReader(f.hdr.Data.sectionReader(f.r)), order: pos}
+		return &Records{f: f, sr: newReader(), order: pos}
 	}
 
 	return &Records{f: f, sr: newBufferedSectionReader(f.hdr.Data.sectionReader(f.r))}
 }
 
+// decompressedData returns the data section of f with each
+// compressed record replaced by the records it contains. Records in
+// the result are at their offsets (relative to the data section) as
+// reported by Records.
+func (f *File) decompressedData() ([]byte, error) {
+	var data []byte
+	rs := f.Records(RecordsFileOrder)
+	for rs.Next() {
+		var hdr [8]byte
+		f.ByteOrder.PutUint32(hdr[0:], uint32(rs.rawHdr.Type))
+		f.ByteOrder.PutUint16(hdr[4:], uint16(rs.rawHdr.Misc))
+		f.ByteOrder.PutUint16(hdr[6:], rs.rawHdr.Size)
+		data = append(data, hdr[:]...)
+		data = append(data, rs.raw...)
+		if r, ok := rs.Record.(*RecordAuxtrace); ok {
+			data = append(data, r.Data...)
+		}
+	}
+	return data, rs.Err()
+}
+
 type timeSorter struct {
 	pos []int64
 	ts  []uint64
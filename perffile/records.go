@@ -8,6 +8,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+
+	"github.com/aclements/go-perf/internal/zstd"
 )
 
 // A Records is an iterator over the records in a "perf.data" file.
@@ -30,7 +32,7 @@ type Records struct {
 	Record Record
 
 	f   *File
-	sr  *bufferedSectionReader // or *io.SectionReader
+	sr  io.ReadSeeker // *bufferedSectionReader or *streamReader
 	err error
 
 	// order specifies the seek order to read records in. If nil,
@@ -41,6 +43,24 @@ type Records struct {
 	// Read buffer.  Reused (and resized) by Next.
 	buf []byte
 
+	// rawHdr and raw are the header and undecoded body of the
+	// current record.
+	rawHdr recordHeader
+	raw    []byte
+
+	// zbuf holds records decompressed from compressed records
+	// that Next hasn't returned yet. A record may span several
+	// compressed records, so zbuf may end with a partial record.
+	zdec  *zstd.Decoder
+	zbuf  []byte
+	zdata []byte // Backing store of zbuf
+
+	// zdelta is the number of bytes the compressed records read
+	// so far grew by when decompressed. Offsets of records are in
+	// the decompressed stream, so they are file offsets plus
+	// zdelta.
+	zdelta int64
+
 	// Cache for common record types
 	recordMmap          RecordMmap
 	recordComm          RecordComm
@@ -83,27 +103,76 @@ func (r *Records) Next() bool {
 	}
 
 	var common RecordCommon
-	offset, _ := r.sr.Seek(0, 1)
-	common.Offset = offset + int64(r.f.hdr.Data.Offset)
-
-	// Read record header
 	var hdr recordHeader
-	if err := binary.Read(r.sr, binary.LittleEndian, &hdr); err != nil {
-		if err != io.EOF {
+	var bd *bufDecoder
+	for {
+		offset, _ := r.sr.Seek(0, 1)
+
+		// Return records decompressed from earlier
+		// compressed records first.
+		if len(r.zbuf) >= 8 {
+			hdr = recordHeader{
+				Type: RecordType(r.f.ByteOrder.Uint32(r.zbuf)),
+				Misc: recordMisc(r.f.ByteOrder.Uint16(r.zbuf[4:])),
+				Size: r.f.ByteOrder.Uint16(r.zbuf[6:]),
+			}
+			if hdr.Size < 8 {
+				r.err = fmt.Errorf("compressed record has bad size %d", hdr.Size)
+				return false
+			}
+			if len(r.zbuf) >= int(hdr.Size) {
+				common.Offset = offset + r.zdelta - int64(len(r.zbuf)) + int64(r.f.hdr.Data.Offset)
+				bd = &bufDecoder{r.zbuf[8:hdr.Size], r.f.ByteOrder}
+				r.zbuf = r.zbuf[hdr.Size:]
+				break
+			}
+		}
+
+		common.Offset = offset + r.zdelta + int64(r.f.hdr.Data.Offset)
+
+		// Read record header
+		if err := binary.Read(r.sr, r.f.ByteOrder, &hdr); err != nil {
+			if err == io.EOF && len(r.zbuf) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != io.EOF {
+				r.err = err
+			}
+			return false
+		}
+
+		// Read record data
+		rlen := int(hdr.Size - 8)
+		if rlen > len(r.buf) {
+			r.buf = make([]byte, rlen)
+		}
+		bd = &bufDecoder{r.buf[:rlen], r.f.ByteOrder}
+		if _, err := io.ReadFull(r.sr, bd.buf); err != nil {
 			r.err = err
+			return false
 		}
-		return false
-	}
 
-	// Read record data
-	rlen := int(hdr.Size - 8)
-	if rlen > len(r.buf) {
-		r.buf = make([]byte, rlen)
+		if hdr.Type == recordTypeCompressed || hdr.Type == recordTypeCompressed2 {
+			if !r.decompress(&hdr, bd) {
+				return false
+			}
+			continue
+		}
+		if len(r.zbuf) > 0 {
+			r.err = fmt.Errorf("compressed records end in the middle of a record")
+			return false
+		}
+		break
 	}
-	var bd = &bufDecoder{r.buf[:rlen], binary.LittleEndian}
-	if _, err := io.ReadFull(r.sr, bd.buf); err != nil {
-		r.err = err
-		return false
+
+	r.rawHdr, r.raw = hdr, bd.buf
+
+	if r.f.pipe && isPipeHeaderRecord(hdr.Type) {
+		// Consume metadata records in pipe-mode profiles.
+		if r.err = r.f.pipeRecord(common.Offset, &hdr, bd.buf, r.sr); r.err != nil {
+			return false
+		}
+		return r.Next()
 	}
 
 	// Parse common sample_id fields
@@ -198,6 +267,45 @@ func (r *Records) Next() bool {
 	return true
 }
 
+// decompress decompresses the compressed record in bd and adds the
+// records it contains to r.zbuf. See
+// perf_session__process_compressed_event in tools/perf/util/session.c.
+func (r *Records) decompress(hdr *recordHeader, bd *bufDecoder) bool {
+	if c := r.f.Meta.Compression; c != nil && c.Type != CompressionZstd {
+		r.err = fmt.Errorf("unsupported record compression %s", c.Type)
+		return false
+	}
+	data := bd.buf
+	if hdr.Type == recordTypeCompressed2 {
+		// This version has an explicit data size, followed by
+		// padding.
+		size := bd.u64()
+		if size > uint64(len(bd.buf)) {
+			r.err = fmt.Errorf("compressed record data size %d exceeds record size", size)
+			return false
+		}
+		data = bd.buf[:size]
+	}
+
+	if r.zdec == nil {
+		r.zdec = zstd.NewDecoder()
+		// perf decompresses each record into a buffer of the
+		// ring buffer's size, so a record can't legitimately
+		// decompress to much more than that.
+		r.zdec.MaxOutput = 64 << 20
+	}
+	n := copy(r.zdata, r.zbuf)
+	before := n
+	r.zdata, r.err = r.zdec.Decode(r.zdata[:n], data)
+	if r.err != nil {
+		r.err = fmt.Errorf("decompressing records: %w", r.err)
+		return false
+	}
+	r.zbuf = r.zdata
+	r.zdelta += int64(len(r.zdata)-before) - int64(hdr.Size)
+	return true
+}
+
 func (r *Records) getAttr(id attrID, nilOk bool) *EventAttr {
 	// See perf_evlist__id2evsel in tools/perf/util/evlist.c.
 
@@ -252,6 +360,7 @@ func (r *Records) parseMmap(bd *bufDecoder, hdr *recordHeader, common *RecordCom
 	o.Format |= SampleFormatTID
 
 	// Decode hdr.Misc
+	o.CPUMode = CPUMode(hdr.Misc & recordMiscCPUModeMask)
 	o.Data = (hdr.Misc&recordMiscMmapData != 0)
 
 	// Decode fields. Note that perf calls the file offset
@@ -269,6 +378,10 @@ func (r *Records) parseMmap(bd *bufDecoder, hdr *recordHeader, common *RecordCom
 			}
 			bd.skip(3)
 			bd.bytes(o.BuildID)
+			// The build ID field is always 20 bytes.
+			if buildIDLen < 20 {
+				bd.skip(20 - buildIDLen)
+			}
 
 			o.Major, o.Minor = 0, 0
 			o.Ino, o.InoGeneration = 0, 0
@@ -534,8 +647,17 @@ func (r *Records) parseSample(bd *bufDecoder, hdr *recordHeader, common *RecordC
 		o.Callchain = nil
 	}
 
-	rawSize := bd.u32If(t&SampleFormatRaw != 0)
-	bd.skip(int(rawSize))
+	if t&SampleFormatRaw != 0 {
+		rawSize := int(bd.u32())
+		if o.Raw == nil || cap(o.Raw) < rawSize {
+			o.Raw = make([]byte, rawSize)
+		} else {
+			o.Raw = o.Raw[:rawSize]
+		}
+		bd.bytes(o.Raw)
+	} else {
+		o.Raw = nil
+	}
 
 	o.BranchHWIndex = bd.i64If(o.EventAttr.BranchSampleType&BranchSampleHWIndex != 0)
 
@@ -551,6 +673,9 @@ func (r *Records) parseSample(bd *bufDecoder, hdr *recordHeader, common *RecordC
 			br.From = bd.u64()
 			br.To = bd.u64()
 			flags := bd.u64()
+			if bd.order == binary.BigEndian {
+				flags = swapBitfield(flags, branchFlagWidths)
+			}
 			// First 4 bits are flags
 			br.Flags = BranchFlags(flags & 0x0f)
 			// Next 16 bits are cycles
@@ -683,10 +808,12 @@ func (r *Records) parseReadFormat(bd *bufDecoder, f ReadFormat, out *[]Count) {
 			o.EventAttr = nil
 		}
 	} else {
+		// The times are shared by the whole group.
+		enabled := bd.u64If(f&ReadFormatTotalTimeEnabled != 0)
+		running := bd.u64If(f&ReadFormatTotalTimeRunning != 0)
 		for i := range *out {
 			o := &(*out)[i]
-			o.TimeEnabled = bd.u64If(f&ReadFormatTotalTimeEnabled != 0)
-			o.TimeRunning = bd.u64If(f&ReadFormatTotalTimeRunning != 0)
+			o.TimeEnabled, o.TimeRunning = enabled, running
 			o.Value = bd.u64()
 			if f&ReadFormatID != 0 {
 				o.EventAttr = r.getAttr(attrID(bd.u64()), false)
@@ -0,0 +1,45 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestParseGroupRead(t *testing.T) {
+	f := &File{
+		attrs:    []*fileAttr{{Attr: EventAttr{Event: EventHardware{ID: EventHardwareIDCPUCycles}}}, {Attr: EventAttr{Event: EventHardware{ID: EventHardwareIDInstructions}}}},
+		idToAttr: make(map[attrID]*EventAttr),
+	}
+	f.idToAttr[10] = &f.attrs[0].Attr
+	f.idToAttr[11] = &f.attrs[1].Attr
+	r := &Records{f: f}
+
+	// A group read is the number of members, the group's enabled
+	// and running times, then a value and ID for each member.
+	order := binary.LittleEndian
+	vals := []uint64{2, 1000, 500, 123, 10, 456, 11}
+	buf := make([]byte, 8*len(vals))
+	for i, v := range vals {
+		order.PutUint64(buf[8*i:], v)
+	}
+	bd := &bufDecoder{buf, order}
+	format := ReadFormatGroup | ReadFormatTotalTimeEnabled | ReadFormatTotalTimeRunning | ReadFormatID
+	var got []Count
+	r.parseReadFormat(bd, format, &got)
+
+	want := []Count{
+		{Value: 123, TimeEnabled: 1000, TimeRunning: 500, EventAttr: &f.attrs[0].Attr},
+		{Value: 456, TimeEnabled: 1000, TimeRunning: 500, EventAttr: &f.attrs[1].Attr},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if len(bd.buf) != 0 {
+		t.Errorf("%d bytes left over", len(bd.buf))
+	}
+}
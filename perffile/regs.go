@@ -0,0 +1,117 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RegisterNames returns the names of the registers selected by mask
+// (such as EventAttr.SampleRegsUser or SampleRegsIntr) on
+// architecture arch (such as FileMeta.Arch) with register ABI abi.
+// The i'th name corresponds to the i'th register value in
+// RecordSample.RegsUser or RegsIntr.
+//
+// The names follow those used by perf. Registers that are unknown for
+// arch are named "regN", where N is the register's bit index in
+// mask.
+//
+// This does not depend on the architecture of the host, so it can be
+// used to interpret profiles recorded on other architectures.
+func RegisterNames(arch string, abi SampleRegsABI, mask uint64) []string {
+	table := regTable(arch, abi)
+	names := make([]string, 0, weight(mask))
+	for bit := 0; bit < 64; bit++ {
+		if mask&(1<<uint(bit)) == 0 {
+			continue
+		}
+		if bit < len(table) && table[bit] != "" {
+			names = append(names, table[bit])
+		} else {
+			names = append(names, fmt.Sprintf("reg%d", bit))
+		}
+	}
+	return names
+}
+
+// regTable returns the register names indexed by PERF_REG_* value
+// for arch and abi, or nil if unknown.
+func regTable(arch string, abi SampleRegsABI) []string {
+	switch {
+	case arch == "x86_64" || arch == "amd64" || arch == "i386" || arch == "i686" || arch == "x86":
+		// 32-bit tasks on x86_64 use the same register
+		// numbering. R8-R15 are simply not available.
+		return regsX86
+	case arch == "aarch64" || arch == "arm64":
+		if abi == SampleRegsABI32 {
+			// Compat tasks use the 32-bit ARM layout.
+			return regsARM
+		}
+		return regsARM64
+	case strings.HasPrefix(arch, "arm"):
+		return regsARM
+	case arch == "riscv64" || arch == "riscv32":
+		return regsRISCV
+	case arch == "s390x" || arch == "s390":
+		return regsS390
+	}
+	return nil
+}
+
+// perf_event_x86_regs from arch/x86/include/uapi/asm/perf_regs.h
+var regsX86 = func() []string {
+	regs := make([]string, 64)
+	copy(regs, []string{
+		"AX", "BX", "CX", "DX", "SI", "DI", "BP", "SP",
+		"IP", "FLAGS", "CS", "SS", "DS", "ES", "FS", "GS",
+		"R8", "R9", "R10", "R11", "R12", "R13", "R14", "R15",
+	})
+	// Each XMM register occupies two bits, starting at 32. The
+	// name is on the low half.
+	for i := 0; i < 16; i++ {
+		regs[32+2*i] = fmt.Sprintf("XMM%d", i)
+	}
+	return regs
+}()
+
+// perf_event_arm64_regs from arch/arm64/include/uapi/asm/perf_regs.h
+var regsARM64 = func() []string {
+	regs := make([]string, 47)
+	for i := 0; i <= 29; i++ {
+		regs[i] = fmt.Sprintf("x%d", i)
+	}
+	regs[30] = "lr"
+	regs[31] = "sp"
+	regs[32] = "pc"
+	regs[46] = "vg"
+	return regs
+}()
+
+// perf_event_arm_regs from arch/arm/include/uapi/asm/perf_regs.h
+var regsARM = []string{
+	"r0", "r1", "r2", "r3", "r4", "r5", "r6", "r7",
+	"r8", "r9", "r10", "fp", "ip", "sp", "lr", "pc",
+}
+
+// perf_event_riscv_regs from arch/riscv/include/uapi/asm/perf_regs.h
+var regsRISCV = []string{
+	"pc", "ra", "sp", "gp", "tp", "t0", "t1", "t2",
+	"s0", "s1", "a0", "a1", "a2", "a3", "a4", "a5",
+	"a6", "a7", "s2", "s3", "s4", "s5", "s6", "s7",
+	"s8", "s9", "s10", "s11", "t3", "t4", "t5", "t6",
+}
+
+// perf_event_s390_regs from arch/s390/include/uapi/asm/perf_regs.h
+var regsS390 = func() []string {
+	regs := make([]string, 34)
+	for i := 0; i < 16; i++ {
+		regs[i] = fmt.Sprintf("r%d", i)
+		regs[16+i] = fmt.Sprintf("fp%d", i)
+	}
+	regs[32] = "mask"
+	regs[33] = "pc"
+	return regs
+}()
@@ -0,0 +1,33 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRegisterNames(t *testing.T) {
+	for _, test := range []struct {
+		arch string
+		abi  SampleRegsABI
+		mask uint64
+		want []string
+	}{
+		{"x86_64", SampleRegsABI64, 1<<6 | 1<<7 | 1<<8, []string{"BP", "SP", "IP"}},
+		{"x86_64", SampleRegsABI64, 3 << 34, []string{"XMM1", "reg35"}},
+		{"aarch64", SampleRegsABI64, 1<<29 | 1<<30 | 1<<31 | 1<<32, []string{"x29", "lr", "sp", "pc"}},
+		{"aarch64", SampleRegsABI32, 1<<11 | 1<<15, []string{"fp", "pc"}},
+		{"armv7l", SampleRegsABI32, 1<<13 | 1<<14, []string{"sp", "lr"}},
+		{"riscv64", SampleRegsABI64, 1<<0 | 1<<10, []string{"pc", "a0"}},
+		{"s390x", SampleRegsABI64, 1<<15 | 1<<33, []string{"r15", "pc"}},
+		{"mips", SampleRegsABI64, 1 << 2, []string{"reg2"}},
+	} {
+		got := RegisterNames(test.arch, test.abi, test.mask)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("RegisterNames(%q, %v, %#x) = %v; want %v", test.arch, test.abi, test.mask, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A TracepointDecoder decodes the raw data of a tracepoint directly
+// into a Go struct. This resolves the struct's fields against the
+// tracepoint format once, so it's cheaper than looking up each field
+// by name for every sample.
+type TracepointDecoder struct {
+	typ    reflect.Type // Pointer to struct
+	fields []decodeField
+	minLen int
+}
+
+type decodeField struct {
+	index    int // Index of the Go field
+	f        *TracepointField
+	elemSize int // Element size of array fields
+
+	// lo and width select a bit field, if width != 0.
+	lo, width uint
+}
+
+// Decoder returns a TracepointDecoder that decodes t's raw data into
+// structs of the type v points to.
+//
+// Each exported field of the struct with a "perf" tag is decoded from
+// the tracepoint field named by the tag. For example,
+//
+//	type sched_switch struct {
+//		PrevComm  string `perf:"prev_comm"`
+//		PrevPID   int32  `perf:"prev_pid"`
+//		PrevState uint8  `perf:"prev_state,bits=0-3"`
+//		NextPID   int32  `perf:"next_pid"`
+//	}
+//
+// Integer and bool fields are decoded from integer tracepoint fields.
+// The "bits=lo-hi" option extracts bits lo through hi, inclusive, of
+// the integer. String and []byte fields are decoded from character
+// arrays, including dynamic (__data_loc) arrays. Arrays and slices of
+// integers are decoded from arrays of integers.
+//
+// Decoder returns an error if a tagged field doesn't exist in the
+// tracepoint or has an incompatible type.
+func (t *TracepointFormat) Decoder(v interface{}) (*TracepointDecoder, error) {
+	typ := reflect.TypeOf(v)
+	if typ == nil || typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("decoding %s: want pointer to struct, got %v", t, typ)
+	}
+	d := &TracepointDecoder{typ: typ}
+	st := typ.Elem()
+	for i := 0; i < st.NumField(); i++ {
+		sf := st.Field(i)
+		tag, ok := sf.Tag.Lookup("perf")
+		if !ok || tag == "-" || sf.PkgPath != "" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		f := t.Field(opts[0])
+		if f == nil {
+			return nil, fmt.Errorf("decoding %s: no field %q", t, opts[0])
+		}
+		df := decodeField{index: i, f: f}
+		for _, opt := range opts[1:] {
+			if !strings.HasPrefix(opt, "bits=") || !df.parseBits(opt[len("bits="):], f.Size) {
+				return nil, fmt.Errorf("decoding %s: bad option %q for field %s", t, opt, f.Name)
+			}
+		}
+		if err := df.check(sf.Type); err != nil {
+			return nil, fmt.Errorf("decoding %s: field %s: %v", t, f.Name, err)
+		}
+		d.fields = append(d.fields, df)
+		if end := f.Offset + f.Size; end > d.minLen {
+			d.minLen = end
+		}
+	}
+	return d, nil
+}
+
+// parseBits parses a bit range "lo-hi" in an integer of size bytes.
+func (df *decodeField) parseBits(s string, size int) bool {
+	i := strings.IndexByte(s, '-')
+	if i < 0 {
+		return false
+	}
+	lo, err1 := strconv.ParseUint(s[:i], 10, 8)
+	hi, err2 := strconv.ParseUint(s[i+1:], 10, 8)
+	if err1 != nil || err2 != nil || hi < lo || hi >= uint64(size*8) {
+		return false
+	}
+	df.lo, df.width = uint(lo), uint(hi-lo+1)
+	return true
+}
+
+// check checks that the tracepoint field can be decoded into Go type
+// typ and computes the element size of array fields.
+func (df *decodeField) check(typ reflect.Type) error {
+	f := df.f
+	isArray := strings.HasSuffix(f.Type, "]")
+	if df.width != 0 && (isArray || !isIntKind(typ.Kind())) {
+		return fmt.Errorf("bits option requires an integer")
+	}
+	switch {
+	case isIntKind(typ.Kind()) || typ.Kind() == reflect.Bool:
+		if isArray || (f.Size != 1 && f.Size != 2 && f.Size != 4 && f.Size != 8) {
+			return fmt.Errorf("cannot decode %s into %v", f.Type, typ)
+		}
+		return nil
+
+	case typ.Kind() == reflect.String, typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8:
+		if !isArray {
+			return fmt.Errorf("cannot decode %s into %v", f.Type, typ)
+		}
+		df.elemSize = 1
+		return nil
+
+	case (typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array) && isIntKind(typ.Elem().Kind()):
+		df.elemSize = arrayElemSize(f)
+		if df.elemSize == 0 {
+			return fmt.Errorf("cannot decode %s into %v", f.Type, typ)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported type %v", typ)
+}
+
+func isIntKind(k reflect.Kind) bool {
+	return reflect.Int <= k && k <= reflect.Uintptr
+}
+
+// cTypeSizes gives the sizes of C integer types whose size doesn't
+// depend on the architecture.
+var cTypeSizes = map[string]int{
+	"char": 1, "unsigned char": 1, "signed char": 1, "u8": 1, "s8": 1, "bool": 1,
+	"short": 2, "unsigned short": 2, "u16": 2, "s16": 2,
+	"int": 4, "unsigned int": 4, "u32": 4, "s32": 4, "pid_t": 4,
+	"long long": 8, "unsigned long long": 8, "u64": 8, "s64": 8,
+}
+
+// arrayElemSize returns the size of the elements of array field f, or
+// 0 if f isn't an array or its element size is unknown.
+func arrayElemSize(f *TracepointField) int {
+	i := strings.LastIndexByte(f.Type, '[')
+	if i < 0 || !strings.HasSuffix(f.Type, "]") {
+		return 0
+	}
+	if n, err := strconv.Atoi(f.Type[i+1 : len(f.Type)-1]); err == nil {
+		// Fixed-size array.
+		if n <= 0 || f.Size%n != 0 {
+			return 0
+		}
+		return f.Size / n
+	}
+	elem := strings.TrimSpace(strings.TrimPrefix(f.Type[:i], "__data_loc"))
+	return cTypeSizes[elem]
+}
+
+// Decode decodes the tracepoint raw data raw, such as from
+// RecordSample.Raw, into v, which must have the type passed to
+// Decoder.
+func (d *TracepointDecoder) Decode(raw []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Type() != d.typ {
+		return fmt.Errorf("cannot decode into %v, want %v", rv.Type(), d.typ)
+	}
+	if len(raw) < d.minLen {
+		return fmt.Errorf("tracepoint data too short: %d bytes, want %d", len(raw), d.minLen)
+	}
+	st := rv.Elem()
+	for i := range d.fields {
+		df := &d.fields[i]
+		fv := st.Field(df.index)
+		switch kind := fv.Kind(); {
+		case isIntKind(kind) || kind == reflect.Bool:
+			x := df.f.Uint(raw)
+			if df.width != 0 {
+				x = x >> df.lo & (1<<df.width - 1)
+			}
+			setInt(fv, x)
+
+		case kind == reflect.String:
+			fv.SetString(df.f.String(raw))
+
+		case kind == reflect.Slice && fv.Type().Elem().Kind() == reflect.Uint8:
+			fv.SetBytes(append([]byte(nil), df.f.Bytes(raw)...))
+
+		default:
+			// Array or slice of integers.
+			b := df.f.Bytes(raw)
+			n := len(b) / df.elemSize
+			if kind == reflect.Slice {
+				fv.Set(reflect.MakeSlice(fv.Type(), n, n))
+			} else if n > fv.Len() {
+				n = fv.Len()
+			}
+			elem := TracepointField{Size: df.elemSize, Signed: isSignedKind(fv.Type().Elem().Kind()), order: df.f.order}
+			for j := 0; j < n; j++ {
+				setInt(fv.Index(j), elem.Uint(b[j*df.elemSize:]))
+			}
+		}
+	}
+	return nil
+}
+
+func isSignedKind(k reflect.Kind) bool {
+	return reflect.Int <= k && k <= reflect.Int64
+}
+
+// setInt stores x in integer or bool value v, truncating it to v's
+// size.
+func setInt(v reflect.Value, x uint64) {
+	switch {
+	case v.Kind() == reflect.Bool:
+		v.SetBool(x != 0)
+	case isSignedKind(v.Kind()):
+		v.SetInt(int64(x))
+	default:
+		v.SetUint(x)
+	}
+}
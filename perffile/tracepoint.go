@@ -0,0 +1,313 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A TracepointFormat describes the layout of the raw data of a
+// tracepoint event, as found in RecordSample.Raw.
+//
+// This corresponds to the tracing/events/*/*/format files under
+// tracefs.
+type TracepointFormat struct {
+	ID     EventTracepoint
+	System string // Such as "sched"
+	Name   string // Such as "sched_switch"
+	Fields []TracepointField
+}
+
+// A TracepointField is one field of a tracepoint's raw data.
+type TracepointField struct {
+	Name string
+
+	// Type is the C type of the field, such as "unsigned int" or
+	// "char[16]". Dynamic arrays have type "__data_loc T[]".
+	Type string
+
+	Offset, Size int
+	Signed       bool
+
+	order binary.ByteOrder
+}
+
+// Field returns the field of t named name, or nil if there is none.
+func (t *TracepointFormat) Field(name string) *TracepointField {
+	for i := range t.Fields {
+		if t.Fields[i].Name == name {
+			return &t.Fields[i]
+		}
+	}
+	return nil
+}
+
+// Uint returns the value of integer field f in raw data raw.
+// Signed fields are sign-extended, so they can be converted to int64.
+// It returns 0 if raw is too short.
+func (f *TracepointField) Uint(raw []byte) uint64 {
+	if !f.inBounds(raw) {
+		return 0
+	}
+	b := raw[f.Offset:]
+	var x uint64
+	switch f.Size {
+	case 1:
+		x = uint64(b[0])
+		if f.Signed {
+			x = uint64(int8(x))
+		}
+	case 2:
+		x = uint64(f.order.Uint16(b))
+		if f.Signed {
+			x = uint64(int16(x))
+		}
+	case 4:
+		x = uint64(f.order.Uint32(b))
+		if f.Signed {
+			x = uint64(int32(x))
+		}
+	case 8:
+		x = f.order.Uint64(b)
+	}
+	return x
+}
+
+// Bytes returns the contents of array field f in raw data raw. For
+// dynamic arrays (__data_loc), it returns the referenced data. It
+// returns nil if raw is too short.
+func (f *TracepointField) Bytes(raw []byte) []byte {
+	if !f.inBounds(raw) {
+		return nil
+	}
+	if strings.HasPrefix(f.Type, "__data_loc") && f.Size == 4 {
+		// The low 16 bits are the offset of the data; the
+		// high 16 bits are its length.
+		loc := f.order.Uint32(raw[f.Offset:])
+		off, n := int(loc&0xffff), int(loc>>16)
+		if off+n > len(raw) {
+			return nil
+		}
+		return raw[off : off+n]
+	}
+	return raw[f.Offset : f.Offset+f.Size]
+}
+
+// inBounds reports whether field f lies within raw data raw.
+func (f *TracepointField) inBounds(raw []byte) bool {
+	return f.Offset >= 0 && f.Size >= 0 && f.Offset <= len(raw)-f.Size
+}
+
+// String returns the contents of character array field f in raw data
+// raw, up to the first NUL.
+func (f *TracepointField) String(raw []byte) string {
+	b := f.Bytes(raw)
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// TracepointFormats returns the formats of the tracepoint events
+// recorded in the profile, indexed by tracepoint ID. It returns nil
+// if the profile has no tracing data.
+//
+// This decodes the tracing data on every call, so callers should
+// save the result.
+func (m *FileMeta) TracepointFormats() (map[EventTracepoint]*TracepointFormat, error) {
+	load := m.raw[featureTracingData]
+	if load == nil {
+		return nil, nil
+	}
+	data, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return parseTracingData(data)
+}
+
+var errTracingData = errors.New("malformed tracing data")
+
+// parseTracingData parses the tracing data written by perf. See
+// trace_report in tools/perf/util/trace-event-read.c.
+func parseTracingData(data []byte) (map[EventTracepoint]*TracepointFormat, error) {
+	const magic = "\x17\x08\x44tracing"
+	if !bytes.HasPrefix(data, []byte(magic)) {
+		return nil, errTracingData
+	}
+	td := &traceDecoder{buf: data[len(magic):]}
+	td.cstring() // Version
+	if td.err != nil || len(td.buf) < 6 {
+		return nil, errTracingData
+	}
+	td.order = binary.LittleEndian
+	if td.buf[0] != 0 {
+		td.order = binary.BigEndian
+	}
+	td.buf = td.buf[2:] // Skip endianness and long size
+	td.u32()            // Page size
+
+	// Header files.
+	for _, name := range []string{"header_page", "header_event"} {
+		if td.cstring() != name {
+			return nil, errTracingData
+		}
+		td.next(int(td.u64()))
+	}
+
+	formats := make(map[EventTracepoint]*TracepointFormat)
+	add := func(system string, text []byte) {
+		if t := parseTracepointFormat(system, string(text), td.order); t != nil {
+			formats[t.ID] = t
+		}
+	}
+
+	// Ftrace events.
+	for n := td.u32(); n > 0 && td.err == nil; n-- {
+		add("ftrace", td.next(int(td.u64())))
+	}
+
+	// Event systems.
+	for n := td.u32(); n > 0 && td.err == nil; n-- {
+		system := td.cstring()
+		for m := td.u32(); m > 0 && td.err == nil; m-- {
+			add(system, td.next(int(td.u64())))
+		}
+	}
+	if td.err != nil {
+		return nil, td.err
+	}
+
+	// The remaining sections (kallsyms, printk formats, and, in
+	// version 0.6, saved cmdlines) aren't needed.
+	return formats, nil
+}
+
+// parseTracepointFormat parses the text of a tracepoint format file.
+// It returns nil if the text isn't a valid format.
+func parseTracepointFormat(system, text string, order binary.ByteOrder) *TracepointFormat {
+	t := &TracepointFormat{System: system}
+	haveID := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "name:"):
+			t.Name = strings.TrimSpace(line[len("name:"):])
+		case strings.HasPrefix(line, "ID:"):
+			id, err := strconv.ParseUint(strings.TrimSpace(line[len("ID:"):]), 10, 64)
+			if err != nil {
+				return nil
+			}
+			t.ID, haveID = EventTracepoint(id), true
+		case strings.HasPrefix(line, "field:"):
+			if f, ok := parseTracepointField(line, order); ok {
+				t.Fields = append(t.Fields, f)
+			}
+		}
+	}
+	if !haveID {
+		return nil
+	}
+	return t
+}
+
+// parseTracepointField parses a field line such as
+//
+//	field:char prev_comm[16];	offset:8;	size:16;	signed:1;
+func parseTracepointField(line string, order binary.ByteOrder) (TracepointField, bool) {
+	f := TracepointField{order: order}
+	for _, part := range strings.Split(line, ";") {
+		part = strings.TrimSpace(part)
+		i := strings.IndexByte(part, ':')
+		if i < 0 {
+			continue
+		}
+		key, val := part[:i], strings.TrimSpace(part[i+1:])
+		switch key {
+		case "field":
+			// Split the declaration into its type and name,
+			// moving any array suffix to the type.
+			decl, suffix := val, ""
+			if strings.HasSuffix(decl, "]") {
+				j := strings.LastIndexByte(decl, '[')
+				if j < 0 {
+					return f, false
+				}
+				decl, suffix = decl[:j], decl[j:]
+			}
+			j := strings.LastIndexAny(decl, " \t*")
+			if j < 0 {
+				return f, false
+			}
+			f.Name = decl[j+1:]
+			f.Type = strings.TrimSpace(decl[:j+1]) + suffix
+		case "offset", "size":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return f, false
+			}
+			if key == "offset" {
+				f.Offset = n
+			} else {
+				f.Size = n
+			}
+		case "signed":
+			f.Signed = val == "1"
+		}
+	}
+	return f, f.Name != ""
+}
+
+// traceDecoder decodes tracing data. Unlike bufDecoder, it checks
+// bounds, since the tracing data is free-form.
+type traceDecoder struct {
+	buf   []byte
+	order binary.ByteOrder
+	err   error
+}
+
+func (d *traceDecoder) next(n int) []byte {
+	if d.err != nil || n < 0 || n > len(d.buf) {
+		d.err = errTracingData
+		return nil
+	}
+	x := d.buf[:n]
+	d.buf = d.buf[n:]
+	return x
+}
+
+func (d *traceDecoder) u32() uint32 {
+	if b := d.next(4); b != nil {
+		return d.order.Uint32(b)
+	}
+	return 0
+}
+
+func (d *traceDecoder) u64() uint64 {
+	if b := d.next(8); b != nil {
+		return d.order.Uint64(b)
+	}
+	return 0
+}
+
+func (d *traceDecoder) cstring() string {
+	i := bytes.IndexByte(d.buf, 0)
+	if d.err != nil || i < 0 {
+		d.err = errTracingData
+		return ""
+	}
+	s := string(d.buf[:i])
+	d.buf = d.buf[i+1:]
+	return s
+}
+
+func (t *TracepointFormat) String() string {
+	return fmt.Sprintf("%s:%s", t.System, t.Name)
+}
@@ -0,0 +1,236 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+const testTracepointFormat = `name: contention_begin
+ID: 1234
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:void * lock_addr;	offset:8;	size:8;	signed:0;
+	field:unsigned int flags;	offset:16;	size:4;	signed:0;
+	field:char comm[8];	offset:20;	size:8;	signed:1;
+	field:__data_loc char[] name;	offset:28;	size:4;	signed:1;
+
+print fmt: "%p %s", REC->lock_addr, __get_str(name)
+`
+
+func TestTracepointFormats(t *testing.T) {
+	order := binary.LittleEndian
+	var buf bytes.Buffer
+	w := func(v interface{}) { binary.Write(&buf, order, v) }
+	buf.WriteString("\x17\x08\x44tracing0.6\x00")
+	buf.Write([]byte{0, 8})
+	w(uint32(4096))
+	buf.WriteString("header_page\x00")
+	w(uint64(0))
+	buf.WriteString("header_event\x00")
+	w(uint64(0))
+	w(uint32(0)) // No ftrace events
+	w(uint32(1)) // One system
+	buf.WriteString("lock\x00")
+	w(uint32(1))
+	w(uint64(len(testTracepointFormat)))
+	buf.WriteString(testTracepointFormat)
+
+	var m FileMeta
+	data := buf.Bytes()
+	m.addRaw(featureTracingData, order, func() ([]byte, error) { return data, nil })
+	formats, err := m.TracepointFormats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf := formats[1234]
+	if tf == nil {
+		t.Fatalf("tracepoint 1234 not found in %v", formats)
+	}
+	if tf.String() != "lock:contention_begin" || len(tf.Fields) != 6 {
+		t.Fatalf("bad format %s %+v", tf, tf.Fields)
+	}
+
+	raw := make([]byte, 40)
+	order.PutUint32(raw[4:], uint32(0xfffffffe))
+	order.PutUint64(raw[8:], 0xdeadbeef)
+	order.PutUint32(raw[16:], 3)
+	copy(raw[20:], "gopher\x00")
+	order.PutUint32(raw[28:], 4<<16|32)
+	copy(raw[32:], "mu\x00\x00")
+
+	if got := int64(tf.Field("common_pid").Uint(raw)); got != -2 {
+		t.Errorf("common_pid = %d, want -2", got)
+	}
+	if got := tf.Field("lock_addr").Uint(raw); got != 0xdeadbeef {
+		t.Errorf("lock_addr = %#x, want 0xdeadbeef", got)
+	}
+	if f := tf.Field("comm"); f.Type != "char[8]" || f.String(raw) != "gopher" {
+		t.Errorf("comm = %q (type %q), want \"gopher\" (type char[8])", f.String(raw), f.Type)
+	}
+	if f := tf.Field("name"); f.Type != "__data_loc char[]" || f.String(raw) != "mu" {
+		t.Errorf("name = %q (type %q), want \"mu\" (type __data_loc char[])", f.String(raw), f.Type)
+	}
+	if f := tf.Field("lock_addr"); f.Type != "void *" {
+		t.Errorf("lock_addr type = %q, want \"void *\"", f.Type)
+	}
+}
+
+func TestTracepointDecoder(t *testing.T) {
+	const format = `name: test
+ID: 1
+format:
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+	field:unsigned int flags;	offset:8;	size:4;	signed:0;
+	field:char comm[8];	offset:12;	size:8;	signed:1;
+	field:__data_loc char[] name;	offset:20;	size:4;	signed:1;
+	field:u16 ports[2];	offset:24;	size:4;	signed:0;
+	field:__data_loc s32[] vals;	offset:28;	size:4;	signed:0;
+`
+	order := binary.LittleEndian
+	tf := parseTracepointFormat("test", format, order)
+
+	raw := make([]byte, 48)
+	order.PutUint32(raw[4:], uint32(0xfffffffe))
+	order.PutUint32(raw[8:], 0xa5)
+	copy(raw[12:], "gopher\x00")
+	order.PutUint32(raw[20:], 3<<16|32)
+	order.PutUint16(raw[24:], 80)
+	order.PutUint16(raw[26:], 443)
+	order.PutUint32(raw[28:], 8<<16|36)
+	copy(raw[32:], "mu\x00")
+	order.PutUint32(raw[36:], 1)
+	order.PutUint32(raw[40:], uint32(0xffffffff))
+
+	type event struct {
+		PID    int64   `perf:"common_pid"`
+		Low    uint8   `perf:"flags,bits=0-3"`
+		High   uint8   `perf:"flags,bits=4-7"`
+		Set    bool    `perf:"flags"`
+		Comm   string  `perf:"comm"`
+		Name   string  `perf:"name"`
+		Ports  [2]int  `perf:"ports"`
+		Vals   []int32 `perf:"vals"`
+		Ignore string
+	}
+	d, err := tf.Decoder((*event)(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got event
+	if err := d.Decode(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := event{-2, 5, 10, true, "gopher", "mu", [2]int{80, 443}, []int32{1, -1}, ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if err := d.Decode(raw[:20], &got); err == nil {
+		t.Errorf("decoding short data succeeded")
+	}
+	for _, v := range []interface{}{
+		&struct {
+			X int `perf:"missing"`
+		}{},
+		&struct {
+			X int `perf:"comm"`
+		}{},
+		&struct {
+			X string `perf:"flags"`
+		}{},
+		&struct {
+			X int `perf:"flags,bits=4-40"`
+		}{},
+	} {
+		if _, err := tf.Decoder(v); err == nil {
+			t.Errorf("Decoder(%T) succeeded, want error", v)
+		}
+	}
+}
+
+func TestKprobeFormat(t *testing.T) {
+	// The format of a kprobe defined as
+	// p:myprobe do_sys_openat2 filename=+0($arg2):string flags=%dx:u64
+	const format = `name: myprobe
+ID: 2021
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:unsigned long __probe_ip;	offset:8;	size:8;	signed:0;
+	field:__data_loc char[] filename;	offset:16;	size:4;	signed:1;
+	field:u64 flags;	offset:20;	size:8;	signed:0;
+
+print fmt: "(%lx) filename=\"%s\" flags=0x%Lx", REC->__probe_ip, __get_str(filename), REC->flags
+`
+	order := binary.LittleEndian
+	tf := parseTracepointFormat("kprobes", format, order)
+	if tf == nil || tf.String() != "kprobes:myprobe" {
+		t.Fatalf("bad format %v", tf)
+	}
+
+	raw := make([]byte, 40)
+	order.PutUint64(raw[8:], 0xffffffff81234560)
+	order.PutUint32(raw[16:], 12<<16|28)
+	order.PutUint64(raw[20:], 0x8000)
+	copy(raw[28:], "/etc/passwd\x00")
+
+	var args struct {
+		IP       uint64 `perf:"__probe_ip"`
+		Filename string `perf:"filename"`
+		Flags    uint64 `perf:"flags"`
+	}
+	d, err := tf.Decoder(&args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Decode(raw, &args); err != nil {
+		t.Fatal(err)
+	}
+	if args.IP != 0xffffffff81234560 || args.Filename != "/etc/passwd" || args.Flags != 0x8000 {
+		t.Errorf("got %+v", args)
+	}
+}
+
+func TestMalformedTracepointField(t *testing.T) {
+	for _, line := range []string{
+		"field:int x];	offset:8;	size:4;	signed:1;",
+		"field:x;	offset:8;	size:4;	signed:1;",
+		"field:int x;	offset:-8;	size:4;	signed:1;",
+		"field:int x;	offset:8;	size:-4;	signed:1;",
+		"field:int x;	offset:eight;	size:4;	signed:1;",
+	} {
+		if f, ok := parseTracepointField(line, binary.LittleEndian); ok {
+			t.Errorf("parseTracepointField(%q) = %+v, want failure", line, f)
+		}
+	}
+}
+
+func TestTracepointFieldBounds(t *testing.T) {
+	raw := make([]byte, 16)
+	for _, f := range []TracepointField{
+		{Offset: -8, Size: 4},
+		{Offset: 8, Size: -4},
+		{Offset: 14, Size: 4},
+		{Offset: math.MaxInt, Size: 1},
+	} {
+		f.order = binary.LittleEndian
+		if x := f.Uint(raw); x != 0 {
+			t.Errorf("%+v: Uint = %#x, want 0", f, x)
+		}
+		if b := f.Bytes(raw); b != nil {
+			t.Errorf("%+v: Bytes = %x, want nil", f, b)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/aclements/go-perf/internal/zstd"
+)
+
+// Copy writes a copy of the profile in to out. The output is a
+// regular (not pipe-mode) profile in in's byte order, with the same
+// events, records, and metadata as in, including any changes the
+// caller has made to in.Meta.
+func Copy(in *File, out io.WriteSeeker) error {
+	w := &writer{w: out, order: in.ByteOrder}
+	return w.write(in, func(*Records) bool { return true })
+}
+
+// Filter writes a copy of the profile in to out, keeping only the
+// samples for which keep returns true. For example, to keep only
+// samples from CPU 3 in a time range:
+//
+//	perffile.Filter(in, out, func(r *perffile.RecordSample) bool {
+//		return r.CPU == 3 && start <= r.Time && r.Time < end
+//	})
+//
+// Non-sample records that describe processes, such as mmap, comm,
+// fork, and exit records, are kept only for processes that have
+// kept samples and their ancestors, since child processes inherit
+// their parent's mappings. All other non-sample records are kept.
+// If in was opened with NewPipe, it can only be read once, so all
+// non-sample records are kept.
+//
+// The output is a regular (not pipe-mode) profile in in's byte
+// order, with the same events and metadata as in, including any
+// changes the caller has made to in.Meta.
+func Filter(in *File, out io.WriteSeeker, keep func(*RecordSample) bool) error {
+	var pids map[int]bool
+	if in.r != nil {
+		var err error
+		pids, err = filterPIDs(in, keep)
+		if err != nil {
+			return err
+		}
+	}
+	keepPID := func(pid int) bool {
+		return pids == nil || pid == -1 || pids[pid]
+	}
+
+	w := &writer{w: out, order: in.ByteOrder}
+	return w.write(in, func(rs *Records) bool {
+		switch r := rs.Record.(type) {
+		case *RecordSample:
+			return keep(r)
+		case *RecordMmap:
+			return keepPID(r.PID)
+		case *RecordComm:
+			return keepPID(r.PID)
+		case *RecordExit:
+			return keepPID(r.PID)
+		case *RecordFork:
+			return keepPID(r.PID) || keepPID(r.PPID)
+		}
+		return true
+	})
+}
+
+// filterPIDs returns the set of processes with samples that satisfy
+// keep, plus all of their ancestors.
+func filterPIDs(in *File, keep func(*RecordSample) bool) (map[int]bool, error) {
+	pids := make(map[int]bool)
+	parent := make(map[int]int)
+	rs := in.Records(RecordsFileOrder)
+	for rs.Next() {
+		switch r := rs.Record.(type) {
+		case *RecordSample:
+			if keep(r) {
+				pids[r.PID] = true
+			}
+		case *RecordFork:
+			if r.PID != r.PPID {
+				parent[r.PID] = r.PPID
+			}
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	for pid := range pids {
+		for p, ok := parent[pid]; ok && !pids[p]; p, ok = parent[p] {
+			pids[p] = true
+		}
+	}
+	return pids, nil
+}
+
+// writer writes a "perf.data" file.
+//
+// The file is laid out as the header, the attribute ID arrays, the
+// attributes, the records, the feature section table, and finally
+// the feature sections. See perf_session__write_header in
+// tools/perf/util/header.c.
+type writer struct {
+	w     io.WriteSeeker
+	order binary.ByteOrder
+	pos   int64
+	err   error
+}
+
+func (w *writer) write(in *File, keep func(*Records) bool) error {
+	var hdr fileHeader
+	if w.order == binary.BigEndian {
+		copy(hdr.Magic[:], "2ELIFREP")
+	} else {
+		copy(hdr.Magic[:], "PERFILE2")
+	}
+	hdr.Size = uint64(binary.Size(&hdr))
+
+	// Write a placeholder header. We'll come back and fill it in
+	// once we know where everything is.
+	w.binary(&hdr)
+
+	// Write the ID arrays of each attr.
+	ids := make(map[*EventAttr][]attrID)
+	for id, attr := range in.idToAttr {
+		ids[attr] = append(ids[attr], id)
+	}
+	idSecs := make([]fileSection, len(in.attrs))
+	for i, fa := range in.attrs {
+		attrIDs := ids[&fa.Attr]
+		sort.Slice(attrIDs, func(a, b int) bool { return attrIDs[a] < attrIDs[b] })
+		idSecs[i].Offset = uint64(w.pos)
+		w.binary(attrIDs)
+		idSecs[i].Size = uint64(w.pos) - idSecs[i].Offset
+	}
+
+	// Write the attrs. perf expects all attrs to be the same
+	// size, so pad them to the largest size.
+	attrSize := 0
+	for _, fa := range in.attrs {
+		if len(fa.raw) > attrSize {
+			attrSize = len(fa.raw)
+		}
+	}
+	hdr.AttrSize = uint64(attrSize + binary.Size(fileSection{}))
+	hdr.Attrs.Offset = uint64(w.pos)
+	for i, fa := range in.attrs {
+		raw := make([]byte, attrSize)
+		copy(raw, fa.raw)
+		w.order.PutUint32(raw[4:], uint32(attrSize))
+		w.bytes(raw)
+		w.binary(idSecs[i])
+	}
+	hdr.Attrs.Size = uint64(w.pos) - hdr.Attrs.Offset
+
+	// Write the records, compressing them if the profile says
+	// they're compressed.
+	meta := in.Meta
+	var zw *zstdRecordWriter
+	if c := meta.Compression; c != nil {
+		if c.Type != CompressionZstd {
+			return fmt.Errorf("unsupported record compression %s", c.Type)
+		}
+		if c.MmapLen <= 0 {
+			// perf decompresses each compressed record into
+			// a buffer of this size, so it must be set.
+			c2 := *c
+			c2.MmapLen = defaultCompressChunk
+			meta.Compression = &c2
+		}
+		zw = newZstdRecordWriter(w, meta.Compression.MmapLen)
+	}
+	hdr.Data.Offset = uint64(w.pos)
+	rs := in.Records(RecordsFileOrder)
+	for rs.Next() && w.err == nil {
+		if !keep(rs) {
+			continue
+		}
+		if r, ok := rs.Record.(*RecordAuxtrace); ok {
+			// perf never compresses aux data, which follows
+			// the record.
+			zw.flush()
+			w.binary(&rs.rawHdr)
+			w.bytes(rs.raw)
+			w.bytes(r.Data)
+			continue
+		}
+		if zw != nil {
+			zw.add(&rs.rawHdr, rs.raw)
+			continue
+		}
+		w.binary(&rs.rawHdr)
+		w.bytes(rs.raw)
+	}
+	if err := rs.Err(); err != nil {
+		return err
+	}
+	zw.flush()
+	hdr.Data.Size = uint64(w.pos) - hdr.Data.Offset
+
+	// Write the feature section table, followed by the sections.
+	secs, err := meta.sections(w.order)
+	if err != nil {
+		return err
+	}
+	var table []fileSection
+	off := uint64(w.pos) + uint64(len(secs)*binary.Size(fileSection{}))
+	for bit := feature(0); bit < feature(numFeatureBits); bit++ {
+		data, ok := secs[bit]
+		if !ok {
+			continue
+		}
+		hdr.Features[bit/64] |= 1 << (uint(bit) % 64)
+		table = append(table, fileSection{off, uint64(len(data))})
+		off += uint64(len(data))
+	}
+	w.binary(table)
+	for bit := feature(0); bit < feature(numFeatureBits); bit++ {
+		if data, ok := secs[bit]; ok {
+			w.bytes(data)
+		}
+	}
+
+	// Fill in the header.
+	if w.err == nil {
+		_, w.err = w.w.Seek(0, io.SeekStart)
+	}
+	w.binary(&hdr)
+	if w.err != nil {
+		return fmt.Errorf("writing profile: %w", w.err)
+	}
+	return nil
+}
+
+// defaultCompressChunk is the amount of record data compressed at a
+// time if the profile doesn't specify it.
+const defaultCompressChunk = 256 << 10
+
+// A zstdRecordWriter compresses records into compressed records, the
+// way "perf record -z" does. perf compresses the records in each
+// ring buffer read as one flush of a single zstd stream, splitting
+// the output into compressed records that fit the record size
+// limit. See zstd_compress_stream_to_records in
+// tools/perf/util/zstd.c.
+type zstdRecordWriter struct {
+	w     *writer
+	enc   *zstd.Encoder
+	chunk int    // Uncompressed bytes per flush
+	buf   []byte // Records to compress
+	out   []byte
+}
+
+func newZstdRecordWriter(w *writer, chunk int) *zstdRecordWriter {
+	return &zstdRecordWriter{w: w, enc: zstd.NewEncoder(), chunk: chunk}
+}
+
+// add adds a record to be compressed.
+func (z *zstdRecordWriter) add(hdr *recordHeader, raw []byte) {
+	if len(z.buf) > 0 && len(z.buf)+int(hdr.Size) > z.chunk {
+		z.flush()
+	}
+	var h [8]byte
+	z.w.order.PutUint32(h[0:], uint32(hdr.Type))
+	z.w.order.PutUint16(h[4:], uint16(hdr.Misc))
+	z.w.order.PutUint16(h[6:], hdr.Size)
+	z.buf = append(z.buf, h[:]...)
+	z.buf = append(z.buf, raw...)
+}
+
+// flush writes compressed records for the buffered records. z may be
+// nil, in which case flush does nothing.
+func (z *zstdRecordWriter) flush() {
+	if z == nil || len(z.buf) == 0 {
+		return
+	}
+	z.out = z.enc.Encode(z.out[:0], z.buf)
+	z.buf = z.buf[:0]
+	const maxData = 0xffff - 8
+	for out := z.out; len(out) > 0; {
+		n := len(out)
+		if n > maxData {
+			n = maxData
+		}
+		z.w.binary(&recordHeader{Type: recordTypeCompressed, Size: uint16(8 + n)})
+		z.w.bytes(out[:n])
+		out = out[n:]
+	}
+}
+
+func (w *writer) bytes(b []byte) {
+	if w.err != nil {
+		return
+	}
+	var n int
+	n, w.err = w.w.Write(b)
+	w.pos += int64(n)
+}
+
+func (w *writer) binary(v interface{}) {
+	if w.err != nil {
+		return
+	}
+	w.err = binary.Write(w.w, w.order, v)
+	w.pos += int64(binary.Size(v))
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		// Extend the pipe profile with a second process.
+		buf := bytes.NewBuffer(pipeProfile(order))
+		w := func(v interface{}) { binary.Write(buf, order, v) }
+		for _, pid := range []int32{10, 20} {
+			w(recordHeader{RecordTypeComm, 0, 8 + 8 + 8 + 8})
+			w([]int32{pid, pid})
+			buf.WriteString("gopher\x00\x00")
+			w([]int32{pid, pid})
+		}
+		w(recordHeader{RecordTypeSample, 0, 8 + 8 + 8})
+		w(uint64(0x5678))
+		w([]int32{20, 20})
+
+		in, err := NewPipe(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "perf.data")
+		out, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Filter(in, out, func(r *RecordSample) bool { return r.PID == 20 })
+		out.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Re-open the filtered profile and filter it again,
+		// which will also prune unreferenced sideband records.
+		f, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if f.ByteOrder != order || f.Meta.Hostname != "gopher" || len(f.Events) != 1 {
+			t.Fatalf("%s: bad filtered profile %+v", order, f)
+		}
+		var out2 bytes.Buffer
+		path2 := filepath.Join(t.TempDir(), "perf.data")
+		o2, err := os.Create(path2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Filter(f, o2, func(r *RecordSample) bool { return true })
+		o2.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f2, err := Open(path2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f2.Close()
+
+		for _, f := range []*File{f, f2} {
+			out2.Reset()
+			rs := f.Records(RecordsCausalOrder)
+			for rs.Next() {
+				switch r := rs.Record.(type) {
+				case *RecordSample:
+					fmt.Fprintf(&out2, "sample %d %#x;", r.PID, r.IP)
+				case *RecordComm:
+					fmt.Fprintf(&out2, "comm %d;", r.PID)
+				}
+			}
+			if err := rs.Err(); err != nil {
+				t.Fatal(err)
+			}
+			want := "comm 10;comm 20;sample 20 0x5678;"
+			if f == f2 {
+				want = "comm 20;sample 20 0x5678;"
+			}
+			if got := out2.String(); got != want {
+				t.Errorf("%s: got records %q, want %q", order, got, want)
+			}
+		}
+	}
+}
+
+func TestCompressed(t *testing.T) {
+	// Build a profile with enough samples that each flush of
+	// compressed data spans several compressed records.
+	order := binary.LittleEndian
+	buf := bytes.NewBuffer(pipeProfile(order))
+	rnd := rand.New(rand.NewSource(1))
+	var ips []uint64
+	for i := 0; i < 50000; i++ {
+		ip := uint64(rnd.Uint32())
+		ips = append(ips, ip)
+		binary.Write(buf, order, recordHeader{RecordTypeSample, 0, 8 + 8 + 8})
+		binary.Write(buf, order, ip)
+		binary.Write(buf, order, []int32{10, 11})
+	}
+	in, err := NewPipe(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.Meta.Compression = &Compression{Type: CompressionZstd, Level: 1, MmapLen: 1 << 20}
+	path := filepath.Join(t.TempDir(), "perf.data")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Filter(in, out, func(*RecordSample) bool { return true })
+	out.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Meta.Compression == nil || f.Meta.Compression.Type != CompressionZstd {
+		t.Fatalf("compression = %+v, want zstd", f.Meta.Compression)
+	}
+	if size := f.hdr.Data.Size; size > uint64(len(ips))*24/2 {
+		t.Errorf("data section is %d bytes; records weren't compressed", size)
+	}
+
+	// The ith sample is at offset base+24*(i+1), after the
+	// pipe profile's sample.
+	base := int64(f.hdr.Data.Offset)
+	for _, order := range []RecordsOrder{RecordsFileOrder, RecordsCausalOrder} {
+		rs := f.Records(order)
+		i := -1
+		for rs.Next() {
+			r, ok := rs.Record.(*RecordSample)
+			if !ok {
+				continue
+			}
+			if want := base + 24*int64(i+1); r.Offset != want {
+				t.Fatalf("%s: sample %d at offset %d, want %d", order, i, r.Offset, want)
+			}
+			if i >= 0 && r.IP != ips[i] {
+				t.Fatalf("%s: sample %d has IP %#x, want %#x", order, i, r.IP, ips[i])
+			}
+			i++
+		}
+		if err := rs.Err(); err != nil {
+			t.Fatalf("%s: %v", order, err)
+		}
+		if i != len(ips) {
+			t.Fatalf("%s: got %d samples, want %d", order, i, len(ips))
+		}
+	}
+}
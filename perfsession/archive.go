@@ -0,0 +1,86 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// Archive writes a tar archive to w containing every file listed in
+// f's build ID table, like "perf archive". Extracting the archive
+// into the build ID cache directory (usually ~/.debug) on another
+// machine lets Symbolize find these files there, even if the
+// original binaries have since been replaced or removed.
+//
+// Each file is taken from the local build ID cache if present, or
+// else from its original path if its build ID still matches. Files
+// that can't be found are logged and skipped. Profiles recorded
+// without build IDs can be given them with cmd/perfinject.
+func Archive(f *perffile.File, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	seen := make(map[string]bool)
+	for _, bid := range f.Meta.BuildIDs {
+		id := bid.BuildID.String()
+		if len(id) < 3 || seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		data, err := readArchiveFile(bid)
+		if err != nil {
+			log.Printf("%s: %v", bid.Filename, err)
+			continue
+		}
+		hdr := &tar.Header{
+			Name: ".build-id/" + id[:2] + "/" + id[2:],
+			Mode: 0644,
+			Size: int64(len(data)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// readArchiveFile returns the contents of the file described by bid.
+func readArchiveFile(bid perffile.BuildIDInfo) ([]byte, error) {
+	if path := buildIDPath(buildIDDir, bid.BuildID); path != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			return data, nil
+		}
+	}
+
+	// The build ID cache stores a copy of kallsyms for the
+	// kernel. See build_id_cache__add_s in
+	// tools/perf/util/build-id.c.
+	filename := bid.Filename
+	if strings.HasPrefix(filename, "[kernel.kallsyms]") {
+		filename = "/proc/kallsyms"
+	}
+	id, err := ReadBuildID(bid.Filename)
+	if err != nil {
+		return nil, err
+	}
+	// perf.data stores build IDs zero-padded to 20 bytes.
+	if len(id) < 20 {
+		id = append(id, make([]byte, 20-len(id))...)
+	}
+	if !bytes.Equal(id, bid.BuildID) {
+		return nil, fmt.Errorf("build ID is %s, want %s", id, bid.BuildID)
+	}
+	return os.ReadFile(filename)
+}
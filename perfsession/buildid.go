@@ -0,0 +1,91 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// ReadBuildID returns the GNU build ID of the ELF file filename, or
+// nil if it doesn't have one. If filename is a kernel mapping such as
+// "[kernel.kallsyms]", it returns the build ID of the running kernel.
+func ReadBuildID(filename string) (perffile.BuildID, error) {
+	if strings.HasPrefix(filename, "[kernel.kallsyms]") {
+		f, err := os.Open("/sys/kernel/notes")
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		// The notes are in the kernel's byte order. Assume
+		// that's little endian, like nearly every machine perf
+		// runs on.
+		return findBuildID(f, binary.LittleEndian), nil
+	}
+
+	ef, err := elf.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer ef.Close()
+	for _, prog := range ef.Progs {
+		if prog.Type != elf.PT_NOTE {
+			continue
+		}
+		if id := findBuildID(prog.Open(), ef.ByteOrder); id != nil {
+			return id, nil
+		}
+	}
+	for _, sec := range ef.Sections {
+		if sec.Type != elf.SHT_NOTE {
+			continue
+		}
+		if id := findBuildID(sec.Open(), ef.ByteOrder); id != nil {
+			return id, nil
+		}
+	}
+	return nil, nil
+}
+
+// findBuildID returns the descriptor of the first NT_GNU_BUILD_ID
+// note in r, which consists of ELF note entries, or nil if there is
+// none.
+func findBuildID(r io.Reader, order binary.ByteOrder) perffile.BuildID {
+	const ntGNUBuildID = 3
+	for {
+		var hdr struct{ Namesz, Descsz, Type uint32 }
+		if err := binary.Read(r, order, &hdr); err != nil {
+			return nil
+		}
+		// The name and descriptor are each padded to 4 bytes.
+		name := make([]byte, (hdr.Namesz+3)&^3)
+		desc := make([]byte, (hdr.Descsz+3)&^3)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil
+		}
+		if _, err := io.ReadFull(r, desc); err != nil {
+			return nil
+		}
+		if hdr.Type == ntGNUBuildID && bytes.Equal(name[:hdr.Namesz], []byte("GNU\x00")) {
+			return desc[:hdr.Descsz]
+		}
+	}
+}
+
+// buildIDPath returns the path of the file with build ID id in the
+// build ID cache directory dir, or "" if id is empty.
+func buildIDPath(dir string, id perffile.BuildID) string {
+	if len(id) == 0 {
+		return ""
+	}
+	s := id.String()
+	return dir + "/.build-id/" + s[:2] + "/" + s[2:]
+}
@@ -0,0 +1,28 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestNoCgo checks that symbolization doesn't depend on cgo, so
+// tools built on it can be statically linked. Standard packages that
+// use cgo all have pure Go fallbacks used when CGO_ENABLED=0.
+func TestNoCgo(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+	out, err := exec.Command(goTool, "list", "-deps", "-f", "{{if and (not .Standard) .CgoFiles}}{{.ImportPath}}{{end}}", ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go list failed: %v\n%s", err, out)
+	}
+	for _, pkg := range strings.Fields(string(out)) {
+		t.Errorf("depends on cgo package %s", pkg)
+	}
+}
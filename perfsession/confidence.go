@@ -0,0 +1,100 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"math"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// z95 is the critical value of the standard normal distribution for
+// 95% confidence.
+const z95 = 1.959964
+
+// ShareInterval returns the 95% confidence interval of the fraction
+// of samples in a bucket, such as a function or stack, given that
+// count of total samples landed in the bucket. The true fraction of
+// time spent in the bucket is likely within [lo, hi].
+//
+// This uses the Wilson score interval, which behaves well even for
+// small counts.
+func ShareInterval(count, total uint64) (lo, hi float64) {
+	if total == 0 {
+		return 0, 1
+	}
+	n := float64(total)
+	p := float64(count) / n
+	z2 := z95 * z95
+	center := (p + z2/(2*n)) / (1 + z2/n)
+	half := z95 / (1 + z2/n) * math.Sqrt(p*(1-p)/n+z2/(4*n*n))
+	return math.Max(0, center-half), math.Min(1, center+half)
+}
+
+// Distinguishable reports whether two buckets with a and b of total
+// samples differ by more than sampling noise, at 95% confidence. If
+// not, the buckets' relative ranking in a profile is not meaningful.
+func Distinguishable(a, b, total uint64) bool {
+	if total == 0 || a == b {
+		return false
+	}
+	// The bucket counts are multinomial, so the variance of a-b
+	// is n(p_a + p_b - (p_a - p_b)^2).
+	n := float64(total)
+	pa, pb := float64(a)/n, float64(b)/n
+	v := n * (pa + pb - (pa-pb)*(pa-pb))
+	if v <= 0 {
+		return true
+	}
+	return math.Abs(float64(a)-float64(b))/math.Sqrt(v) > z95
+}
+
+// LossRate returns the fraction of records that were lost, either
+// because the ring buffer was full or because the kernel dropped
+// them. A high loss rate may bias a profile, since records tend to be
+// lost in bursts.
+func (st *Stats) LossRate() float64 {
+	lost := st.Lost + st.LostSamples
+	if lost == 0 {
+		return 0
+	}
+	return float64(lost) / float64(st.Samples+lost)
+}
+
+// Scaling returns the factor by which the counts of event attr are
+// underestimated because the kernel multiplexed it with other events,
+// or 1 if it was not multiplexed. This is computed from the time the
+// event was enabled and running, which is only available if samples
+// read the event's count (perffile.SampleFormatRead) with
+// perffile.ReadFormatTotalTimeEnabled and
+// perffile.ReadFormatTotalTimeRunning.
+func (s *Session) Scaling(attr *perffile.EventAttr) float64 {
+	t, ok := s.scaling[attr]
+	if !ok || t[1] == 0 {
+		return 1
+	}
+	return float64(t[0]) / float64(t[1])
+}
+
+// updateScaling records the enabled and running times from the
+// counts read by a sample.
+func (s *Session) updateScaling(r *perffile.RecordSample) {
+	for _, c := range r.SampleRead {
+		attr := c.EventAttr
+		if attr == nil {
+			attr = r.EventAttr
+		}
+		if attr == nil || attr.ReadFormat&perffile.ReadFormatTotalTimeEnabled == 0 || attr.ReadFormat&perffile.ReadFormatTotalTimeRunning == 0 {
+			continue
+		}
+		if s.scaling == nil {
+			s.scaling = make(map[*perffile.EventAttr][2]uint64)
+		}
+		// The times are cumulative, so keep the latest.
+		if t := s.scaling[attr]; c.TimeEnabled >= t[0] {
+			s.scaling[attr] = [2]uint64{c.TimeEnabled, c.TimeRunning}
+		}
+	}
+}
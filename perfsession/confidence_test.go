@@ -0,0 +1,65 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"math"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+func TestShareInterval(t *testing.T) {
+	for _, tc := range []struct {
+		count, total uint64
+		lo, hi       float64
+	}{
+		{0, 0, 0, 1},
+		{0, 10, 0, 0.2775},
+		{5, 10, 0.2366, 0.7634},
+		{500, 1000, 0.4691, 0.5309},
+	} {
+		lo, hi := ShareInterval(tc.count, tc.total)
+		if math.Abs(lo-tc.lo) > 1e-4 || math.Abs(hi-tc.hi) > 1e-4 {
+			t.Errorf("ShareInterval(%d, %d) = [%.4f, %.4f], want [%.4f, %.4f]", tc.count, tc.total, lo, hi, tc.lo, tc.hi)
+		}
+	}
+}
+
+func TestDistinguishable(t *testing.T) {
+	for _, tc := range []struct {
+		a, b, total uint64
+		want        bool
+	}{
+		{10, 10, 100, false},
+		{12, 10, 100, false},
+		{30, 10, 100, true},
+		{1200, 1000, 10000, true},
+	} {
+		if got := Distinguishable(tc.a, tc.b, tc.total); got != tc.want {
+			t.Errorf("Distinguishable(%d, %d, %d) = %v, want %v", tc.a, tc.b, tc.total, got, tc.want)
+		}
+	}
+}
+
+func TestScaling(t *testing.T) {
+	attr := &perffile.EventAttr{
+		SampleFormat: perffile.SampleFormatRead,
+		ReadFormat:   perffile.ReadFormatTotalTimeEnabled | perffile.ReadFormatTotalTimeRunning,
+	}
+	s := New(nil)
+	if got := s.Scaling(attr); got != 1 {
+		t.Errorf("scaling before samples is %v, want 1", got)
+	}
+	for _, times := range [][2]uint64{{100, 100}, {400, 100}} {
+		s.Update(&perffile.RecordSample{
+			RecordCommon: perffile.RecordCommon{EventAttr: attr},
+			SampleRead:   []perffile.Count{{TimeEnabled: times[0], TimeRunning: times[1]}},
+		})
+	}
+	if got := s.Scaling(attr); got != 4 {
+		t.Errorf("scaling is %v, want 4", got)
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// A Contention measures how long threads waited for locks, like
+// "perf lock contention", and aggregates the waits by the call stack
+// at which each wait began.
+//
+// Contention pairs two kinds of events by thread:
+//
+//   - The lock:contention_begin and lock:contention_end tracepoints
+//     (Linux 5.19 and later) measure waits for kernel locks.
+//
+//   - The syscalls:sys_enter_futex and syscalls:sys_exit_futex
+//     tracepoints measure waits for user-space locks, which block in
+//     the futex system call. Only futex operations that wait are
+//     counted.
+//
+// A profile needs only one of these pairs. For example,
+//
+//	perf record -g -e lock:contention_begin -e lock:contention_end \
+//		-e syscalls:sys_enter_futex -e syscalls:sys_exit_futex <cmd>
+type Contention struct {
+	session *Session
+
+	begin, end            *perffile.TracepointFormat
+	futexEnter, futexExit *perffile.TracepointFormat
+	flags, op             *perffile.TracepointField
+
+	// Pending waits by TID. A thread may wait for a kernel lock
+	// while in a futex call, so these are separate.
+	lockWaits, futexWaits map[int]contentionWait
+
+	stats map[string]*ContentionStat
+}
+
+type contentionWait struct {
+	time  uint64
+	typ   string
+	stack []Frame
+}
+
+// A ContentionStat aggregates the waits that began at one stack.
+type ContentionStat struct {
+	// Stack is the call stack at which the waits began, starting
+	// with the leaf.
+	Stack []Frame
+
+	// Type is the kind of lock, such as "spinlock" or "mutex",
+	// or "futex" for futex waits.
+	Type string
+
+	Count int    // Number of waits
+	Total uint64 // Total wait time in nanoseconds
+	Max   uint64 // Longest wait in nanoseconds
+}
+
+// ErrNoContentionEvents is returned by NewContention if a profile
+// has neither the lock contention nor the futex tracepoints.
+var ErrNoContentionEvents = errors.New("profile has neither lock:contention_begin/end nor syscalls:sys_enter/exit_futex events")
+
+// NewContention returns a Contention that analyzes the samples of
+// the profile in s. It returns ErrNoContentionEvents if the profile
+// doesn't have the tracepoints it needs.
+func NewContention(s *Session) (*Contention, error) {
+	formats, err := s.File.Meta.TracepointFormats()
+	if err != nil {
+		return nil, err
+	}
+	return newContention(s, formats)
+}
+
+func newContention(s *Session, formats map[perffile.EventTracepoint]*perffile.TracepointFormat) (*Contention, error) {
+	c := &Contention{
+		session:    s,
+		lockWaits:  make(map[int]contentionWait),
+		futexWaits: make(map[int]contentionWait),
+		stats:      make(map[string]*ContentionStat),
+	}
+	for _, tf := range formats {
+		switch tf.String() {
+		case "lock:contention_begin":
+			c.begin = tf
+		case "lock:contention_end":
+			c.end = tf
+		case "syscalls:sys_enter_futex":
+			c.futexEnter = tf
+		case "syscalls:sys_exit_futex":
+			c.futexExit = tf
+		}
+	}
+	if c.begin != nil && c.end != nil {
+		c.flags = c.begin.Field("flags")
+	}
+	if c.flags == nil {
+		c.begin, c.end = nil, nil
+	}
+	if c.futexEnter != nil && c.futexExit != nil {
+		c.op = c.futexEnter.Field("op")
+	}
+	if c.op == nil {
+		c.futexEnter, c.futexExit = nil, nil
+	}
+	if c.begin == nil && c.futexEnter == nil {
+		return nil, ErrNoContentionEvents
+	}
+	return c, nil
+}
+
+// Sample processes sample r. The Session must be up to date with
+// the records preceding r, and samples must be processed in time
+// order. Sample returns an error if a contention sample doesn't have
+// a time stamp and thread ID.
+func (c *Contention) Sample(r *perffile.RecordSample) error {
+	tp, ok := r.EventAttr.Event.(perffile.EventTracepoint)
+	if !ok {
+		return nil
+	}
+	var start, stop bool
+	var waits map[int]contentionWait
+	var typ string
+	switch {
+	case c.begin != nil && tp == c.begin.ID:
+		start, waits = true, c.lockWaits
+		typ = lockType(c.flags.Uint(r.Raw))
+	case c.end != nil && tp == c.end.ID:
+		stop, waits = true, c.lockWaits
+	case c.futexEnter != nil && tp == c.futexEnter.ID:
+		if !isFutexWait(c.op.Uint(r.Raw)) {
+			return nil
+		}
+		start, waits, typ = true, c.futexWaits, "futex"
+	case c.futexExit != nil && tp == c.futexExit.ID:
+		stop, waits = true, c.futexWaits
+	default:
+		return nil
+	}
+	if r.Format&perffile.SampleFormatTime == 0 || r.Format&perffile.SampleFormatTID == 0 {
+		return fmt.Errorf("%v samples do not have timestamps and thread IDs", r.EventAttr.Event)
+	}
+
+	if start {
+		waits[r.TID] = contentionWait{r.Time, typ, c.session.Stack(r)}
+		return nil
+	}
+	if !stop {
+		return nil
+	}
+	w, ok := waits[r.TID]
+	if !ok {
+		// The wait began before the profile, or this futex
+		// call didn't wait.
+		return nil
+	}
+	delete(waits, r.TID)
+	key := w.typ + ":" + StackKey(w.stack)
+	st := c.stats[key]
+	if st == nil {
+		st = &ContentionStat{Stack: w.stack, Type: w.typ}
+		c.stats[key] = st
+	}
+	d := r.Time - w.time
+	st.Count++
+	st.Total += d
+	if d > st.Max {
+		st.Max = d
+	}
+	return nil
+}
+
+// Stats returns the aggregated waits, sorted by decreasing total
+// wait time.
+func (c *Contention) Stats() []*ContentionStat {
+	stats := make([]*ContentionStat, 0, len(c.stats))
+	keys := make(map[*ContentionStat]string, len(c.stats))
+	for key, st := range c.stats {
+		stats = append(stats, st)
+		keys[st] = key
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Total != stats[j].Total {
+			return stats[i].Total > stats[j].Total
+		}
+		return keys[stats[i]] < keys[stats[j]]
+	})
+	return stats
+}
+
+// Caller returns the name of the first frame of st's stack outside
+// of the lock implementation, which is the code that tried to take
+// the lock.
+func (st *ContentionStat) Caller() string {
+	for i := range st.Stack {
+		if f := &st.Stack[i]; f.FuncName == "" || !isLockFunc(f.FuncName) {
+			return f.Name()
+		}
+	}
+	return "[unknown]"
+}
+
+// Lock flags from include/trace/events/lock.h.
+const (
+	lcbSpin   = 1 << 0
+	lcbRead   = 1 << 1
+	lcbWrite  = 1 << 2
+	lcbRT     = 1 << 3
+	lcbPerCPU = 1 << 4
+	lcbMutex  = 1 << 5
+)
+
+// lockTypes names combinations of lock flags. See lock_type_table in
+// tools/perf/builtin-lock.c.
+var lockTypes = map[uint64]string{
+	lcbSpin:              "spinlock",
+	lcbSpin | lcbRead:    "rwlock:R",
+	lcbSpin | lcbWrite:   "rwlock:W",
+	lcbRead:              "rwsem:R",
+	lcbWrite:             "rwsem:W",
+	lcbRT:                "rt-mutex",
+	lcbRT | lcbRead:      "rwlock-rt:R",
+	lcbRT | lcbWrite:     "rwlock-rt:W",
+	lcbPerCPU | lcbRead:  "pcpu-sem:R",
+	lcbPerCPU | lcbWrite: "pcpu-sem:W",
+	lcbMutex:             "mutex",
+	lcbMutex | lcbSpin:   "mutex-spin",
+}
+
+func lockType(flags uint64) string {
+	// The low 16 bits are the LCB_F_* lock type flags. The
+	// upper bits carry the task state, which doesn't affect the
+	// type.
+	if name, ok := lockTypes[flags&0xffff]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Futex operations that wait, from include/uapi/linux/futex.h.
+const (
+	futexWait          = 0
+	futexLockPI        = 6
+	futexWaitBitset    = 9
+	futexWaitRequeuePI = 11
+	futexLockPI2       = 13
+
+	futexPrivateFlag   = 128
+	futexClockRealtime = 256
+)
+
+func isFutexWait(op uint64) bool {
+	switch op &^ (futexPrivateFlag | futexClockRealtime) {
+	case futexWait, futexLockPI, futexWaitBitset, futexWaitRequeuePI, futexLockPI2:
+		return true
+	}
+	return false
+}
+
+// lockFuncPrefixes are prefixes of the names of functions that
+// implement locks: the kernel's, like is_lock_function in
+// tools/perf/builtin-lock.c, and common user-space ones built on
+// futexes.
+var lockFuncPrefixes = []string{
+	// Kernel
+	"__lock_text", "_raw_", "__raw_", "queued_", "native_queued_", "__mutex_lock", "mutex_lock", "__down", "down_", "rwsem_", "__rwsem", "rt_mutex", "__rt_mutex", "percpu_down", "osq_lock", "do_raw_", "__pv_queued",
+	// Futex system call path
+	"entry_SYSCALL", "do_syscall", "__x64_sys_futex", "__arm64_sys_futex", "__se_sys_futex", "do_futex", "futex_", "__futex",
+	// glibc and the Go runtime
+	"syscall", "__lll_lock", "lll_lock", "__pthread_mutex", "pthread_mutex", "__pthread_rwlock", "pthread_rwlock", "___pthread_cond", "pthread_cond",
+	"runtime.futex", "runtime.lock", "runtime.semasleep", "runtime.notesleep",
+}
+
+func isLockFunc(name string) bool {
+	for _, prefix := range lockFuncPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
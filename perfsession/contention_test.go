@@ -0,0 +1,140 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perffile/perffiletest"
+)
+
+func TestContention(t *testing.T) {
+	formats := make(map[perffile.EventTracepoint]*perffile.TracepointFormat)
+	for i, name := range []string{"lock:contention_begin", "lock:contention_end", "syscalls:sys_enter_futex", "syscalls:sys_exit_futex"} {
+		id := perffile.EventTracepoint(i + 1)
+		tf := &perffile.TracepointFormat{ID: id}
+		for j := range name {
+			if name[j] == ':' {
+				tf.System, tf.Name = name[:j], name[j+1:]
+			}
+		}
+		switch i {
+		case 0:
+			tf.Fields = []perffile.TracepointField{{Name: "flags", Type: "unsigned char", Offset: 0, Size: 1}}
+		case 2:
+			tf.Fields = []perffile.TracepointField{{Name: "op", Type: "unsigned char", Offset: 0, Size: 1}}
+		}
+		formats[id] = tf
+	}
+
+	var p perffiletest.Profile
+	format := perffile.SampleFormatRaw | perffile.SampleFormatCallchain
+	begin := p.Event(perffile.EventTracepoint(1), format)
+	end := p.Event(perffile.EventTracepoint(2), format)
+	enter := p.Event(perffile.EventTracepoint(3), format)
+	exit := p.Event(perffile.EventTracepoint(4), format)
+	raw := func(r *perffile.RecordSample, v byte) { r.Raw = []byte{v, 0, 0, 0} }
+
+	// A futex wait of 1000ns on thread 1 with a nested mutex wait
+	// of 100ns, and a spinlock wait of 50ns on thread 2.
+	raw(p.Sample(enter, 1, 1, 1000, 0x100, 0x200), futexWait|futexPrivateFlag)
+	raw(p.Sample(begin, 1, 1, 1100, 0x300, 0x400), lcbMutex)
+	p.Sample(end, 1, 1, 1200, 0x300)
+	raw(p.Sample(begin, 1, 2, 1300, 0x500), lcbSpin)
+	p.Sample(end, 1, 2, 1350, 0x500)
+	p.Sample(exit, 1, 1, 2000, 0x100)
+	// A futex wake on thread 2, which doesn't wait, and another
+	// futex wait on thread 1 at the same stack as the first.
+	raw(p.Sample(enter, 1, 2, 3000, 0x600), 1)
+	raw(p.Sample(enter, 1, 1, 4000, 0x100, 0x200), futexWaitBitset)
+	p.Sample(exit, 1, 1, 4500, 0x100)
+	p.Sample(exit, 1, 2, 9000, 0x600)
+	f, err := p.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(f)
+	c, err := newContention(s, formats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := f.Records(perffile.RecordsFileOrder)
+	for rs.Next() {
+		s.Update(rs.Record)
+		if r, ok := rs.Record.(*perffile.RecordSample); ok {
+			if err := c.Sample(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	type want struct {
+		typ        string
+		ip         uint64
+		count      int
+		total, max uint64
+	}
+	wants := []want{
+		{"futex", 0x100, 2, 1500, 1000},
+		{"mutex", 0x300, 1, 100, 100},
+		{"spinlock", 0x500, 1, 50, 50},
+	}
+	stats := c.Stats()
+	if len(stats) != len(wants) {
+		t.Fatalf("got %d stats, want %d", len(stats), len(wants))
+	}
+	for i, w := range wants {
+		st := stats[i]
+		if st.Type != w.typ || st.Stack[0].IP != w.ip || st.Count != w.count || st.Total != w.total || st.Max != w.max {
+			t.Errorf("stat %d: got %s at %#x count %d total %d max %d, want %+v", i, st.Type, st.Stack[0].IP, st.Count, st.Total, st.Max, w)
+		}
+	}
+
+	if _, err := newContention(s, nil); err != ErrNoContentionEvents {
+		t.Errorf("with no tracepoints, got error %v, want %v", err, ErrNoContentionEvents)
+	}
+}
+
+func TestContentionCaller(t *testing.T) {
+	frame := func(name string) Frame { return Frame{IP: 0x1234, Symbolic: Symbolic{FuncName: name}} }
+	tests := []struct {
+		stack []Frame
+		want  string
+	}{
+		{[]Frame{frame("_raw_spin_lock"), frame("do_work")}, "do_work"},
+		{[]Frame{frame("futex_wait"), frame("do_futex"), frame("__lll_lock_wait"), frame("pthread_mutex_lock"), frame("worker")}, "worker"},
+		{[]Frame{frame("runtime.futex"), frame("runtime.lock2"), frame("")}, "0x1234"},
+		{[]Frame{frame("mutex_lock")}, "[unknown]"},
+	}
+	for _, test := range tests {
+		st := &ContentionStat{Stack: test.stack}
+		if got := st.Caller(); got != test.want {
+			t.Errorf("Caller of %v = %q, want %q", test.stack, got, test.want)
+		}
+	}
+}
+
+func TestLockType(t *testing.T) {
+	for _, test := range []struct {
+		flags uint64
+		want  string
+	}{
+		{lcbMutex, "mutex"},
+		{lcbSpin | lcbRead, "rwlock:R"},
+		// The task state in the upper bits is ignored.
+		{lcbMutex | 2<<16, "mutex"},
+		{lcbRead | 1<<40, "rwsem:R"},
+		{1 << 15, "unknown"},
+	} {
+		if got := lockType(test.flags); got != test.want {
+			t.Errorf("lockType(%#x) = %q, want %q", test.flags, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"log"
+	"sort"
+	"strings"
+)
+
+// DataSymbolic describes the object containing a data address.
+type DataSymbolic struct {
+	// VarName is the name of the variable or object containing
+	// the address, or "" if unknown.
+	VarName string
+
+	// Offset is the offset of the address from the start of the
+	// object.
+	Offset uint64
+
+	// Type is the type of the variable, if known from DWARF.
+	Type dwarf.Type
+}
+
+// SymbolizeData resolves data address addr in process pid, such as
+// the address of a sampled memory access (RecordSample.Addr), to the
+// global or static variable containing it. It uses the symbol tables
+// and DWARF variables of the binaries mapped by pid. Sample addresses
+// are recorded by "perf mem record" and "perf record -d".
+//
+// If addr isn't in a static variable, SymbolizeData calls
+// session.DataResolver, if set, which can attribute heap addresses.
+// SymbolizeData returns false if addr could not be resolved.
+func SymbolizeData(session *Session, pid int, addr uint64, out *DataSymbolic) bool {
+	*out = DataSymbolic{}
+	if pidInfo := session.LookupPID(pid); pidInfo != nil {
+		for _, mmap := range pidInfo.maps {
+			if isAnon(mmap.Filename) || strings.HasPrefix(mmap.Filename, "[") {
+				continue
+			}
+			t := getDataTable(session, mmap)
+			if t == nil {
+				continue
+			}
+			// The address may be in the mapping itself or,
+			// for .bss, in the anonymous memory following
+			// it, so map it back to the ELF virtual address
+			// through the binary's segments.
+			vaddr, ok := t.vaddr(mmap, addr)
+			if !ok {
+				continue
+			}
+			if t.find(vaddr, out) {
+				return true
+			}
+		}
+	}
+	if session.DataResolver != nil {
+		return session.DataResolver(pid, addr, out)
+	}
+	return false
+}
+
+var dataTableKey = NewExtraKey("perfsession.dataTable")
+
+// A dataTable is the table of data objects in an ELF file.
+type dataTable struct {
+	loads []elf.ProgHeader
+	vars  []dataRange // Sorted by lo
+}
+
+type dataRange struct {
+	name   string
+	lo, hi uint64
+	typ    dwarf.Type
+}
+
+func getDataTable(session *Session, mmap *Mmap) *dataTable {
+	tables, ok := session.Extra[dataTableKey].(map[string]*dataTable)
+	if !ok {
+		tables = make(map[string]*dataTable)
+		session.Extra[dataTableKey] = tables
+	}
+	key, root := fileKey(session, mmap, mmap.Filename, false)
+	if t, ok := tables[key]; ok {
+		return t
+	}
+	tables[key] = nil
+
+	// Look for the file in the same places as Symbolize.
+	paths := buildIDFiles(session, mmap, mmap.Filename)
+	if root != "" {
+		paths = append(paths, root+mmap.Filename)
+	}
+	paths = append(paths, mmap.Filename)
+
+	var err error
+	for _, path := range paths {
+		var t *dataTable
+		t, err = newDataTable(path)
+		if err == nil {
+			tables[key] = t
+			return t
+		}
+	}
+	log.Println(err)
+	return nil
+}
+
+func newDataTable(filename string) (*dataTable, error) {
+	elff, err := elf.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer elff.Close()
+
+	t := &dataTable{}
+	for _, p := range elff.Progs {
+		if p.Type == elf.PT_LOAD {
+			t.loads = append(t.loads, p.ProgHeader)
+		}
+	}
+
+	// Collect variables from the ELF symbol table and DWARF,
+	// preferring DWARF because it has types.
+	vars := make(map[uint64]dataRange)
+	if syms, err := elff.Symbols(); err == nil {
+		for _, sym := range syms {
+			if elf.ST_TYPE(sym.Info) != elf.STT_OBJECT || sym.Section == elf.SHN_UNDEF || sym.Size == 0 {
+				continue
+			}
+			vars[sym.Value] = dataRange{sym.Name, sym.Value, sym.Value + sym.Size, nil}
+		}
+	}
+	if dwarff, err := elff.DWARF(); err == nil {
+		dwarfVars(dwarff, elff.ByteOrder, vars)
+	}
+
+	t.vars = make([]dataRange, 0, len(vars))
+	for _, v := range vars {
+		t.vars = append(t.vars, v)
+	}
+	sort.Slice(t.vars, func(i, j int) bool {
+		return t.vars[i].lo < t.vars[j].lo
+	})
+	return t, nil
+}
+
+// dwarfVars adds the variables with static addresses in dwarff to
+// vars.
+func dwarfVars(dwarff *dwarf.Data, order binary.ByteOrder, vars map[uint64]dataRange) {
+	const opAddr = 0x03 // DW_OP_addr
+	r := dwarff.Reader()
+	for {
+		ent, err := r.Next()
+		if ent == nil || err != nil {
+			break
+		}
+		switch ent.Tag {
+		case dwarf.TagVariable:
+			// Local variables are skipped along with their
+			// subprogram, so this only sees globals and
+			// static variables at compilation unit and
+			// namespace scope.
+			loc, ok := ent.Val(dwarf.AttrLocation).([]byte)
+			if !ok || len(loc) != 1+r.AddressSize() || loc[0] != opAddr {
+				break
+			}
+			var addr uint64
+			if r.AddressSize() == 8 {
+				addr = order.Uint64(loc[1:])
+			} else {
+				addr = uint64(order.Uint32(loc[1:]))
+			}
+			name, _ := ent.Val(dwarf.AttrName).(string)
+			if name == "" {
+				break
+			}
+			off, ok := ent.Val(dwarf.AttrType).(dwarf.Offset)
+			if !ok {
+				break
+			}
+			typ, err := dwarff.Type(off)
+			if err != nil || typ.Size() <= 0 {
+				break
+			}
+			vars[addr] = dataRange{name, addr, addr + uint64(typ.Size()), typ}
+
+		case dwarf.TagCompileUnit, dwarf.TagModule, dwarf.TagNamespace:
+			break
+
+		default:
+			r.SkipChildren()
+		}
+	}
+}
+
+// vaddr returns the ELF virtual address of run-time address addr,
+// which is in mmap or, for .bss, may be in the anonymous memory
+// following it. It reports false if addr isn't in a segment mapped by
+// mmap.
+//
+// The loader maps each segment starting at the page that contains
+// the segment's first byte, so the start of a mapping may hold the
+// end of the previous segment. Hence, this works from file offsets
+// rather than from the segment the mapping starts in.
+func (t *dataTable) vaddr(mmap *Mmap, addr uint64) (uint64, bool) {
+	if addr < mmap.Addr {
+		return 0, false
+	}
+	off := addr - mmap.Addr + mmap.FileOffset
+	for _, p := range t.loads {
+		if off < p.Off || off-p.Off >= p.Memsz {
+			continue
+		}
+		if addr-mmap.Addr >= mmap.Len {
+			// addr is past the mapping, so it must be in
+			// the zero-filled part of a segment whose file
+			// data ends in the mapping.
+			fileEnd := p.Off + p.Filesz
+			if fileEnd <= mmap.FileOffset || fileEnd > mmap.FileOffset+mmap.Len {
+				return 0, false
+			}
+		}
+		return off - p.Off + p.Vaddr, true
+	}
+	return 0, false
+}
+
+// find looks up the variable containing ELF virtual address addr.
+func (t *dataTable) find(addr uint64, out *DataSymbolic) bool {
+	i := sort.Search(len(t.vars), func(i int) bool {
+		return addr < t.vars[i].lo
+	}) - 1
+	if i < 0 || addr >= t.vars[i].hi {
+		return false
+	}
+	v := &t.vars[i]
+	*out = DataSymbolic{VarName: v.name, Offset: addr - v.lo, Type: v.typ}
+	return true
+}
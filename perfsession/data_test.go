@@ -0,0 +1,169 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"debug/elf"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perffile/perffiletest"
+)
+
+const dataProgram = `
+struct point { long x, y; };
+struct point origin = {1, 2};
+char buf[4096];
+
+int main(void) {
+	buf[0] = origin.x;
+	return buf[1];
+}
+`
+
+// buildData builds dataProgram with the C compiler flag buildmode
+// and returns the path of the binary.
+func buildData(t *testing.T, buildmode string) string {
+	return buildC(t, dataProgram, buildmode)
+}
+
+// buildC builds the C program src with the C compiler flag buildmode
+// and returns the path of the binary.
+func buildC(t *testing.T, src, buildmode string) string {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("C compiler not found")
+	}
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "prog.c")
+	if err := os.WriteFile(srcPath, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "prog")
+	if out, err := exec.Command(cc, "-g", buildmode, "-o", bin, srcPath).CombinedOutput(); err != nil {
+		t.Skipf("building C program failed: %v\n%s", err, out)
+	}
+	return bin
+}
+
+func TestSymbolizeData(t *testing.T) {
+	for _, buildmode := range []string{"-no-pie", "-pie"} {
+		t.Run(buildmode, func(t *testing.T) {
+			bin := buildData(t, buildmode)
+			elff, err := elf.Open(bin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer elff.Close()
+			syms, err := elff.Symbols()
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs := make(map[string]uint64)
+			for _, sym := range syms {
+				addrs[sym.Name] = sym.Value
+			}
+			if addrs["origin"] == 0 || addrs["buf"] == 0 {
+				t.Fatal("origin or buf not in symbol table")
+			}
+
+			// Put the binary in the build ID cache under the
+			// build ID its mappings carry, and map it from a
+			// path that doesn't exist, so it can only be found
+			// by build ID.
+			id := perffile.BuildID{0xda, 0x7a, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18}
+			defer func(dir string) { buildIDDir = dir }(buildIDDir)
+			buildIDDir = t.TempDir()
+			data, err := os.ReadFile(bin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cachePath := buildIDPath(buildIDDir, id)
+			if err := os.MkdirAll(filepath.Dir(cachePath), 0777); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(cachePath, data, 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			// Map each segment from the start of its first
+			// page, as the loader does. The data segment's
+			// first page is also the read-only segment's
+			// last page, and its .bss extends past the file
+			// mapping.
+			var p perffiletest.Profile
+			p.Event(perffile.EventHardware{ID: perffile.EventHardwareIDCPUCycles}, 0)
+			var base uint64
+			if elff.Type == elf.ET_DYN {
+				base = 0x555555554000
+			}
+			const page = 0x1000
+			for _, prog := range elff.Progs {
+				if prog.Type != elf.PT_LOAD {
+					continue
+				}
+				start := prog.Vaddr &^ (page - 1)
+				end := (prog.Vaddr + prog.Filesz + page - 1) &^ (page - 1)
+				p.Add(&perffile.RecordMmap{
+					RecordCommon: perffile.RecordCommon{PID: 1, TID: 1},
+					Addr:         base + start,
+					Len:          end - start,
+					FileOffset:   prog.Off &^ (page - 1),
+					BuildID:      id,
+					Filename:     "/nonexistent/data",
+				})
+			}
+			f, err := p.File()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := New(f)
+			rs := f.Records(perffile.RecordsFileOrder)
+			for rs.Next() {
+				s.Update(rs.Record)
+			}
+			if err := rs.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				addr   uint64
+				name   string
+				offset uint64
+				typ    string
+			}{
+				{addrs["origin"] + 8, "origin", 8, "struct point"},
+				{addrs["buf"] + 0x10, "buf", 0x10, "[4096]char"},
+				// Past the end of the file mapping.
+				{addrs["buf"] + 0xff0, "buf", 0xff0, "[4096]char"},
+				{addrs["buf"] + 0x1000, "", 0, ""},
+			}
+			for _, test := range tests {
+				var sym DataSymbolic
+				ok := SymbolizeData(s, 1, base+test.addr, &sym)
+				if test.name == "" {
+					if ok {
+						t.Errorf("%#x: got %+v, want no variable", test.addr, sym)
+					}
+					continue
+				}
+				if !ok {
+					t.Errorf("%#x: not symbolized, want %s+%#x", test.addr, test.name, test.offset)
+					continue
+				}
+				if sym.VarName != test.name || sym.Offset != test.offset {
+					t.Errorf("%#x: got %s+%#x, want %s+%#x", test.addr, sym.VarName, sym.Offset, test.name, test.offset)
+				}
+				// The types come from DWARF.
+				if sym.Type == nil || sym.Type.String() != test.typ {
+					t.Errorf("%#x: got type %v, want %s", test.addr, sym.Type, test.typ)
+				}
+			}
+		})
+	}
+}
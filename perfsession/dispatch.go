@@ -0,0 +1,120 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"errors"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// SkipRecord can be returned by a Dispatcher callback to drop the
+// current record. Later callbacks will not see the record and it
+// will not be applied to the Session.
+var SkipRecord = errors.New("skip this record")
+
+// A Dispatcher delivers the records of a profile to callbacks
+// registered for each record type, and keeps a Session up to date
+// with the records.
+//
+// For each record, the Dispatcher calls the callbacks registered for
+// that record's type in the order they were registered, and then
+// applies the record to the Session. Hence, callbacks may modify a
+// record, such as to rewrite a mapping's file name, and the
+// modification will be seen by later callbacks and by the Session.
+// When a sample callback runs, the Session reflects all records
+// before that sample.
+//
+// If a callback returns SkipRecord, the record is dropped. If it
+// returns any other error, Run stops and returns that error.
+type Dispatcher struct {
+	Session *Session
+
+	callbacks []func(r perffile.Record) error
+}
+
+// NewDispatcher returns a Dispatcher with a new Session for f.
+func NewDispatcher(f *perffile.File) *Dispatcher {
+	return &Dispatcher{Session: New(f)}
+}
+
+// OnRecord registers fn to be called for every record.
+func (d *Dispatcher) OnRecord(fn func(r perffile.Record) error) {
+	d.callbacks = append(d.callbacks, fn)
+}
+
+// OnSample registers fn to be called for every sample record.
+func (d *Dispatcher) OnSample(fn func(r *perffile.RecordSample) error) {
+	d.OnRecord(func(r perffile.Record) error {
+		if r, ok := r.(*perffile.RecordSample); ok {
+			return fn(r)
+		}
+		return nil
+	})
+}
+
+// OnMmap registers fn to be called for every mmap record.
+func (d *Dispatcher) OnMmap(fn func(r *perffile.RecordMmap) error) {
+	d.OnRecord(func(r perffile.Record) error {
+		if r, ok := r.(*perffile.RecordMmap); ok {
+			return fn(r)
+		}
+		return nil
+	})
+}
+
+// OnComm registers fn to be called for every comm record.
+func (d *Dispatcher) OnComm(fn func(r *perffile.RecordComm) error) {
+	d.OnRecord(func(r perffile.Record) error {
+		if r, ok := r.(*perffile.RecordComm); ok {
+			return fn(r)
+		}
+		return nil
+	})
+}
+
+// OnFork registers fn to be called for every fork record.
+func (d *Dispatcher) OnFork(fn func(r *perffile.RecordFork) error) {
+	d.OnRecord(func(r perffile.Record) error {
+		if r, ok := r.(*perffile.RecordFork); ok {
+			return fn(r)
+		}
+		return nil
+	})
+}
+
+// OnExit registers fn to be called for every exit record.
+func (d *Dispatcher) OnExit(fn func(r *perffile.RecordExit) error) {
+	d.OnRecord(func(r perffile.Record) error {
+		if r, ok := r.(*perffile.RecordExit); ok {
+			return fn(r)
+		}
+		return nil
+	})
+}
+
+// Run delivers each record from rs to the registered callbacks. It
+// returns the first error returned by a callback, other than
+// SkipRecord, or the error from rs.
+func (d *Dispatcher) Run(rs *perffile.Records) error {
+	for rs.Next() {
+		if err := d.dispatch(rs.Record); err != nil {
+			return err
+		}
+	}
+	return rs.Err()
+}
+
+func (d *Dispatcher) dispatch(r perffile.Record) error {
+	for _, fn := range d.callbacks {
+		if err := fn(r); err == SkipRecord {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	d.Session.Update(r)
+	return nil
+}
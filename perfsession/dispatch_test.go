@@ -0,0 +1,45 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+func TestDispatcher(t *testing.T) {
+	d := &Dispatcher{Session: New(nil)}
+	var log []string
+	d.OnComm(func(r *perffile.RecordComm) error {
+		log = append(log, "comm1 "+r.Comm)
+		if r.Comm == "skip" {
+			return SkipRecord
+		}
+		r.Comm = "renamed"
+		return nil
+	})
+	d.OnRecord(func(r perffile.Record) error {
+		if r, ok := r.(*perffile.RecordComm); ok {
+			log = append(log, "record "+r.Comm)
+		}
+		return nil
+	})
+
+	d.dispatch(&perffile.RecordComm{RecordCommon: perffile.RecordCommon{PID: 1}, Comm: "skip"})
+	if info := d.Session.LookupPID(1); info != nil {
+		t.Errorf("skipped record was applied to session: %+v", info)
+	}
+	d.dispatch(&perffile.RecordComm{RecordCommon: perffile.RecordCommon{PID: 2}, Comm: "orig"})
+	if info := d.Session.LookupPID(2); info == nil || info.Comm != "renamed" {
+		t.Errorf("modified record was not applied to session")
+	}
+
+	want := []string{"comm1 skip", "comm1 orig", "record renamed"}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("got callbacks %q, want %q", log, want)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"debug/gosym"
+	"fmt"
+	"sort"
+)
+
+// loadGo loads the Go symbol table of a Go binary from its
+// .gopclntab section into s. This is present even in stripped Go
+// binaries, but covers only Go code.
+//
+// TODO: The pclntab also records inlining, but debug/gosym doesn't
+// expose it.
+func (s *symbolicExtra) loadGo(elff *elf.File) error {
+	pclntab, err := elff.Section(".gopclntab").Data()
+	if err != nil {
+		return err
+	}
+	text := elff.Section(".text")
+	if text == nil {
+		return fmt.Errorf("no .text section")
+	}
+	var symtab []byte
+	if sec := elff.Section(".gosymtab"); sec != nil {
+		symtab, _ = sec.Data()
+	}
+	// With external linking, as in cgo binaries, .text may begin
+	// with C code. The Go text starts at runtime.text.
+	textStart := text.Addr
+	if syms, err := elff.Symbols(); err == nil {
+		for _, sym := range syms {
+			if sym.Name == "runtime.text" {
+				textStart = sym.Value
+				break
+			}
+		}
+	}
+	tab, err := gosym.NewTable(symtab, gosym.NewLineTable(pclntab, textStart))
+	if err != nil {
+		return err
+	}
+
+	var bias uint64
+	if elff.Type == elf.ET_DYN {
+		// PIE binary. As with ELF symbols, index gofunctab by
+		// file offset.
+		for _, p := range elff.Progs {
+			if p.Type == elf.PT_LOAD && p.Vaddr <= textStart && textStart < p.Vaddr+p.Memsz {
+				bias = p.Vaddr - p.Off
+				break
+			}
+		}
+		s.isReloc = true
+	}
+
+	s.gotab, s.gobias = tab, bias
+	s.gofiles = make(map[string]*dwarf.LineFile)
+	s.gofunctab = make([]funcRange, 0, len(tab.Funcs))
+	for _, fn := range tab.Funcs {
+		s.gofunctab = append(s.gofunctab, funcRange{fn.Name, fn.Entry - bias, fn.End - bias, true})
+	}
+	sort.Sort(funcRangeSorter(s.gofunctab))
+
+	return nil
+}
+
+// goLine returns the line table entry for ip, which is in the same
+// address space as gofunctab.
+func (s *symbolicExtra) goLine(ip uint64) *dwarf.LineEntry {
+	pc := ip + s.gobias
+	file, line, fn := s.gotab.PCToLine(pc)
+	if fn == nil {
+		return nil
+	}
+	lf := s.gofiles[file]
+	if lf == nil {
+		lf = &dwarf.LineFile{Name: file}
+		s.gofiles[file] = lf
+	}
+	return &dwarf.LineEntry{Address: pc, File: lf, Line: line, IsStmt: true}
+}
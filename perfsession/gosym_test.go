@@ -0,0 +1,117 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"debug/elf"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+const cgoProgram = `package main
+
+/*
+int cfunc(int x) {
+	return x * 2 + 1;
+}
+*/
+import "C"
+
+func main() {
+	println(C.cfunc(1))
+}
+`
+
+// buildCgo builds cgoProgram with the given build mode and returns
+// the path of the binary.
+func buildCgo(t *testing.T, buildmode string) string {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("C compiler not found")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte(cgoProgram), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module cgotest\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "cgotest")
+	cmd := exec.Command(goTool, "build", "-buildmode="+buildmode, "-o", bin)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("building cgo program failed: %v\n%s", err, out)
+	}
+	return bin
+}
+
+func TestSymbolizeCgo(t *testing.T) {
+	for _, buildmode := range []string{"exe", "pie"} {
+		t.Run(buildmode, func(t *testing.T) {
+			bin := buildCgo(t, buildmode)
+			extra, err := newSymbolicExtra(bin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if extra.gotab == nil {
+				t.Fatal("Go symbol table not loaded")
+			}
+
+			elff, err := elf.Open(bin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer elff.Close()
+			syms, err := elff.Symbols()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Map the binary's text segment at an arbitrary
+			// base, as the loader would for a PIE.
+			var mmap Mmap
+			var base uint64
+			if elff.Type == elf.ET_DYN {
+				base = 0x555555554000
+			}
+			for _, p := range elff.Progs {
+				if p.Type == elf.PT_LOAD && p.Flags&elf.PF_X != 0 {
+					mmap.RecordMmap = perffile.RecordMmap{Addr: base + p.Vaddr, Len: p.Memsz, FileOffset: p.Off}
+					break
+				}
+			}
+
+			found := 0
+			for _, sym := range syms {
+				if sym.Name != "cfunc" && sym.Name != "main.main" {
+					continue
+				}
+				found++
+				f, l := extra.findIP(&mmap, base+sym.Value, DemangleNone)
+				if f == nil {
+					t.Errorf("%s: no function", sym.Name)
+					continue
+				}
+				if f.name != sym.Name {
+					t.Errorf("%s: got function %s", sym.Name, f.name)
+				}
+				if sym.Name == "main.main" && (l == nil || filepath.Base(l.File.Name) != "main.go") {
+					t.Errorf("%s: got line %+v, want main.go", sym.Name, l)
+				}
+			}
+			if found != 2 {
+				t.Fatalf("found %d of 2 symbols", found)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"bufio"
+	"debug/dwarf"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aclements/go-perf/jitdump"
+)
+
+var jitdumpRe = regexp.MustCompile(`^jit-[0-9]+\.dump$`)
+
+// isJITDump returns whether filename is a jitdump file.
+func isJITDump(filename string) bool {
+	return jitdumpRe.MatchString(filepath.Base(filename))
+}
+
+// isAnon returns whether filename is the name perf uses for an
+// anonymous mapping, which is where JIT runtimes put their code.
+func isAnon(filename string) bool {
+	return filename == "" || strings.HasPrefix(filename, "//anon") || strings.HasPrefix(filename, "[anon")
+}
+
+// getJITExtra returns the symbol table for anonymous mapping mmap
+// from the jitdump file of mmap's process, or, failing that, from its
+// /tmp/perf-<pid>.map file. It returns nil if there's neither.
+func getJITExtra(session *Session, tables map[string]*symbolicExtra, mmap *Mmap) *symbolicExtra {
+	info := session.pidInfo[mmap.PID]
+	if info == nil {
+		return nil
+	}
+	filename, load := info.jitdump, newJITSymbolicExtra
+	if filename == "" {
+		filename, load = fmt.Sprintf("/tmp/perf-%d.map", mmap.PID), newPerfMapSymbolicExtra
+	}
+
+	key := "jit:" + filename
+	root, mntNS := session.mountRoot(mmap.PID)
+	if root != "" {
+		key = fmt.Sprintf("%s (mnt:%d)", key, mntNS)
+	}
+	extra, ok := tables[key]
+	if ok {
+		return extra
+	}
+	tables[key] = nil
+
+	var err error
+	if root != "" {
+		extra, err = load(root + filename)
+	}
+	if extra == nil {
+		extra, err = load(filename)
+		if err != nil && !(info.jitdump == "" && os.IsNotExist(errors.Unwrap(err))) {
+			// Most processes don't have a perf map, so
+			// don't complain about those.
+			log.Println(err)
+		}
+	}
+	tables[key] = extra
+	return extra
+}
+
+// newPerfMapSymbolicExtra creates a symbol table from a perf map file.
+// Each line of a perf map has the form "START SIZE name", where START
+// and SIZE are hexadecimal. See tools/perf/Documentation/jit-interface.txt.
+func newPerfMapSymbolicExtra(filename string) (*symbolicExtra, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error loading perf map %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	// Later entries replace earlier entries at the same address.
+	byAddr := make(map[uint64]funcRange)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		start, err1 := strconv.ParseUint(strings.TrimPrefix(fields[0], "0x"), 16, 64)
+		size, err2 := strconv.ParseUint(strings.TrimPrefix(fields[1], "0x"), 16, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		byAddr[start] = funcRange{fields[2], start, start + size, false}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading perf map %s: %w", filename, err)
+	}
+
+	extra := &symbolicExtra{}
+	for _, fr := range byAddr {
+		extra.functab = append(extra.functab, fr)
+	}
+	sort.Sort(funcRangeSorter(extra.functab))
+	return extra, nil
+}
+
+// newJITSymbolicExtra creates a symbol table from a jitdump file.
+//
+// TODO: Code addresses may be reused for different functions over
+// the life of a process. This uses the most recent function loaded
+// at each address, but should consider the time of the sample.
+func newJITSymbolicExtra(filename string) (*symbolicExtra, error) {
+	f, err := jitdump.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error loading jitdump %s: %s", filename, err)
+	}
+	defer f.Close()
+
+	type codeLoad struct {
+		name       string
+		addr, size uint64
+		debug      *jitdump.RecordDebugInfo
+	}
+	byAddr := make(map[uint64]*codeLoad)
+	byIndex := make(map[uint64]*codeLoad)
+	debug := make(map[uint64]*jitdump.RecordDebugInfo)
+	rs := f.Records()
+	for rs.Next() {
+		switch r := rs.Record.(type) {
+		case *jitdump.RecordDebugInfo:
+			// This precedes the corresponding code load.
+			debug[r.CodeAddr] = r
+
+		case *jitdump.RecordCodeLoad:
+			cl := &codeLoad{r.Name, r.CodeAddr, uint64(len(r.Code)), debug[r.CodeAddr]}
+			delete(debug, r.CodeAddr)
+			byAddr[cl.addr] = cl
+			byIndex[r.CodeIndex] = cl
+
+		case *jitdump.RecordCodeMove:
+			cl := byIndex[r.CodeIndex]
+			if cl == nil || byAddr[cl.addr] != cl {
+				break
+			}
+			delete(byAddr, cl.addr)
+			cl.addr = r.NewCodeAddr
+			byAddr[cl.addr] = cl
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return nil, fmt.Errorf("error reading jitdump %s: %s", filename, err)
+	}
+
+	extra := &symbolicExtra{}
+	files := make(map[string]*dwarf.LineFile)
+	for _, cl := range byAddr {
+		extra.functab = append(extra.functab, funcRange{cl.name, cl.addr, cl.addr + cl.size, false})
+		if cl.debug == nil {
+			continue
+		}
+		for _, e := range cl.debug.Entries {
+			lf := files[e.File]
+			if lf == nil {
+				lf = &dwarf.LineFile{Name: e.File}
+				files[e.File] = lf
+			}
+			// Debug info addresses are relative to where
+			// the code was originally loaded.
+			addr := e.Addr - cl.debug.CodeAddr + cl.addr
+			extra.linetab = append(extra.linetab, dwarf.LineEntry{Address: addr, File: lf, Line: e.Line, Discriminator: e.Discrim, IsStmt: true})
+		}
+		extra.linetab = append(extra.linetab, dwarf.LineEntry{Address: cl.addr + cl.size, EndSequence: true})
+	}
+	sort.Sort(funcRangeSorter(extra.functab))
+	sort.SliceStable(extra.linetab, func(i, j int) bool {
+		a, b := &extra.linetab[i], &extra.linetab[j]
+		if a.Address != b.Address {
+			return a.Address < b.Address
+		}
+		// End the previous sequence before starting the
+		// next.
+		return a.EndSequence && !b.EndSequence
+	})
+	return extra, nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"sort"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// ksymbolFile is the file name of the mappings created for kernel
+// symbols registered at run time, such as BPF programs and ftrace
+// trampolines. These are described by RecordKsymbol rather than by a
+// file, so Symbolize looks them up in Session.ksyms.
+const ksymbolFile = "[kernel.ksymbol]"
+
+// updateKsymbol applies a kernel symbol registration or
+// unregistration to the kernel's mappings.
+func (s *Session) updateKsymbol(r *perffile.RecordKsymbol) {
+	start, end := r.Addr, r.Addr+uint64(r.Len)
+	s.kernel.munmap(start, uint64(r.Len))
+	if s.ksyms == nil {
+		s.ksyms = &symbolicExtra{}
+	}
+
+	// Remove any symbols this overlaps.
+	tab := s.ksyms.functab[:0]
+	for _, f := range s.ksyms.functab {
+		if f.highpc <= start || end <= f.lowpc {
+			tab = append(tab, f)
+		}
+	}
+
+	if r.Flags&perffile.KsymbolFlagUnregister == 0 {
+		tab = append(tab, funcRange{name: r.Name, lowpc: start, highpc: end})
+		sort.Sort(funcRangeSorter(tab))
+
+		m := &Mmap{Extra: make(ForkableExtra)}
+		m.RecordCommon = r.RecordCommon
+		m.PID, m.TID = -1, -1
+		m.Addr, m.Len, m.FileOffset = start, uint64(r.Len), start
+		m.Filename = ksymbolFile
+		m.CPUMode = perffile.CPUModeKernel
+		s.kernel.maps = append(s.kernel.maps, m)
+	}
+	s.ksyms.functab = tab
+}
+
+// A textPoke is a kernel text modification recorded by a
+// RecordTextPoke.
+type textPoke struct {
+	addr uint64
+	new  []byte
+}
+
+// PatchKernelText applies the kernel text modifications recorded in
+// the profile to code, which holds the kernel's text starting at
+// address addr. It reports whether any bytes of code were modified.
+//
+// The kernel modifies its own code at run time, for example to toggle
+// static keys or enable ftrace, and records these modifications in
+// the profile as RecordTextPoke records. Hence, the code in vmlinux
+// may differ from the code that actually ran. PatchKernelText applies
+// the modifications seen by Update so far, so after processing the
+// whole profile, code reflects the kernel text at the end of the
+// profile.
+func (s *Session) PatchKernelText(addr uint64, code []byte) bool {
+	end := addr + uint64(len(code))
+	patched := false
+	for _, p := range s.textPokes {
+		pend := p.addr + uint64(len(p.new))
+		if pend <= addr || end <= p.addr {
+			continue
+		}
+		lo, hi := p.addr, pend
+		if lo < addr {
+			lo = addr
+		}
+		if hi > end {
+			hi = end
+		}
+		copy(code[lo-addr:hi-addr], p.new[lo-p.addr:])
+		patched = true
+	}
+	return patched
+}
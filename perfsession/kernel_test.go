@@ -0,0 +1,114 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+func TestKsymbol(t *testing.T) {
+	s := New(nil)
+	s.Update(&perffile.RecordKsymbol{Addr: 0x1000, Len: 0x100, Name: "bpf_prog_1"})
+	s.Update(&perffile.RecordKsymbol{Addr: 0x2000, Len: 0x100, Name: "bpf_prog_2"})
+
+	lookup := func(ip uint64) string {
+		mmap := s.kernel.LookupMmap(ip)
+		if mmap == nil {
+			return ""
+		}
+		var sym Symbolic
+		if !Symbolize(s, mmap, ip, &sym) {
+			return ""
+		}
+		return sym.FuncName
+	}
+	if got := lookup(0x1080); got != "bpf_prog_1" {
+		t.Errorf("symbol at 0x1080 is %q, want bpf_prog_1", got)
+	}
+	if got := lookup(0x2000); got != "bpf_prog_2" {
+		t.Errorf("symbol at 0x2000 is %q, want bpf_prog_2", got)
+	}
+
+	s.Update(&perffile.RecordKsymbol{Addr: 0x1000, Len: 0x100, Name: "bpf_prog_1", Flags: perffile.KsymbolFlagUnregister})
+	if got := lookup(0x1080); got != "" {
+		t.Errorf("symbol at 0x1080 after unregister is %q, want none", got)
+	}
+	if got := lookup(0x2000); got != "bpf_prog_2" {
+		t.Errorf("symbol at 0x2000 is %q, want bpf_prog_2", got)
+	}
+}
+
+func TestPatchKernelText(t *testing.T) {
+	s := New(nil)
+	s.Update(&perffile.RecordTextPoke{Addr: 0x102, Old: []byte{0, 0}, New: []byte{1, 2}})
+	s.Update(&perffile.RecordTextPoke{Addr: 0xfe, Old: []byte{0, 0, 0}, New: []byte{3, 4, 5}})
+	s.Update(&perffile.RecordTextPoke{Addr: 0x200, Old: []byte{0}, New: []byte{6}})
+
+	// Records may be reused, so changing one after Update must
+	// not change the session.
+	r := &perffile.RecordTextPoke{Addr: 0x101, Old: []byte{0}, New: []byte{7}}
+	s.Update(r)
+	r.Addr, r.New[0] = 0x103, 8
+
+	code := make([]byte, 4)
+	if !s.PatchKernelText(0x100, code) {
+		t.Errorf("PatchKernelText reported no changes")
+	}
+	if want := []byte{5, 7, 1, 2}; !bytes.Equal(code, want) {
+		t.Errorf("patched code is %v, want %v", code, want)
+	}
+	if s.PatchKernelText(0x300, code) {
+		t.Errorf("PatchKernelText reported changes outside of any text poke")
+	}
+}
+
+func TestGuestKernels(t *testing.T) {
+	// Two VMs, with host PIDs 100 and 200, each with their own
+	// guest kallsyms.
+	dir := t.TempDir()
+	for pid, fn := range map[int]string{100: "vm1_func", 200: "vm2_func"} {
+		procDir := filepath.Join(dir, strconv.Itoa(pid), "proc")
+		if err := os.MkdirAll(procDir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		kallsyms := "ffffffff81000000 T " + fn + "\nffffffff82000000 T _etext\n"
+		if err := os.WriteFile(filepath.Join(procDir, "kallsyms"), []byte(kallsyms), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := New(nil)
+	s.GuestMount = dir
+	for _, pid := range []int{100, 200} {
+		r := &perffile.RecordMmap{Addr: 0xffffffff81000000, Len: 0x1000000, Filename: guestKallsyms}
+		r.PID, r.TID = pid, pid
+		r.CPUMode = perffile.CPUModeGuestKernel
+		s.Update(r)
+	}
+
+	for _, test := range []struct {
+		pid  int
+		want string
+	}{
+		{100, "vm1_func"},
+		{200, "vm2_func"},
+		{300, ""},
+	} {
+		const ip = 0xffffffff81000010
+		var sym Symbolic
+		if mmap := s.LookupGuestKernelMmap(test.pid, ip); mmap != nil {
+			Symbolize(s, mmap, ip, &sym)
+		}
+		if sym.FuncName != test.want {
+			t.Errorf("VM %d: got %q, want %q", test.pid, sym.FuncName, test.want)
+		}
+	}
+}
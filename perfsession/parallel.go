@@ -0,0 +1,62 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"runtime"
+	"sync"
+)
+
+// SymbolizeAll symbolizes frames[i] into out[i] for each i, using up
+// to workers goroutines. If workers is <= 0, it uses GOMAXPROCS.
+// Frames that can't be symbolized are set to the zero Symbolic.
+//
+// Frames are divided among workers by build ID, so each worker
+// consults only its own symbol tables, and each table is loaded once.
+// The results are in the same order as frames regardless of the order
+// in which they are resolved.
+func (s *Symbolizer) SymbolizeAll(frames []RawFrame, out []Symbolic, workers int) {
+	if len(out) < len(frames) {
+		panic("output slice too short")
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	// Shard the frames by build ID.
+	shards := make(map[string][]int)
+	var keys []string
+	for i, f := range frames {
+		key := f.BuildID.String()
+		if _, ok := shards[key]; !ok {
+			keys = append(keys, key)
+		}
+		shards[key] = append(shards[key], i)
+	}
+
+	work := make(chan []int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(keys); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idxs := range work {
+				t := s.table(frames[idxs[0]].BuildID)
+				for _, i := range idxs {
+					if t == nil {
+						out[i] = Symbolic{}
+					} else {
+						s.symbolize(t, frames[i], &out[i])
+					}
+				}
+			}
+		}()
+	}
+	for _, key := range keys {
+		work <- shards[key]
+	}
+	close(work)
+	wg.Wait()
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"debug/elf"
+	"runtime"
+	"testing"
+)
+
+const pltProgram = `
+#include <string.h>
+
+char dst[64], src[64];
+
+int main(int argc, char **argv) {
+	memcpy(dst, src, argc);
+	return dst[0];
+}
+`
+
+func TestPLTFuncs(t *testing.T) {
+	if runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64" {
+		t.Skipf("PLT stubs not supported on %s", runtime.GOARCH)
+	}
+	for _, buildmode := range []string{"-no-pie", "-pie"} {
+		t.Run(buildmode, func(t *testing.T) {
+			bin := buildC(t, pltProgram, buildmode)
+			elff, err := elf.Open(bin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer elff.Close()
+			functab, isReloc := elfFuncTable(bin, elff)
+			if want := buildmode == "-pie"; isReloc != want {
+				t.Fatalf("got isReloc %v, want %v", isReloc, want)
+			}
+
+			var stub *funcRange
+			for i := range functab {
+				if functab[i].name == "memcpy@plt" {
+					stub = &functab[i]
+				}
+			}
+			if stub == nil {
+				t.Fatal("no memcpy@plt in function table")
+			}
+
+			// The stub must be inside the PLT.
+			plt := elff.Section(".plt.sec")
+			if plt == nil {
+				plt = elff.Section(".plt")
+			}
+			lo, hi := plt.Addr, plt.Addr+plt.Size
+			if isReloc {
+				lo, hi = plt.Offset, plt.Offset+plt.Size
+			}
+			if stub.lowpc < lo || stub.highpc > hi {
+				t.Errorf("memcpy@plt at [%#x,%#x) is outside the PLT [%#x,%#x)", stub.lowpc, stub.highpc, lo, hi)
+			}
+			if f := findFunc(functab, stub.lowpc+4, DemangleNone); f == nil || f.name != "memcpy@plt" {
+				t.Errorf("PC in memcpy@plt symbolized as %v", f)
+			}
+
+			stack := []Frame{{Symbolic: Symbolic{FuncName: stub.name}}, {Symbolic: Symbolic{FuncName: "main"}}}
+			stack = TrimPLT.Apply(stack)
+			if stack[0].FuncName != "memcpy" {
+				t.Errorf("TrimPLT left %q", stack[0].FuncName)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"container/list"
+	"debug/dwarf"
+	"debug/elf"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// A RawFrame identifies a code location independently of the
+// process and machine it was recorded on. RawFrames can be recorded
+// cheaply and symbolized later, possibly elsewhere, by a Symbolizer.
+type RawFrame struct {
+	// BuildID is the build ID of the mapped file.
+	BuildID perffile.BuildID
+
+	// Offset is the offset of the location in the mapped file.
+	// For the kernel, Offset is the kernel virtual address.
+	Offset uint64
+}
+
+// RawFrame returns the RawFrame for ip in mmap. It returns false if
+// the build ID of mmap's file is unknown.
+func (s *Session) RawFrame(mmap *Mmap, ip uint64) (RawFrame, bool) {
+	id, isKernel := perffile.BuildID(mmap.BuildID), isKernelMmap(mmap)
+	if id == nil && s.File != nil {
+		for _, bid := range s.File.Meta.BuildIDs {
+			if bid.Filename == mmap.Filename || isKernel && strings.HasPrefix(bid.Filename, "[kernel.kallsyms]") {
+				id = bid.BuildID
+				break
+			}
+		}
+	}
+	if len(id) == 0 {
+		return RawFrame{}, false
+	}
+	if isKernel {
+		return RawFrame{id, ip}, true
+	}
+	return RawFrame{id, ip - mmap.Addr + mmap.FileOffset}, true
+}
+
+func isKernelMmap(mmap *Mmap) bool {
+	return strings.HasPrefix(mmap.Filename, "[kernel.kallsyms]")
+}
+
+// A FrameSymbolizer symbolizes RawFrames. *Symbolizer is a
+// FrameSymbolizer that reads files from a build ID cache; other
+// implementations might query a symbol server.
+type FrameSymbolizer interface {
+	// Symbolize symbolizes frame and stores the result in out. It
+	// returns false if frame's file can't be found.
+	Symbolize(frame RawFrame, out *Symbolic) bool
+}
+
+// A Symbolizer symbolizes RawFrames using files from a build ID
+// cache.
+type Symbolizer struct {
+	// Dir is the build ID cache directory. If "", it defaults to
+	// perf's default, usually ~/.debug.
+	Dir string
+
+	// Demangle specifies how names are demangled. It must be set
+	// before the first call to Symbolize.
+	Demangle DemangleStyle
+
+	// MaxTables, if non-zero, limits the number of symbol tables
+	// kept in memory. Beyond this, the least recently used table
+	// is discarded.
+	MaxTables int
+
+	// CacheDir, if non-empty, is a directory in which to cache
+	// symbol tables between runs, so large DWARF tables don't
+	// have to be parsed again. Entries are keyed by build ID, so
+	// they never need to be invalidated.
+	CacheDir string
+
+	mu      sync.Mutex // Protects tables, lru, and missing
+	tables  map[string]*list.Element
+	lru     list.List // Of *rawTable, most recently used first
+	missing map[string]bool
+}
+
+type rawTable struct {
+	*symbolicExtra
+
+	// key is the build ID of this table.
+	key string
+
+	// loads are the loadable segments of the file, used to map
+	// file offsets to virtual addresses if symbolicExtra is not
+	// indexed by file offset. nil for the kernel.
+	loads []loadSeg
+}
+
+// loadSeg is a PT_LOAD segment.
+type loadSeg struct {
+	Off, Filesz, Vaddr uint64
+}
+
+// Symbolize symbolizes frame and stores the result in out. It
+// returns false if the file with frame's build ID can't be found.
+//
+// Symbolize must not be called concurrently. To symbolize many frames
+// in parallel, use SymbolizeAll.
+func (s *Symbolizer) Symbolize(frame RawFrame, out *Symbolic) bool {
+	t := s.table(frame.BuildID)
+	if t == nil {
+		return false
+	}
+	s.symbolize(t, frame, out)
+	return true
+}
+
+func (s *Symbolizer) symbolize(t *rawTable, frame RawFrame, out *Symbolic) {
+
+	ip := frame.Offset
+	if !t.isReloc && t.loads != nil {
+		// Translate the file offset to a virtual address.
+		for _, p := range t.loads {
+			if p.Off <= ip && ip < p.Off+p.Filesz {
+				ip = ip - p.Off + p.Vaddr
+				break
+			}
+		}
+	}
+
+	// The zero Mmap makes findIP treat ip as a file offset if
+	// the table is indexed that way.
+	f, l := t.findIP(&Mmap{}, ip, s.Demangle)
+	if f == nil {
+		out.FuncName = ""
+	} else {
+		out.FuncName = f.name
+	}
+	if l == nil {
+		out.Line = dwarf.LineEntry{}
+	} else {
+		out.Line = *l
+	}
+}
+
+// table returns the symbol table for build ID id, or nil if it can't
+// be found.
+func (s *Symbolizer) table(id perffile.BuildID) *rawTable {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tables == nil {
+		s.tables = make(map[string]*list.Element)
+		s.missing = make(map[string]bool)
+	}
+	key := id.String()
+	if e, ok := s.tables[key]; ok {
+		s.lru.MoveToFront(e)
+		return e.Value.(*rawTable)
+	}
+	if s.missing[key] {
+		return nil
+	}
+
+	// Loading can be slow, so let other goroutines look up other
+	// tables in the meantime.
+	s.mu.Unlock()
+	t := s.load(id)
+	s.mu.Lock()
+	if t == nil {
+		s.missing[key] = true
+		return nil
+	}
+	if e, ok := s.tables[key]; ok {
+		// Someone else loaded it first.
+		return e.Value.(*rawTable)
+	}
+	s.tables[key] = s.lru.PushFront(t)
+	if s.MaxTables > 0 && s.lru.Len() > s.MaxTables {
+		old := s.lru.Remove(s.lru.Back()).(*rawTable)
+		delete(s.tables, old.key)
+	}
+	return t
+}
+
+// load loads the symbol table for build ID id, or returns nil if it
+// can't be found.
+func (s *Symbolizer) load(id perffile.BuildID) *rawTable {
+	dir := s.Dir
+	if dir == "" {
+		dir = buildIDDir
+	}
+	path := buildIDPath(dir, id)
+	if path == "" {
+		return nil
+	}
+	if t := s.loadCache(id); t != nil {
+		return t
+	}
+
+	elff, err := elf.Open(path)
+	if err != nil {
+		// The build ID cache stores the kernel as a kallsyms
+		// file.
+		extra, err := newKallsyms(path)
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+		t := &rawTable{extra, id.String(), nil}
+		s.storeCache(t)
+		return t
+	}
+	var loads []loadSeg
+	for _, p := range elff.Progs {
+		if p.Type == elf.PT_LOAD {
+			loads = append(loads, loadSeg{p.Off, p.Filesz, p.Vaddr})
+		}
+	}
+	elff.Close()
+
+	extra, err := newSymbolicExtra(path)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	t := &rawTable{extra, id.String(), loads}
+	s.storeCache(t)
+	return t
+}
@@ -0,0 +1,27 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+func TestEmptyBuildID(t *testing.T) {
+	s := New(nil)
+	mmap := &Mmap{RecordMmap: perffile.RecordMmap{Filename: "/bin/true", BuildID: []byte{}}}
+	if _, ok := s.RawFrame(mmap, 0x1000); ok {
+		t.Errorf("RawFrame succeeded for a mapping with an empty build ID")
+	}
+
+	sym := &Symbolizer{Dir: t.TempDir()}
+	var out Symbolic
+	for _, id := range []perffile.BuildID{nil, {}} {
+		if sym.Symbolize(RawFrame{BuildID: id}, &out) {
+			t.Errorf("Symbolize succeeded for build ID %#v", id)
+		}
+	}
+}
@@ -4,7 +4,16 @@
 
 package perfsession
 
-import "github.com/aclements/go-perf/perffile"
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aclements/go-perf/perffile"
+)
 
 // TODO: Per-TID state.
 
@@ -12,8 +21,129 @@ type Session struct {
 	kernel  *PIDInfo
 	pidInfo map[int]*PIDInfo
 
+	// guestKernels records the guest kernel mappings of each
+	// virtual machine, keyed by the PID of the VM's host process.
+	// guestMmaps indicates the profile had guest kernel mmap
+	// records.
+	guestKernels map[int]*PIDInfo
+	guestMmaps   bool
+
 	File  *perffile.File
 	Extra map[ExtraKey]interface{}
+
+	// Demangle specifies how Symbolize demangles symbol names.
+	// Symbolize caches demangled names, so this must be set
+	// before the first call to Symbolize.
+	Demangle DemangleStyle
+
+	// GuestKernel is the path to a kallsyms or vmlinux file for
+	// the guest kernel when profiling virtual machines from the
+	// host (e.g., with "perf kvm record"). If set, Symbolize uses
+	// it to symbolize guest kernel mappings of VMs that don't have
+	// their own kallsyms under GuestMount. Like Demangle, it must
+	// be set before the first call to Symbolize.
+	GuestKernel string
+
+	// GuestMount, like perf's --guestmount option, is a directory
+	// with a subdirectory for each VM named by the PID of the VM's
+	// host process. If <GuestMount>/<pid>/proc/kallsyms exists,
+	// Symbolize uses it to symbolize that VM's guest kernel. Like
+	// Demangle, it must be set before the first call to Symbolize.
+	GuestMount string
+
+	// DataResolver, if non-nil, is called by SymbolizeData for
+	// data addresses that are not in a static variable, such as
+	// heap addresses. It should fill in out and report whether
+	// it found the object containing addr. This lets callers
+	// attribute heap addresses using allocation information from
+	// other sources.
+	DataResolver func(pid int, addr uint64, out *DataSymbolic) bool
+
+	// Unwinder, if non-nil, computes the call stacks returned by
+	// Stack. By default, Stack uses CallchainUnwinder.
+	Unwinder Unwinder
+
+	// Symbolizer, if non-nil, is used by Symbolize to symbolize
+	// code by build ID before falling back to the files named in
+	// the profile. For example, this can be a *Symbolizer for a
+	// build ID cache, or a client for a symbol server.
+	Symbolizer FrameSymbolizer
+
+	// Stats records counts of samples and of samples the kernel
+	// dropped or didn't take, as seen by Update.
+	Stats Stats
+
+	// throttled maps event IDs to the time they were throttled.
+	throttled map[uint64]uint64
+
+	// ksyms is the symbol table of kernel symbols registered at
+	// run time. See updateKsymbol.
+	ksyms *symbolicExtra
+
+	// textPokes records kernel text modifications, in order.
+	textPokes []textPoke
+
+	// scaling records the latest enabled and running times of
+	// each event. See Scaling.
+	scaling map[*perffile.EventAttr][2]uint64
+}
+
+// Stats explains why a profile may have fewer samples or symbols than
+// expected.
+type Stats struct {
+	// Samples is the number of samples.
+	Samples uint64
+
+	// Lost is the number of records lost because the ring buffer
+	// was full. Increase the buffer size ("perf record -m") to
+	// reduce this.
+	Lost uint64
+
+	// LostSamples is the number of samples dropped by the
+	// kernel, for example because they couldn't be completed.
+	LostSamples uint64
+
+	// Throttles is the number of times an event was throttled
+	// because it exceeded kernel.perf_event_max_sample_rate or
+	// kernel.perf_cpu_time_max_percent. Lower the sampling rate
+	// to avoid this.
+	Throttles uint64
+
+	// Throttled is the total time events spent throttled. This
+	// requires timestamps in the profile.
+	Throttled time.Duration
+
+	// CPUSamples is the number of samples on each CPU, if the
+	// profile records CPUs. A CPU with far fewer samples than
+	// the others may have been offline or excluded from the
+	// profile.
+	CPUSamples map[uint32]uint64
+
+	// Frames counts how the frames returned by Stack were
+	// symbolized. It is meaningful only if Stack is called once
+	// per sample.
+	Frames FrameStats
+}
+
+// FrameStats explains why stacks may be missing symbols. It counts
+// only frames returned by Session.Stack, not calls to Symbolize.
+type FrameStats struct {
+	// Frames is the number of frames returned by Stack.
+	Frames uint64
+
+	// Unmapped is the number of frames whose IP wasn't in any
+	// known mapping, for example because the mmap record was
+	// lost.
+	Unmapped uint64
+
+	// NoFile is the number of frames in mappings whose file
+	// couldn't be read, for example because it was deleted or
+	// the profile was recorded on another machine.
+	NoFile uint64
+
+	// NoFunc is the number of frames that weren't in any known
+	// function, for example because the file is stripped.
+	NoFunc uint64
 }
 
 func New(f *perffile.File) *Session {
@@ -22,7 +152,8 @@ func New(f *perffile.File) *Session {
 		Extra: make(ForkableExtra),
 	}
 	return &Session{
-		kernel: kernel,
+		kernel:       kernel,
+		guestKernels: make(map[int]*PIDInfo),
 		pidInfo: map[int]*PIDInfo{
 			// The kernel is implicitly PID -1
 			-1: kernel,
@@ -62,14 +193,70 @@ func (s *Session) Update(r perffile.Record) {
 		// Otherwise this is thread creation
 
 	case *perffile.RecordMmap:
-		info := ensurePID(r.PID)
+		var info *PIDInfo
+		if r.CPUMode == perffile.CPUModeGuestKernel {
+			// Guest kernel mappings are per-VM, not
+			// per-process. Their PID is the VM's host
+			// process.
+			info = s.ensureGuest(r.PID)
+			s.guestMmaps = true
+		} else {
+			info = ensurePID(r.PID)
+		}
 		info.munmap(r.Addr, r.Len)
-		info.maps = append(info.maps, &Mmap{make(ForkableExtra), *r})
+		m := &Mmap{make(ForkableExtra), *r}
+		// The record may be reused, so copy its build ID.
+		m.BuildID = append([]byte(nil), r.BuildID...)
+		info.maps = append(info.maps, m)
+		if isJITDump(r.Filename) {
+			// The runtime maps its jitdump file so that
+			// perf can find it.
+			info.jitdump = r.Filename
+		}
+
+	case *perffile.RecordNamespaces:
+		ensurePID(r.PID).Namespaces = r.Namespaces
+
+	case *perffile.RecordKsymbol:
+		s.updateKsymbol(r)
+
+	case *perffile.RecordTextPoke:
+		// The record may be reused, so copy what
+		// PatchKernelText needs.
+		s.textPokes = append(s.textPokes, textPoke{r.Addr, append([]byte(nil), r.New...)})
 
 	case *perffile.RecordSample:
 		// Sometimes (particularly early in sample files), we
 		// see kernel samples before the RecordComm.
 		ensurePID(r.PID)
+		s.Stats.Samples++
+		if r.Format&perffile.SampleFormatCPU != 0 {
+			if s.Stats.CPUSamples == nil {
+				s.Stats.CPUSamples = make(map[uint32]uint64)
+			}
+			s.Stats.CPUSamples[r.CPU]++
+		}
+		s.updateScaling(r)
+
+	case *perffile.RecordLost:
+		s.Stats.Lost += r.NumLost
+
+	case *perffile.RecordLostSamples:
+		s.Stats.LostSamples += r.Lost
+
+	case *perffile.RecordThrottle:
+		if s.throttled == nil {
+			s.throttled = make(map[uint64]uint64)
+		}
+		if !r.Enable {
+			s.Stats.Throttles++
+			s.throttled[uint64(r.ID)] = r.Time
+		} else if start, ok := s.throttled[uint64(r.ID)]; ok {
+			if start != 0 && r.Time > start {
+				s.Stats.Throttled += time.Duration(r.Time - start)
+			}
+			delete(s.throttled, uint64(r.ID))
+		}
 	}
 }
 
@@ -77,12 +264,65 @@ func (s *Session) LookupPID(pid int) *PIDInfo {
 	return s.pidInfo[pid]
 }
 
+// LookupGuestKernelMmap returns the guest kernel mapping containing
+// addr in the virtual machine whose host process is pid, for samples
+// with CPUMode perffile.CPUModeGuestKernel.
+//
+// Like perf, if there are no mappings for pid, this uses the mappings
+// of the default guest, which has PID 0. If the profile has no guest
+// kernel mappings at all but s.GuestKernel or s.GuestMount is set,
+// this returns a mapping covering the entire address space so that
+// guest kernel addresses can still be symbolized.
+func (s *Session) LookupGuestKernelMmap(pid int, addr uint64) *Mmap {
+	g := s.guestKernels[pid]
+	if g == nil && s.guestMmaps {
+		g = s.guestKernels[0]
+	}
+	if g != nil {
+		return g.mapFind(addr)
+	}
+	if s.guestMmaps || (s.GuestKernel == "" && s.GuestMount == "") {
+		return nil
+	}
+	m := &Mmap{Extra: make(ForkableExtra)}
+	m.CPUMode = perffile.CPUModeGuestKernel
+	m.PID, m.TID = pid, pid
+	m.Len = ^uint64(0)
+	m.Filename = guestKallsyms
+	g = s.ensureGuest(pid)
+	g.maps = append(g.maps, m)
+	return m
+}
+
+func (s *Session) ensureGuest(pid int) *PIDInfo {
+	g, ok := s.guestKernels[pid]
+	if !ok {
+		g = &PIDInfo{
+			Comm:  "[guest.kernel]",
+			Extra: make(ForkableExtra),
+		}
+		s.guestKernels[pid] = g
+	}
+	return g
+}
+
 type PIDInfo struct {
 	Extra ForkableExtra
 
-	Comm   string
+	Comm string
+
+	// Namespaces records the namespaces of this process, indexed
+	// by perffile.Namespace* constants, or nil if unknown. This is
+	// only available if the profile was recorded with
+	// perf record --namespaces.
+	Namespaces []perffile.Namespace
+
 	kernel *PIDInfo
 	maps   []*Mmap
+
+	// jitdump is the path of this process's jitdump file, if
+	// it has one.
+	jitdump string
 }
 
 func (p *PIDInfo) fork(pid int) *PIDInfo {
@@ -90,7 +330,13 @@ func (p *PIDInfo) fork(pid int) *PIDInfo {
 	for i, mmap := range p.maps {
 		maps[i] = mmap.fork(pid)
 	}
-	return &PIDInfo{p.Extra.Fork(pid).(ForkableExtra), p.Comm, p.kernel, maps}
+	return &PIDInfo{
+		Extra:      p.Extra.Fork(pid).(ForkableExtra),
+		Comm:       p.Comm,
+		Namespaces: p.Namespaces,
+		kernel:     p.kernel,
+		maps:       maps,
+	}
 }
 
 func (p *PIDInfo) munmap(addr, mlen uint64) {
@@ -153,6 +399,42 @@ func (p *PIDInfo) LookupMmap(addr uint64) *Mmap {
 	return m
 }
 
+// mountRoot returns the path of the root directory of pid, and the
+// inode of its mount namespace, if pid is known to be in a different
+// mount namespace than the current process. Otherwise, it returns "".
+func (s *Session) mountRoot(pid int) (root string, mntNS uint64) {
+	info := s.pidInfo[pid]
+	if info == nil || len(info.Namespaces) <= perffile.NamespaceMnt {
+		return "", 0
+	}
+	mntNS = info.Namespaces[perffile.NamespaceMnt].Inode
+	if mntNS == 0 || mntNS == selfMountNS() {
+		return "", 0
+	}
+	return fmt.Sprintf("/proc/%d/root", pid), mntNS
+}
+
+var selfMountNSCache struct {
+	once sync.Once
+	ino  uint64
+}
+
+// selfMountNS returns the inode of the current process's mount
+// namespace, or 0 if unknown.
+func selfMountNS() uint64 {
+	c := &selfMountNSCache
+	c.once.Do(func() {
+		// This link has the form "mnt:[<inode>]".
+		link, err := os.Readlink("/proc/self/ns/mnt")
+		if err != nil {
+			return
+		}
+		link = strings.TrimSuffix(strings.TrimPrefix(link, "mnt:["), "]")
+		c.ino, _ = strconv.ParseUint(link, 10, 64)
+	})
+	return c.ino
+}
+
 type Mmap struct {
 	Extra ForkableExtra
 
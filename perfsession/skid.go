@@ -0,0 +1,85 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// A Skid describes how the IP of a sample relates to the instruction
+// that caused the sample.
+type Skid int
+
+const (
+	// SkidNone means the IP is the instruction that caused the
+	// sample, or the sample wasn't caused by an instruction.
+	SkidNone Skid = iota
+
+	// SkidNext means the IP is the instruction following the one
+	// that caused the sample. This is the "IP+1" behavior of
+	// Intel PEBS without eventing IP fixup.
+	SkidNext
+
+	// SkidArbitrary means the IP may be any number of
+	// instructions after the one that caused the sample, as with
+	// ordinary interrupt-based sampling. The preceding
+	// instruction is the most likely cause.
+	SkidArbitrary
+)
+
+// exactPMUs are prefixes of the names of PMUs that always report the
+// IP of the instruction that caused a sample.
+var exactPMUs = []string{
+	"ibs_op",    // AMD Instruction-Based Sampling
+	"ibs_fetch", // AMD Instruction-Based Sampling
+	"arm_spe",   // Arm Statistical Profiling Extension
+}
+
+// SampleSkid returns the expected skid of the IP of sample r, based on
+// the sample's event and PMU.
+//
+// Tools that attribute samples to instructions can use this to
+// attribute samples with SkidNext or SkidArbitrary to the preceding
+// instruction instead.
+func (s *Session) SampleSkid(r *perffile.RecordSample) Skid {
+	if r.ExactIP {
+		return SkidNone
+	}
+	attr := r.EventAttr
+	if attr == nil {
+		return SkidArbitrary
+	}
+	g := attr.Event.Generic()
+	var pmu perffile.PMUTypeID
+	switch g.Type {
+	case perffile.EventTypeSoftware, perffile.EventTypeTracepoint, perffile.EventTypeBreakpoint:
+		// These are raised synchronously by the kernel or
+		// sample wherever the CPU happened to be.
+		return SkidNone
+	case perffile.EventTypeHardware, perffile.EventTypeHWCache:
+		// Hybrid systems encode the PMU in the upper bits.
+		pmu = perffile.PMUTypeID(g.ID >> 32)
+	case perffile.EventTypeRaw:
+	default:
+		// Dynamic PMUs use their PMU type as the event type.
+		pmu = perffile.PMUTypeID(g.Type)
+	}
+	if pmu != 0 && s.File != nil {
+		name := s.File.Meta.PMUMappings[pmu]
+		for _, prefix := range exactPMUs {
+			if strings.HasPrefix(name, prefix) {
+				return SkidNone
+			}
+		}
+	}
+	if attr.Precise >= perffile.EventPrecisionConstantSkid {
+		// Precise samples without the exact IP flag report
+		// the following instruction.
+		return SkidNext
+	}
+	return SkidArbitrary
+}
@@ -0,0 +1,44 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+func TestSampleSkid(t *testing.T) {
+	f := &perffile.File{}
+	f.Meta.PMUMappings = map[perffile.PMUTypeID]string{4: "cpu", 11: "ibs_op"}
+	s := New(f)
+
+	cycles := perffile.EventHardware{ID: perffile.EventHardwareIDCPUCycles}
+	tests := []struct {
+		name    string
+		ev      perffile.Event
+		precise perffile.EventPrecision
+		exact   bool
+		want    Skid
+	}{
+		{"cycles", cycles, perffile.EventPrecisionArbitrarySkid, false, SkidArbitrary},
+		{"cycles:p", cycles, perffile.EventPrecisionConstantSkid, false, SkidNext},
+		{"cycles:pp exact", cycles, perffile.EventPrecisionTryZeroSkid, true, SkidNone},
+		{"raw", perffile.EventRaw(0x1c2), perffile.EventPrecisionArbitrarySkid, false, SkidArbitrary},
+		{"cpu-clock", perffile.EventSoftwareCPUClock, perffile.EventPrecisionArbitrarySkid, false, SkidNone},
+		{"tracepoint", perffile.EventTracepoint(1), perffile.EventPrecisionArbitrarySkid, false, SkidNone},
+		{"ibs_op", (&perffile.EventGeneric{Type: 11}).Decode(), perffile.EventPrecisionArbitrarySkid, false, SkidNone},
+		{"cpu PMU", (&perffile.EventGeneric{Type: 4, ID: 0x3c}).Decode(), perffile.EventPrecisionArbitrarySkid, false, SkidArbitrary},
+	}
+	for _, test := range tests {
+		r := &perffile.RecordSample{
+			RecordCommon: perffile.RecordCommon{EventAttr: &perffile.EventAttr{Event: test.ev, Precise: test.precise}},
+			ExactIP:      test.exact,
+		}
+		if got := s.SampleSkid(r); got != test.want {
+			t.Errorf("%s: got skid %d, want %d", test.name, got, test.want)
+		}
+	}
+}
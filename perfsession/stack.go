@@ -0,0 +1,195 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// A Frame is one symbolized frame of a call stack.
+type Frame struct {
+	IP uint64
+
+	// Mmap is the mapping containing IP, or nil if unknown.
+	Mmap *Mmap
+
+	// Symbolic is the symbolic information for IP. It is zero
+	// if Mmap is nil or IP couldn't be symbolized.
+	Symbolic
+}
+
+// Name returns the name of f's function, or f's IP in hex if the
+// function is unknown.
+func (f *Frame) Name() string {
+	if f.FuncName != "" {
+		return f.FuncName
+	}
+	return fmt.Sprintf("%#x", f.IP)
+}
+
+// callchainContextMax is PERF_CONTEXT_MAX. Callchain entries at or
+// above this are context markers rather than IPs.
+const callchainContextMax = ^uint64(4094) // -4095
+
+// Stack returns the symbolized call stack of sample r, starting with
+// the leaf, as computed by s.Unwinder. Context markers in the
+// callchain are omitted.
+//
+// Stack counts the frames it returns, and those it couldn't
+// symbolize, in s.Stats.Frames. Each call adds to the counts, so to
+// get per-sample statistics, call Stack exactly once for each sample.
+// Frames symbolized directly with Symbolize are not counted.
+//
+// s must be up to date with the records preceding r.
+func (s *Session) Stack(r *perffile.RecordSample) []Frame {
+	pidInfo := s.LookupPID(r.PID)
+	lookup := func(mode uint64, ip uint64) *Mmap {
+		if mode == perffile.CallchainGuestKernel {
+			return s.LookupGuestKernelMmap(r.PID, ip)
+		}
+		if pidInfo == nil {
+			return nil
+		}
+		return pidInfo.LookupMmap(ip)
+	}
+
+	var mode uint64
+	switch r.CPUMode {
+	case perffile.CPUModeKernel:
+		mode = perffile.CallchainKernel
+	case perffile.CPUModeGuestKernel:
+		mode = perffile.CallchainGuestKernel
+	default:
+		mode = perffile.CallchainUser
+	}
+
+	var u Unwinder = CallchainUnwinder{}
+	if s.Unwinder != nil {
+		u = s.Unwinder
+	}
+	ips := u.Unwind(s, r)
+	stack := make([]Frame, 0, len(ips))
+	for _, ip := range ips {
+		if ip >= callchainContextMax {
+			mode = ip
+			continue
+		}
+		f := Frame{IP: ip, Mmap: lookup(mode, ip)}
+		s.Stats.Frames.Frames++
+		switch {
+		case f.Mmap == nil:
+			s.Stats.Frames.Unmapped++
+		case !Symbolize(s, f.Mmap, ip, &f.Symbolic):
+			s.Stats.Frames.NoFile++
+		case f.FuncName == "":
+			s.Stats.Frames.NoFunc++
+		}
+		stack = append(stack, f)
+	}
+	return stack
+}
+
+// An Unwinder computes the call stack of a sample.
+type Unwinder interface {
+	// Unwind returns the call stack of sample r in the form of a
+	// perffile callchain: IPs starting with the leaf, possibly
+	// interspersed with context markers such as
+	// perffile.CallchainUser. s is up to date with the records
+	// preceding r.
+	Unwind(s *Session, r *perffile.RecordSample) []uint64
+}
+
+// CallchainUnwinder is the default Unwinder. It returns the callchain
+// recorded by the kernel, or just r.IP if r has no callchain.
+type CallchainUnwinder struct{}
+
+func (CallchainUnwinder) Unwind(s *Session, r *perffile.RecordSample) []uint64 {
+	if len(r.Callchain) == 0 {
+		return []uint64{r.IP}
+	}
+	return r.Callchain
+}
+
+// StackTrim is a set of rules for removing uninteresting frames from
+// call stacks, so that profiles aggregated by stack (such as flame
+// graphs) show the program's own structure.
+type StackTrim int
+
+const (
+	// TrimGoRuntime removes Go runtime frames at the root of a
+	// stack, below the outermost user frame. For example,
+	// main.main ← runtime.main ← runtime.goexit becomes just
+	// main.main. Stacks that are entirely in the runtime, such
+	// as the garbage collector's, are left alone.
+	TrimGoRuntime StackTrim = 1 << iota
+
+	// TrimStartup removes C program startup frames such as
+	// __libc_start_main and _start from the root of a stack.
+	TrimStartup
+
+	// TrimPLT attributes samples in PLT stubs to the function the
+	// stub jumps to. The symbolizer names stubs "name@plt" on
+	// x86-64 and arm64.
+	TrimPLT
+
+	// TrimAll applies all trimming rules.
+	TrimAll = TrimGoRuntime | TrimStartup | TrimPLT
+)
+
+// startupFuncs are C runtime entry points that appear at the root of
+// every native stack.
+var startupFuncs = map[string]bool{
+	"_start":                 true,
+	"__libc_start_main":      true,
+	"__libc_start_main_impl": true,
+	"__libc_start_call_main": true,
+	"libc_start_main_stage2": true, // musl
+}
+
+// Apply applies the rules in t to stack, which starts at the leaf,
+// and returns the trimmed stack. It may modify stack in place. It
+// never removes every frame.
+func (t StackTrim) Apply(stack []Frame) []Frame {
+	if t&TrimPLT != 0 {
+		for i := range stack {
+			if name := stack[i].FuncName; strings.HasSuffix(name, "@plt") {
+				stack[i].FuncName = strings.TrimSuffix(name, "@plt")
+			}
+		}
+	}
+
+	// Trim from the root while frames match a rule, but keep at
+	// least one frame that doesn't.
+	drop := func(name string) bool {
+		if t&TrimGoRuntime != 0 && strings.HasPrefix(name, "runtime.") {
+			return true
+		}
+		if t&TrimStartup != 0 && startupFuncs[name] {
+			return true
+		}
+		return false
+	}
+	n := len(stack)
+	for n > 0 && drop(stack[n-1].FuncName) {
+		n--
+	}
+	if n == 0 {
+		return stack
+	}
+	return stack[:n]
+}
+
+// StackKey returns a string that identifies stack by its IPs, for
+// use as a map key when aggregating samples by stack.
+func StackKey(stack []Frame) string {
+	var b strings.Builder
+	for _, f := range stack {
+		fmt.Fprintf(&b, "%x,", f.IP)
+	}
+	return b.String()
+}
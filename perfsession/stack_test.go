@@ -0,0 +1,108 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perffile/perffiletest"
+)
+
+func TestStackTrim(t *testing.T) {
+	tests := []struct {
+		trim StackTrim
+		in   string
+		want string
+	}{
+		{TrimGoRuntime, "main.f main.main runtime.main runtime.goexit", "main.f main.main"},
+		{TrimGoRuntime, "runtime.scanobject runtime.gcBgMarkWorker runtime.goexit", "runtime.scanobject runtime.gcBgMarkWorker runtime.goexit"},
+		{TrimGoRuntime, "runtime.mallocgc main.main runtime.main", "runtime.mallocgc main.main"},
+		{TrimStartup, "f main __libc_start_call_main __libc_start_main _start", "f main"},
+		{TrimStartup, "main.main runtime.main", "main.main runtime.main"},
+		{TrimPLT, "memcpy@plt f", "memcpy f"},
+		{TrimAll, "memcpy@plt main __libc_start_main _start", "memcpy main"},
+		{0, "main.main runtime.main", "main.main runtime.main"},
+	}
+	for _, test := range tests {
+		var stack []Frame
+		for _, name := range strings.Fields(test.in) {
+			stack = append(stack, Frame{Symbolic: Symbolic{FuncName: name}})
+		}
+		var got []string
+		for _, f := range test.trim.Apply(stack) {
+			got = append(got, f.FuncName)
+		}
+		if want := strings.Fields(test.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%d.Apply(%s) = %v, want %v", test.trim, test.in, got, want)
+		}
+	}
+}
+
+// fakeUnwinder returns a fixed stack below each sample's IP.
+type fakeUnwinder []uint64
+
+func (u fakeUnwinder) Unwind(s *Session, r *perffile.RecordSample) []uint64 {
+	return append([]uint64{r.IP}, u...)
+}
+
+// fakeSymbolizer names each frame after its file offset.
+type fakeSymbolizer struct{}
+
+func (fakeSymbolizer) Symbolize(frame RawFrame, out *Symbolic) bool {
+	out.FuncName = fmt.Sprintf("%x+%#x", []byte(frame.BuildID), frame.Offset)
+	return true
+}
+
+func TestStackPlugins(t *testing.T) {
+	var p perffiletest.Profile
+	cycles := p.Event(perffile.EventHardware{ID: perffile.EventHardwareIDCPUCycles}, 0)
+	p.Add(&perffile.RecordMmap{
+		RecordCommon: perffile.RecordCommon{PID: 1, TID: 1},
+		Addr:         0x400000,
+		Len:          0x10000,
+		FileOffset:   0x1000,
+		BuildID:      []byte{0xab, 0xcd},
+		Filename:     "/bin/prog",
+	})
+	p.Mmap(1, 0, 0x600000, 0x1000, 0, "/nonexistent/lib.so")
+	p.Sample(cycles, 1, 1, 0, 0x400010)
+	f, err := p.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(f)
+	s.Unwinder = fakeUnwinder{0x400020, 0x500000, 0x600010}
+	s.Symbolizer = fakeSymbolizer{}
+	var got []string
+	rs := f.Records(perffile.RecordsFileOrder)
+	for rs.Next() {
+		s.Update(rs.Record)
+		if r, ok := rs.Record.(*perffile.RecordSample); ok {
+			for _, fr := range s.Stack(r) {
+				got = append(got, fr.FuncName)
+			}
+		}
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// The last two frames are unmapped and in a file with no
+	// build ID that can't be read, so they aren't symbolized.
+	want := []string{"abcd+0x1010", "abcd+0x1020", "", ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got stack %q, want %q", got, want)
+	}
+	if want := (FrameStats{Frames: 4, Unmapped: 1, NoFile: 1}); s.Stats.Frames != want {
+		t.Errorf("got frame stats %+v, want %+v", s.Stats.Frames, want)
+	}
+	if want := map[uint32]uint64{0: 1}; !reflect.DeepEqual(s.Stats.CPUSamples, want) {
+		t.Errorf("got CPU samples %v, want %v", s.Stats.CPUSamples, want)
+	}
+}
@@ -8,19 +8,49 @@ import (
 	"bufio"
 	"debug/dwarf"
 	"debug/elf"
+	"debug/gosym"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/user"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/aclements/go-perf/perffile"
 	"github.com/ianlancetaylor/demangle"
 )
 
+// DemangleStyle specifies how Symbolize demangles C++ and Rust
+// symbol names.
+type DemangleStyle int
+
+const (
+	// DemangleFull demangles names to their full signatures,
+	// including parameter and template parameter types.
+	DemangleFull DemangleStyle = iota
+
+	// DemangleNoParams demangles names but omits function
+	// parameter types. For example, "ns::Class::method(int, char
+	// const*)" becomes "ns::Class::method".
+	DemangleNoParams
+
+	// DemangleNone leaves names mangled.
+	DemangleNone
+)
+
+func (d DemangleStyle) demangle(name string) string {
+	switch d {
+	case DemangleNoParams:
+		return demangle.Filter(name, demangle.NoParams)
+	case DemangleNone:
+		return name
+	}
+	return demangle.Filter(name)
+}
+
 type Symbolic struct {
 	FuncName string
 	Line     dwarf.LineEntry
@@ -29,11 +59,16 @@ type Symbolic struct {
 // TODO: Take a PID and look up the mmap.
 
 func Symbolize(session *Session, mmap *Mmap, ip uint64, out *Symbolic) bool {
-	s := getSymbolicExtra(session, mmap.Filename)
+	if session.Symbolizer != nil {
+		if frame, ok := session.RawFrame(mmap, ip); ok && session.Symbolizer.Symbolize(frame, out) {
+			return true
+		}
+	}
+	s := getSymbolicExtra(session, mmap)
 	if s == nil {
 		return false
 	}
-	f, l := s.findIP(mmap, ip)
+	f, l := s.findIP(mmap, ip, session.Demangle)
 	if f == nil {
 		out.FuncName = ""
 	} else {
@@ -50,15 +85,17 @@ func Symbolize(session *Session, mmap *Mmap, ip uint64, out *Symbolic) bool {
 var symbolicExtraKey = NewExtraKey("perfsession.symbolicExtra")
 
 var buildIDDir = (func() string {
-	// See set_buildid_dir in tools/perf/util/config.c.
-	u, err := user.Current()
+	// See set_buildid_dir in tools/perf/util/config.c. Like perf,
+	// this uses $HOME rather than looking up the user, which needs
+	// cgo to work reliably.
+	home, err := os.UserHomeDir()
 	if err != nil {
 		return ".debug"
 	}
-	return fmt.Sprintf("%s/.debug", u.HomeDir)
+	return fmt.Sprintf("%s/.debug", home)
 })()
 
-func getSymbolicExtra(session *Session, filename string) *symbolicExtra {
+func getSymbolicExtra(session *Session, mmap *Mmap) *symbolicExtra {
 	var err error
 
 	tables, ok := session.Extra[symbolicExtraKey].(map[string]*symbolicExtra)
@@ -67,6 +104,17 @@ func getSymbolicExtra(session *Session, filename string) *symbolicExtra {
 		session.Extra[symbolicExtraKey] = tables
 	}
 
+	filename := mmap.Filename
+	if strings.HasPrefix(filename, guestKallsyms) {
+		return getGuestKernelExtra(session, tables, mmap)
+	}
+	if isAnon(filename) {
+		return getJITExtra(session, tables, mmap)
+	}
+	if filename == ksymbolFile {
+		return session.ksyms
+	}
+
 	// For some reason, the filename for the kernel mapping looks
 	// like "[kernel.kallsyms]_text", but the build ID file name
 	// is just "[kernel.kallsyms]". Match them up.
@@ -83,31 +131,37 @@ func getSymbolicExtra(session *Session, filename string) *symbolicExtra {
 		filename = "[kernel.kallsyms]"
 	}
 
-	extra, ok := tables[filename]
+	key, root := fileKey(session, mmap, filename, isKallsyms)
+
+	extra, ok := tables[key]
 	if ok {
 		return extra
 	}
-	tables[filename] = (*symbolicExtra)(nil)
+	tables[key] = (*symbolicExtra)(nil)
 
 	// See dso__data_fd in toosl/perf/util/dso.c.
 
 	// Try build ID cache first.
 	//
 	// TODO: Cache filename to build ID mapping.
-	for _, bid := range session.File.Meta.BuildIDs {
-		if bid.Filename == filename {
-			nfilename := fmt.Sprintf("%s/.build-id/%.2s/%s", buildIDDir, bid.BuildID, bid.BuildID.String()[2:])
-			if isKallsyms {
-				extra, err = newKallsyms(nfilename)
-			} else {
-				extra, err = newSymbolicExtra(nfilename)
-			}
-			if err == nil {
-				break
-			}
+	for _, nfilename := range buildIDFiles(session, mmap, filename) {
+		if isKallsyms {
+			extra, err = newKallsyms(nfilename)
+		} else {
+			extra, err = newSymbolicExtra(nfilename)
+		}
+		if err == nil {
+			break
 		}
 	}
 
+	// Try the path in the process's mount namespace. The process
+	// may have exited, in which case fall back to the original
+	// path.
+	if extra == nil && root != "" {
+		extra, err = newSymbolicExtra(root + filename)
+	}
+
 	// Try original path.
 	if extra == nil {
 		extra, err = newSymbolicExtra(filename)
@@ -116,7 +170,88 @@ func getSymbolicExtra(session *Session, filename string) *symbolicExtra {
 		}
 	}
 
-	tables[filename] = extra
+	tables[key] = extra
+	return extra
+}
+
+// buildIDFiles returns the paths in the build ID cache that may hold
+// the file filename mapped by mmap. The build ID recorded in mmap
+// itself comes first, followed by those in the profile's header.
+func buildIDFiles(session *Session, mmap *Mmap, filename string) []string {
+	var paths []string
+	if path := buildIDPath(buildIDDir, perffile.BuildID(mmap.BuildID)); path != "" {
+		paths = append(paths, path)
+	}
+	for _, bid := range session.File.Meta.BuildIDs {
+		if bid.Filename != filename {
+			continue
+		}
+		if path := buildIDPath(buildIDDir, bid.BuildID); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// fileKey returns a key identifying the file filename mapped by mmap,
+// and the root directory through which to open the file, or "" if it
+// should be opened directly.
+func fileKey(session *Session, mmap *Mmap, filename string, isKallsyms bool) (key, root string) {
+	// If the process is in a different mount namespace (e.g., a
+	// container), the same path may refer to a different file, so
+	// key the table by namespace and open the file through the
+	// process's root.
+	key = filename
+	root, mntNS := session.mountRoot(mmap.PID)
+	if root != "" && !isKallsyms {
+		key = fmt.Sprintf("%s (mnt:%d)", filename, mntNS)
+	} else {
+		root = ""
+	}
+	// Likewise, if the file was rebuilt while the profile was
+	// being recorded, its mappings will have different build IDs.
+	if mmap.BuildID != nil {
+		key = fmt.Sprintf("%s (build-id:%x)", key, mmap.BuildID)
+	}
+	return key, root
+}
+
+// guestKallsyms is the file name perf uses for guest kernel
+// mappings.
+const guestKallsyms = "[guest.kernel.kallsyms]"
+
+func getGuestKernelExtra(session *Session, tables map[string]*symbolicExtra, mmap *Mmap) *symbolicExtra {
+	// Prefer the VM's own kallsyms under GuestMount, if any.
+	key, path := guestKallsyms, session.GuestKernel
+	if session.GuestMount != "" {
+		p := filepath.Join(session.GuestMount, strconv.Itoa(mmap.PID), "proc", "kallsyms")
+		if _, err := os.Stat(p); err == nil {
+			key, path = fmt.Sprintf("%s (pid:%d)", guestKallsyms, mmap.PID), p
+		}
+	}
+
+	extra, ok := tables[key]
+	if ok {
+		return extra
+	}
+	tables[key] = nil
+	if path == "" {
+		return nil
+	}
+
+	// GuestKernel may be either a vmlinux ELF file or a copy of
+	// the guest's /proc/kallsyms.
+	var err error
+	if elff, err2 := elf.Open(path); err2 == nil {
+		elff.Close()
+		extra, err = newSymbolicExtra(path)
+	} else {
+		extra, err = newKallsyms(path)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+	tables[key] = extra
 	return extra
 }
 
@@ -142,13 +277,12 @@ func newSymbolicExtra(filename string) (*symbolicExtra, error) {
 		}
 
 		extra.functab = dwarfFuncTable(dwarff)
+		if extra.functab != nil {
+			// DWARF doesn't describe PLT stubs.
+			extra.functab = append(extra.functab, elfPLTFuncs(elff, false)...)
+			sort.Sort(funcRangeSorter(extra.functab))
+		}
 		extra.linetab = dwarfLineTable(dwarff)
-
-		return &symbolicExtra{
-			dwarfFuncTable(dwarff),
-			dwarfLineTable(dwarff),
-			false,
-		}, nil
 	}
 
 	if extra.functab == nil {
@@ -156,6 +290,15 @@ func newSymbolicExtra(filename string) (*symbolicExtra, error) {
 		extra.functab, extra.isReloc = elfFuncTable(filename, elff)
 	}
 
+	// If this is a Go binary, prefer the Go symbol table for the
+	// PCs it covers. The tables above still cover any C code
+	// linked in with cgo.
+	if elff.Section(".gopclntab") != nil {
+		if err := extra.loadGo(elff); err != nil {
+			log.Printf("error loading Go symbol table from %s: %s", filename, err)
+		}
+	}
+
 	return extra, nil
 }
 
@@ -191,7 +334,7 @@ func newKallsyms(filename string) (*symbolicExtra, error) {
 	sort.Sort(funcRangeSorter(functab))
 	setFuncHighPCs(functab)
 
-	return &symbolicExtra{functab, nil, false}, nil
+	return &symbolicExtra{functab: functab}, nil
 }
 
 type symbolicExtra struct {
@@ -201,26 +344,30 @@ type symbolicExtra struct {
 	// isReloc indicates that lowpc/highpc in functab are ELF file
 	// offsets rather than virtual addresses.
 	isReloc bool
+
+	// gotab, if non-nil, is the Go symbol table. It is used
+	// instead of functab and linetab for PCs in gofunctab. gobias
+	// is the difference between virtual addresses in gotab and
+	// addresses in gofunctab.
+	gotab     *gosym.Table
+	gofunctab []funcRange
+	gobias    uint64
+	gofiles   map[string]*dwarf.LineFile
 }
 
-func (s *symbolicExtra) findIP(mmap *Mmap, ip uint64) (f *funcRange, l *dwarf.LineEntry) {
-	if s.functab != nil {
-		if s.isReloc {
-			// functab is indexed by file offset.
-			ip = ip - mmap.Addr + mmap.FileOffset
-		}
-		i := sort.Search(len(s.functab), func(i int) bool {
-			return ip < s.functab[i].highpc
-		})
-		if i < len(s.functab) && s.functab[i].lowpc <= ip && ip < s.functab[i].highpc {
-			f = &s.functab[i]
-			if !f.demangled {
-				f.name = demangle.Filter(f.name)
-				f.demangled = true
-			}
+func (s *symbolicExtra) findIP(mmap *Mmap, ip uint64, style DemangleStyle) (f *funcRange, l *dwarf.LineEntry) {
+	if s.isReloc {
+		// The tables are indexed by file offset.
+		ip = ip - mmap.Addr + mmap.FileOffset
+	}
+
+	if s.gotab != nil {
+		if f = findFunc(s.gofunctab, ip, style); f != nil {
+			return f, s.goLine(ip)
 		}
 	}
 
+	f = findFunc(s.functab, ip, style)
 	if s.linetab != nil {
 		i := sort.Search(len(s.linetab), func(i int) bool {
 			return ip < s.linetab[i].Address
@@ -233,6 +380,23 @@ func (s *symbolicExtra) findIP(mmap *Mmap, ip uint64) (f *funcRange, l *dwarf.Li
 	return
 }
 
+// findFunc returns the function in sorted table functab containing
+// ip, or nil if there is none.
+func findFunc(functab []funcRange, ip uint64, style DemangleStyle) *funcRange {
+	i := sort.Search(len(functab), func(i int) bool {
+		return ip < functab[i].highpc
+	})
+	if i < len(functab) && functab[i].lowpc <= ip && ip < functab[i].highpc {
+		f := &functab[i]
+		if !f.demangled {
+			f.name = style.demangle(f.name)
+			f.demangled = true
+		}
+		return f
+	}
+	return nil
+}
+
 type funcRange struct {
 	name          string
 	lowpc, highpc uint64
@@ -251,36 +415,20 @@ func dwarfFuncTable(dwarff *dwarf.Data) []funcRange {
 		}
 		// TODO: We should process TagInlinedSubroutine, but
 		// apparently gc doesn't produce these.
-		//
-		// TODO: Support DW_AT_ranges.
-	tag:
 		switch ent.Tag {
 		case dwarf.TagSubprogram:
 			r.SkipChildren()
-			const AttrLinkageName dwarf.Attr = 0x6e
-			name, ok := ent.Val(AttrLinkageName).(string)
-			demangled := true
+			name, demangled, ok := dwarfFuncName(dwarff, ent)
 			if !ok {
-				name, ok = ent.Val(dwarf.AttrName).(string)
-				demangled = false
-				if !ok {
-					break
-				}
+				break
 			}
-			lowpc, ok := ent.Val(dwarf.AttrLowpc).(uint64)
-			if !ok {
+			ranges, err := dwarff.Ranges(ent)
+			if err != nil {
 				break
 			}
-			var highpc uint64
-			switch highpcx := ent.Val(dwarf.AttrHighpc).(type) {
-			case uint64:
-				highpc = highpcx
-			case int64:
-				highpc = lowpc + uint64(highpcx)
-			default:
-				break tag
+			for _, pcs := range ranges {
+				out = append(out, funcRange{name, pcs[0], pcs[1], demangled})
 			}
-			out = append(out, funcRange{name, lowpc, highpc, demangled})
 
 		case dwarf.TagCompileUnit, dwarf.TagModule, dwarf.TagNamespace:
 			break
@@ -298,6 +446,35 @@ func dwarfFuncTable(dwarff *dwarf.Data) []funcRange {
 	return out
 }
 
+// dwarfFuncName returns the name of subprogram entry ent. Out-of-line
+// instances of inlined functions and definitions of C++ methods often
+// don't carry a name themselves, so this follows DW_AT_abstract_origin
+// and DW_AT_specification references until it finds one. demangled
+// indicates that name is already human-readable.
+func dwarfFuncName(dwarff *dwarf.Data, ent *dwarf.Entry) (name string, demangled, ok bool) {
+	const AttrLinkageName dwarf.Attr = 0x6e
+	// Bound the chain in case of malformed (cyclic) references.
+	for depth := 0; depth < 8 && ent != nil; depth++ {
+		if name, ok := ent.Val(AttrLinkageName).(string); ok {
+			return name, false, true
+		}
+		if name, ok := ent.Val(dwarf.AttrName).(string); ok {
+			return name, true, true
+		}
+		off, ok := ent.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset)
+		if !ok {
+			off, ok = ent.Val(dwarf.AttrSpecification).(dwarf.Offset)
+			if !ok {
+				break
+			}
+		}
+		r := dwarff.Reader()
+		r.Seek(off)
+		ent, _ = r.Next()
+	}
+	return "", false, false
+}
+
 func elfFuncTable(filename string, elff *elf.File) (out []funcRange, isReloc bool) {
 	switch elff.Type {
 	case elf.ET_EXEC:
@@ -313,11 +490,8 @@ func elfFuncTable(filename string, elff *elf.File) (out []funcRange, isReloc boo
 
 	out = make([]funcRange, 0)
 	syms, err := elff.Symbols()
-	if err != nil {
-		if err != elf.ErrNoSymbols {
-			log.Fatalf("%s: %s", filename, err)
-		}
-		return nil, false
+	if err != nil && err != elf.ErrNoSymbols {
+		log.Fatalf("%s: %s", filename, err)
 	}
 	for _, sym := range syms {
 		if elf.SymType(sym.Info&0xF) != elf.STT_FUNC || sym.Section == elf.SHN_UNDEF {
@@ -335,6 +509,11 @@ func elfFuncTable(filename string, elff *elf.File) (out []funcRange, isReloc boo
 		}
 		out = append(out, funcRange{sym.Name, lowpc, lowpc + sym.Size, false})
 	}
+	// Even stripped binaries have PLT stubs.
+	out = append(out, elfPLTFuncs(elff, isReloc)...)
+	if len(out) == 0 {
+		return nil, false
+	}
 
 	sort.Sort(funcRangeSorter(out))
 	setFuncHighPCs(out)
@@ -342,6 +521,67 @@ func elfFuncTable(filename string, elff *elf.File) (out []funcRange, isReloc boo
 	return
 }
 
+// elfPLTFuncs returns a function for each PLT stub in elff, named
+// "name@plt" after the function the stub jumps to, as perf and
+// objdump name them. The symbol table doesn't cover PLT stubs, so
+// without these, samples in them would have no function.
+//
+// This supports lazy-binding PLTs on x86-64 and arm64, where each
+// .rela.plt entry has a stub in .plt after a fixed-size header, or in
+// .plt.sec without one if the binary was built with IBT.
+func elfPLTFuncs(elff *elf.File, isReloc bool) []funcRange {
+	var hdrSize, entSize uint64
+	switch elff.Machine {
+	case elf.EM_X86_64:
+		hdrSize, entSize = 16, 16
+	case elf.EM_AARCH64:
+		hdrSize, entSize = 32, 16
+	default:
+		return nil
+	}
+	rela, plt := elff.Section(".rela.plt"), elff.Section(".plt.sec")
+	if plt != nil {
+		hdrSize = 0
+	} else {
+		plt = elff.Section(".plt")
+	}
+	if rela == nil || plt == nil || elff.Class != elf.ELFCLASS64 {
+		return nil
+	}
+	data, err := rela.Data()
+	if err != nil {
+		return nil
+	}
+	dynsyms, err := elff.DynamicSymbols()
+	if err != nil {
+		return nil
+	}
+
+	base := plt.Addr
+	if isReloc {
+		base = plt.Offset
+	}
+	var out []funcRange
+	for i := 0; (i+1)*24 <= len(data); i++ {
+		// Each entry is an Elf64_Rela: r_offset, r_info, and
+		// r_addend, where r_info holds the symbol index in
+		// its upper 32 bits.
+		info := elff.ByteOrder.Uint64(data[i*24+8:])
+		symIdx := int(info >> 32)
+		lowpc := hdrSize + uint64(i)*entSize
+		if lowpc+entSize > plt.Size {
+			break
+		}
+		// DynamicSymbols omits the null symbol at index 0.
+		if symIdx == 0 || symIdx > len(dynsyms) {
+			continue
+		}
+		name := dynsyms[symIdx-1].Name + "@plt"
+		out = append(out, funcRange{name, base + lowpc, base + lowpc + entSize, false})
+	}
+	return out
+}
+
 type funcRangeSorter []funcRange
 
 func (s funcRangeSorter) Len() int {
@@ -0,0 +1,122 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"debug/dwarf"
+	"encoding/gob"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// cachedTable is the on-disk form of a rawTable.
+type cachedTable struct {
+	Funcs   []cachedFunc
+	Files   []dwarf.LineFile
+	Lines   []cachedLine
+	IsReloc bool
+	Loads   []loadSeg
+}
+
+type cachedFunc struct {
+	Name      string
+	Low, High uint64
+	Demangled bool
+}
+
+// cachedLine is a dwarf.LineEntry with File replaced by an index
+// into cachedTable.Files, so files aren't repeated for every line.
+type cachedLine struct {
+	dwarf.LineEntry
+	File int // -1 for nil
+}
+
+func (s *Symbolizer) cachePath(key string) string {
+	return filepath.Join(s.CacheDir, key+".gob")
+}
+
+// loadCache returns the table for id from s.CacheDir, or nil if
+// it's not there.
+func (s *Symbolizer) loadCache(id perffile.BuildID) *rawTable {
+	if s.CacheDir == "" {
+		return nil
+	}
+	key := id.String()
+	f, err := os.Open(s.cachePath(key))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var ct cachedTable
+	if err := gob.NewDecoder(f).Decode(&ct); err != nil {
+		log.Printf("%s: %v", f.Name(), err)
+		return nil
+	}
+
+	extra := &symbolicExtra{isReloc: ct.IsReloc}
+	for _, fn := range ct.Funcs {
+		extra.functab = append(extra.functab, funcRange{fn.Name, fn.Low, fn.High, fn.Demangled})
+	}
+	for _, l := range ct.Lines {
+		if l.File >= 0 && l.File < len(ct.Files) {
+			l.LineEntry.File = &ct.Files[l.File]
+		}
+		extra.linetab = append(extra.linetab, l.LineEntry)
+	}
+	return &rawTable{extra, key, ct.Loads}
+}
+
+// storeCache writes t to s.CacheDir. Tables backed by a Go symbol
+// table are not cached, since those are cheap to load.
+func (s *Symbolizer) storeCache(t *rawTable) {
+	if s.CacheDir == "" || t.gotab != nil {
+		return
+	}
+	ct := cachedTable{IsReloc: t.isReloc, Loads: t.loads}
+	for _, fn := range t.functab {
+		ct.Funcs = append(ct.Funcs, cachedFunc{fn.name, fn.lowpc, fn.highpc, fn.demangled})
+	}
+	files := make(map[*dwarf.LineFile]int)
+	for _, l := range t.linetab {
+		cl := cachedLine{l, -1}
+		if l.File != nil {
+			i, ok := files[l.File]
+			if !ok {
+				i = len(ct.Files)
+				files[l.File] = i
+				ct.Files = append(ct.Files, *l.File)
+			}
+			cl.File = i
+		}
+		cl.LineEntry.File = nil
+		ct.Lines = append(ct.Lines, cl)
+	}
+
+	// Write to a temporary file and rename it into place so
+	// concurrent readers never see a partial file.
+	if err := os.MkdirAll(s.CacheDir, 0777); err != nil {
+		log.Println(err)
+		return
+	}
+	f, err := os.CreateTemp(s.CacheDir, "tmp-*")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = gob.NewEncoder(f).Encode(&ct)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.cachePath(t.key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Println(err)
+	}
+}